@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+
+	"github.com/pterm/pterm"
+
+	"github.com/sargisis/edgecore/internal/config"
+	"github.com/sargisis/edgecore/internal/ipset"
+	"github.com/sargisis/edgecore/internal/proxy"
+)
+
+var (
+	// tcpAccess holds the access lists of TCP listeners by port.
+	tcpAccess atomic.Pointer[map[int]*ipset.AccessList]
+
+	// accessFiles holds the prefixes last read from each list file; they
+	// stay in force when a reload cannot read the file.
+	accessFiles = make(map[string][]netip.Prefix)
+	// accessFilesRead marks the files read during the current load, so a
+	// file shared by several lists is read once.
+	accessFilesRead map[string]bool
+)
+
+// denyAll refuses every client; ::/0 covers IPv4 through its mapped form.
+var denyAll = &ipset.AccessList{Deny: ipset.New([]netip.Prefix{netip.MustParsePrefix("::/0")})}
+
+// loadAccessLists builds the access lists of cfg, installs those of the
+// listeners and returns those of the routes, by route index.
+func loadAccessLists(cfg *config.Config) []*ipset.AccessList {
+	accessFilesRead = make(map[string]bool)
+
+	listeners := make(map[int]*ipset.AccessList)
+	for _, l := range cfg.HTTPListeners() {
+		if l.Access != nil {
+			listeners[l.Port] = accessList(fmt.Sprintf("listener %d", l.Port), l.Access)
+		}
+	}
+	if a := cfg.Admin; a != nil && a.Access != nil {
+		listeners[adminPort(a)] = accessList("admin listener", a.Access)
+	}
+	proxy.SetListenerAccessLists(listeners)
+
+	tcp := make(map[int]*ipset.AccessList)
+	for _, l := range cfg.TCPListeners {
+		if l.Access != nil {
+			tcp[l.Port] = accessList(fmt.Sprintf("tcp listener %d", l.Port), l.Access)
+		}
+	}
+	tcpAccess.Store(&tcp)
+
+	routes := make([]*ipset.AccessList, len(cfg.Routes))
+	for i, r := range cfg.Routes {
+		if r.Access != nil {
+			routes[i] = accessList(fmt.Sprintf("route %d", i), r.Access)
+		}
+	}
+	return routes
+}
+
+// accessList builds the list of c. A list that cannot be built refuses
+// every client rather than letting denied ones in.
+func accessList(scope string, c *config.AccessConfig) *ipset.AccessList {
+	allow, err := accessPrefixes(c.Allow, c.AllowFiles)
+	if err == nil {
+		var deny []netip.Prefix
+		deny, err = accessPrefixes(c.Deny, c.DenyFiles)
+		if err == nil {
+			return &ipset.AccessList{Allow: ipset.New(allow), Deny: ipset.New(deny)}
+		}
+	}
+	pterm.Error.Printf("Access list of %s unavailable, refusing all clients: %v\n", scope, err)
+	return denyAll
+}
+
+// accessPrefixes parses cidrs and reads the prefixes of files.
+func accessPrefixes(cidrs, files []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range cidrs {
+		p, err := ipset.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p)
+	}
+	for _, path := range files {
+		if !accessFilesRead[path] {
+			read, err := ipset.ReadFile(path)
+			if err != nil {
+				if _, ok := accessFiles[path]; !ok {
+					return nil, err
+				}
+				pterm.Error.Printf("Failed to reload access list file, keeping the previous version: %v\n", err)
+			} else {
+				accessFiles[path] = read
+			}
+			accessFilesRead[path] = true
+		}
+		prefixes = append(prefixes, accessFiles[path]...)
+	}
+	return prefixes, nil
+}
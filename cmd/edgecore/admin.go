@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pterm/pterm"
+
+	"github.com/sargisis/edgecore/internal/config"
+	"github.com/sargisis/edgecore/internal/proxy"
+)
+
+// adminServer serves the admin API when it is configured. Like the other
+// listeners it is created at startup; reloads only change its token and
+// access list.
+var adminServer *http.Server
+
+// adminPort returns the port of the admin listener of cfg.
+func adminPort(cfg *config.AdminConfig) int {
+	if cfg.Port == 0 {
+		return 9901
+	}
+	return cfg.Port
+}
+
+// startAdminListener opens and serves the admin listener, if configured.
+// Failed tokens are seen by the ban rules, so a client guessing tokens is
+// banned like any other.
+func startAdminListener(cfg *config.Config) {
+	if cfg.Admin == nil {
+		return
+	}
+	addr := cfg.Admin.Address
+	if addr == "" {
+		addr = "127.0.0.1"
+	}
+	port := adminPort(cfg.Admin)
+	ln, err := net.Listen("tcp", net.JoinHostPort(addr, strconv.Itoa(port)))
+	if err != nil {
+		pterm.Fatal.Printf("Failed to start admin listener on port %d: %v\n", port, err)
+	}
+	adminServer = &http.Server{
+		Handler:           proxy.Logger(proxy.ListenerAccess(port, proxy.BanAbusers(proxy.AdminAPI()))),
+		ReadTimeout:       15 * time.Second,
+		WriteTimeout:      15 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		if err := adminServer.Serve(ln); err != http.ErrServerClosed {
+			pterm.Fatal.Printf("Admin listener error: %v\n", err)
+		}
+	}()
+	pterm.Success.Printf("Admin API on %s\n", ln.Addr())
+}
+
+func shutdownAdminListener(ctx context.Context) {
+	if adminServer == nil {
+		return
+	}
+	if err := adminServer.Shutdown(ctx); err != nil {
+		pterm.Error.Printf("Admin listener shutdown error: %v\n", err)
+	}
+}
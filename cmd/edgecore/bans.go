@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/pterm/pterm"
+
+	"github.com/sargisis/edgecore/internal/config"
+	"github.com/sargisis/edgecore/internal/ipset"
+	"github.com/sargisis/edgecore/internal/proxy"
+)
+
+// banner bans abusive clients, or is nil. Its goroutine saves bans to
+// banStateFile until banStop is closed.
+var (
+	banner       *proxy.Banner
+	banStop      chan struct{}
+	banStateFile string
+)
+
+// loadBans applies the ban rules of cfg. Reloads keep the bans unless the
+// state file changes, in which case bans are loaded from the new file.
+func loadBans(cfg *config.Config) {
+	c := cfg.Bans
+	if c == nil {
+		stopBans()
+		proxy.SetBanner(nil)
+		return
+	}
+	rules := make([]proxy.BanRule, 0, len(c.Rules))
+	for _, r := range c.Rules {
+		rules = append(rules, proxy.BanRule{
+			Name:      r.Name,
+			Statuses:  r.Statuses,
+			Threshold: r.Threshold,
+			Window:    time.Duration(r.WindowSeconds) * time.Second,
+		})
+	}
+	exempt := make([]netip.Prefix, 0, len(c.Exempt))
+	for _, s := range c.Exempt {
+		p, _ := ipset.ParsePrefix(s)
+		exempt = append(exempt, p)
+	}
+	banSeconds, maxBanSeconds, forgetSeconds := c.BanSeconds, c.MaxBanSeconds, c.ForgetSeconds
+	if banSeconds == 0 {
+		banSeconds = 600
+	}
+	if maxBanSeconds == 0 {
+		maxBanSeconds = 86400
+	}
+	if forgetSeconds == 0 {
+		forgetSeconds = 86400
+	}
+	opts := proxy.BanOptions{
+		Rules:       rules,
+		BanTime:     time.Duration(banSeconds) * time.Second,
+		MaxBanTime:  time.Duration(maxBanSeconds) * time.Second,
+		ForgetAfter: time.Duration(forgetSeconds) * time.Second,
+		Exempt:      ipset.New(exempt),
+		IPv6Prefix:  c.IPv6PrefixBits,
+		MaxClients:  c.MaxClients,
+		StateFile:   c.StateFile,
+	}
+
+	if banner != nil && banStateFile == c.StateFile {
+		banner.SetOptions(opts)
+		return
+	}
+	b, err := proxy.NewBanner(opts)
+	if err != nil {
+		pterm.Error.Printf("Failed to load bans: %v\n", err)
+		return
+	}
+	stopBans()
+	banner, banStop, banStateFile = b, make(chan struct{}), c.StateFile
+	go b.Run(banStop)
+	proxy.SetBanner(b)
+}
+
+// stopBans stops saving the bans of the running banner, after saving them
+// once more.
+func stopBans() {
+	if banner == nil {
+		return
+	}
+	close(banStop)
+	banner = nil
+}
+
+// saveBans saves the bans before exit.
+func saveBans() {
+	if banner == nil {
+		return
+	}
+	if err := banner.Save(); err != nil {
+		pterm.Error.Printf("Failed to save bans: %v\n", err)
+	}
+}
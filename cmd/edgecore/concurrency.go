@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/sargisis/edgecore/internal/config"
+	"github.com/sargisis/edgecore/internal/proxy"
+)
+
+// concurrencyLimiter is a running limiter and the configuration it was
+// built from.
+type concurrencyLimiter struct {
+	cfg     config.ConcurrencyConfig
+	limiter *proxy.ConcurrencyLimiter
+}
+
+// Running limiters by route and pool name. Reloads keep the limiters whose
+// configuration did not change, along with their requests in flight and
+// adapted limits.
+var (
+	routeConcurrency = make(map[string]*concurrencyLimiter)
+	poolConcurrency  = make(map[string]*concurrencyLimiter)
+)
+
+// loadConcurrencyLimits builds the concurrency limits of cfg and installs
+// them in the proxy.
+func loadConcurrencyLimits(cfg *config.Config) {
+	routes := make(map[string]*config.ConcurrencyConfig)
+	for _, r := range cfg.Routes {
+		if r.Concurrency != nil {
+			routes[r.Name] = r.Concurrency
+		}
+	}
+	pools := make(map[string]*config.ConcurrencyConfig)
+	for name, p := range cfg.AllPools() {
+		if p.Concurrency != nil {
+			pools[name] = p.Concurrency
+		}
+	}
+
+	routeConcurrency = reuseConcurrencyLimiters(routeConcurrency, routes)
+	poolConcurrency = reuseConcurrencyLimiters(poolConcurrency, pools)
+	proxy.SetConcurrencyLimits(proxy.ConcurrencyLimits{
+		Routes:      concurrencyLimiters(routeConcurrency),
+		Pools:       concurrencyLimiters(poolConcurrency),
+		DefaultPool: config.DefaultPool,
+	})
+}
+
+// reuseConcurrencyLimiters returns limiters for cfgs, keeping those in
+// running whose configuration is unchanged.
+func reuseConcurrencyLimiters(running map[string]*concurrencyLimiter, cfgs map[string]*config.ConcurrencyConfig) map[string]*concurrencyLimiter {
+	next := make(map[string]*concurrencyLimiter, len(cfgs))
+	for name, c := range cfgs {
+		if l, ok := running[name]; ok && reflect.DeepEqual(l.cfg, *c) {
+			next[name] = l
+			continue
+		}
+		next[name] = &concurrencyLimiter{cfg: *c, limiter: proxy.NewConcurrencyLimiter(proxy.ConcurrencyOptions{
+			Limit:            c.Limit,
+			MaxQueue:         c.MaxQueue,
+			MaxWait:          time.Duration(c.MaxWaitMs) * time.Millisecond,
+			Adaptive:         proxy.AdaptiveMode(c.Adaptive),
+			MinLimit:         c.MinLimit,
+			MaxLimit:         c.MaxLimit,
+			LatencyThreshold: time.Duration(c.LatencyThresholdMs) * time.Millisecond,
+		})}
+	}
+	return next
+}
+
+func concurrencyLimiters(running map[string]*concurrencyLimiter) map[string]*proxy.ConcurrencyLimiter {
+	limiters := make(map[string]*proxy.ConcurrencyLimiter, len(running))
+	for name, l := range running {
+		limiters[name] = l.limiter
+	}
+	return limiters
+}
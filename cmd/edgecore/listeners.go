@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pterm/pterm"
+
+	"github.com/sargisis/edgecore/internal/certs"
+	"github.com/sargisis/edgecore/internal/config"
+	"github.com/sargisis/edgecore/internal/h3"
+	"github.com/sargisis/edgecore/internal/proxy"
+	"github.com/sargisis/edgecore/internal/proxyproto"
+)
+
+var (
+	httpListeners []*httpListener
+	listenersMu   sync.Mutex
+)
+
+// httpListener is a running HTTP or HTTPS listener.
+type httpListener struct {
+	port   int
+	server *http.Server
+	ln     net.Listener
+	// certs is set for TLS listeners and reloaded on SIGHUP.
+	certs *certs.Manager
+	// h3 and udp are set when the listener also serves HTTP/3.
+	h3  *h3.Server
+	udp net.PacketConn
+}
+
+// newHTTPListener opens the socket for l and prepares its server, which
+// serves proxied requests with proxied. Plain listeners with redirect_https
+// redirect them to the HTTPS listener instead.
+func newHTTPListener(l config.ListenerConfig, cfg *config.Config, proxied http.Handler) (*httpListener, error) {
+	ln, err := listen(l, cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	hl := &httpListener{port: l.Port, ln: ln}
+
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(l.TLS != nil && !l.DisableHTTP2)
+	protocols.SetUnencryptedHTTP2(l.H2C)
+
+	if l.TLS != nil {
+		hl.certs, err = certs.NewManager(tlsOptions(l, cfg))
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		go hl.certs.Run(shutdownChan)
+		hl.ln = tls.NewListener(ln, hl.certs.TLSConfig())
+	}
+
+	if l.RedirectHTTPS {
+		proxied = proxy.RedirectToHTTPS(cfg.HTTPSPort())
+	}
+	var handler http.Handler = serveMux(proxied)
+	if hl.certs != nil {
+		handler = proxy.RequireHostClientCert(hl.certs.CheckRequest, handler)
+	}
+	policy := proxy.ForwardingPolicy{
+		TrustIncoming: l.Forwarding.TrustIncoming,
+		Forwarded:     l.Forwarding.Forwarded,
+	}
+	handler = proxy.WithForwarding(policy, proxy.ListenerAccess(l.Port, handler))
+	if l.HTTP3 {
+		hl.udp, err = net.ListenPacket("udp", fmt.Sprintf(":%d", l.Port))
+		if err != nil {
+			hl.ln.Close()
+			return nil, err
+		}
+		hl.h3 = h3.New(hl.certs.TLSConfig(), handler, 60*time.Second)
+		handler = hl.h3.AdvertiseHTTP3(handler)
+	}
+	hl.server = &http.Server{
+		Addr:              fmt.Sprintf(":%d", l.Port),
+		Handler:           handler,
+		Protocols:         protocols,
+		ReadTimeout:       15 * time.Second,
+		WriteTimeout:      15 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	return hl, nil
+}
+
+// serveMux serves the metrics and health endpoints, and everything else
+// with proxied.
+func serveMux(proxied http.Handler) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/", proxied)
+	mux.HandleFunc("/metrics", proxy.PrometheusMetrics)
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "OK")
+	})
+	return mux
+}
+
+func (hl *httpListener) serve() {
+	if hl.h3 != nil {
+		go func() {
+			if err := hl.h3.Serve(hl.udp); err != http.ErrServerClosed {
+				pterm.Fatal.Printf("HTTP/3 server error: %v\n", err)
+			}
+		}()
+	}
+	if err := hl.server.Serve(hl.ln); err != http.ErrServerClosed {
+		pterm.Fatal.Printf("Server error: %v\n", err)
+	}
+}
+
+// shutdown stops the listener gracefully, HTTP/3 included.
+func (hl *httpListener) shutdown(ctx context.Context) error {
+	err := hl.server.Shutdown(ctx)
+	if hl.h3 != nil {
+		err = errors.Join(err, hl.h3.Shutdown(ctx))
+		// The HTTP/3 server does not own the socket it was given.
+		hl.udp.Close()
+	}
+	return err
+}
+
+// reloadTLS reloads certificates and TLS settings of running listeners.
+// Adding or removing listeners requires a restart.
+func reloadTLS(cfg *config.Config) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	for _, l := range cfg.HTTPListeners() {
+		for _, hl := range httpListeners {
+			if hl.port != l.Port || hl.certs == nil || l.TLS == nil {
+				continue
+			}
+			if err := hl.certs.Reload(tlsOptions(l, cfg)); err != nil {
+				pterm.Error.Printf("Failed to reload TLS for port %d: %v\n", l.Port, err)
+				continue
+			}
+			pterm.Success.Printf("Reloaded TLS certificates for port %d\n", l.Port)
+		}
+	}
+}
+
+func tlsOptions(l config.ListenerConfig, cfg *config.Config) certs.Options {
+	t := l.TLS
+	warnDays := cfg.CertExpiryWarningDays
+	if warnDays == 0 {
+		warnDays = 14
+	}
+	opts := certs.Options{
+		MinVersion:    t.MinVersion,
+		CipherSuites:  t.CipherSuites,
+		OCSPStapling:  t.OCSPStapling,
+		OCSPResponder: t.OCSPResponder,
+		ExpiryWarning: time.Duration(warnDays) * 24 * time.Hour,
+		NextProtos:    []string{"h2", "http/1.1"},
+	}
+	if l.DisableHTTP2 {
+		opts.NextProtos = []string{"http/1.1"}
+	}
+	for _, c := range t.Certificates {
+		opts.Certificates = append(opts.Certificates, certs.KeyPair{CertFile: c.CertFile, KeyFile: c.KeyFile})
+	}
+	if ca := t.ClientAuth; ca != nil {
+		opts.ClientAuth = &certs.ClientAuth{
+			CAFile:    ca.CAFile,
+			Optional:  ca.Optional,
+			Hosts:     ca.Hosts,
+			OnFailure: onClientAuthFailure,
+		}
+	}
+	return opts
+}
+
+func onClientAuthFailure(err error) {
+	atomic.AddUint64(&proxy.GlobalMetrics.ClientCertFailures, 1)
+	pterm.Warning.Printf("TLS client authentication failed: %v\n", err)
+}
+
+// listen opens the socket for an HTTP listener, decoding PROXY protocol
+// headers from trusted sources when enabled.
+func listen(l config.ListenerConfig, trustedProxies []string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", l.Port))
+	if err != nil {
+		return nil, err
+	}
+	if !l.ProxyProtocol {
+		return ln, nil
+	}
+
+	cidrs := l.ProxyProtocolTrusted
+	if len(cidrs) == 0 {
+		cidrs = trustedProxies
+	}
+	trusted, err := proxy.ParsePrefixes(cidrs)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &proxyproto.Listener{Listener: ln, Trusted: trusted, Timeout: 5 * time.Second}, nil
+}
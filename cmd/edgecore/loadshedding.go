@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/pterm/pterm"
+
+	"github.com/sargisis/edgecore/internal/config"
+	"github.com/sargisis/edgecore/internal/proxy"
+)
+
+// pressureMonitor watches CPU use and goroutines for load shedding. It runs
+// for the life of the process; reloads only change its thresholds.
+var pressureMonitor = proxy.NewPressureMonitor(proxy.PressureOptions{})
+
+// loadPriorities builds the request priorities of cfg and installs them in
+// the proxy. Rules that fail to build are skipped.
+func loadPriorities(cfg *config.Config) {
+	ls := cfg.LoadShedding
+	if ls == nil {
+		pressureMonitor.SetOptions(proxy.PressureOptions{})
+		proxy.SetPriorityOptions(proxy.PriorityOptions{Default: proxy.PriorityNormal})
+		return
+	}
+
+	opts := proxy.PriorityOptions{Default: proxy.PriorityNormal}
+	if ls.DefaultPriority != "" {
+		p, err := proxy.ParsePriority(ls.DefaultPriority)
+		if err != nil {
+			pterm.Error.Printf("Invalid default priority: %v\n", err)
+		} else {
+			opts.Default = p
+		}
+	}
+	for i, c := range ls.Priorities {
+		rule, err := newPriorityRule(c)
+		if err != nil {
+			pterm.Error.Printf("Invalid priority rule %d: %v\n", i, err)
+			continue
+		}
+		opts.Rules = append(opts.Rules, rule)
+	}
+	pressureMonitor.SetOptions(proxy.PressureOptions{
+		MaxCPU:        ls.MaxCPUPercent / 100,
+		MaxGoroutines: ls.MaxGoroutines,
+	})
+	if ls.MaxCPUPercent > 0 || ls.MaxGoroutines > 0 {
+		opts.Pressure = pressureMonitor
+	}
+	proxy.SetPriorityOptions(opts)
+}
+
+func newPriorityRule(c config.PriorityConfig) (proxy.PriorityRule, error) {
+	p, err := proxy.ParsePriority(c.Priority)
+	if err != nil {
+		return proxy.PriorityRule{}, err
+	}
+	networks, err := proxy.ParsePrefixes(c.ClientCIDRs)
+	if err != nil {
+		return proxy.PriorityRule{}, err
+	}
+	rule := proxy.PriorityRule{Priority: p, Routes: c.Routes, Values: c.Values, Networks: networks}
+	if c.Key != "" {
+		key, err := proxy.ParseKeyTemplate(c.Key)
+		if err != nil {
+			return proxy.PriorityRule{}, err
+		}
+		rule.Key = &key
+	}
+	return rule, nil
+}
@@ -3,11 +3,8 @@ package main
 import (
 	"context"
 	"flag"
-	"fmt"
 	"math/rand"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
 	"os/signal"
 	"syscall"
@@ -15,16 +12,16 @@ import (
 
 	"github.com/pterm/pterm"
 
-	"github.com/sargisis/edgecore/internal/backend"
-	"github.com/sargisis/edgecore/internal/balancer"
 	"github.com/sargisis/edgecore/internal/config"
 	"github.com/sargisis/edgecore/internal/devtools"
+	"github.com/sargisis/edgecore/internal/ipset"
 	"github.com/sargisis/edgecore/internal/proxy"
+	"github.com/sargisis/edgecore/internal/router"
 )
 
 var (
-	serverPool    balancer.ServerPool
-	ipRateLimiter *proxy.IPRateLimiter
+	routes        = router.NewTable(nil)
+	ipRateLimiter *proxy.KeyedRateLimiter
 	devMode       = flag.Bool("dev", false, "Start test backends automatically")
 	configPath    *string
 	logFormat     *string
@@ -32,50 +29,103 @@ var (
 )
 
 func lbHandler(w http.ResponseWriter, r *http.Request) {
-	peer := serverPool.GetLeastConnections()
+	peer := poolFor(r).GetLeastConnections()
 	if peer != nil {
 		// Store backend URL in request context for logging
 		r.Header.Set("X-Backend-URL", peer.URL.String())
 		peer.IncConnections()
 		defer peer.DecConnections()
-		peer.ReverseProxy.ServeHTTP(w, r)
+		if proxy.IsWebSocketUpgrade(r) {
+			proxy.ServeWebSocket(w, r, peer)
+			return
+		}
+		rp := peer.ReverseProxy
+		if route := router.FromContext(r.Context()); route != nil && route.Streaming {
+			streamed := *rp
+			streamed.FlushInterval = route.FlushInterval
+			rp = &streamed
+		}
+		rp.ServeHTTP(w, r)
+		return
+	}
+	if router.IsGRPC(r) {
+		proxy.GRPCError(w, proxy.GRPCUnavailable, "no backend available")
 		return
 	}
 	http.Error(w, "Service not available", http.StatusServiceUnavailable)
 }
 
 func loadConfig(cfg *config.Config) {
-	serverPool.Clear()
-	transport := &http.Transport{
-		MaxIdleConns:        100,
-		MaxIdleConnsPerHost: 100,
-		IdleConnTimeout:     90 * time.Second,
+	if err := proxy.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		pterm.Error.Printf("Invalid trusted proxies: %v\n", err)
 	}
+	proxy.SetClientIPHeader(cfg.ClientIPHeader)
 
-	spinner, _ := pterm.DefaultSpinner.Start("Loading backends...")
+	routes.Store(routeTable(cfg.Routes, loadAccessLists(cfg)))
 
-	for _, target := range cfg.Backends {
-		serverUrl, err := url.Parse(target)
-		if err != nil {
-			pterm.Error.Printf("Invalid backend URL %s: %v\n", target, err)
-			continue
-		}
+	idle := cfg.WebSocket.IdleTimeoutSeconds
+	if idle == 0 {
+		idle = 300
+	}
+	proxy.SetWebSocketOptions(proxy.WebSocketOptions{
+		IdleTimeout:  time.Duration(idle) * time.Second,
+		MaxLifetime:  time.Duration(cfg.WebSocket.MaxLifetimeSeconds) * time.Second,
+		MaxPerClient: cfg.WebSocket.MaxPerClient,
+	})
 
-		proxy := httputil.NewSingleHostReverseProxy(serverUrl)
-		proxy.Transport = transport
-		proxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, e error) {
-			pterm.Warning.Printf("[%s] %s\n", serverUrl.Host, e.Error())
-			writer.WriteHeader(http.StatusBadGateway)
-		}
+	proxy.SetRateLimitResponse(proxy.RateLimitResponseOptions{
+		DisableHeaders: cfg.RateLimitResponse.DisableHeaders,
+		LegacyHeaders:  cfg.RateLimitResponse.LegacyHeaders,
+		ErrorBody:      cfg.RateLimitResponse.ErrorBody,
+	})
+
+	loadRateLimitRules(cfg)
+	loadConcurrencyLimits(cfg)
+	loadPriorities(cfg)
+	loadQuotas(cfg)
+	loadBans(cfg)
 
-		b := backend.NewBackend(serverUrl, proxy)
-		serverPool.AddBackend(b)
-		pterm.Success.Printf("Registered backend: %s\n", serverUrl)
+	adminToken := ""
+	if cfg.Admin != nil {
+		adminToken = cfg.Admin.Token
 	}
+	proxy.SetAdminToken(adminToken)
 
+	spinner, _ := pterm.DefaultSpinner.Start("Loading backends...")
+	loadPools(cfg)
 	spinner.Success("All backends loaded!")
 }
 
+func routeTable(cfgRoutes []config.RouteConfig, access []*ipset.AccessList) []router.Route {
+	rs := make([]router.Route, 0, len(cfgRoutes))
+	for i, r := range cfgRoutes {
+		route := router.Route{
+			Name:              r.Name,
+			Host:              r.Host,
+			PathPrefix:        r.PathPrefix,
+			RequireClientCert: r.RequireClientCert,
+			Pool:              r.Pool,
+			GRPCService:       r.GRPCService,
+			GRPCMethod:        r.GRPCMethod,
+			Access:            access[i],
+		}
+		if s := r.Streaming; s != nil {
+			route.Streaming = true
+			route.FlushInterval = time.Duration(s.FlushIntervalMs) * time.Millisecond
+			if route.FlushInterval == 0 {
+				route.FlushInterval = -1
+			}
+			idle := s.IdleTimeoutSeconds
+			if idle == 0 {
+				idle = 60
+			}
+			route.StreamIdleTimeout = time.Duration(idle) * time.Second
+		}
+		rs = append(rs, route)
+	}
+	return rs
+}
+
 func main() {
 	// Allow overriding config path via environment variable with CLI flag taking precedence.
 	cfgEnv := os.Getenv("EDGECORE_CONFIG")
@@ -118,8 +168,9 @@ func main() {
 			Println("Starting test backend servers...")
 
 		devtools.StartAllBackends()
+		devtools.StartAllUDPEchoServers()
 		time.Sleep(500 * time.Millisecond)
-		pterm.Success.Println("Test backends ready on :8081, :8082, :8083")
+		pterm.Success.Println("Test backends ready on :8081, :8082, :8083 (UDP echo on :9081, :9082, :9083)")
 		pterm.Println()
 	}
 
@@ -133,8 +184,18 @@ func main() {
 		pterm.Fatal.Printf("Invalid config: %v\n", err)
 	}
 
+	rateLimitStore = newRateLimitStore(cfg.RateLimitStore)
 	loadConfig(cfg)
-	ipRateLimiter = proxy.NewIPRateLimiter(cfg.RateLimit, cfg.Burst)
+	proxy.SetBackendLister(poolBackends)
+	ipRateLimiter = proxy.NewKeyedRateLimiter(proxy.Limit{Rate: cfg.RateLimit, Burst: cfg.Burst}, proxy.KeyedRateLimiterOptions{
+		IdleTTL:   time.Duration(cfg.RateLimitIdleTTLSeconds) * time.Second,
+		MaxKeys:   cfg.RateLimitMaxKeys,
+		Algorithm: proxy.Algorithm(cfg.RateLimitAlgorithm),
+		Store:     rateLimitStore,
+		Namespace: "ip",
+	})
+	go ipRateLimiter.Run(shutdownChan)
+	go pressureMonitor.Run(shutdownChan)
 
 	// 3. Setup Signal Handling for Hot-reload + Graceful Shutdown
 	sigs := make(chan os.Signal, 1)
@@ -155,6 +216,7 @@ func main() {
 					continue
 				}
 				loadConfig(newCfg)
+				reloadTLS(newCfg)
 			case syscall.SIGINT, syscall.SIGTERM:
 				pterm.Warning.Println("🛑 Shutting down gracefully...")
 				close(shutdownChan)
@@ -175,7 +237,7 @@ func main() {
 		for {
 			select {
 			case <-t.C:
-				serverPool.HealthCheck()
+				healthCheckPools()
 			case <-shutdownChan:
 				return
 			}
@@ -184,43 +246,39 @@ func main() {
 
 	// 5. Setup Middleware Chain
 	handler := http.HandlerFunc(lbHandler)
-	finalHandler := proxy.Logger(proxy.IPRateLimitMiddleware(ipRateLimiter, handler))
-
-	// 6. Setup HTTP Server with Metrics endpoint
-	mux := http.NewServeMux()
-	mux.Handle("/", finalHandler)
-	mux.HandleFunc("/metrics", proxy.PrometheusMetrics)
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprint(w, "OK")
-	})
+	finalHandler := proxy.Logger(proxy.BanAbusers(router.Middleware(routes, proxy.Streaming(
+		proxy.RouteAccess(proxy.RequireClientCert(proxy.Prioritize(proxy.IPRateLimitMiddleware(ipRateLimiter, proxy.ConcurrencyLimit(proxy.EnforceQuotas(handler))))))))))
 
-	server := &http.Server{
-		Addr:              fmt.Sprintf(":%d", cfg.Port),
-		Handler:           mux,
-		ReadTimeout:       15 * time.Second,
-		WriteTimeout:      15 * time.Second,
-		IdleTimeout:       60 * time.Second,
-		ReadHeaderTimeout: 5 * time.Second,
+	// 6. Setup HTTP Servers with Metrics endpoint
+	listenersMu.Lock()
+	for _, l := range cfg.HTTPListeners() {
+		hl, err := newHTTPListener(l, cfg, finalHandler)
+		if err != nil {
+			pterm.Fatal.Printf("Failed to start listener on port %d: %v\n", l.Port, err)
+		}
+		httpListeners = append(httpListeners, hl)
 	}
+	listenersMu.Unlock()
 
+	port := cfg.HTTPListeners()[0].Port
 	pterm.Println()
 	pterm.DefaultBox.WithTitle("🚀 Server Started").
 		WithTitleTopCenter().
 		WithBoxStyle(pterm.NewStyle(pterm.FgLightGreen)).
 		Printfln("Port: %d\nRate Limit: %.0f req/s\nMetrics: http://localhost:%d/metrics\nHealth: http://localhost:%d/health",
-			cfg.Port, cfg.RateLimit, cfg.Port, cfg.Port)
+			port, cfg.RateLimit, port, port)
 
 	if *devMode {
 		pterm.Info.Println("💡 Dev Mode is ON. Press Ctrl+C to stop everything.")
 	}
 	pterm.Println()
 
-	go func() {
-		if err := server.ListenAndServe(); err != http.ErrServerClosed {
-			pterm.Fatal.Printf("Server error: %v\n", err)
-		}
-	}()
+	for _, hl := range httpListeners {
+		go hl.serve()
+	}
+	startTCPListeners(cfg)
+	startUDPListeners(cfg)
+	startAdminListener(cfg)
 
 	// Wait for shutdown signal
 	<-shutdownChan
@@ -228,8 +286,17 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	if err := server.Shutdown(ctx); err != nil {
-		pterm.Error.Printf("Server shutdown error: %v\n", err)
+	for _, hl := range httpListeners {
+		if err := hl.shutdown(ctx); err != nil {
+			pterm.Error.Printf("Server shutdown error: %v\n", err)
+		}
 	}
+	// Hijacked WebSocket connections are not tracked by the servers.
+	proxy.CloseWebSockets(ctx)
+	shutdownTCPListeners(ctx)
+	shutdownUDPListeners(ctx)
+	shutdownAdminListener(ctx)
+	saveQuotas()
+	saveBans()
 	pterm.Success.Println("✅ EdgeCore stopped")
 }
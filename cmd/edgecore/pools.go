@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/pterm/pterm"
+
+	"github.com/sargisis/edgecore/internal/backend"
+	"github.com/sargisis/edgecore/internal/balancer"
+	"github.com/sargisis/edgecore/internal/certs"
+	"github.com/sargisis/edgecore/internal/config"
+	"github.com/sargisis/edgecore/internal/proxy"
+	"github.com/sargisis/edgecore/internal/proxyproto"
+	"github.com/sargisis/edgecore/internal/router"
+)
+
+var (
+	// pools maps pool names to their backends; it is replaced as a whole on reload.
+	pools atomic.Pointer[map[string]*balancer.ServerPool]
+	// transports are the upstream transports of the current pools, kept so
+	// their idle connections can be closed after a reload.
+	transports []*http.Transport
+)
+
+// loadPools builds every configured pool and swaps them in.
+func loadPools(cfg *config.Config) {
+	newPools := make(map[string]*balancer.ServerPool)
+	var newTransports []*http.Transport
+
+	for name, pc := range cfg.AllPools() {
+		// byAddr lets the transport attribute dialed connections to backends.
+		byAddr := make(map[string]*backend.Backend)
+		transport, ppVersion, err := newTransport(pc.Upstream, func(addr string) *backend.Backend {
+			return byAddr[addr]
+		})
+		if err != nil {
+			pterm.Error.Printf("Pool %s: %v\n", name, err)
+			continue
+		}
+		newTransports = append(newTransports, transport)
+
+		pool := &balancer.ServerPool{}
+		switch {
+		case pc.HealthCheck != nil && pc.HealthCheck.Type == "grpc":
+			pool.SetHealthCheck(balancer.GRPCHealthCheck(transport, pc.HealthCheck.Service))
+		case pc.Kind() == config.PoolUDP && (pc.HealthCheck == nil || pc.HealthCheck.Type != "tcp"):
+			pool.SetHealthCheck(balancer.UDPHealthCheck)
+		}
+		for _, target := range pc.Backends {
+			serverUrl, err := url.Parse(target)
+			if err != nil {
+				pterm.Error.Printf("Invalid backend URL %s: %v\n", target, err)
+				continue
+			}
+			b := backend.NewBackend(serverUrl, newReverseProxy(serverUrl, transport, ppVersion))
+			byAddr[balancer.HostPort(serverUrl)] = b
+			pool.AddBackend(b)
+			pterm.Success.Printf("Registered backend: %s (pool %s)\n", serverUrl, name)
+		}
+		newPools[name] = pool
+	}
+
+	pools.Store(&newPools)
+	for _, t := range transports {
+		t.CloseIdleConnections()
+	}
+	transports = newTransports
+}
+
+// newTransport builds the upstream transport for a pool and returns the PROXY
+// protocol version it announces (0 when disabled). Every dialed connection is
+// counted on the backend returned by lookup for its address.
+func newTransport(up config.UpstreamConfig, lookup func(addr string) *backend.Backend) (*http.Transport, int, error) {
+	transport := &http.Transport{
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 100,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	if up.TLS != nil {
+		if up.TLS.InsecureSkipVerify && !*devMode {
+			return nil, 0, fmt.Errorf("upstream insecure_skip_verify is only allowed with --dev")
+		}
+		u := &certs.Upstream{
+			CAFile:             up.TLS.CAFile,
+			CertFile:           up.TLS.CertFile,
+			KeyFile:            up.TLS.KeyFile,
+			ServerName:         up.TLS.ServerName,
+			InsecureSkipVerify: up.TLS.InsecureSkipVerify,
+			PinnedSPKI:         up.TLS.PinnedSPKI,
+		}
+		tlsConfig, err := u.ClientTLSConfig()
+		if err != nil {
+			return nil, 0, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	transport.Protocols = new(http.Protocols)
+	switch up.Protocol {
+	case "http2":
+		transport.Protocols.SetHTTP1(true)
+		transport.Protocols.SetHTTP2(true)
+	case "h2c":
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	default:
+		transport.Protocols.SetHTTP1(true)
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	dial := proxyproto.DialFunc(dialer.DialContext)
+
+	ppVersion := 0
+	switch up.ProxyProtocol {
+	case "v1":
+		ppVersion = 1
+	case "v2":
+		ppVersion = 2
+	}
+	if ppVersion != 0 {
+		// Each upstream connection announces a single client, so it cannot be reused.
+		dial = proxyproto.Dialer(ppVersion, dial)
+		transport.DisableKeepAlives = true
+	}
+
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if b := lookup(addr); b != nil {
+			conn = b.TrackConn(conn)
+		}
+		return conn, nil
+	}
+	return transport, ppVersion, nil
+}
+
+func newReverseProxy(serverUrl *url.URL, transport http.RoundTripper, ppVersion int) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(serverUrl)
+			// Keep the client's Host header, like NewSingleHostReverseProxy.
+			pr.Out.Host = pr.In.Host
+			proxy.SetForwardedHeaders(pr)
+			proxy.SetClientCertHeaders(pr)
+			if ppVersion != 0 {
+				pr.Out = pr.Out.WithContext(withProxyProtocolAddrs(pr.In))
+			}
+		},
+		Transport: transport,
+		ErrorHandler: func(writer http.ResponseWriter, request *http.Request, e error) {
+			pterm.Warning.Printf("[%s] %s\n", serverUrl.Host, e.Error())
+			if router.IsGRPC(request) {
+				proxy.GRPCError(writer, proxy.GRPCUnavailable, "upstream error")
+				return
+			}
+			writer.WriteHeader(http.StatusBadGateway)
+		},
+	}
+}
+
+// poolFor returns the pool of the request's route, or the default pool.
+func poolFor(r *http.Request) *balancer.ServerPool {
+	ps := *pools.Load()
+	if route := router.FromContext(r.Context()); route != nil && route.Pool != "" {
+		if pool, ok := ps[route.Pool]; ok {
+			return pool
+		}
+	}
+	if pool, ok := ps[config.DefaultPool]; ok {
+		return pool
+	}
+	return &balancer.ServerPool{}
+}
+
+// poolBackends lists the backends of every pool for metrics.
+func poolBackends() map[string][]*backend.Backend {
+	out := make(map[string][]*backend.Backend)
+	for name, pool := range *pools.Load() {
+		out[name] = pool.Backends()
+	}
+	return out
+}
+
+func healthCheckPools() {
+	for _, pool := range *pools.Load() {
+		pool.HealthCheck()
+	}
+}
+
+// withProxyProtocolAddrs stores the downstream client and destination
+// addresses of r for the upstream PROXY protocol dialer.
+func withProxyProtocolAddrs(r *http.Request) context.Context {
+	ctx := r.Context()
+	src, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return ctx
+	}
+	dst, _ := ctx.Value(http.LocalAddrContextKey).(*net.TCPAddr)
+	return proxyproto.WithAddrs(ctx, net.TCPAddrFromAddrPort(src), dst)
+}
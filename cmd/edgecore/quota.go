@@ -0,0 +1,84 @@
+package main
+
+import (
+	"time"
+	// Quota timezones must load on images without a zoneinfo database.
+	_ "time/tzdata"
+
+	"github.com/pterm/pterm"
+
+	"github.com/sargisis/edgecore/internal/config"
+	"github.com/sargisis/edgecore/internal/proxy"
+)
+
+// quotaTracker counts quota usage, or is nil. Its goroutine saves usage to
+// quotaStateFile until quotaStop is closed.
+var (
+	quotaTracker   *proxy.QuotaTracker
+	quotaStop      chan struct{}
+	quotaStateFile string
+)
+
+// loadQuotas applies the quotas of cfg. Reloads keep the usage unless the
+// state file changes, in which case usage is loaded from the new file.
+func loadQuotas(cfg *config.Config) {
+	c := cfg.Quotas
+	if c == nil {
+		stopQuotas()
+		proxy.SetQuotaTracker(nil)
+		return
+	}
+	consumer, err := proxy.ParseKeyTemplate(c.Consumer)
+	if err != nil {
+		pterm.Error.Printf("Invalid quota consumer: %v\n", err)
+		return
+	}
+	loc, _ := time.LoadLocation(c.Timezone)
+	plans := make(map[string]proxy.Quota, len(c.Plans))
+	for name, p := range c.Plans {
+		plans[name] = proxy.Quota{Daily: p.Daily, Monthly: p.Monthly}
+	}
+	opts := proxy.QuotaOptions{
+		Consumer:     consumer,
+		Plans:        plans,
+		Consumers:    c.Consumers,
+		DefaultPlan:  c.DefaultPlan,
+		MaxConsumers: c.MaxConsumers,
+		Location:     loc,
+		StateFile:    c.StateFile,
+	}
+
+	if quotaTracker != nil && quotaStateFile == c.StateFile {
+		quotaTracker.SetOptions(opts)
+		return
+	}
+	t, err := proxy.NewQuotaTracker(opts)
+	if err != nil {
+		pterm.Error.Printf("Failed to load quota usage: %v\n", err)
+		return
+	}
+	stopQuotas()
+	quotaTracker, quotaStop, quotaStateFile = t, make(chan struct{}), c.StateFile
+	go t.Run(quotaStop)
+	proxy.SetQuotaTracker(t)
+}
+
+// stopQuotas stops saving the usage of the running tracker, after saving
+// it once more.
+func stopQuotas() {
+	if quotaTracker == nil {
+		return
+	}
+	close(quotaStop)
+	quotaTracker = nil
+}
+
+// saveQuotas saves the quota usage before exit.
+func saveQuotas() {
+	if quotaTracker == nil {
+		return
+	}
+	if err := quotaTracker.Save(); err != nil {
+		pterm.Error.Printf("Failed to save quota usage: %v\n", err)
+	}
+}
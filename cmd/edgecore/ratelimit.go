@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/pterm/pterm"
+
+	"github.com/sargisis/edgecore/internal/config"
+	"github.com/sargisis/edgecore/internal/proxy"
+	"github.com/sargisis/edgecore/internal/resp"
+)
+
+// rateLimitStore shares limits between instances, or is nil. It is set up
+// at startup; changing rate_limit_store requires a restart.
+var rateLimitStore *proxy.RateLimitStore
+
+func newRateLimitStore(c *config.RateLimitStoreConfig) *proxy.RateLimitStore {
+	if c == nil {
+		return nil
+	}
+	timeout := c.TimeoutMs
+	if timeout == 0 {
+		timeout = 50
+	}
+	prefix := c.Prefix
+	if prefix == "" {
+		prefix = "edgecore:ratelimit:"
+	}
+	client := resp.NewClient(resp.Options{
+		Addr:     c.Address,
+		Password: c.Password,
+		DB:       c.DB,
+		Timeout:  time.Duration(timeout) * time.Millisecond,
+	})
+	return proxy.NewRateLimitStore(proxy.RateLimitStoreOptions{
+		Client:     client,
+		Prefix:     prefix,
+		LeaseSize:  c.LeaseSize,
+		FailClosed: c.FailClosed,
+	})
+}
+
+// rateLimitRule is a running rule and the configuration it was built from.
+type rateLimitRule struct {
+	cfg  config.RateLimitConfig
+	rule *proxy.RateLimitRule
+	stop chan struct{}
+}
+
+// rateLimitRules are the running rules by name. Reloads keep the buckets of
+// rules whose configuration did not change.
+var rateLimitRules = make(map[string]*rateLimitRule)
+
+// loadRateLimitRules builds the rules of cfg and installs them in the proxy.
+func loadRateLimitRules(cfg *config.Config) {
+	next := make(map[string]*rateLimitRule, len(cfg.RateLimits))
+	rules := make([]*proxy.RateLimitRule, 0, len(cfg.RateLimits))
+	for _, c := range cfg.RateLimits {
+		r, ok := rateLimitRules[c.Name]
+		if !ok || !reflect.DeepEqual(r.cfg, c) {
+			built, err := newRateLimitRule(c, cfg)
+			if err != nil {
+				pterm.Error.Printf("Invalid rate limit rule %q: %v\n", c.Name, err)
+				if !ok {
+					continue
+				}
+			} else {
+				r = built
+				go r.rule.Limiter.Run(r.stop)
+			}
+		}
+		next[c.Name] = r
+		rules = append(rules, r.rule)
+	}
+	proxy.SetRateLimitRules(rules)
+
+	for name, r := range rateLimitRules {
+		if next[name] != r {
+			close(r.stop)
+		}
+	}
+	rateLimitRules = next
+}
+
+func newRateLimitRule(c config.RateLimitConfig, cfg *config.Config) (*rateLimitRule, error) {
+	key, err := proxy.ParseKeyTemplate(c.Key)
+	if err != nil {
+		return nil, err
+	}
+	overrides := make(map[string]proxy.Limit, len(c.Overrides))
+	for k, o := range c.Overrides {
+		overrides[k] = proxy.Limit{Rate: o.Rate, Burst: o.Burst}
+	}
+	limiter := proxy.NewKeyedRateLimiter(proxy.Limit{Rate: c.Rate, Burst: c.Burst}, proxy.KeyedRateLimiterOptions{
+		IdleTTL:   time.Duration(cfg.RateLimitIdleTTLSeconds) * time.Second,
+		MaxKeys:   cfg.RateLimitMaxKeys,
+		Overrides: overrides,
+		Algorithm: proxy.Algorithm(c.Algorithm),
+		Store:     rateLimitStore,
+		Namespace: "rule:" + c.Name,
+	})
+	return &rateLimitRule{
+		cfg:  c,
+		rule: &proxy.RateLimitRule{Name: c.Name, Key: key, Limiter: limiter},
+		stop: make(chan struct{}),
+	}, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/pterm/pterm"
+
+	"github.com/sargisis/edgecore/internal/balancer"
+	"github.com/sargisis/edgecore/internal/config"
+	"github.com/sargisis/edgecore/internal/ipset"
+	"github.com/sargisis/edgecore/internal/tcpproxy"
+)
+
+// tcpListeners are the running layer-4 listeners. Like HTTP listeners they
+// are created at startup; reloads only change the pools behind them.
+var tcpListeners []*tcpproxy.Server
+
+// startTCPListeners opens and serves every configured TCP listener.
+func startTCPListeners(cfg *config.Config) {
+	for _, l := range cfg.TCPListeners {
+		ln, err := listen(config.ListenerConfig{
+			Port:                 l.Port,
+			ProxyProtocol:        l.ProxyProtocol,
+			ProxyProtocolTrusted: l.ProxyProtocolTrusted,
+		}, cfg.TrustedProxies)
+		if err != nil {
+			pterm.Fatal.Printf("Failed to start TCP listener on port %d: %v\n", l.Port, err)
+		}
+
+		idle := l.IdleTimeoutSeconds
+		if idle == 0 {
+			idle = 300
+		}
+		port := l.Port
+		srv := &tcpproxy.Server{
+			Pool:        poolByName(l.Pool),
+			IdleTimeout: time.Duration(idle) * time.Second,
+			Access:      func() *ipset.AccessList { return (*tcpAccess.Load())[port] },
+		}
+		for _, r := range l.SNIRoutes {
+			srv.SNIRoutes = append(srv.SNIRoutes, tcpproxy.SNIRoute{Host: r.Host, Pool: poolByName(r.Pool)})
+		}
+		tcpListeners = append(tcpListeners, srv)
+
+		go func(port int) {
+			if err := srv.Serve(ln); err != tcpproxy.ErrServerClosed {
+				pterm.Fatal.Printf("TCP listener %d error: %v\n", port, err)
+			}
+		}(l.Port)
+		if len(l.SNIRoutes) > 0 {
+			pterm.Success.Printf("TLS passthrough listener on :%d with %d SNI routes\n", l.Port, len(l.SNIRoutes))
+		} else {
+			pterm.Success.Printf("TCP listener on :%d -> pool %s\n", l.Port, l.Pool)
+		}
+	}
+}
+
+// poolByName returns a lookup of the named pool in the current pool set, or
+// nil for an empty name.
+func poolByName(name string) func() *balancer.ServerPool {
+	if name == "" {
+		return nil
+	}
+	return func() *balancer.ServerPool { return (*pools.Load())[name] }
+}
+
+func shutdownTCPListeners(ctx context.Context) {
+	for _, srv := range tcpListeners {
+		if err := srv.Shutdown(ctx); err != nil {
+			pterm.Error.Printf("TCP listener shutdown error: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/pterm/pterm"
+
+	"github.com/sargisis/edgecore/internal/config"
+	"github.com/sargisis/edgecore/internal/udpproxy"
+)
+
+// udpListeners are the running UDP listeners; reloads only change the
+// pools behind them.
+var udpListeners []*udpproxy.Server
+
+// startUDPListeners opens and serves every configured UDP listener.
+func startUDPListeners(cfg *config.Config) {
+	for _, l := range cfg.UDPListeners {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: l.Port})
+		if err != nil {
+			pterm.Fatal.Printf("Failed to start UDP listener on port %d: %v\n", l.Port, err)
+		}
+
+		srv := &udpproxy.Server{
+			Pool:           poolByName(l.Pool),
+			SessionTimeout: time.Duration(l.SessionTimeoutSeconds) * time.Second,
+			MaxSessions:    l.MaxSessions,
+		}
+		udpListeners = append(udpListeners, srv)
+
+		go func(port int) {
+			if err := srv.Serve(conn); err != udpproxy.ErrServerClosed {
+				pterm.Fatal.Printf("UDP listener %d error: %v\n", port, err)
+			}
+		}(l.Port)
+		pterm.Success.Printf("UDP listener on :%d -> pool %s\n", l.Port, l.Pool)
+	}
+}
+
+func shutdownUDPListeners(ctx context.Context) {
+	for _, srv := range udpListeners {
+		if err := srv.Shutdown(ctx); err != nil {
+			pterm.Error.Printf("UDP listener shutdown error: %v\n", err)
+		}
+	}
+}
@@ -1,10 +1,14 @@
 module github.com/sargisis/edgecore
 
-go 1.23.0
+go 1.24.0
 
 toolchain go1.24.12
 
-require github.com/pterm/pterm v0.12.82
+require (
+	github.com/pterm/pterm v0.12.82
+	github.com/quic-go/quic-go v0.59.1
+	golang.org/x/crypto v0.41.0
+)
 
 require (
 	atomicgo.dev/cursor v0.2.0 // indirect
@@ -14,9 +18,11 @@ require (
 	github.com/gookit/color v1.5.4 // indirect
 	github.com/lithammer/fuzzysearch v1.1.8 // indirect
 	github.com/mattn/go-runewidth v0.0.16 // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
 	github.com/xo/terminfo v0.0.0-20220910002029-abceb7e1c41e // indirect
-	golang.org/x/sys v0.33.0 // indirect
-	golang.org/x/term v0.32.0 // indirect
-	golang.org/x/text v0.26.0 // indirect
+	golang.org/x/net v0.43.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/term v0.34.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
 )
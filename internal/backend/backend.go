@@ -1,6 +1,8 @@
 package backend
 
 import (
+	"errors"
+	"net"
 	"net/http/httputil"
 	"net/url"
 	"sync"
@@ -13,7 +15,16 @@ type Backend struct {
 	Alive        bool
 	mux          sync.RWMutex
 	ReverseProxy *httputil.ReverseProxy
-	Connections  int64
+	// Connections counts in-flight requests. Over HTTP/2 every stream counts
+	// on its own, so least-connections balancing still sees the real load
+	// when many requests share one upstream connection.
+	Connections int64
+	// upstreamConns counts open transport connections to the backend.
+	upstreamConns int64
+	// webSockets counts open WebSocket sessions, which are not requests.
+	webSockets int64
+	// dialFailures counts failed connection attempts in a row.
+	dialFailures int32
 }
 
 // NewBackend creates a new Backend
@@ -40,6 +51,21 @@ func (b *Backend) IsAlive() (alive bool) {
 	return
 }
 
+// DialFailed records a failed connection attempt and reports whether limit
+// attempts in a row have now failed, in which case the count restarts.
+func (b *Backend) DialFailed(limit int32) bool {
+	if atomic.AddInt32(&b.dialFailures, 1) < limit {
+		return false
+	}
+	atomic.StoreInt32(&b.dialFailures, 0)
+	return true
+}
+
+// DialSucceeded resets the count of failed connection attempts
+func (b *Backend) DialSucceeded() {
+	atomic.StoreInt32(&b.dialFailures, 0)
+}
+
 // GetConnections returns active connections count
 func (b *Backend) GetConnections() int64 {
 	return atomic.LoadInt64(&b.Connections)
@@ -54,3 +80,49 @@ func (b *Backend) IncConnections() {
 func (b *Backend) DecConnections() {
 	atomic.AddInt64(&b.Connections, -1)
 }
+
+// GetWebSockets returns the number of open WebSocket sessions
+func (b *Backend) GetWebSockets() int64 {
+	return atomic.LoadInt64(&b.webSockets)
+}
+
+// IncWebSockets increases the open WebSocket sessions count
+func (b *Backend) IncWebSockets() {
+	atomic.AddInt64(&b.webSockets, 1)
+}
+
+// DecWebSockets decreases the open WebSocket sessions count
+func (b *Backend) DecWebSockets() {
+	atomic.AddInt64(&b.webSockets, -1)
+}
+
+// GetUpstreamConns returns the number of open transport connections
+func (b *Backend) GetUpstreamConns() int64 {
+	return atomic.LoadInt64(&b.upstreamConns)
+}
+
+// TrackConn counts conn as an open upstream connection until it is closed
+func (b *Backend) TrackConn(conn net.Conn) net.Conn {
+	atomic.AddInt64(&b.upstreamConns, 1)
+	return &trackedConn{Conn: conn, backend: b}
+}
+
+// trackedConn decrements the backend's connection count once on Close.
+type trackedConn struct {
+	net.Conn
+	backend *Backend
+	closed  sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.closed.Do(func() { atomic.AddInt64(&c.backend.upstreamConns, -1) })
+	return c.Conn.Close()
+}
+
+// CloseWrite half-closes the underlying connection when it supports it.
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,26 @@
+package backend
+
+import (
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestTrackConnCountsUntilClose(t *testing.T) {
+	u, _ := url.Parse("http://backend1")
+	b := NewBackend(u, nil)
+
+	client, server := net.Pipe()
+	defer server.Close()
+
+	conn := b.TrackConn(client)
+	if got := b.GetUpstreamConns(); got != 1 {
+		t.Fatalf("expected 1 upstream connection, got %d", got)
+	}
+
+	conn.Close()
+	conn.Close()
+	if got := b.GetUpstreamConns(); got != 0 {
+		t.Fatalf("expected double close to decrement once, got %d", got)
+	}
+}
@@ -0,0 +1,129 @@
+package balancer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/sargisis/edgecore/internal/backend"
+)
+
+// grpcServing is HealthCheckResponse.ServingStatus SERVING.
+const grpcServing = 1
+
+// GRPCHealthCheck returns a probe calling grpc.health.v1.Health/Check for
+// service on each backend through rt, which must speak HTTP/2 to the
+// backends. A backend is alive only when it answers SERVING.
+func GRPCHealthCheck(rt http.RoundTripper, service string) func(*backend.Backend) bool {
+	return func(b *backend.Backend) bool {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		status, err := grpcHealthCheck(ctx, rt, b.URL.Scheme+"://"+b.URL.Host, service)
+		if err != nil {
+			return false
+		}
+		return status == grpcServing
+	}
+}
+
+// grpcHealthCheck performs the call and returns the serving status.
+func grpcHealthCheck(ctx context.Context, rt http.RoundTripper, baseURL, service string) (uint64, error) {
+	// HealthCheckRequest{service = 1}, length-prefixed as a gRPC message.
+	var msg []byte
+	if service != "" {
+		msg = binary.AppendUvarint([]byte{0x0a}, uint64(len(service)))
+		msg = append(msg, service...)
+	}
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	frame = append(frame, msg...)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+"/grpc.health.v1.Health/Check", bytes.NewReader(frame))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected HTTP status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err != nil {
+		return 0, err
+	}
+	// grpc-status arrives in the trailers, or in the headers of a
+	// trailers-only response.
+	code := resp.Trailer.Get("Grpc-Status")
+	if code == "" {
+		code = resp.Header.Get("Grpc-Status")
+	}
+	if code != "0" {
+		return 0, fmt.Errorf("grpc-status %q", code)
+	}
+
+	if len(body) < 5 || body[0] != 0 {
+		return 0, errors.New("malformed or compressed response message")
+	}
+	n := binary.BigEndian.Uint32(body[1:5])
+	if uint32(len(body)-5) < n {
+		return 0, errors.New("truncated response message")
+	}
+	return servingStatus(body[5 : 5+n])
+}
+
+// servingStatus decodes field 1 of a HealthCheckResponse, skipping unknown
+// fields.
+func servingStatus(msg []byte) (uint64, error) {
+	var status uint64
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0, errors.New("invalid field tag")
+		}
+		msg = msg[n:]
+
+		switch tag & 7 {
+		case 0: // varint
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0, errors.New("invalid varint")
+			}
+			if tag>>3 == 1 {
+				status = v
+			}
+			msg = msg[n:]
+		case 1: // fixed64
+			if len(msg) < 8 {
+				return 0, errors.New("truncated field")
+			}
+			msg = msg[8:]
+		case 2: // length-delimited
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < l {
+				return 0, errors.New("truncated field")
+			}
+			msg = msg[n+int(l):]
+		case 5: // fixed32
+			if len(msg) < 4 {
+				return 0, errors.New("truncated field")
+			}
+			msg = msg[4:]
+		default:
+			return 0, fmt.Errorf("unsupported wire type %d", tag&7)
+		}
+	}
+	return status, nil
+}
@@ -0,0 +1,83 @@
+package balancer
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sargisis/edgecore/internal/backend"
+)
+
+// newHealthServer starts an h2c server answering Health/Check with the
+// given serving status for every service except "unknown", which gets
+// grpc-status NOT_FOUND.
+func newHealthServer(t *testing.T, status byte) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/grpc.health.v1.Health/Check" || r.ProtoMajor != 2 {
+			t.Errorf("unexpected request %s %s", r.Proto, r.URL.Path)
+		}
+		req, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		if len(req) > 7 && string(req[7:]) == "unknown" {
+			w.Header().Set("Grpc-Status", "5")
+			return
+		}
+		msg := []byte{0x08, status}
+		frame := make([]byte, 5)
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+		w.Write(append(frame, msg...))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func h2cTransport() *http.Transport {
+	tr := &http.Transport{Protocols: new(http.Protocols)}
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	return tr
+}
+
+func TestGRPCHealthCheck(t *testing.T) {
+	serving := newTestBackend(t, newHealthServer(t, 1).URL)
+	notServing := newTestBackend(t, newHealthServer(t, 2).URL)
+	tr := h2cTransport()
+
+	if !GRPCHealthCheck(tr, "")(serving) {
+		t.Fatalf("expected SERVING backend to be alive")
+	}
+	if GRPCHealthCheck(tr, "")(notServing) {
+		t.Fatalf("expected NOT_SERVING backend to be down")
+	}
+	if GRPCHealthCheck(tr, "unknown")(serving) {
+		t.Fatalf("expected unknown service to be reported down")
+	}
+}
+
+func TestServerPoolHealthCheckUsesProbe(t *testing.T) {
+	var pool ServerPool
+	b := newTestBackend(t, "http://backend1")
+	pool.AddBackend(b)
+
+	pool.SetHealthCheck(func(*backend.Backend) bool { return false })
+	pool.HealthCheck()
+	if b.IsAlive() {
+		t.Fatalf("expected probe result to mark backend down")
+	}
+}
+
+func TestServingStatusSkipsUnknownFields(t *testing.T) {
+	// field 2 (string "x"), then field 1 = 1
+	status, err := servingStatus([]byte{0x12, 0x01, 'x', 0x08, 0x01})
+	if err != nil || status != grpcServing {
+		t.Fatalf("expected status 1, got %d (%v)", status, err)
+	}
+}
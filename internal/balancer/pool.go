@@ -16,6 +16,15 @@ type ServerPool struct {
 	backends []*backend.Backend
 	current  uint64
 	mux      sync.RWMutex
+	// check probes a backend; nil means a TCP connect.
+	check func(*backend.Backend) bool
+}
+
+// SetHealthCheck replaces the probe used by HealthCheck
+func (s *ServerPool) SetHealthCheck(check func(*backend.Backend) bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.check = check
 }
 
 // AddBackend adds a new backend to the pool
@@ -25,6 +34,13 @@ func (s *ServerPool) AddBackend(b *backend.Backend) {
 	s.backends = append(s.backends, b)
 }
 
+// Backends returns a snapshot of the pool's backends
+func (s *ServerPool) Backends() []*backend.Backend {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return append([]*backend.Backend(nil), s.backends...)
+}
+
 // Clear removes all backends from the pool
 func (s *ServerPool) Clear() {
 	s.mux.Lock()
@@ -60,15 +76,22 @@ func (s *ServerPool) GetNextPeer() *backend.Backend {
 	return nil
 }
 
-// GetLeastConnections returns the backend with the least number of active connections
+// GetLeastConnections returns the backend with the least number of active
+// connections, counting both in-flight requests and open WebSocket sessions
 func (s *ServerPool) GetLeastConnections() *backend.Backend {
+	return s.GetLeastConnectionsExcept(nil)
+}
+
+// GetLeastConnectionsExcept is GetLeastConnections leaving out the backends
+// in skip, e.g. those that already failed a request
+func (s *ServerPool) GetLeastConnectionsExcept(skip map[*backend.Backend]bool) *backend.Backend {
 	s.mux.RLock()
 	defer s.mux.RUnlock()
 
 	var leastConnPeer *backend.Backend
 	for _, b := range s.backends {
-		if b.IsAlive() {
-			if leastConnPeer == nil || b.GetConnections() < leastConnPeer.GetConnections() {
+		if b.IsAlive() && !skip[b] {
+			if leastConnPeer == nil || load(b) < load(leastConnPeer) {
 				leastConnPeer = b
 			}
 		}
@@ -76,6 +99,10 @@ func (s *ServerPool) GetLeastConnections() *backend.Backend {
 	return leastConnPeer
 }
 
+func load(b *backend.Backend) int64 {
+	return b.GetConnections() + b.GetWebSockets()
+}
+
 // nextIndex atomically increases the counter and returns the index
 func (s *ServerPool) nextIndex() uint64 {
 	return atomic.AddUint64(&s.current, 1) % uint64(len(s.backends))
@@ -86,9 +113,13 @@ func (s *ServerPool) HealthCheck() {
 	s.mux.RLock()
 	defer s.mux.RUnlock()
 
+	check := s.check
+	if check == nil {
+		check = func(b *backend.Backend) bool { return isBackendAlive(b.URL) }
+	}
 	for _, b := range s.backends {
 		status := "up"
-		alive := isBackendAlive(b.URL)
+		alive := check(b)
 		b.SetAlive(alive)
 		if !alive {
 			status = "down"
@@ -99,10 +130,44 @@ func (s *ServerPool) HealthCheck() {
 
 // isBackendAlive checks whether a backend is responsive by attempting a TCP connection
 func isBackendAlive(u *url.URL) bool {
-	conn, err := net.DialTimeout("tcp", u.Host, 2*time.Second)
+	conn, err := net.DialTimeout("tcp", HostPort(u), 2*time.Second)
 	if err != nil {
 		return false
 	}
 	_ = conn.Close()
 	return true
 }
+
+// HostPort returns the host:port to dial for u, using the scheme's default
+// port when none is given.
+func HostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// UDPHealthCheck probes a UDP backend with an empty datagram. A closed port
+// answers with ICMP port unreachable, which shows up as a read error; no
+// answer at all counts as alive, since UDP services need not reply.
+func UDPHealthCheck(b *backend.Backend) bool {
+	conn, err := net.DialTimeout("udp", HostPort(b.URL), 2*time.Second)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(nil); err != nil {
+		return false
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	return err == nil
+}
@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/sargisis/edgecore/internal/backend"
+	"github.com/sargisis/edgecore/internal/devtools"
 )
 
 func newTestBackend(t *testing.T, rawURL string) *backend.Backend {
@@ -57,3 +58,52 @@ func TestServerPoolGetLeastConnectionsSkipsDead(t *testing.T) {
 		t.Fatalf("expected alive backend2 to be chosen, got %v", least.URL)
 	}
 }
+
+func TestHostPortDefaultsByScheme(t *testing.T) {
+	cases := map[string]string{
+		"http://backend1":       "backend1:80",
+		"https://backend1":      "backend1:443",
+		"https://backend1:8443": "backend1:8443",
+		"http://[::1]":          "[::1]:80",
+	}
+
+	for rawURL, want := range cases {
+		u, _ := url.Parse(rawURL)
+		if got := HostPort(u); got != want {
+			t.Errorf("%s: expected %q, got %q", rawURL, want, got)
+		}
+	}
+}
+
+func TestServerPoolGetLeastConnectionsCountsWebSockets(t *testing.T) {
+	var pool ServerPool
+
+	b1 := newTestBackend(t, "http://backend1")
+	b2 := newTestBackend(t, "http://backend2")
+	pool.AddBackend(b1)
+	pool.AddBackend(b2)
+
+	b1.IncWebSockets()
+	b2.IncConnections()
+	b2.IncConnections()
+
+	if least := pool.GetLeastConnections(); least != b1 {
+		t.Fatalf("expected backend1 with a single WebSocket to be chosen, got %v", least.URL)
+	}
+}
+
+func TestUDPHealthCheck(t *testing.T) {
+	conn, err := devtools.ListenUDPEcho("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start UDP echo: %v", err)
+	}
+	addr := conn.LocalAddr().String()
+
+	if !UDPHealthCheck(newTestBackend(t, "udp://"+addr)) {
+		t.Fatalf("expected listening UDP backend to be alive")
+	}
+	conn.Close()
+	if UDPHealthCheck(newTestBackend(t, "udp://"+addr)) {
+		t.Fatalf("expected closed UDP port to be reported down")
+	}
+}
@@ -0,0 +1,305 @@
+// Package certs manages TLS server configuration: certificates selected by
+// SNI, protocol versions, cipher suites and client certificate
+// authentication, all reloadable at runtime.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// KeyPair points at a PEM certificate chain and its private key.
+type KeyPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// Options describes a TLS listener.
+type Options struct {
+	Certificates []KeyPair
+	// MinVersion is "1.0", "1.1", "1.2" or "1.3"; empty means "1.2".
+	MinVersion string
+	// CipherSuites restricts the TLS 1.0-1.2 cipher suites by their Go name
+	// (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256). TLS 1.3 suites are fixed.
+	CipherSuites []string
+	// ClientAuth enables mutual TLS when set.
+	ClientAuth *ClientAuth
+	// OCSPStapling fetches OCSP responses and staples them to handshakes.
+	OCSPStapling bool
+	// OCSPResponder overrides the responder URL found in the certificates.
+	OCSPResponder string
+	// ExpiryWarning logs a warning when a certificate expires within this
+	// duration. Zero disables the warning.
+	ExpiryWarning time.Duration
+	// NextProtos lists the ALPN protocols offered, e.g. "h2" and "http/1.1".
+	NextProtos []string
+}
+
+// Manager holds the current TLS configuration of a listener. Reload swaps it
+// atomically: new handshakes use the new settings while established
+// connections are left alone.
+type Manager struct {
+	current atomic.Pointer[state]
+	// kick asks Run to refresh staples right away after a reload.
+	kick chan struct{}
+	// maintainMu serializes Maintain calls.
+	maintainMu sync.Mutex
+	client     *http.Client
+}
+
+// state is one loaded generation of a Manager's settings.
+type state struct {
+	plain *tls.Config
+	// mutual additionally requests and verifies client certificates; it is
+	// used for server names covered by the client auth settings.
+	mutual     *tls.Config
+	clientAuth *ClientAuth
+	store      *store
+	opts       Options
+}
+
+// NewManager builds a Manager from opts.
+func NewManager(opts Options) (*Manager, error) {
+	m := &Manager{
+		kick:   make(chan struct{}, 1),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	if err := m.Reload(opts); err != nil {
+		return nil, err
+	}
+	registerManager(m)
+	return m, nil
+}
+
+// Reload loads certificates and settings from opts. On error the previous
+// configuration stays active.
+func (m *Manager) Reload(opts Options) error {
+	store, err := loadStore(opts.Certificates)
+	if err != nil {
+		return err
+	}
+	minVersion, err := ParseVersion(opts.MinVersion)
+	if err != nil {
+		return err
+	}
+	suites, err := ParseCipherSuites(opts.CipherSuites)
+	if err != nil {
+		return err
+	}
+
+	st := &state{
+		store: store,
+		opts:  opts,
+		plain: &tls.Config{
+			MinVersion:     minVersion,
+			CipherSuites:   suites,
+			NextProtos:     opts.NextProtos,
+			GetCertificate: store.getCertificate,
+		},
+	}
+	if opts.ClientAuth != nil {
+		verifier, err := newClientVerifier(opts.ClientAuth)
+		if err != nil {
+			return err
+		}
+		st.clientAuth = opts.ClientAuth
+		st.mutual = st.plain.Clone()
+		// Verification happens in VerifyConnection rather than in crypto/tls
+		// so that failures can be reported.
+		st.mutual.ClientAuth = tls.RequestClientCert
+		st.mutual.VerifyConnection = verifier.verify
+	}
+
+	m.current.Store(st)
+	select {
+	case m.kick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// TLSConfig returns a config for tls.NewListener that always resolves to the
+// most recently loaded settings.
+func (m *Manager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			st := m.current.Load()
+			if st.mutual != nil && st.clientAuth.covers(hello.ServerName) {
+				return st.mutual, nil
+			}
+			return st.plain, nil
+		},
+	}
+}
+
+// CheckRequest applies client authentication to a request for host, its
+// Host header, on a connection with state cs. The handshake only sees the
+// SNI name, which clients may leave out or set to another host, so a
+// request for a host that requires a client certificate must have presented
+// one, and with per-host client authentication the SNI name must match the
+// host whenever either is covered.
+func (m *Manager) CheckRequest(cs *tls.ConnectionState, host string) error {
+	st := m.current.Load()
+	if st.mutual == nil || cs == nil {
+		return nil
+	}
+	auth := st.clientAuth
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = normalizeName(strings.Trim(host, "[]"))
+	sni := normalizeName(cs.ServerName)
+
+	if !auth.Optional && auth.covers(host) && len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("client certificate required for %s", host)
+	}
+	if len(auth.Hosts) > 0 && host != sni && (auth.covers(host) || auth.covers(sni)) {
+		return fmt.Errorf("host %s does not match TLS server name %q", host, sni)
+	}
+	return nil
+}
+
+// ParseVersion converts "1.0" - "1.3" to a crypto/tls version constant.
+func ParseVersion(v string) (uint16, error) {
+	switch v {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS version %q", v)
+	}
+}
+
+// ParseCipherSuites converts cipher suite names to their IDs. Suites that
+// crypto/tls considers insecure are rejected.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, s := range tls.CipherSuites() {
+		known[s.Name] = s.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// store indexes certificates by the DNS names they cover.
+type store struct {
+	entries []*entry
+	byName  map[string]*entry
+	// fallback is served to clients without SNI or with an unknown name.
+	fallback *entry
+}
+
+// entry is one loaded certificate. The served tls.Certificate is replaced
+// whenever a new OCSP staple arrives.
+type entry struct {
+	cert   atomic.Pointer[tls.Certificate]
+	leaf   *x509.Certificate
+	issuer *x509.Certificate
+	// The fields below are only touched by Maintain.
+	stapleRefresh time.Time
+	stapleExpiry  time.Time
+	lastWarned    time.Time
+}
+
+// name is the primary name of the certificate, used in logs and metrics.
+func (e *entry) name() string {
+	if len(e.leaf.DNSNames) > 0 {
+		return e.leaf.DNSNames[0]
+	}
+	return e.leaf.Subject.CommonName
+}
+
+func loadStore(pairs []KeyPair) (*store, error) {
+	if len(pairs) == 0 {
+		return nil, errors.New("no certificates configured")
+	}
+
+	s := &store{byName: make(map[string]*entry)}
+	for _, p := range pairs {
+		cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load certificate %s: %w", p.CertFile, err)
+		}
+		if cert.Leaf == nil {
+			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return nil, fmt.Errorf("parse certificate %s: %w", p.CertFile, err)
+			}
+		}
+
+		e := &entry{leaf: cert.Leaf}
+		if len(cert.Certificate) > 1 {
+			// The issuer is needed to build OCSP requests.
+			e.issuer, _ = x509.ParseCertificate(cert.Certificate[1])
+		}
+		e.cert.Store(&cert)
+		s.entries = append(s.entries, e)
+
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			// The first certificate listed for a name wins.
+			if _, ok := s.byName[name]; !ok {
+				s.byName[name] = e
+			}
+		}
+		if s.fallback == nil {
+			s.fallback = e
+		}
+	}
+	return s, nil
+}
+
+// getCertificate picks a certificate by exact SNI match, then by wildcard
+// (one label deep), then falls back to the first certificate.
+func (s *store) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := normalizeName(hello.ServerName)
+	if e, ok := s.byName[name]; ok {
+		return e.cert.Load(), nil
+	}
+	if e, ok := s.byName[wildcard(name)]; ok {
+		return e.cert.Load(), nil
+	}
+	return s.fallback.cert.Load(), nil
+}
+
+// normalizeName lowercases a server name and strips a trailing dot.
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// wildcard returns the one-label wildcard covering name ("*.example.com" for
+// "www.example.com"), or "" if name has a single label.
+func wildcard(name string) string {
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		return "*." + parent
+	}
+	return ""
+}
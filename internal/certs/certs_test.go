@@ -0,0 +1,137 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert creates a self-signed certificate for names in dir.
+func writeCert(t *testing.T, dir, file string, names ...string) KeyPair {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	pair := KeyPair{
+		CertFile: filepath.Join(dir, file+".crt"),
+		KeyFile:  filepath.Join(dir, file+".key"),
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(pair.CertFile, certPEM, 0o600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(pair.KeyFile, keyPEM, 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return pair
+}
+
+// servedName returns the first DNS name of the certificate chosen for sni.
+func servedName(t *testing.T, m *Manager, sni string) string {
+	t.Helper()
+
+	hello := &tls.ClientHelloInfo{ServerName: sni}
+	cfg, err := m.TLSConfig().GetConfigForClient(hello)
+	if err != nil {
+		t.Fatalf("GetConfigForClient failed: %v", err)
+	}
+	cert, err := cfg.GetCertificate(hello)
+	if err != nil {
+		t.Fatalf("GetCertificate failed: %v", err)
+	}
+	return cert.Leaf.DNSNames[0]
+}
+
+func TestManagerSelectsCertificateBySNI(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewManager(Options{Certificates: []KeyPair{
+		writeCert(t, dir, "default", "default.example"),
+		writeCert(t, dir, "api", "api.example.com"),
+		writeCert(t, dir, "wildcard", "*.example.com"),
+	}})
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	t.Cleanup(m.Close)
+
+	cases := map[string]string{
+		"api.example.com":     "api.example.com",
+		"API.Example.com.":    "api.example.com",
+		"www.example.com":     "*.example.com",
+		"a.b.example.com":     "default.example",
+		"unknown.example.org": "default.example",
+		"":                    "default.example",
+	}
+	for sni, want := range cases {
+		if got := servedName(t, m, sni); got != want {
+			t.Errorf("SNI %q: expected certificate for %q, got %q", sni, want, got)
+		}
+	}
+}
+
+func TestManagerReload(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewManager(Options{Certificates: []KeyPair{writeCert(t, dir, "old", "old.example")}})
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	t.Cleanup(m.Close)
+
+	if err := m.Reload(Options{Certificates: []KeyPair{{CertFile: "missing.crt", KeyFile: "missing.key"}}}); err == nil {
+		t.Fatalf("expected reload with missing files to fail")
+	}
+	if got := servedName(t, m, "old.example"); got != "old.example" {
+		t.Fatalf("expected failed reload to keep previous certificate, got %q", got)
+	}
+
+	if err := m.Reload(Options{Certificates: []KeyPair{writeCert(t, dir, "new", "new.example")}}); err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	if got := servedName(t, m, "old.example"); got != "new.example" {
+		t.Fatalf("expected reloaded certificate, got %q", got)
+	}
+}
+
+func TestParseVersionAndCipherSuites(t *testing.T) {
+	if v, err := ParseVersion("1.3"); err != nil || v != tls.VersionTLS13 {
+		t.Fatalf("expected TLS 1.3, got %x (%v)", v, err)
+	}
+	if _, err := ParseVersion("1.4"); err == nil {
+		t.Fatalf("expected error for unknown TLS version")
+	}
+
+	if _, err := ParseCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}); err != nil {
+		t.Fatalf("expected known cipher suite to parse, got %v", err)
+	}
+	if _, err := ParseCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"}); err == nil {
+		t.Fatalf("expected insecure cipher suite to be rejected")
+	}
+}
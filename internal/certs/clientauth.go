@@ -0,0 +1,86 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ClientAuth configures client certificate (mutual TLS) authentication.
+type ClientAuth struct {
+	// CAFile is a PEM bundle of CAs that may issue client certificates.
+	CAFile string
+	// Optional verifies certificates that are presented but lets clients
+	// without one through, so individual routes can decide.
+	Optional bool
+	// Hosts limits client authentication to these server names (SNI);
+	// "*.example.com" covers one label. Empty means every name.
+	Hosts []string
+	// OnFailure is called for every rejected client certificate.
+	OnFailure func(err error)
+}
+
+// covers reports whether client auth applies to the given SNI name.
+func (c *ClientAuth) covers(serverName string) bool {
+	if len(c.Hosts) == 0 {
+		return true
+	}
+	name := normalizeName(serverName)
+	for _, h := range c.Hosts {
+		h = normalizeName(h)
+		if h == name || (h != "" && h == wildcard(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+type clientVerifier struct {
+	roots *x509.CertPool
+	auth  *ClientAuth
+}
+
+func newClientVerifier(auth *ClientAuth) (*clientVerifier, error) {
+	pem, err := os.ReadFile(auth.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("load client CA bundle: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in client CA bundle %s", auth.CAFile)
+	}
+	return &clientVerifier{roots: roots, auth: auth}, nil
+}
+
+// verify checks the client's chain against the CA bundle. It runs for full
+// and resumed handshakes alike.
+func (v *clientVerifier) verify(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		if v.auth.Optional {
+			return nil
+		}
+		return v.fail(errors.New("client certificate required"))
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := cs.PeerCertificates[0].Verify(opts); err != nil {
+		return v.fail(fmt.Errorf("client certificate verification failed: %w", err))
+	}
+	return nil
+}
+
+func (v *clientVerifier) fail(err error) error {
+	if v.auth.OnFailure != nil {
+		v.auth.OnFailure(err)
+	}
+	return err
+}
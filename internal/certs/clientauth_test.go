@@ -0,0 +1,216 @@
+package certs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	file string
+}
+
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate CA key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create CA: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	file := filepath.Join(dir, name+".pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("failed to write CA bundle: %v", err)
+	}
+	return &testCA{cert: cert, key: key, file: file}
+}
+
+// issueClient returns a client certificate for cn signed by ca.
+func (ca *testCA) issueClient(t *testing.T, cn string) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate client key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("failed to issue client certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// handshake runs a TLS handshake against m and returns the server's error.
+func handshake(t *testing.T, m *Manager, serverName string, clientCert *tls.Certificate) error {
+	t.Helper()
+	_, err := serverHandshake(t, m, serverName, clientCert)
+	return err
+}
+
+// serverHandshake runs a TLS handshake against m and returns the server's
+// connection state.
+func serverHandshake(t *testing.T, m *Manager, serverName string, clientCert *tls.Certificate) (tls.ConnectionState, error) {
+	t.Helper()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	clientCfg := &tls.Config{ServerName: serverName, InsecureSkipVerify: true}
+	if clientCert != nil {
+		clientCfg.Certificates = []tls.Certificate{*clientCert}
+	}
+	go func() {
+		c := tls.Client(clientConn, clientCfg)
+		if c.Handshake() == nil {
+			// TLS 1.3 clients finish before the server checks their certificate;
+			// read so the server's verdict arrives.
+			c.Read(make([]byte, 1))
+		}
+		clientConn.Close()
+	}()
+
+	server := tls.Server(serverConn, m.TLSConfig())
+	err := server.Handshake()
+	return server.ConnectionState(), err
+}
+
+func TestClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "trusted-ca")
+	rogue := newTestCA(t, dir, "rogue-ca")
+
+	var failures atomic.Int64
+	m, err := NewManager(Options{
+		Certificates: []KeyPair{writeCert(t, dir, "server", "api.example.com", "www.example.com")},
+		ClientAuth: &ClientAuth{
+			CAFile:    ca.file,
+			Hosts:     []string{"api.example.com"},
+			OnFailure: func(error) { failures.Add(1) },
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	t.Cleanup(m.Close)
+
+	good := ca.issueClient(t, "good-client")
+	if err := handshake(t, m, "api.example.com", &good); err != nil {
+		t.Fatalf("expected certificate from trusted CA to be accepted, got %v", err)
+	}
+
+	bad := rogue.issueClient(t, "bad-client")
+	if err := handshake(t, m, "api.example.com", &bad); err == nil {
+		t.Fatalf("expected certificate from unknown CA to be rejected")
+	}
+	if err := handshake(t, m, "api.example.com", nil); err == nil {
+		t.Fatalf("expected missing client certificate to be rejected")
+	}
+	if got := failures.Load(); got != 2 {
+		t.Fatalf("expected 2 reported failures, got %d", got)
+	}
+
+	if err := handshake(t, m, "www.example.com", nil); err != nil {
+		t.Fatalf("expected host without client auth to accept anonymous clients, got %v", err)
+	}
+}
+
+func TestClientAuthOptional(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "trusted-ca")
+
+	m, err := NewManager(Options{
+		Certificates: []KeyPair{writeCert(t, dir, "server", "api.example.com")},
+		ClientAuth:   &ClientAuth{CAFile: ca.file, Optional: true},
+	})
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	t.Cleanup(m.Close)
+
+	if err := handshake(t, m, "api.example.com", nil); err != nil {
+		t.Fatalf("expected anonymous client to be accepted in optional mode, got %v", err)
+	}
+}
+
+func TestCheckRequestWithoutSNI(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "trusted-ca")
+
+	m, err := NewManager(Options{
+		Certificates: []KeyPair{writeCert(t, dir, "server", "api.example.com", "www.example.com")},
+		ClientAuth:   &ClientAuth{CAFile: ca.file, Hosts: []string{"api.example.com"}},
+	})
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	t.Cleanup(m.Close)
+
+	// Without SNI the handshake does not ask for a certificate.
+	cs, err := serverHandshake(t, m, "", nil)
+	if err != nil {
+		t.Fatalf("expected anonymous handshake without SNI, got %v", err)
+	}
+	if err := m.CheckRequest(&cs, "api.example.com"); err == nil {
+		t.Fatalf("expected request for a protected host without a certificate to be refused")
+	}
+	if err := m.CheckRequest(&cs, "www.example.com:443"); err != nil {
+		t.Fatalf("expected request for an unprotected host to pass, got %v", err)
+	}
+
+	// A certificate for another name does not carry over.
+	cs, err = serverHandshake(t, m, "www.example.com", nil)
+	if err != nil {
+		t.Fatalf("expected anonymous handshake for www.example.com, got %v", err)
+	}
+	if err := m.CheckRequest(&cs, "api.example.com"); err == nil {
+		t.Fatalf("expected request for a protected host on another SNI name to be refused")
+	}
+
+	good := ca.issueClient(t, "good-client")
+	cs, err = serverHandshake(t, m, "api.example.com", &good)
+	if err != nil {
+		t.Fatalf("expected certificate from trusted CA to be accepted, got %v", err)
+	}
+	if err := m.CheckRequest(&cs, "API.example.com"); err != nil {
+		t.Fatalf("expected request matching its SNI name to pass, got %v", err)
+	}
+	if err := m.CheckRequest(&cs, "www.example.com"); err == nil {
+		t.Fatalf("expected request for a host other than the SNI name to be refused")
+	}
+}
@@ -0,0 +1,184 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// maintainInterval is how often Run checks staples and expiry.
+	maintainInterval = time.Minute
+	// ocspRetry is the delay before retrying a failed OCSP fetch.
+	ocspRetry = 5 * time.Minute
+	// expiryWarningInterval rate-limits expiry warnings per certificate.
+	expiryWarningInterval = 24 * time.Hour
+)
+
+// Run keeps OCSP staples fresh and warns about expiring certificates until
+// stop is closed.
+func (m *Manager) Run(stop <-chan struct{}) {
+	t := time.NewTicker(maintainInterval)
+	defer t.Stop()
+
+	for {
+		m.Maintain(time.Now())
+		select {
+		case <-t.C:
+		case <-m.kick:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Maintain performs one round of OCSP refreshes and expiry checks as of now.
+func (m *Manager) Maintain(now time.Time) {
+	m.maintainMu.Lock()
+	defer m.maintainMu.Unlock()
+
+	st := m.current.Load()
+	for _, e := range st.store.entries {
+		if warn := st.opts.ExpiryWarning; warn > 0 {
+			left := e.leaf.NotAfter.Sub(now)
+			if left < warn && now.Sub(e.lastWarned) >= expiryWarningInterval {
+				log.Printf("WARNING: TLS certificate %s expires in %s (%s)",
+					e.name(), left.Round(time.Hour), e.leaf.NotAfter.Format(time.RFC3339))
+				e.lastWarned = now
+			}
+		}
+		if st.opts.OCSPStapling {
+			m.refreshStaple(e, now, st.opts.OCSPResponder)
+		}
+	}
+}
+
+// refreshStaple fetches a new OCSP response for e once half of the current
+// response's validity has passed. Failed fetches keep the old staple until it
+// expires.
+func (m *Manager) refreshStaple(e *entry, now time.Time, responder string) {
+	if !e.stapleExpiry.IsZero() && !now.Before(e.stapleExpiry) {
+		e.setStaple(nil)
+		e.stapleExpiry = time.Time{}
+	}
+	if now.Before(e.stapleRefresh) {
+		return
+	}
+
+	if responder == "" && len(e.leaf.OCSPServer) > 0 {
+		responder = e.leaf.OCSPServer[0]
+	}
+	if responder == "" || e.issuer == nil {
+		// Nothing to staple; check again in case the config changes.
+		e.stapleRefresh = now.Add(24 * time.Hour)
+		return
+	}
+
+	raw, resp, err := m.fetchOCSP(responder, e.leaf, e.issuer)
+	if err != nil {
+		log.Printf("OCSP fetch for %s failed: %v", e.name(), err)
+		e.stapleRefresh = now.Add(ocspRetry)
+		return
+	}
+	if resp.Status != ocsp.Good {
+		log.Printf("OCSP responder reports certificate %s as not good (status %d)", e.name(), resp.Status)
+		e.setStaple(nil)
+		e.stapleExpiry = time.Time{}
+		e.stapleRefresh = now.Add(ocspRetry)
+		return
+	}
+
+	e.setStaple(raw)
+	e.stapleExpiry = resp.NextUpdate
+	if resp.NextUpdate.IsZero() {
+		e.stapleRefresh = now.Add(time.Hour)
+	} else {
+		e.stapleRefresh = resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2)
+	}
+}
+
+func (m *Manager) fetchOCSP(responder string, leaf, issuer *x509.Certificate) ([]byte, *ocsp.Response, error) {
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	httpResp, err := m.client.Post(responder, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("responder returned status %d", httpResp.StatusCode)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(httpResp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return raw, resp, nil
+}
+
+// setStaple publishes a copy of the certificate carrying staple.
+func (e *entry) setStaple(staple []byte) {
+	cert := *e.cert.Load()
+	cert.OCSPStaple = staple
+	e.cert.Store(&cert)
+}
+
+// CertificateExpiry describes a certificate served by a Manager.
+type CertificateExpiry struct {
+	Name     string
+	Serial   string
+	NotAfter time.Time
+}
+
+var (
+	managersMu sync.Mutex
+	managers   []*Manager
+)
+
+func registerManager(m *Manager) {
+	managersMu.Lock()
+	defer managersMu.Unlock()
+	managers = append(managers, m)
+}
+
+// Close stops reporting m's certificates in Expiries.
+func (m *Manager) Close() {
+	managersMu.Lock()
+	defer managersMu.Unlock()
+	managers = slices.DeleteFunc(managers, func(other *Manager) bool { return other == m })
+}
+
+// Expiries lists the certificates currently served by all managers, without
+// duplicates.
+func Expiries() []CertificateExpiry {
+	managersMu.Lock()
+	defer managersMu.Unlock()
+
+	seen := make(map[string]bool)
+	var out []CertificateExpiry
+	for _, m := range managers {
+		for _, e := range m.current.Load().store.entries {
+			serial := e.leaf.SerialNumber.Text(16)
+			if seen[serial+"/"+e.name()] {
+				continue
+			}
+			seen[serial+"/"+e.name()] = true
+			out = append(out, CertificateExpiry{Name: e.name(), Serial: serial, NotAfter: e.leaf.NotAfter})
+		}
+	}
+	return out
+}
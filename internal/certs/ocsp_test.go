@@ -0,0 +1,176 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// issueServer writes a server certificate signed by ca, followed by the CA
+// certificate, so the issuer is available for OCSP.
+func (ca *testCA) issueServer(t *testing.T, dir, name string, notAfter time.Time) KeyPair {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("failed to issue server certificate: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	pair := KeyPair{CertFile: filepath.Join(dir, name+".crt"), KeyFile: filepath.Join(dir, name+".key")}
+	chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})...)
+	if err := os.WriteFile(pair.CertFile, chain, 0o600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(pair.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return pair
+}
+
+// newResponder starts a local OCSP responder signing "good" responses valid
+// for validity. Setting failing makes it answer with 500.
+func newResponder(t *testing.T, ca *testCA, validity time.Duration) (*httptest.Server, *atomic.Bool, *atomic.Int64) {
+	t.Helper()
+
+	var failing atomic.Bool
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		resp, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   now,
+			NextUpdate:   now.Add(validity),
+		}, ca.key)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(resp)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &failing, &requests
+}
+
+func TestManagerStaplesOCSP(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	responder, failing, requests := newResponder(t, ca, 4*time.Hour)
+
+	m, err := NewManager(Options{
+		Certificates:  []KeyPair{ca.issueServer(t, dir, "www.example.com", time.Now().Add(30*24*time.Hour))},
+		OCSPStapling:  true,
+		OCSPResponder: responder.URL,
+	})
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	t.Cleanup(m.Close)
+	e := m.current.Load().store.entries[0]
+
+	now := time.Now()
+	m.Maintain(now)
+	staple := e.cert.Load().OCSPStaple
+	if len(staple) == 0 {
+		t.Fatalf("expected OCSP response to be stapled")
+	}
+	if _, err := ocsp.ParseResponse(staple, ca.cert); err != nil {
+		t.Fatalf("expected valid stapled response, got %v", err)
+	}
+
+	// Within the first half of the validity window nothing is fetched.
+	m.Maintain(now.Add(time.Hour))
+	if got := requests.Load(); got != 1 {
+		t.Fatalf("expected cached staple to be reused, got %d requests", got)
+	}
+
+	// A failing responder keeps the old staple while it is still valid...
+	failing.Store(true)
+	m.Maintain(now.Add(3 * time.Hour))
+	if got := requests.Load(); got != 2 {
+		t.Fatalf("expected refresh after half the validity, got %d requests", got)
+	}
+	if len(e.cert.Load().OCSPStaple) == 0 {
+		t.Fatalf("expected old staple to be kept while valid")
+	}
+
+	// ...and drops it once it has expired.
+	m.Maintain(now.Add(5 * time.Hour))
+	if len(e.cert.Load().OCSPStaple) != 0 {
+		t.Fatalf("expected expired staple to be dropped")
+	}
+}
+
+func TestExpiries(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	notAfter := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+
+	m, err := NewManager(Options{
+		Certificates:  []KeyPair{ca.issueServer(t, dir, "expiring.example.com", notAfter)},
+		ExpiryWarning: 7 * 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	t.Cleanup(m.Close)
+	m.Maintain(time.Now())
+
+	var found bool
+	for _, exp := range Expiries() {
+		if exp.Name == "expiring.example.com" {
+			found = true
+			if !exp.NotAfter.Equal(notAfter) {
+				t.Fatalf("expected expiry %s, got %s", notAfter, exp.NotAfter)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("expected certificate to be listed in Expiries")
+	}
+
+	m.Close()
+	for _, exp := range Expiries() {
+		if exp.Name == "expiring.example.com" {
+			t.Fatalf("expected closed manager to be removed from Expiries")
+		}
+	}
+}
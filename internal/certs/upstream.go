@@ -0,0 +1,101 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Upstream describes TLS towards backends.
+type Upstream struct {
+	// CAFile is a PEM bundle used instead of the system roots.
+	CAFile string
+	// CertFile and KeyFile are presented as the client certificate.
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the SNI name and the name verified in the
+	// backend's certificate.
+	ServerName string
+	// InsecureSkipVerify disables chain and host name verification.
+	InsecureSkipVerify bool
+	// PinnedSPKI lists base64 SHA-256 hashes of acceptable public keys
+	// (as produced by "openssl x509 -pubkey | openssl pkey -pubin -outform der
+	// | openssl dgst -sha256 -binary | base64"). One certificate of the
+	// verified chain must match; with InsecureSkipVerify, the backend's own
+	// certificate must.
+	PinnedSPKI []string
+}
+
+// ClientTLSConfig builds the TLS configuration for connections to backends.
+func (u *Upstream) ClientTLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         u.ServerName,
+		InsecureSkipVerify: u.InsecureSkipVerify,
+	}
+
+	if u.CAFile != "" {
+		pem, err := os.ReadFile(u.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("load upstream CA bundle: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in upstream CA bundle %s", u.CAFile)
+		}
+	}
+
+	if u.CertFile != "" || u.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(u.CertFile, u.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load upstream client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(u.PinnedSPKI) > 0 {
+		pins := make([][]byte, 0, len(u.PinnedSPKI))
+		for _, p := range u.PinnedSPKI {
+			pin, err := base64.StdEncoding.DecodeString(p)
+			if err != nil || len(pin) != sha256.Size {
+				return nil, fmt.Errorf("invalid SPKI pin %q: must be a base64 SHA-256 hash", p)
+			}
+			pins = append(pins, pin)
+		}
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			// Only certificates that verification linked to the backend
+			// count: a server may append any certificate to what it sends.
+			chains := cs.VerifiedChains
+			if len(chains) == 0 && len(cs.PeerCertificates) > 0 {
+				chains = [][]*x509.Certificate{cs.PeerCertificates[:1]}
+			}
+			return verifyPins(chains, pins)
+		}
+	}
+	return cfg, nil
+}
+
+// SPKIHash returns the base64 SHA-256 hash of cert's public key, the format
+// used by Upstream.PinnedSPKI.
+func SPKIHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func verifyPins(chains [][]*x509.Certificate, pins [][]byte) error {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if bytes.Equal(sum[:], pin) {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New("upstream certificate does not match any pinned public key")
+}
@@ -0,0 +1,114 @@
+package certs
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newUpstream starts a TLS backend that reports whether it saw a client
+// certificate, and writes its certificate as a CA bundle.
+func newUpstream(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+		}
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	caFile := filepath.Join(t.TempDir(), "backend-ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatalf("failed to write CA bundle: %v", err)
+	}
+	return srv, caFile
+}
+
+func get(t *testing.T, u *Upstream, url string) (string, error) {
+	t.Helper()
+
+	cfg, err := u.ClientTLSConfig()
+	if err != nil {
+		t.Fatalf("failed to build upstream TLS config: %v", err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	buf := make([]byte, 64)
+	n, _ := resp.Body.Read(buf)
+	return string(buf[:n]), nil
+}
+
+func TestUpstreamPrivateCAAndClientCert(t *testing.T) {
+	srv, caFile := newUpstream(t)
+	pair := writeCert(t, t.TempDir(), "client", "edgecore-client")
+
+	if _, err := get(t, &Upstream{}, srv.URL); err == nil {
+		t.Fatalf("expected backend signed by private CA to be rejected with system roots")
+	}
+
+	body, err := get(t, &Upstream{
+		CAFile:     caFile,
+		CertFile:   pair.CertFile,
+		KeyFile:    pair.KeyFile,
+		ServerName: "example.com",
+	}, srv.URL)
+	if err != nil {
+		t.Fatalf("expected request with private CA to succeed, got %v", err)
+	}
+	if body != "edgecore-client" {
+		t.Fatalf("expected backend to see client certificate, got %q", body)
+	}
+}
+
+func TestUpstreamPinning(t *testing.T) {
+	srv, caFile := newUpstream(t)
+
+	if _, err := get(t, &Upstream{
+		CAFile:     caFile,
+		ServerName: "example.com",
+		PinnedSPKI: []string{SPKIHash(srv.Certificate())},
+	}, srv.URL); err != nil {
+		t.Fatalf("expected matching pin to succeed, got %v", err)
+	}
+
+	otherPin := SPKIHash(newTestCA(t, t.TempDir(), "other").cert)
+	if _, err := get(t, &Upstream{InsecureSkipVerify: true, PinnedSPKI: []string{otherPin}}, srv.URL); err == nil {
+		t.Fatalf("expected mismatched pin to fail even with insecure_skip_verify")
+	}
+}
+
+func TestUpstreamPinningIgnoresAppendedCertificates(t *testing.T) {
+	pinned, _ := newUpstream(t)
+
+	// A backend with its own certificate sends the pinned one along.
+	pair := writeCert(t, t.TempDir(), "impostor", "example.com")
+	cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+	if err != nil {
+		t.Fatalf("failed to load certificate: %v", err)
+	}
+	cert.Certificate = append(cert.Certificate, pinned.Certificate().Raw)
+	impostor := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	impostor.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	impostor.StartTLS()
+	t.Cleanup(impostor.Close)
+
+	pin := []string{SPKIHash(pinned.Certificate())}
+	if _, err := get(t, &Upstream{CAFile: pair.CertFile, ServerName: "example.com", PinnedSPKI: pin}, impostor.URL); err == nil {
+		t.Fatalf("expected pin outside the verified chain to fail")
+	}
+	if _, err := get(t, &Upstream{InsecureSkipVerify: true, PinnedSPKI: pin}, impostor.URL); err == nil {
+		t.Fatalf("expected pin on an appended certificate to fail with insecure_skip_verify")
+	}
+}
@@ -1,17 +1,641 @@
 package config
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"net"
+	"net/netip"
 	"net/url"
 	"os"
+	"slices"
+	"strings"
+	"time"
 )
 
 type Config struct {
-	Backends  []string `json:"backends"`
-	Port      int      `json:"port"`
-	RateLimit float64  `json:"rate_limit"`
-	Burst     float64  `json:"burst"`
+	Backends       []string         `json:"backends"`
+	Port           int              `json:"port"`
+	RateLimit      float64          `json:"rate_limit"`
+	Burst          float64          `json:"burst"`
+	Forwarding     ForwardingConfig `json:"forwarding"`
+	Listeners      []ListenerConfig `json:"listeners"`
+	TrustedProxies []string         `json:"trusted_proxies"`
+	// ClientIPHeader is the header trusted proxies report the client in:
+	// "x-forwarded-for" (the default), "forwarded" or "x-real-ip". The
+	// others are ignored, since a client can send them through a proxy
+	// that does not overwrite them.
+	ClientIPHeader string         `json:"client_ip_header"`
+	Upstream       UpstreamConfig `json:"upstream"`
+	Routes         []RouteConfig  `json:"routes"`
+	// RateLimitMaxKeys caps the clients tracked by the rate limiter; the
+	// least recently seen are forgotten beyond it. Defaults to 100000.
+	RateLimitMaxKeys int `json:"rate_limit_max_keys"`
+	// RateLimitIdleTTLSeconds forgets clients idle this long; defaults to 600.
+	RateLimitIdleTTLSeconds int `json:"rate_limit_idle_ttl_seconds"`
+	// RateLimitAlgorithm is token_bucket (the default), gcra,
+	// sliding_window_log or sliding_window_counter.
+	RateLimitAlgorithm string `json:"rate_limit_algorithm"`
+	// RateLimitResponse shapes the headers and body of rate limited responses.
+	RateLimitResponse RateLimitResponseConfig `json:"rate_limit_response"`
+	// RateLimits stack limits keyed by request attributes on top of the
+	// per-IP limit.
+	RateLimits []RateLimitConfig `json:"rate_limits"`
+	// RateLimitStore shares the per-IP limit and the rules between edgecore
+	// instances. It is read at startup only.
+	RateLimitStore *RateLimitStoreConfig `json:"rate_limit_store,omitempty"`
+	// Pools are additional named backend pools that routes can send traffic
+	// to. Backends and Upstream above form the "default" pool.
+	Pools map[string]PoolConfig `json:"pools"`
+	// WebSocket limits proxied WebSocket sessions.
+	WebSocket WebSocketConfig `json:"websocket"`
+	// TCPListeners balance raw TCP connections over pools of tcp:// backends.
+	TCPListeners []TCPListenerConfig `json:"tcp_listeners"`
+	// UDPListeners balance datagrams over pools of udp:// backends.
+	UDPListeners []UDPListenerConfig `json:"udp_listeners"`
+	// HealthCheck configures how the default pool's backends are probed.
+	HealthCheck *HealthCheckConfig `json:"health_check,omitempty"`
+	// Concurrency caps requests in flight to the default pool.
+	Concurrency *ConcurrencyConfig `json:"concurrency,omitempty"`
+	// LoadShedding gives requests priorities so that overload sheds the
+	// lower ones first.
+	LoadShedding *LoadSheddingConfig `json:"load_shedding,omitempty"`
+	// Quotas cap the requests of API consumers per calendar day and month.
+	Quotas *QuotaConfig `json:"quotas,omitempty"`
+	// Admin enables the admin API under /_admin/ on its own listener.
+	Admin *AdminConfig `json:"admin,omitempty"`
+	// Access limits the clients of HTTP listeners without their own list.
+	Access *AccessConfig `json:"access,omitempty"`
+	// Bans temporarily ban clients that keep getting error responses.
+	Bans *BanConfig `json:"bans,omitempty"`
+	// CertExpiryWarningDays logs a warning when a served certificate expires
+	// within this many days. Defaults to 14.
+	CertExpiryWarningDays int `json:"cert_expiry_warning_days"`
+}
+
+// DefaultPool is the name of the pool built from the top-level backends.
+const DefaultPool = "default"
+
+// PoolConfig is a named group of backends sharing upstream settings.
+type PoolConfig struct {
+	Backends    []string           `json:"backends"`
+	Upstream    UpstreamConfig     `json:"upstream"`
+	HealthCheck *HealthCheckConfig `json:"health_check,omitempty"`
+	// Concurrency caps requests in flight to the pool.
+	Concurrency *ConcurrencyConfig `json:"concurrency,omitempty"`
+}
+
+// TCPListenerConfig describes a layer-4 TCP listener.
+type TCPListenerConfig struct {
+	Port int `json:"port"`
+	// Pool names the pool of tcp://host:port backends to balance over. With
+	// SNIRoutes it is optional and takes connections no route matches.
+	Pool string `json:"pool"`
+	// SNIRoutes make the listener a TLS passthrough that picks the pool by
+	// the server name in the ClientHello, without terminating TLS.
+	SNIRoutes []SNIRouteConfig `json:"sni_routes"`
+	// IdleTimeoutSeconds closes connections silent in both directions;
+	// defaults to 300.
+	IdleTimeoutSeconds int `json:"idle_timeout_seconds"`
+	// ProxyProtocol accepts PROXY protocol headers, as on HTTP listeners.
+	ProxyProtocol        bool     `json:"proxy_protocol"`
+	ProxyProtocolTrusted []string `json:"proxy_protocol_trusted"`
+	// Access limits the clients allowed to connect.
+	Access *AccessConfig `json:"access,omitempty"`
+}
+
+// AccessConfig allows or denies clients by IP address. Deny wins; with no
+// allow entries every client not denied is allowed.
+type AccessConfig struct {
+	// Allow and Deny are CIDR prefixes or single addresses.
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+	// AllowFiles and DenyFiles list more prefixes, one per line, and are
+	// read again on reload.
+	AllowFiles []string `json:"allow_files"`
+	DenyFiles  []string `json:"deny_files"`
+}
+
+func (c *AccessConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	for _, cidr := range append(slices.Clip(c.Allow), c.Deny...) {
+		if err := validateCIDR(cidr); err != nil {
+			return fmt.Errorf("access: %w", err)
+		}
+	}
+	for _, f := range append(slices.Clip(c.AllowFiles), c.DenyFiles...) {
+		if f == "" {
+			return fmt.Errorf("access: empty file name")
+		}
+	}
+	return nil
+}
+
+// SNIRouteConfig sends TLS connections for a server name to a pool.
+type SNIRouteConfig struct {
+	// Host is an exact server name or a one-label wildcard ("*.example.com").
+	Host string `json:"host"`
+	Pool string `json:"pool"`
+}
+
+// UDPListenerConfig describes a UDP listener. Datagrams from one client
+// address form a session that sticks to one backend, so replies find their
+// way back.
+type UDPListenerConfig struct {
+	Port int `json:"port"`
+	// Pool names the pool of udp://host:port backends to balance over.
+	Pool string `json:"pool"`
+	// SessionTimeoutSeconds expires sessions without datagrams in either
+	// direction; defaults to 60.
+	SessionTimeoutSeconds int `json:"session_timeout_seconds"`
+	// MaxSessions caps concurrent sessions; defaults to 10000.
+	MaxSessions int `json:"max_sessions"`
+}
+
+// RateLimitResponseConfig shapes rate limit headers and 429 responses.
+type RateLimitResponseConfig struct {
+	// DisableHeaders omits the RateLimit-* headers.
+	DisableHeaders bool `json:"disable_headers"`
+	// LegacyHeaders also sends X-RateLimit-* headers.
+	LegacyHeaders bool `json:"legacy_headers"`
+	// ErrorBody is the JSON body of 429 responses, replacing the default.
+	ErrorBody json.RawMessage `json:"error_body,omitempty"`
+}
+
+// RateLimitConfig is a token bucket per key built from request attributes.
+type RateLimitConfig struct {
+	// Name labels the rule in metrics and identifies it across reloads.
+	Name string `json:"name"`
+	// Key is a template such as "{header:X-API-Key}" or "{user}:{route}";
+	// requests for which a placeholder is empty skip the rule.
+	Key   string  `json:"key"`
+	Rate  float64 `json:"rate"`
+	Burst float64 `json:"burst"`
+	// Algorithm is as RateLimitAlgorithm above; empty means token_bucket.
+	Algorithm string `json:"algorithm"`
+	// Overrides set the rate and burst of specific keys.
+	Overrides map[string]LimitConfig `json:"overrides"`
+}
+
+// RateLimitStoreConfig points at a Redis-compatible store counting requests
+// for every instance.
+type RateLimitStoreConfig struct {
+	// Address is the host:port of the store.
+	Address  string `json:"address"`
+	Password string `json:"password"`
+	DB       int    `json:"db"`
+	// Prefix starts every key; defaults to "edgecore:ratelimit:".
+	Prefix string `json:"prefix"`
+	// TimeoutMs bounds each round trip; defaults to 50.
+	TimeoutMs int `json:"timeout_ms"`
+	// LeaseSize is how many requests an instance reserves per round trip;
+	// defaults to a tenth of the burst.
+	LeaseSize int `json:"lease_size"`
+	// FailClosed rejects requests while the store is unreachable instead of
+	// falling back to per-instance limits.
+	FailClosed bool `json:"fail_closed"`
+}
+
+// LoadSheddingConfig classifies requests into priorities and sheds lower
+// priorities first when the process or a concurrency limit is overloaded.
+type LoadSheddingConfig struct {
+	// DefaultPriority applies to requests matching no rule; defaults to
+	// "normal".
+	DefaultPriority string `json:"default_priority"`
+	// Priorities are checked in order; the first match wins.
+	Priorities []PriorityConfig `json:"priorities"`
+	// MaxCPUPercent is the CPU use, as a percentage of the available cores,
+	// above which lower priorities are shed.
+	MaxCPUPercent float64 `json:"max_cpu_percent"`
+	// MaxGoroutines is the goroutine count above which lower priorities are
+	// shed.
+	MaxGoroutines int `json:"max_goroutines"`
+}
+
+// PriorityConfig gives a priority to the requests matching all of its set
+// conditions.
+type PriorityConfig struct {
+	// Priority is "low", "normal", "high" or "critical".
+	Priority string `json:"priority"`
+	// Routes are route names.
+	Routes []string `json:"routes"`
+	// Key is a rate limit key template, e.g. "{header:X-Plan}"; it must
+	// build one of Values, or any key when Values is empty.
+	Key    string   `json:"key"`
+	Values []string `json:"values"`
+	// ClientCIDRs must contain the client IP.
+	ClientCIDRs []string `json:"client_cidrs"`
+}
+
+// priorities are the request priorities, lowest first.
+var priorities = []string{"low", "normal", "high", "critical"}
+
+func validatePriority(p string) error {
+	if !slices.Contains(priorities, p) {
+		return fmt.Errorf("unknown priority %q, expected one of %s", p, strings.Join(priorities, ", "))
+	}
+	return nil
+}
+
+func (c *LoadSheddingConfig) validate() error {
+	if c.DefaultPriority != "" {
+		if err := validatePriority(c.DefaultPriority); err != nil {
+			return err
+		}
+	}
+	if c.MaxCPUPercent < 0 || c.MaxCPUPercent > 100 {
+		return fmt.Errorf("max_cpu_percent must be between 0 and 100")
+	}
+	if c.MaxGoroutines < 0 {
+		return fmt.Errorf("max_goroutines must be >= 0")
+	}
+	for i, p := range c.Priorities {
+		if err := validatePriority(p.Priority); err != nil {
+			return fmt.Errorf("priority rule %d: %w", i, err)
+		}
+		if len(p.Routes) == 0 && p.Key == "" && len(p.ClientCIDRs) == 0 {
+			return fmt.Errorf("priority rule %d: needs routes, key or client_cidrs", i)
+		}
+		if len(p.Values) > 0 && p.Key == "" {
+			return fmt.Errorf("priority rule %d: values require a key", i)
+		}
+		for _, cidr := range p.ClientCIDRs {
+			if err := validateCIDR(cidr); err != nil {
+				return fmt.Errorf("priority rule %d: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// QuotaConfig caps the requests of API consumers, such as the holders of
+// API keys, per calendar day and month.
+type QuotaConfig struct {
+	// Consumer is a key template naming the consumer of a request, e.g.
+	// "{header:X-API-Key}". Requests without a consumer are not counted.
+	Consumer string `json:"consumer"`
+	// Plans are quotas by plan name.
+	Plans map[string]QuotaPlanConfig `json:"plans"`
+	// Consumers maps consumers to plans; the others are on DefaultPlan.
+	// Consumers without a plan have no quota.
+	Consumers   map[string]string `json:"consumers"`
+	DefaultPlan string            `json:"default_plan"`
+	// MaxConsumers caps the consumers on the default plan whose usage is
+	// kept; the least recently seen are forgotten beyond it. 0 means
+	// 100000.
+	MaxConsumers int `json:"max_consumers"`
+	// StateFile keeps usage across restarts; without it usage is lost.
+	StateFile string `json:"state_file"`
+	// Timezone sets when days and months begin, e.g. "Europe/Berlin";
+	// defaults to UTC.
+	Timezone string `json:"timezone"`
+}
+
+// QuotaPlanConfig limits the requests per day and month; 0 is unlimited.
+type QuotaPlanConfig struct {
+	Daily   int64 `json:"daily"`
+	Monthly int64 `json:"monthly"`
+}
+
+func (c *QuotaConfig) validate() error {
+	if c.Consumer == "" {
+		return fmt.Errorf("consumer is required")
+	}
+	for name, p := range c.Plans {
+		if p.Daily < 0 || p.Monthly < 0 {
+			return fmt.Errorf("plan %q: daily and monthly must be >= 0", name)
+		}
+	}
+	if c.MaxConsumers < 0 {
+		return fmt.Errorf("max_consumers must be >= 0")
+	}
+	if _, ok := c.Plans[c.DefaultPlan]; c.DefaultPlan != "" && !ok {
+		return fmt.Errorf("unknown default_plan %q", c.DefaultPlan)
+	}
+	for consumer, plan := range c.Consumers {
+		if _, ok := c.Plans[plan]; !ok {
+			return fmt.Errorf("consumer %q: unknown plan %q", consumer, plan)
+		}
+	}
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %q", c.Timezone)
+	}
+	return nil
+}
+
+// BanConfig bans clients by IP address when they collect too many
+// responses of some statuses, e.g. 429 or 401, in a short time.
+type BanConfig struct {
+	Rules []BanRuleConfig `json:"rules"`
+	// BanSeconds is the length of a first ban; defaults to 600. Each ban
+	// within ForgetSeconds of the end of the previous one lasts twice as
+	// long, up to MaxBanSeconds, which defaults to 86400.
+	BanSeconds    int `json:"ban_seconds"`
+	MaxBanSeconds int `json:"max_ban_seconds"`
+	// ForgetSeconds is how long past bans count for escalation; defaults
+	// to 86400.
+	ForgetSeconds int `json:"forget_seconds"`
+	// Exempt clients are never banned.
+	Exempt []string `json:"exempt"`
+	// IPv6PrefixBits is the length of the IPv6 networks banned as one
+	// client; defaults to 64.
+	IPv6PrefixBits int `json:"ipv6_prefix_bits"`
+	// MaxClients caps the clients whose responses are counted; defaults
+	// to 100000.
+	MaxClients int `json:"max_clients"`
+	// StateFile keeps bans across restarts; without it they are lost.
+	StateFile string `json:"state_file"`
+}
+
+// BanRuleConfig bans a client that gets Threshold responses with one of
+// Statuses within WindowSeconds.
+type BanRuleConfig struct {
+	Name          string `json:"name"`
+	Statuses      []int  `json:"statuses"`
+	Threshold     int    `json:"threshold"`
+	WindowSeconds int    `json:"window_seconds"`
+}
+
+func (c *BanConfig) validate() error {
+	if len(c.Rules) == 0 {
+		return fmt.Errorf("at least one rule is required")
+	}
+	names := make(map[string]bool)
+	for _, r := range c.Rules {
+		if r.Name == "" {
+			return fmt.Errorf("rule requires a name")
+		}
+		if names[r.Name] {
+			return fmt.Errorf("duplicate rule %q", r.Name)
+		}
+		names[r.Name] = true
+		if len(r.Statuses) == 0 {
+			return fmt.Errorf("rule %q: statuses are required", r.Name)
+		}
+		for _, status := range r.Statuses {
+			if status < 100 || status > 599 {
+				return fmt.Errorf("rule %q: invalid status %d", r.Name, status)
+			}
+		}
+		if r.Threshold < 1 || r.WindowSeconds < 1 {
+			return fmt.Errorf("rule %q: threshold and window_seconds must be > 0", r.Name)
+		}
+	}
+	if c.BanSeconds < 0 || c.MaxBanSeconds < 0 || c.ForgetSeconds < 0 {
+		return fmt.Errorf("ban_seconds, max_ban_seconds and forget_seconds must be >= 0")
+	}
+	if c.IPv6PrefixBits < 0 || c.IPv6PrefixBits > 128 {
+		return fmt.Errorf("ipv6_prefix_bits must be between 0 and 128")
+	}
+	if c.MaxClients < 0 {
+		return fmt.Errorf("max_clients must be >= 0")
+	}
+	for _, cidr := range c.Exempt {
+		if err := validateCIDR(cidr); err != nil {
+			return fmt.Errorf("exempt: %w", err)
+		}
+	}
+	return nil
+}
+
+// AdminConfig enables the admin API. It is served on a listener of its
+// own, so it never shadows backend paths on the public listeners.
+type AdminConfig struct {
+	// Token must be sent as "Authorization: Bearer <token>".
+	Token string `json:"token"`
+	// Address and Port are where the admin listener binds; they default to
+	// 127.0.0.1 and 9901.
+	Address string `json:"address,omitempty"`
+	Port    int    `json:"port,omitempty"`
+	// Access restricts the clients of the admin listener.
+	Access *AccessConfig `json:"access,omitempty"`
+}
+
+func (c *AdminConfig) validate() error {
+	if len(c.Token) < 16 {
+		return fmt.Errorf("token must be at least 16 characters")
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid port %d: must be between 1 and 65535", c.Port)
+	}
+	if c.Address != "" {
+		if _, err := netip.ParseAddr(c.Address); err != nil {
+			return fmt.Errorf("invalid address %q: must be an IP address", c.Address)
+		}
+	}
+	return c.Access.validate()
+}
+
+// rateLimitAlgorithms are the supported rate limiting algorithms.
+var rateLimitAlgorithms = []string{"token_bucket", "sliding_window_log", "sliding_window_counter", "gcra"}
+
+func validateAlgorithm(a string) error {
+	if a != "" && !slices.Contains(rateLimitAlgorithms, a) {
+		return fmt.Errorf("unknown rate limit algorithm %q, expected one of %s", a, strings.Join(rateLimitAlgorithms, ", "))
+	}
+	return nil
+}
+
+// LimitConfig is a rate and burst.
+type LimitConfig struct {
+	Rate  float64 `json:"rate"`
+	Burst float64 `json:"burst"`
+}
+
+// WebSocketConfig limits proxied WebSocket sessions.
+type WebSocketConfig struct {
+	// IdleTimeoutSeconds closes sessions without traffic; defaults to 300.
+	IdleTimeoutSeconds int `json:"idle_timeout_seconds"`
+	// MaxLifetimeSeconds closes sessions older than this; 0 means no limit.
+	MaxLifetimeSeconds int `json:"max_lifetime_seconds"`
+	// MaxPerClient caps concurrent sessions per client IP; 0 means no limit.
+	MaxPerClient int `json:"max_per_client"`
+}
+
+// HealthCheckConfig selects how a pool's backends are probed.
+type HealthCheckConfig struct {
+	// Type is "tcp" (a plain connect, the default for HTTP and TCP pools),
+	// "grpc" (the standard grpc.health.v1.Health/Check call) or "udp" (an
+	// empty datagram that fails on ICMP port unreachable, the default for
+	// UDP pools).
+	Type string `json:"type"`
+	// Service is the gRPC service name to check; empty checks the server
+	// as a whole.
+	Service string `json:"service"`
+}
+
+// ForwardingConfig controls the X-Forwarded-* and Forwarded headers sent to backends.
+type ForwardingConfig struct {
+	// TrustIncoming keeps forwarding headers sent by the client and appends to
+	// them. When false, incoming values are discarded and overwritten.
+	TrustIncoming bool `json:"trust_incoming"`
+	// Forwarded additionally emits the standardized RFC 7239 Forwarded header.
+	Forwarded bool `json:"forwarded"`
+}
+
+// ListenerConfig describes a single HTTP listener.
+type ListenerConfig struct {
+	Port int `json:"port"`
+	// Forwarding overrides the top-level forwarding policy for this listener.
+	Forwarding *ForwardingConfig `json:"forwarding,omitempty"`
+	// ProxyProtocol accepts PROXY protocol v1/v2 headers from
+	// ProxyProtocolTrusted sources (or trusted_proxies when empty).
+	ProxyProtocol        bool     `json:"proxy_protocol"`
+	ProxyProtocolTrusted []string `json:"proxy_protocol_trusted"`
+	// TLS turns this listener into an HTTPS listener.
+	TLS *TLSConfig `json:"tls,omitempty"`
+	// RedirectHTTPS answers every request with a redirect to the first TLS listener.
+	RedirectHTTPS bool `json:"redirect_https"`
+	// DisableHTTP2 turns off HTTP/2 negotiation (ALPN) on TLS listeners.
+	DisableHTTP2 bool `json:"disable_http2"`
+	// H2C accepts cleartext HTTP/2 with prior knowledge on plain listeners.
+	H2C bool `json:"h2c"`
+	// HTTP3 also serves HTTP/3 over QUIC on the same port number (UDP) and
+	// advertises it to TLS clients with Alt-Svc. TLS listeners only.
+	HTTP3 bool `json:"http3"`
+	// Access limits the clients of the listener, overriding the top-level
+	// list.
+	Access *AccessConfig `json:"access,omitempty"`
+}
+
+// TLSConfig configures TLS termination on a listener.
+type TLSConfig struct {
+	// Certificates are chosen by SNI; the first one is the default.
+	Certificates []CertificateConfig `json:"certificates"`
+	MinVersion   string              `json:"min_version"`
+	CipherSuites []string            `json:"cipher_suites"`
+	ClientAuth   *ClientAuthConfig   `json:"client_auth,omitempty"`
+	// OCSPStapling staples OCSP responses, fetched from OCSPResponder or the
+	// responder named in each certificate.
+	OCSPStapling  bool   `json:"ocsp_stapling"`
+	OCSPResponder string `json:"ocsp_responder"`
+}
+
+// ClientAuthConfig enables mutual TLS on a listener.
+type ClientAuthConfig struct {
+	// CAFile is the PEM bundle of CAs trusted to issue client certificates.
+	CAFile string `json:"ca_file"`
+	// Optional accepts clients without a certificate; routes can still
+	// demand one with require_client_cert.
+	Optional bool `json:"optional"`
+	// Hosts limits client authentication to these SNI names. Empty means all.
+	Hosts []string `json:"hosts"`
+}
+
+// RouteConfig matches requests by host and path prefix. Routes are checked
+// in order and the first match wins.
+type RouteConfig struct {
+	Name       string `json:"name"`
+	Host       string `json:"host"`
+	PathPrefix string `json:"path_prefix"`
+	// RequireClientCert rejects requests without a verified client certificate.
+	RequireClientCert bool `json:"require_client_cert"`
+	// Pool sends matching requests to a named pool instead of the default one.
+	Pool string `json:"pool"`
+	// GRPCService matches gRPC requests for a fully qualified service
+	// ("package.Service"), optionally narrowed to one GRPCMethod.
+	GRPCService string `json:"grpc_service"`
+	GRPCMethod  string `json:"grpc_method"`
+	// Streaming serves long-lived responses such as Server-Sent Events.
+	Streaming *StreamingConfig `json:"streaming,omitempty"`
+	// Concurrency caps requests in flight on the route; it needs a name.
+	Concurrency *ConcurrencyConfig `json:"concurrency,omitempty"`
+	// Access limits the clients allowed on the route.
+	Access *AccessConfig `json:"access,omitempty"`
+}
+
+// ConcurrencyConfig caps requests in flight and sheds the excess with 503.
+type ConcurrencyConfig struct {
+	// Limit caps requests in flight; with Adaptive it is the starting limit.
+	Limit int `json:"limit"`
+	// MaxQueue requests may wait for a slot; further ones are shed.
+	MaxQueue int `json:"max_queue"`
+	// MaxWaitMs sheds requests queued this long; defaults to 1000.
+	MaxWaitMs int `json:"max_wait_ms"`
+	// Adaptive adjusts the limit to latency: "aimd" or "gradient".
+	Adaptive string `json:"adaptive"`
+	// MinLimit and MaxLimit bound an adaptive limit; default 1 and 1000.
+	MinLimit int `json:"min_limit"`
+	MaxLimit int `json:"max_limit"`
+	// LatencyThresholdMs is the latency AIMD treats as overload.
+	LatencyThresholdMs int `json:"latency_threshold_ms"`
+}
+
+// StreamingConfig controls streamed responses on a route. The server's
+// fixed read and write timeouts do not apply; IdleTimeoutSeconds does.
+type StreamingConfig struct {
+	// FlushIntervalMs flushes buffered response data at this interval;
+	// 0 flushes after every write.
+	FlushIntervalMs int `json:"flush_interval_ms"`
+	// IdleTimeoutSeconds ends the response when the backend sends nothing
+	// for this long; defaults to 60.
+	IdleTimeoutSeconds int `json:"idle_timeout_seconds"`
+}
+
+// CertificateConfig is a PEM certificate chain and private key pair.
+type CertificateConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// UpstreamConfig controls how connections to backends are made.
+type UpstreamConfig struct {
+	// ProxyProtocol sends a PROXY protocol header ("v1" or "v2") on every
+	// upstream connection. Empty disables it.
+	ProxyProtocol string `json:"proxy_protocol"`
+	// TLS configures connections to https:// backends.
+	TLS *UpstreamTLSConfig `json:"tls,omitempty"`
+	// Protocol is "http1" (default), "http2" (negotiated over TLS, falling
+	// back to HTTP/1.1) or "h2c" (cleartext HTTP/2 with prior knowledge).
+	Protocol string `json:"protocol"`
+}
+
+// UpstreamTLSConfig configures TLS towards backends.
+type UpstreamTLSConfig struct {
+	// CAFile replaces the system roots for verifying backends.
+	CAFile string `json:"ca_file"`
+	// CertFile and KeyFile are presented as a client certificate.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// ServerName overrides the SNI and verified host name.
+	ServerName string `json:"server_name"`
+	// InsecureSkipVerify disables verification; only allowed in dev mode.
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+	// PinnedSPKI lists base64 SHA-256 hashes of acceptable backend public keys.
+	PinnedSPKI []string `json:"pinned_spki_sha256"`
+}
+
+// AllPools returns the named pools together with the default pool.
+func (c *Config) AllPools() map[string]PoolConfig {
+	pools := make(map[string]PoolConfig, len(c.Pools)+1)
+	for name, p := range c.Pools {
+		pools[name] = p
+	}
+	pools[DefaultPool] = PoolConfig{Backends: c.Backends, Upstream: c.Upstream, HealthCheck: c.HealthCheck, Concurrency: c.Concurrency}
+	return pools
+}
+
+// HTTPListeners returns the configured listeners, falling back to a single
+// listener on Port when none are configured. Listeners without their own
+// forwarding policy inherit the top-level one.
+func (c *Config) HTTPListeners() []ListenerConfig {
+	if len(c.Listeners) == 0 {
+		return []ListenerConfig{{Port: c.Port, Forwarding: &c.Forwarding, Access: c.Access}}
+	}
+
+	listeners := make([]ListenerConfig, len(c.Listeners))
+	for i, l := range c.Listeners {
+		if l.Forwarding == nil {
+			l.Forwarding = &c.Forwarding
+		}
+		if l.Access == nil {
+			l.Access = c.Access
+		}
+		listeners[i] = l
+	}
+	return listeners
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -32,15 +656,213 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("no backends configured")
 	}
 
-	for _, rawURL := range c.Backends {
-		u, err := url.Parse(rawURL)
-		if err != nil || u.Scheme == "" || u.Host == "" {
-			return fmt.Errorf("invalid backend URL %q", rawURL)
+	if _, ok := c.Pools[DefaultPool]; ok {
+		return fmt.Errorf("pool name %q is reserved for the top-level backends", DefaultPool)
+	}
+	for name, p := range c.AllPools() {
+		if len(p.Backends) == 0 {
+			return fmt.Errorf("pool %q: no backends configured", name)
+		}
+		for _, rawURL := range p.Backends {
+			u, err := url.Parse(rawURL)
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("invalid backend URL %q", rawURL)
+			}
+			if schemeKind(u.Scheme) != p.Kind() {
+				return fmt.Errorf("pool %q: cannot mix tcp://, udp:// and HTTP backends", name)
+			}
+			if p.Kind() != PoolHTTP && u.Port() == "" {
+				return fmt.Errorf("pool %q: %s backend %q needs a port", name, u.Scheme, rawURL)
+			}
+			if p.Upstream.Protocol == "h2c" && u.Scheme != "http" {
+				return fmt.Errorf("pool %q: h2c requires http:// backends, got %q", name, rawURL)
+			}
+		}
+		if err := p.Upstream.validate(); err != nil {
+			return fmt.Errorf("pool %q: %w", name, err)
+		}
+		if err := p.validateHealthCheck(); err != nil {
+			return fmt.Errorf("pool %q: %w", name, err)
+		}
+		if err := p.Concurrency.validate(); err != nil {
+			return fmt.Errorf("pool %q: %w", name, err)
 		}
 	}
 
-	if c.Port <= 0 || c.Port > 65535 {
-		return fmt.Errorf("invalid port %d: must be between 1 and 65535", c.Port)
+	if len(c.Listeners) == 0 {
+		if c.Port <= 0 || c.Port > 65535 {
+			return fmt.Errorf("invalid port %d: must be between 1 and 65535", c.Port)
+		}
+	}
+	if c.AllPools()[DefaultPool].Kind() != PoolHTTP {
+		return fmt.Errorf("top-level backends must be HTTP; put tcp:// and udp:// backends in a named pool")
+	}
+
+	ports := make(map[int]bool)
+	if len(c.Listeners) == 0 {
+		ports[c.Port] = true
+	}
+	for _, l := range c.Listeners {
+		if l.Port <= 0 || l.Port > 65535 {
+			return fmt.Errorf("invalid listener port %d: must be between 1 and 65535", l.Port)
+		}
+		if ports[l.Port] {
+			return fmt.Errorf("duplicate listener port %d", l.Port)
+		}
+		ports[l.Port] = true
+		if err := l.Access.validate(); err != nil {
+			return fmt.Errorf("listener %d: %w", l.Port, err)
+		}
+
+		for _, cidr := range l.ProxyProtocolTrusted {
+			if err := validateCIDR(cidr); err != nil {
+				return fmt.Errorf("invalid proxy_protocol_trusted on listener %d: %w", l.Port, err)
+			}
+		}
+		if l.ProxyProtocol && len(l.ProxyProtocolTrusted) == 0 && len(c.TrustedProxies) == 0 {
+			return fmt.Errorf("listener %d: proxy_protocol requires proxy_protocol_trusted or trusted_proxies", l.Port)
+		}
+		if l.TLS != nil {
+			if err := l.TLS.validate(); err != nil {
+				return fmt.Errorf("listener %d: %w", l.Port, err)
+			}
+		}
+		if l.H2C && l.TLS != nil {
+			return fmt.Errorf("listener %d: h2c is only for plain HTTP listeners", l.Port)
+		}
+		if l.HTTP3 && l.TLS == nil {
+			return fmt.Errorf("listener %d: http3 requires a TLS listener", l.Port)
+		}
+		if l.RedirectHTTPS {
+			if l.TLS != nil {
+				return fmt.Errorf("listener %d: redirect_https cannot be used on a TLS listener", l.Port)
+			}
+			if c.HTTPSPort() == 0 {
+				return fmt.Errorf("listener %d: redirect_https requires a TLS listener", l.Port)
+			}
+		}
+	}
+
+	for _, l := range c.TCPListeners {
+		if l.Port <= 0 || l.Port > 65535 {
+			return fmt.Errorf("invalid tcp listener port %d: must be between 1 and 65535", l.Port)
+		}
+		if ports[l.Port] {
+			return fmt.Errorf("duplicate listener port %d", l.Port)
+		}
+		ports[l.Port] = true
+		if err := l.Access.validate(); err != nil {
+			return fmt.Errorf("tcp listener %d: %w", l.Port, err)
+		}
+
+		if l.Pool != "" || len(l.SNIRoutes) == 0 {
+			if p, ok := c.Pools[l.Pool]; !ok || p.Kind() != PoolTCP {
+				return fmt.Errorf("tcp listener %d: pool %q must be a pool of tcp:// backends", l.Port, l.Pool)
+			}
+		}
+		for i, r := range l.SNIRoutes {
+			if err := validateSNIHost(r.Host); err != nil {
+				return fmt.Errorf("tcp listener %d: sni route %d: %w", l.Port, i, err)
+			}
+			if p, ok := c.Pools[r.Pool]; !ok || p.Kind() != PoolTCP {
+				return fmt.Errorf("tcp listener %d: sni route %d: pool %q must be a pool of tcp:// backends", l.Port, i, r.Pool)
+			}
+		}
+		if l.IdleTimeoutSeconds < 0 {
+			return fmt.Errorf("tcp listener %d: idle_timeout_seconds must be >= 0", l.Port)
+		}
+		for _, cidr := range l.ProxyProtocolTrusted {
+			if err := validateCIDR(cidr); err != nil {
+				return fmt.Errorf("invalid proxy_protocol_trusted on tcp listener %d: %w", l.Port, err)
+			}
+		}
+		if l.ProxyProtocol && len(l.ProxyProtocolTrusted) == 0 && len(c.TrustedProxies) == 0 {
+			return fmt.Errorf("tcp listener %d: proxy_protocol requires proxy_protocol_trusted or trusted_proxies", l.Port)
+		}
+	}
+
+	udpPorts := make(map[int]bool)
+	for _, l := range c.Listeners {
+		if l.HTTP3 {
+			udpPorts[l.Port] = true
+		}
+	}
+	for _, l := range c.UDPListeners {
+		if l.Port <= 0 || l.Port > 65535 {
+			return fmt.Errorf("invalid udp listener port %d: must be between 1 and 65535", l.Port)
+		}
+		if udpPorts[l.Port] {
+			return fmt.Errorf("duplicate udp listener port %d (HTTP/3 listeners use UDP too)", l.Port)
+		}
+		udpPorts[l.Port] = true
+
+		if p, ok := c.Pools[l.Pool]; !ok || p.Kind() != PoolUDP {
+			return fmt.Errorf("udp listener %d: pool %q must be a pool of udp:// backends", l.Port, l.Pool)
+		}
+		if l.SessionTimeoutSeconds < 0 || l.MaxSessions < 0 {
+			return fmt.Errorf("udp listener %d: session_timeout_seconds and max_sessions must be >= 0", l.Port)
+		}
+	}
+
+	limitedRoutes := make(map[string]bool)
+	for i, r := range c.Routes {
+		if r.Concurrency != nil {
+			if r.Name == "" {
+				return fmt.Errorf("route %d: concurrency needs a route name", i)
+			}
+			if limitedRoutes[r.Name] {
+				return fmt.Errorf("route %d: another route named %q has a concurrency limit", i, r.Name)
+			}
+			limitedRoutes[r.Name] = true
+			if err := r.Concurrency.validate(); err != nil {
+				return fmt.Errorf("route %d: %w", i, err)
+			}
+		}
+		if err := r.Access.validate(); err != nil {
+			return fmt.Errorf("route %d: %w", i, err)
+		}
+		if r.PathPrefix != "" && r.PathPrefix[0] != '/' {
+			return fmt.Errorf("route %d: path_prefix must start with /", i)
+		}
+		if r.RequireClientCert && !c.hasClientAuth() {
+			return fmt.Errorf("route %d: require_client_cert needs a TLS listener with client_auth", i)
+		}
+		if r.GRPCService != "" && r.PathPrefix != "" {
+			return fmt.Errorf("route %d: grpc_service and path_prefix are mutually exclusive", i)
+		}
+		if r.GRPCMethod != "" && r.GRPCService == "" {
+			return fmt.Errorf("route %d: grpc_method requires grpc_service", i)
+		}
+		if strings.Contains(r.GRPCService, "/") || strings.Contains(r.GRPCMethod, "/") {
+			return fmt.Errorf("route %d: grpc_service and grpc_method must not contain /", i)
+		}
+		if r.Streaming != nil && (r.Streaming.FlushIntervalMs < 0 || r.Streaming.IdleTimeoutSeconds < 0) {
+			return fmt.Errorf("route %d: streaming intervals must be >= 0", i)
+		}
+		if p, ok := c.AllPools()[r.Pool]; r.Pool != "" && !ok {
+			return fmt.Errorf("route %d: unknown pool %q", i, r.Pool)
+		} else if p.Kind() != PoolHTTP {
+			return fmt.Errorf("route %d: pool %q is not an HTTP pool", i, r.Pool)
+		}
+	}
+
+	for _, cidr := range c.TrustedProxies {
+		if err := validateCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid trusted proxy: %w", err)
+		}
+	}
+	switch c.ClientIPHeader {
+	case "", "x-forwarded-for", "forwarded", "x-real-ip":
+	default:
+		return fmt.Errorf("unknown client_ip_header %q, expected x-forwarded-for, forwarded or x-real-ip", c.ClientIPHeader)
+	}
+
+	if c.WebSocket.IdleTimeoutSeconds < 0 || c.WebSocket.MaxLifetimeSeconds < 0 || c.WebSocket.MaxPerClient < 0 {
+		return fmt.Errorf("websocket limits must be >= 0")
+	}
+
+	if c.CertExpiryWarningDays < 0 {
+		return fmt.Errorf("cert_expiry_warning_days must be >= 0")
 	}
 
 	if c.RateLimit < 0 {
@@ -49,6 +871,255 @@ func (c *Config) Validate() error {
 	if c.Burst < 0 {
 		return fmt.Errorf("burst must be >= 0")
 	}
+	if c.RateLimitMaxKeys < 0 || c.RateLimitIdleTTLSeconds < 0 {
+		return fmt.Errorf("rate_limit_max_keys and rate_limit_idle_ttl_seconds must be >= 0")
+	}
+	if err := validateAlgorithm(c.RateLimitAlgorithm); err != nil {
+		return fmt.Errorf("rate_limit_algorithm: %w", err)
+	}
+	if body := c.RateLimitResponse.ErrorBody; len(body) > 0 && !json.Valid(body) {
+		return fmt.Errorf("rate_limit_response: error_body must be valid JSON")
+	}
+	if s := c.RateLimitStore; s != nil {
+		if _, _, err := net.SplitHostPort(s.Address); err != nil {
+			return fmt.Errorf("rate_limit_store: invalid address %q", s.Address)
+		}
+		if s.DB < 0 || s.TimeoutMs < 0 || s.LeaseSize < 0 {
+			return fmt.Errorf("rate_limit_store: db, timeout_ms and lease_size must be >= 0")
+		}
+	}
+	if err := c.Access.validate(); err != nil {
+		return err
+	}
+	if q := c.Quotas; q != nil {
+		if err := q.validate(); err != nil {
+			return fmt.Errorf("quotas: %w", err)
+		}
+	}
+	if b := c.Bans; b != nil {
+		if err := b.validate(); err != nil {
+			return fmt.Errorf("bans: %w", err)
+		}
+	}
+	if a := c.Admin; a != nil {
+		if err := a.validate(); err != nil {
+			return fmt.Errorf("admin: %w", err)
+		}
+		port := a.Port
+		if port == 0 {
+			port = 9901
+		}
+		if ports[port] {
+			return fmt.Errorf("admin: port %d is used by another listener", port)
+		}
+	}
+	if ls := c.LoadShedding; ls != nil {
+		if err := ls.validate(); err != nil {
+			return fmt.Errorf("load_shedding: %w", err)
+		}
+	}
+	ruleNames := make(map[string]bool)
+	for _, rl := range c.RateLimits {
+		if rl.Name == "" {
+			return fmt.Errorf("rate limit rule requires a name")
+		}
+		if ruleNames[rl.Name] {
+			return fmt.Errorf("duplicate rate limit rule %q", rl.Name)
+		}
+		ruleNames[rl.Name] = true
+		if rl.Key == "" {
+			return fmt.Errorf("rate limit rule %q: key is required", rl.Name)
+		}
+		if err := validateAlgorithm(rl.Algorithm); err != nil {
+			return fmt.Errorf("rate limit rule %q: %w", rl.Name, err)
+		}
+		if err := (LimitConfig{rl.Rate, rl.Burst}).validate(); err != nil {
+			return fmt.Errorf("rate limit rule %q: %w", rl.Name, err)
+		}
+		for key, o := range rl.Overrides {
+			if err := o.validate(); err != nil {
+				return fmt.Errorf("rate limit rule %q: override %q: %w", rl.Name, key, err)
+			}
+		}
+	}
 
 	return nil
 }
+
+func (l LimitConfig) validate() error {
+	if l.Rate <= 0 {
+		return fmt.Errorf("rate must be > 0")
+	}
+	if l.Burst < 1 {
+		return fmt.Errorf("burst must be >= 1")
+	}
+	return nil
+}
+
+// HTTPSPort returns the port of the first TLS listener, or 0 if there is none.
+func (c *Config) HTTPSPort() int {
+	for _, l := range c.Listeners {
+		if l.TLS != nil {
+			return l.Port
+		}
+	}
+	return 0
+}
+
+func (t *TLSConfig) validate() error {
+	if len(t.Certificates) == 0 {
+		return fmt.Errorf("tls requires at least one certificate")
+	}
+	for _, cert := range t.Certificates {
+		if cert.CertFile == "" || cert.KeyFile == "" {
+			return fmt.Errorf("tls certificate requires cert_file and key_file")
+		}
+	}
+	switch t.MinVersion {
+	case "", "1.0", "1.1", "1.2", "1.3":
+	default:
+		return fmt.Errorf("invalid tls min_version %q", t.MinVersion)
+	}
+	for _, name := range t.CipherSuites {
+		// tls.CipherSuites leaves out the insecure suites.
+		i := slices.IndexFunc(tls.CipherSuites(), func(s *tls.CipherSuite) bool { return s.Name == name })
+		if i < 0 {
+			return fmt.Errorf("unknown or insecure tls cipher suite %q", name)
+		}
+		// Go always enables the TLS 1.3 suites and ignores them here.
+		if !slices.ContainsFunc(tls.CipherSuites()[i].SupportedVersions, func(v uint16) bool { return v < tls.VersionTLS13 }) {
+			return fmt.Errorf("tls cipher suite %q is TLS 1.3 only and cannot be configured", name)
+		}
+	}
+	if t.ClientAuth != nil && t.ClientAuth.CAFile == "" {
+		return fmt.Errorf("tls client_auth requires ca_file")
+	}
+	return nil
+}
+
+func (c *ConcurrencyConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Limit < 1 {
+		return fmt.Errorf("concurrency limit must be >= 1")
+	}
+	if c.MaxQueue < 0 || c.MaxWaitMs < 0 || c.MinLimit < 0 || c.MaxLimit < 0 || c.LatencyThresholdMs < 0 {
+		return fmt.Errorf("concurrency settings must be >= 0")
+	}
+	switch c.Adaptive {
+	case "":
+	case "aimd":
+		if c.LatencyThresholdMs == 0 {
+			return fmt.Errorf("adaptive concurrency aimd requires latency_threshold_ms")
+		}
+	case "gradient":
+	default:
+		return fmt.Errorf("unknown adaptive concurrency %q, expected aimd or gradient", c.Adaptive)
+	}
+	if c.MaxLimit != 0 && c.MinLimit > c.MaxLimit {
+		return fmt.Errorf("concurrency min_limit must not exceed max_limit")
+	}
+	return nil
+}
+
+func (u *UpstreamConfig) validate() error {
+	switch u.ProxyProtocol {
+	case "", "v1", "v2":
+	default:
+		return fmt.Errorf("invalid upstream proxy_protocol %q: must be v1 or v2", u.ProxyProtocol)
+	}
+	switch u.Protocol {
+	case "", "http1", "http2", "h2c":
+	default:
+		return fmt.Errorf("invalid upstream protocol %q: must be http1, http2 or h2c", u.Protocol)
+	}
+	if u.TLS != nil && (u.TLS.CertFile == "") != (u.TLS.KeyFile == "") {
+		return fmt.Errorf("upstream tls requires both cert_file and key_file")
+	}
+	return nil
+}
+
+// Pool kinds, decided by the scheme of the backends.
+const (
+	PoolHTTP = "http"
+	PoolTCP  = "tcp"
+	PoolUDP  = "udp"
+)
+
+// Kind tells whether the pool serves HTTP routes, TCP listeners (tcp://
+// backends) or UDP listeners (udp:// backends), judged by its first backend.
+func (p PoolConfig) Kind() string {
+	if len(p.Backends) == 0 {
+		return PoolHTTP
+	}
+	u, err := url.Parse(p.Backends[0])
+	if err != nil {
+		return PoolHTTP
+	}
+	return schemeKind(u.Scheme)
+}
+
+func schemeKind(scheme string) string {
+	switch scheme {
+	case "tcp":
+		return PoolTCP
+	case "udp":
+		return PoolUDP
+	default:
+		return PoolHTTP
+	}
+}
+
+func (p *PoolConfig) validateHealthCheck() error {
+	if p.HealthCheck == nil {
+		return nil
+	}
+	switch p.HealthCheck.Type {
+	case "", "tcp":
+	case "udp":
+		if p.Kind() != PoolUDP {
+			return fmt.Errorf("udp health checks are only available for udp:// backends")
+		}
+	case "grpc":
+		if p.Kind() != PoolHTTP {
+			return fmt.Errorf("grpc health checks are only available for HTTP backends")
+		}
+		if p.Upstream.Protocol != "http2" && p.Upstream.Protocol != "h2c" {
+			return fmt.Errorf("grpc health checks need upstream protocol http2 or h2c")
+		}
+	default:
+		return fmt.Errorf("invalid health_check type %q: must be tcp, udp or grpc", p.HealthCheck.Type)
+	}
+	return nil
+}
+
+func (c *Config) hasClientAuth() bool {
+	for _, l := range c.Listeners {
+		if l.TLS != nil && l.TLS.ClientAuth != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSNIHost checks an SNI route host: a server name, optionally
+// with a leading "*." wildcard label.
+func validateSNIHost(host string) error {
+	name := strings.TrimPrefix(host, "*.")
+	if name == "" || strings.ContainsAny(name, "*/: ") {
+		return fmt.Errorf("invalid host %q: must be a server name or *.domain", host)
+	}
+	return nil
+}
+
+// validateCIDR accepts a CIDR prefix or a single IP address.
+func validateCIDR(s string) error {
+	if _, err := netip.ParsePrefix(s); err == nil {
+		return nil
+	}
+	if _, err := netip.ParseAddr(s); err == nil {
+		return nil
+	}
+	return fmt.Errorf("%q is not a CIDR or IP address", s)
+}
@@ -1,6 +1,9 @@
 package config
 
-import "testing"
+import (
+	"encoding/json"
+	"testing"
+)
 
 func TestConfigValidateSuccess(t *testing.T) {
 	cfg := &Config{
@@ -53,3 +56,656 @@ func TestConfigValidateInvalidBackendURL(t *testing.T) {
 		t.Fatalf("expected error for invalid backend URL")
 	}
 }
+
+func TestConfigValidateDuplicateListenerPort(t *testing.T) {
+	cfg := &Config{
+		Backends:  []string{"http://localhost:8081"},
+		Listeners: []ListenerConfig{{Port: 8080}, {Port: 8080}},
+	}
+
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for duplicate listener port")
+	}
+}
+
+func TestConfigHTTPListenersInheritForwarding(t *testing.T) {
+	cfg := &Config{
+		Forwarding: ForwardingConfig{Forwarded: true},
+		Listeners: []ListenerConfig{
+			{Port: 8080},
+			{Port: 8081, Forwarding: &ForwardingConfig{TrustIncoming: true}},
+		},
+	}
+
+	listeners := cfg.HTTPListeners()
+	if !listeners[0].Forwarding.Forwarded {
+		t.Fatalf("expected listener without policy to inherit top-level forwarding")
+	}
+	if !listeners[1].Forwarding.TrustIncoming || listeners[1].Forwarding.Forwarded {
+		t.Fatalf("expected listener policy to override top-level forwarding")
+	}
+}
+
+func TestConfigValidateInvalidTrustedProxy(t *testing.T) {
+	cfg := &Config{
+		Backends:       []string{"http://localhost:8081"},
+		Port:           8080,
+		TrustedProxies: []string{"10.0.0.0/8", "not-a-cidr"},
+	}
+
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for invalid trusted proxy CIDR")
+	}
+}
+
+func TestConfigValidateClientIPHeader(t *testing.T) {
+	cfg := &Config{
+		Backends:       []string{"http://localhost:8081"},
+		Port:           8080,
+		ClientIPHeader: "forwarded",
+	}
+
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected forwarded to be accepted, got error: %v", err)
+	}
+
+	cfg.ClientIPHeader = "x-client-ip"
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for unknown client_ip_header")
+	}
+}
+
+func TestConfigValidateProxyProtocolRequiresTrustedSources(t *testing.T) {
+	cfg := &Config{
+		Backends:  []string{"http://localhost:8081"},
+		Listeners: []ListenerConfig{{Port: 8080, ProxyProtocol: true}},
+	}
+
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for proxy_protocol without trusted sources")
+	}
+
+	cfg.TrustedProxies = []string{"10.0.0.0/8"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected trusted_proxies to satisfy proxy_protocol, got error: %v", err)
+	}
+}
+
+func TestConfigValidateRedirectHTTPSRequiresTLSListener(t *testing.T) {
+	cfg := &Config{
+		Backends:  []string{"http://localhost:8081"},
+		Listeners: []ListenerConfig{{Port: 80, RedirectHTTPS: true}},
+	}
+
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for redirect_https without a TLS listener")
+	}
+
+	cfg.Listeners = append(cfg.Listeners, ListenerConfig{
+		Port: 443,
+		TLS: &TLSConfig{
+			Certificates: []CertificateConfig{{CertFile: "server.crt", KeyFile: "server.key"}},
+		},
+	})
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected redirect to TLS listener to be valid, got error: %v", err)
+	}
+}
+
+func TestConfigValidateCipherSuites(t *testing.T) {
+	cfg := &Config{
+		Backends: []string{"http://localhost:8081"},
+		Listeners: []ListenerConfig{{
+			Port: 443,
+			TLS: &TLSConfig{
+				Certificates: []CertificateConfig{{CertFile: "server.crt", KeyFile: "server.key"}},
+				CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+			},
+		}},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected a known cipher suite to be valid, got error: %v", err)
+	}
+
+	for _, name := range []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM", "TLS_RSA_WITH_RC4_128_SHA", "TLS_AES_128_GCM_SHA256"} {
+		cfg.Listeners[0].TLS.CipherSuites = []string{name}
+		if err := cfg.Validate(); err == nil {
+			t.Fatalf("expected error for cipher suite %q", name)
+		}
+	}
+}
+
+func TestConfigValidateHTTP3(t *testing.T) {
+	cfg := &Config{
+		Backends:  []string{"http://localhost:8081"},
+		Listeners: []ListenerConfig{{Port: 443, HTTP3: true}},
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for http3 on a plain listener")
+	}
+
+	cfg.Listeners[0].TLS = &TLSConfig{
+		Certificates: []CertificateConfig{{CertFile: "server.crt", KeyFile: "server.key"}},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected http3 on a TLS listener to be valid, got error: %v", err)
+	}
+
+	cfg.Pools = map[string]PoolConfig{"dns": {Backends: []string{"udp://10.0.0.53:53"}}}
+	cfg.UDPListeners = []UDPListenerConfig{{Port: 443, Pool: "dns"}}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for udp listener on the HTTP/3 port")
+	}
+}
+
+func TestConfigValidateRouteClientCertRequiresClientAuth(t *testing.T) {
+	cfg := &Config{
+		Backends: []string{"http://localhost:8081"},
+		Port:     8080,
+		Routes:   []RouteConfig{{PathPrefix: "/internal", RequireClientCert: true}},
+	}
+
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for require_client_cert without client_auth")
+	}
+}
+
+func TestConfigValidatePools(t *testing.T) {
+	cfg := &Config{
+		Backends: []string{"http://localhost:8081"},
+		Port:     8080,
+		Pools: map[string]PoolConfig{
+			"internal": {Backends: []string{"https://10.0.0.5:8443"}},
+		},
+		Routes: []RouteConfig{{PathPrefix: "/internal", Pool: "internal"}},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected pools to be valid, got error: %v", err)
+	}
+
+	cfg.Routes[0].Pool = "missing"
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for route with unknown pool")
+	}
+
+	cfg.Routes = nil
+	cfg.Pools["internal"] = PoolConfig{
+		Backends: []string{"https://10.0.0.5:8443"},
+		Upstream: UpstreamConfig{TLS: &UpstreamTLSConfig{CertFile: "client.crt"}},
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for upstream cert_file without key_file")
+	}
+}
+
+func TestConfigValidateUpstreamProtocol(t *testing.T) {
+	cfg := &Config{
+		Backends: []string{"http://localhost:8081"},
+		Port:     8080,
+		Upstream: UpstreamConfig{Protocol: "h2c"},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected h2c to http backend to be valid, got error: %v", err)
+	}
+
+	cfg.Backends = []string{"https://localhost:8443"}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for h2c to https backend")
+	}
+
+	cfg.Upstream.Protocol = "spdy"
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for unknown upstream protocol")
+	}
+}
+
+func TestConfigValidateGRPC(t *testing.T) {
+	cfg := &Config{
+		Backends:    []string{"http://localhost:9090"},
+		Port:        8080,
+		Upstream:    UpstreamConfig{Protocol: "h2c"},
+		HealthCheck: &HealthCheckConfig{Type: "grpc"},
+		Routes:      []RouteConfig{{GRPCService: "helloworld.Greeter", GRPCMethod: "SayHello"}},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected gRPC config to be valid, got error: %v", err)
+	}
+
+	cfg.Routes[0].PathPrefix = "/helloworld.Greeter/"
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for grpc_service combined with path_prefix")
+	}
+	cfg.Routes[0] = RouteConfig{GRPCMethod: "SayHello"}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for grpc_method without grpc_service")
+	}
+	cfg.Routes = nil
+
+	cfg.Upstream.Protocol = ""
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for grpc health check over HTTP/1.1")
+	}
+}
+
+func TestConfigValidateWebSocketLimits(t *testing.T) {
+	cfg := &Config{
+		Backends:  []string{"http://localhost:8081"},
+		Port:      8080,
+		WebSocket: WebSocketConfig{IdleTimeoutSeconds: 60, MaxPerClient: 10},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected websocket limits to be valid, got error: %v", err)
+	}
+
+	cfg.WebSocket.MaxLifetimeSeconds = -1
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for negative max_lifetime_seconds")
+	}
+}
+
+func TestConfigValidateRouteStreaming(t *testing.T) {
+	cfg := &Config{
+		Backends: []string{"http://localhost:8081"},
+		Port:     8080,
+		Routes:   []RouteConfig{{PathPrefix: "/events", Streaming: &StreamingConfig{IdleTimeoutSeconds: 120}}},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected streaming route to be valid, got error: %v", err)
+	}
+
+	cfg.Routes[0].Streaming.FlushIntervalMs = -1
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for negative flush_interval_ms")
+	}
+}
+
+func TestConfigValidateTCPListeners(t *testing.T) {
+	cfg := &Config{
+		Backends:     []string{"http://localhost:8081"},
+		Port:         8080,
+		Pools:        map[string]PoolConfig{"postgres": {Backends: []string{"tcp://10.0.0.5:5432"}}},
+		TCPListeners: []TCPListenerConfig{{Port: 5432, Pool: "postgres"}},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected tcp listener to be valid, got error: %v", err)
+	}
+
+	cfg.TCPListeners[0].Port = 8080
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for tcp listener on the HTTP port")
+	}
+	cfg.TCPListeners[0].Port = 5432
+
+	cfg.Routes = []RouteConfig{{PathPrefix: "/db", Pool: "postgres"}}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for HTTP route to a tcp pool")
+	}
+	cfg.Routes = nil
+
+	cfg.Pools["postgres"] = PoolConfig{Backends: []string{"tcp://10.0.0.5"}}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for tcp backend without port")
+	}
+}
+
+func TestConfigValidateSNIRoutes(t *testing.T) {
+	cfg := &Config{
+		Backends: []string{"http://localhost:8081"},
+		Port:     8080,
+		Pools: map[string]PoolConfig{
+			"app": {Backends: []string{"tcp://10.0.0.5:443"}},
+			"web": {Backends: []string{"http://10.0.0.6:80"}},
+		},
+		TCPListeners: []TCPListenerConfig{{
+			Port:      443,
+			SNIRoutes: []SNIRouteConfig{{Host: "*.example.com", Pool: "app"}},
+		}},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected sni routes without a default pool to be valid, got error: %v", err)
+	}
+
+	cfg.TCPListeners[0].SNIRoutes[0].Host = "a.*.example.com"
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for wildcard in the middle of a host")
+	}
+	cfg.TCPListeners[0].SNIRoutes[0].Host = "app.example.com"
+
+	cfg.TCPListeners[0].SNIRoutes[0].Pool = "web"
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for sni route to an HTTP pool")
+	}
+}
+
+func TestConfigValidateUDPListeners(t *testing.T) {
+	cfg := &Config{
+		Backends:     []string{"http://localhost:8081"},
+		Port:         8080,
+		Pools:        map[string]PoolConfig{"dns": {Backends: []string{"udp://10.0.0.53:53"}}},
+		UDPListeners: []UDPListenerConfig{{Port: 53, Pool: "dns"}},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected udp listener to be valid, got error: %v", err)
+	}
+
+	cfg.Pools["dns"] = PoolConfig{Backends: []string{"udp://10.0.0.53:53", "tcp://10.0.0.53:53"}}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for mixed udp and tcp backends")
+	}
+
+	cfg.Pools["dns"] = PoolConfig{Backends: []string{"tcp://10.0.0.53:53"}}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for udp listener on a tcp pool")
+	}
+}
+
+func TestConfigValidateRateLimitResponse(t *testing.T) {
+	cfg := &Config{
+		Backends:          []string{"http://localhost:8081"},
+		Port:              8080,
+		RateLimitResponse: RateLimitResponseConfig{ErrorBody: json.RawMessage(`{"error":"slow down"}`)},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected JSON error body to be valid, got error: %v", err)
+	}
+
+	cfg.RateLimitResponse.ErrorBody = json.RawMessage(`slow down`)
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for non-JSON error body")
+	}
+}
+
+func TestConfigValidateRateLimits(t *testing.T) {
+	cfg := &Config{
+		Backends: []string{"http://localhost:8081"},
+		Port:     8080,
+		RateLimits: []RateLimitConfig{{
+			Name:      "api-key",
+			Key:       "{header:X-API-Key}",
+			Rate:      10,
+			Burst:     20,
+			Overrides: map[string]LimitConfig{"premium": {Rate: 100, Burst: 200}},
+		}},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected rate limit rule to be valid, got error: %v", err)
+	}
+
+	cfg.RateLimits[0].Overrides["premium"] = LimitConfig{Rate: 100}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for override without burst")
+	}
+	delete(cfg.RateLimits[0].Overrides, "premium")
+
+	cfg.RateLimits = append(cfg.RateLimits, RateLimitConfig{Name: "api-key", Key: "{ip}", Rate: 1, Burst: 1})
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for duplicate rule name")
+	}
+
+	cfg.RateLimits[1] = RateLimitConfig{Name: "user", Rate: 1, Burst: 1}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for rule without key")
+	}
+}
+
+func TestConfigValidateRateLimitAlgorithm(t *testing.T) {
+	cfg := &Config{
+		Backends:           []string{"http://localhost:8081"},
+		Port:               8080,
+		RateLimitAlgorithm: "gcra",
+		RateLimits:         []RateLimitConfig{{Name: "api-key", Key: "{header:X-API-Key}", Rate: 1, Burst: 1, Algorithm: "sliding_window_log"}},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected algorithms to be valid, got error: %v", err)
+	}
+
+	cfg.RateLimits[0].Algorithm = "leaky_bucket"
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for unknown rule algorithm")
+	}
+
+	cfg.RateLimits = nil
+	cfg.RateLimitAlgorithm = "fixed_window"
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for unknown rate_limit_algorithm")
+	}
+}
+
+func TestConfigValidateRateLimitStore(t *testing.T) {
+	cfg := &Config{
+		Backends:       []string{"http://localhost:8081"},
+		Port:           8080,
+		RateLimitStore: &RateLimitStoreConfig{Address: "redis:6379", LeaseSize: 5},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected rate limit store to be valid, got error: %v", err)
+	}
+
+	cfg.RateLimitStore.Address = "redis"
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for store address without port")
+	}
+
+	cfg.RateLimitStore = &RateLimitStoreConfig{Address: "redis:6379", TimeoutMs: -1}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for negative timeout")
+	}
+}
+
+func TestConfigValidateConcurrency(t *testing.T) {
+	cfg := &Config{
+		Backends:    []string{"http://localhost:8081"},
+		Port:        8080,
+		Concurrency: &ConcurrencyConfig{Limit: 100, MaxQueue: 50, Adaptive: "gradient", MinLimit: 10, MaxLimit: 500},
+		Pools: map[string]PoolConfig{
+			"slow": {Backends: []string{"http://localhost:8082"}, Concurrency: &ConcurrencyConfig{Limit: 10, Adaptive: "aimd", LatencyThresholdMs: 200}},
+		},
+		Routes: []RouteConfig{{Name: "api", PathPrefix: "/api", Concurrency: &ConcurrencyConfig{Limit: 20}}},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected concurrency limits to be valid, got error: %v", err)
+	}
+
+	cfg.Routes = append(cfg.Routes, RouteConfig{Name: "api", PathPrefix: "/v2", Concurrency: &ConcurrencyConfig{Limit: 5}})
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for two limited routes with the same name")
+	}
+	cfg.Routes[1].Name = ""
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for limited route without a name")
+	}
+	cfg.Routes = cfg.Routes[:1]
+
+	cfg.Pools["slow"].Concurrency.LatencyThresholdMs = 0
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for aimd without latency threshold")
+	}
+	cfg.Pools["slow"].Concurrency.LatencyThresholdMs = 200
+
+	cfg.Concurrency.MinLimit = 1000
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for min_limit above max_limit")
+	}
+
+	cfg.Concurrency = &ConcurrencyConfig{Limit: 0}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for zero limit")
+	}
+
+	cfg.Concurrency = &ConcurrencyConfig{Limit: 1, Adaptive: "vegas"}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for unknown adaptive mode")
+	}
+}
+
+func TestConfigValidateLoadShedding(t *testing.T) {
+	cfg := &Config{
+		Backends: []string{"http://localhost:8081"},
+		Port:     8080,
+		LoadShedding: &LoadSheddingConfig{
+			DefaultPriority: "normal",
+			MaxCPUPercent:   85,
+			Priorities: []PriorityConfig{
+				{Priority: "critical", ClientCIDRs: []string{"10.0.0.0/8"}},
+				{Priority: "low", Key: "{header:X-Plan}", Values: []string{"free"}},
+			},
+		},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected load shedding to be valid, got error: %v", err)
+	}
+
+	cfg.LoadShedding.Priorities[1].Priority = "urgent"
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for unknown priority")
+	}
+	cfg.LoadShedding.Priorities[1] = PriorityConfig{Priority: "low", Values: []string{"free"}}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for values without key")
+	}
+	cfg.LoadShedding.Priorities[1] = PriorityConfig{Priority: "low"}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for rule without conditions")
+	}
+	cfg.LoadShedding.Priorities = cfg.LoadShedding.Priorities[:1]
+
+	cfg.LoadShedding.MaxCPUPercent = 150
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for max_cpu_percent above 100")
+	}
+}
+
+func TestConfigValidateQuotas(t *testing.T) {
+	cfg := &Config{
+		Backends: []string{"http://localhost:8081"},
+		Port:     8080,
+		Quotas: &QuotaConfig{
+			Consumer:    "{header:X-API-Key}",
+			Plans:       map[string]QuotaPlanConfig{"free": {Daily: 1000}, "pro": {Monthly: 1000000}},
+			Consumers:   map[string]string{"key-1": "pro"},
+			DefaultPlan: "free",
+			Timezone:    "America/New_York",
+		},
+		Admin: &AdminConfig{Token: "0123456789abcdef"},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected quotas to be valid, got error: %v", err)
+	}
+
+	cfg.Quotas.Consumers["key-2"] = "enterprise"
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for consumer on an unknown plan")
+	}
+	delete(cfg.Quotas.Consumers, "key-2")
+
+	cfg.Quotas.Timezone = "Mars/Olympus_Mons"
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for unknown timezone")
+	}
+	cfg.Quotas.Timezone = ""
+
+	cfg.Quotas.Consumer = ""
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for quotas without consumer")
+	}
+	cfg.Quotas.Consumer = "{header:X-API-Key}"
+
+	cfg.Admin.Token = "short"
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for short admin token")
+	}
+}
+
+func TestConfigValidateAdmin(t *testing.T) {
+	cfg := &Config{
+		Backends: []string{"http://localhost:8081"},
+		Port:     8080,
+		Admin:    &AdminConfig{Token: "0123456789abcdef", Address: "::1", Access: &AccessConfig{Allow: []string{"10.0.0.0/8"}}},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected admin config to be valid, got error: %v", err)
+	}
+
+	cfg.Admin.Port = 8080
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for admin port shared with a listener")
+	}
+	cfg.Admin.Port = 0
+
+	cfg.Admin.Address = "localhost"
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for admin address that is not an IP")
+	}
+	cfg.Admin.Address = ""
+
+	cfg.Admin.Access.Allow = []string{"10.0.0.0/33"}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for invalid admin access list")
+	}
+}
+
+func TestConfigValidateAccess(t *testing.T) {
+	cfg := &Config{
+		Backends: []string{"http://localhost:8081"},
+		Port:     8080,
+		Access:   &AccessConfig{Deny: []string{"203.0.113.0/24", "2001:db8::1"}, DenyFiles: []string{"/etc/edgecore/blocklist.txt"}},
+		Routes:   []RouteConfig{{PathPrefix: "/internal", Access: &AccessConfig{Allow: []string{"10.0.0.0/8"}}}},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected access lists to be valid, got error: %v", err)
+	}
+	if l := cfg.HTTPListeners()[0]; l.Access != cfg.Access {
+		t.Fatalf("expected the top-level access list on the default listener")
+	}
+
+	cfg.Routes[0].Access.Allow = append(cfg.Routes[0].Access.Allow, "10.0.0.0/33")
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for invalid route CIDR")
+	}
+	cfg.Routes[0].Access.Allow = nil
+
+	cfg.Access.DenyFiles = []string{""}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for empty file name")
+	}
+}
+
+func TestConfigValidateBans(t *testing.T) {
+	cfg := &Config{
+		Backends: []string{"http://localhost:8081"},
+		Port:     8080,
+		Bans: &BanConfig{
+			Rules: []BanRuleConfig{
+				{Name: "rate_limited", Statuses: []int{429}, Threshold: 50, WindowSeconds: 60},
+				{Name: "auth", Statuses: []int{401, 403}, Threshold: 10, WindowSeconds: 300},
+			},
+			Exempt: []string{"10.0.0.0/8"},
+		},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected bans to be valid, got error: %v", err)
+	}
+
+	cfg.Bans.Rules[1].Name = "rate_limited"
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for duplicate rule name")
+	}
+	cfg.Bans.Rules[1].Name = "auth"
+
+	cfg.Bans.Rules[1].Statuses = []int{4010}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for invalid status")
+	}
+	cfg.Bans.Rules[1].Statuses = []int{401}
+
+	cfg.Bans.Rules[0].Threshold = 0
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for zero threshold")
+	}
+	cfg.Bans.Rules[0].Threshold = 50
+
+	cfg.Bans.IPv6PrefixBits = 129
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for ipv6_prefix_bits over 128")
+	}
+}
@@ -3,6 +3,7 @@ package devtools
 import (
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 )
 
@@ -26,3 +27,34 @@ func StartAllBackends() {
 		go StartBackend(port)
 	}
 }
+
+// ListenUDPEcho starts a UDP server on addr that sends every datagram back
+// to its sender. Closing the returned connection stops it.
+func ListenUDPEcho(addr string) (net.PacketConn, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], from)
+		}
+	}()
+	return conn, nil
+}
+
+// StartAllUDPEchoServers starts UDP echo servers on :9081, :9082 and :9083
+func StartAllUDPEchoServers() {
+	for _, port := range []string{"9081", "9082", "9083"} {
+		if _, err := ListenUDPEcho(":" + port); err != nil {
+			log.Printf("UDP echo :%s failed: %v", port, err)
+			continue
+		}
+		log.Printf("🟢 Dev UDP echo started on :%s\n", port)
+	}
+}
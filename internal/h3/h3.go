@@ -0,0 +1,138 @@
+// Package h3 serves HTTP/3 over QUIC next to an HTTPS listener, sharing its
+// certificates and handler.
+package h3
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/sargisis/edgecore/internal/proxy"
+)
+
+// Server is an HTTP/3 server on one UDP socket.
+type Server struct {
+	srv *http3.Server
+
+	mu    sync.Mutex
+	conns map[*conn]struct{}
+}
+
+// conn is an open QUIC connection and its number of running requests.
+type conn struct {
+	qc     *quic.Conn
+	active atomic.Int64
+}
+
+type connKey struct{}
+
+// New returns a server answering with handler. tlsConf is the HTTPS
+// listener's configuration; ALPN is switched to h3 per connection, so
+// certificates reloaded through GetConfigForClient apply to both.
+func New(tlsConf *tls.Config, handler http.Handler, idleTimeout time.Duration) *Server {
+	s := &Server{conns: make(map[*conn]struct{})}
+	s.srv = &http3.Server{
+		Handler:   s.trackRequests(handler),
+		TLSConfig: tlsConf,
+		// 0-RTT requests can be replayed by an attacker; a proxy cannot
+		// tell which backends are safe for that, so it stays off.
+		QUICConfig:  &quic.Config{MaxIdleTimeout: idleTimeout},
+		IdleTimeout: idleTimeout,
+		ConnContext: s.trackConn,
+	}
+	return s
+}
+
+// Serve answers HTTP/3 requests arriving on conn until Shutdown is called.
+// It returns http.ErrServerClosed after Shutdown.
+func (s *Server) Serve(conn net.PacketConn) error {
+	return s.srv.Serve(conn)
+}
+
+// Shutdown sends GOAWAY to every connection and waits for their requests
+// to finish; connections still open when ctx expires are closed. Like
+// net/http, it closes connections without running requests instead of
+// waiting for clients that may be gone to close them.
+func (s *Server) Shutdown(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() { done <- s.srv.Shutdown(ctx) }()
+
+	t := time.NewTicker(50 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-t.C:
+			s.closeIdle()
+		}
+	}
+}
+
+func (s *Server) closeIdle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		if c.active.Load() == 0 {
+			c.qc.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeNoError), "")
+		}
+	}
+}
+
+// AdvertiseHTTP3 adds an Alt-Svc header pointing clients of next to this
+// server. Clients that honour it switch to HTTP/3 for later requests.
+func (s *Server) AdvertiseHTTP3(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fails only before Serve has bound the socket.
+		_ = s.srv.SetQUICHeaders(w.Header())
+		next.ServeHTTP(w, r)
+	})
+}
+
+// trackRequests counts HTTP/3 requests and keeps track of the requests
+// running on each connection.
+func (s *Server) trackRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&proxy.GlobalMetrics.HTTP3Requests, 1)
+		if c, ok := r.Context().Value(connKey{}).(*conn); ok {
+			c.active.Add(1)
+			defer c.active.Add(-1)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// trackConn registers a new QUIC connection and adds its packet statistics
+// to the metrics once it closes.
+func (s *Server) trackConn(ctx context.Context, qc *quic.Conn) context.Context {
+	c := &conn{qc: qc}
+	s.mu.Lock()
+	s.conns[c] = struct{}{}
+	s.mu.Unlock()
+
+	m := &proxy.GlobalMetrics
+	atomic.AddUint64(&m.QUICConnections, 1)
+	atomic.AddInt64(&m.QUICConnectionsActive, 1)
+	go func() {
+		<-qc.Context().Done()
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+
+		st := qc.ConnectionStats()
+		atomic.AddInt64(&m.QUICConnectionsActive, -1)
+		atomic.AddUint64(&m.QUICPacketsSent, st.PacketsSent)
+		atomic.AddUint64(&m.QUICPacketsReceived, st.PacketsReceived)
+		atomic.AddUint64(&m.QUICPacketsLost, st.PacketsLost)
+		atomic.AddUint64(&m.QUICBytesSent, st.BytesSent)
+		atomic.AddUint64(&m.QUICBytesReceived, st.BytesReceived)
+	}()
+	return context.WithValue(ctx, connKey{}, c)
+}
@@ -0,0 +1,142 @@
+package h3
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/sargisis/edgecore/internal/proxy"
+)
+
+// startServer serves handler over HTTP/3 on loopback with the test
+// certificate of httptest and returns the server and its address.
+func startServer(t *testing.T, handler http.Handler) (*Server, string) {
+	t.Helper()
+
+	// Borrow the test certificate of an HTTPS server.
+	tlsSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	tlsConf := &tls.Config{Certificates: tlsSrv.TLS.Certificates}
+	tlsSrv.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := New(tlsConf, handler, 5*time.Second)
+	go srv.Serve(conn)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+		conn.Close()
+	})
+	return srv, conn.LocalAddr().String()
+}
+
+func newClient() (*http.Client, *http3.Transport) {
+	tr := &http3.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	return &http.Client{Transport: tr, Timeout: 5 * time.Second}, tr
+}
+
+func TestServerAnswersOverHTTP3(t *testing.T) {
+	_, addr := startServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Proto, r.URL.Path)
+	}))
+	requests := atomic.LoadUint64(&proxy.GlobalMetrics.HTTP3Requests)
+	conns := atomic.LoadUint64(&proxy.GlobalMetrics.QUICConnections)
+
+	client, tr := newClient()
+	resp, err := client.Get("https://" + addr + "/hello")
+	if err != nil {
+		t.Fatalf("HTTP/3 request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "HTTP/3.0 /hello" {
+		t.Fatalf("expected HTTP/3 request to reach the handler, got %q", body)
+	}
+	if got := atomic.LoadUint64(&proxy.GlobalMetrics.HTTP3Requests) - requests; got != 1 {
+		t.Fatalf("expected 1 HTTP/3 request counted, got %d", got)
+	}
+	if got := atomic.LoadUint64(&proxy.GlobalMetrics.QUICConnections) - conns; got != 1 {
+		t.Fatalf("expected 1 QUIC connection counted, got %d", got)
+	}
+
+	received := atomic.LoadUint64(&proxy.GlobalMetrics.QUICPacketsReceived)
+	tr.Close()
+	deadline := time.Now().Add(3 * time.Second)
+	for atomic.LoadInt64(&proxy.GlobalMetrics.QUICConnectionsActive) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := atomic.LoadInt64(&proxy.GlobalMetrics.QUICConnectionsActive); got != 0 {
+		t.Fatalf("expected no open QUIC connections after client closed, got %d", got)
+	}
+	if atomic.LoadUint64(&proxy.GlobalMetrics.QUICPacketsReceived) == received {
+		t.Fatalf("expected packet statistics of the closed connection to be recorded")
+	}
+}
+
+func TestAdvertiseHTTP3SetsAltSvc(t *testing.T) {
+	srv, addr := startServer(t, http.NotFoundHandler())
+	_, port, _ := net.SplitHostPort(addr)
+
+	// The header is available once Serve has bound the socket.
+	var altSvc string
+	deadline := time.Now().Add(time.Second)
+	for altSvc == "" && time.Now().Before(deadline) {
+		rec := httptest.NewRecorder()
+		srv.AdvertiseHTTP3(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		altSvc = rec.Header().Get("Alt-Svc")
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.HasPrefix(altSvc, `h3=":`+port+`"`) {
+		t.Fatalf("expected Alt-Svc advertising h3 on port %s, got %q", port, altSvc)
+	}
+}
+
+func TestShutdownClosesIdleConnections(t *testing.T) {
+	srv, addr := startServer(t, http.NotFoundHandler())
+
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	tr := &http3.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		Dial: func(ctx context.Context, addr string, tlsConf *tls.Config, conf *quic.Config) (*quic.Conn, error) {
+			raddr, err := net.ResolveUDPAddr("udp", addr)
+			if err != nil {
+				return nil, err
+			}
+			return quic.DialEarly(ctx, udp, raddr, tlsConf, conf)
+		},
+	}
+	defer tr.Close()
+	client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+	resp, err := client.Get("https://" + addr + "/")
+	if err != nil {
+		t.Fatalf("HTTP/3 request failed: %v", err)
+	}
+	resp.Body.Close()
+	// The client vanishes without closing its connection.
+	udp.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	start := time.Now()
+	srv.Shutdown(ctx)
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("expected shutdown to close the idle connection, took %v", d)
+	}
+}
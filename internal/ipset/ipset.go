@@ -0,0 +1,222 @@
+// Package ipset matches IP addresses against large sets of CIDR prefixes.
+package ipset
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// Set is an immutable set of IPv4 and IPv6 prefixes, stored in a
+// path-compressed binary trie so that a lookup costs at most one step per
+// address bit however many prefixes the set holds. IPv4 prefixes are stored
+// in their IPv4-mapped IPv6 form, so IPv4-mapped addresses match them too.
+type Set struct {
+	root *node
+	len  int
+}
+
+type node struct {
+	// key holds the first bits bits of the prefix; the rest are zero.
+	key  [16]byte
+	bits int
+	// end marks a prefix of the set; its subtree is then fully covered.
+	end   bool
+	child [2]*node
+}
+
+// New returns a set of prefixes. Prefixes covered by others are dropped.
+func New(prefixes []netip.Prefix) *Set {
+	s := &Set{}
+	for _, p := range prefixes {
+		s.insert(p)
+	}
+	return s
+}
+
+// Len returns the number of prefixes added, covered ones included.
+func (s *Set) Len() int {
+	if s == nil {
+		return 0
+	}
+	return s.len
+}
+
+// Contains reports whether addr is in a prefix of the set. A nil set is
+// empty.
+func (s *Set) Contains(addr netip.Addr) bool {
+	if s == nil || !addr.IsValid() {
+		return false
+	}
+	key := addr.Unmap().As16()
+	// Bits above the parent node already matched.
+	matched := 0
+	for n := s.root; n != nil; n = n.child[bit(key, n.bits)] {
+		if commonBits(n.key, key, matched, n.bits) < n.bits {
+			return false
+		}
+		matched = n.bits
+		if n.end {
+			return true
+		}
+		if n.bits == 128 {
+			return false
+		}
+	}
+	return false
+}
+
+func (s *Set) insert(p netip.Prefix) {
+	s.len++
+	p = p.Masked()
+	// IPv4-mapped prefixes already count the 96 bits of the mapping.
+	key, bits := p.Addr().As16(), p.Bits()
+	if p.Addr().Is4() {
+		bits += 96
+	}
+
+	link := &s.root
+	for {
+		n := *link
+		if n == nil {
+			*link = &node{key: key, bits: bits, end: true}
+			return
+		}
+		common := commonBits(n.key, key, 0, min(n.bits, bits))
+		switch {
+		case common == n.bits && n.bits == bits:
+			n.end, n.child = true, [2]*node{}
+			return
+		case common == n.bits:
+			// n covers the new prefix.
+			if n.end {
+				return
+			}
+			link = &n.child[bit(key, n.bits)]
+		case common == bits:
+			// The new prefix covers n.
+			*link = &node{key: key, bits: bits, end: true}
+			return
+		default:
+			split := &node{key: mask(key, common), bits: common}
+			split.child[bit(key, common)] = &node{key: key, bits: bits, end: true}
+			split.child[bit(n.key, common)] = n
+			*link = split
+			return
+		}
+	}
+}
+
+// bit returns bit i of key, counting from the most significant.
+func bit(key [16]byte, i int) int {
+	if i >= 128 {
+		return 0
+	}
+	return int(key[i/8]>>(7-i%8)) & 1
+}
+
+// commonBits returns how many of the first n bits of a and b are equal,
+// given that the first from bits are.
+func commonBits(a, b [16]byte, from, n int) int {
+	for i := from &^ 7; i < n; i += 8 {
+		if x := a[i/8] ^ b[i/8]; x != 0 {
+			for j := 0; j < 8; j++ {
+				if x&(0x80>>j) != 0 {
+					return min(n, i+j)
+				}
+			}
+		}
+	}
+	return n
+}
+
+// mask clears all but the first bits bits of key.
+func mask(key [16]byte, bits int) [16]byte {
+	for i := range key {
+		switch {
+		case bits >= 8*(i+1):
+		case bits <= 8*i:
+			key[i] = 0
+		default:
+			key[i] &= byte(0xff << (8 - bits%8))
+		}
+	}
+	return key
+}
+
+// ParsePrefix parses a CIDR prefix or a single IP address. IPv4-mapped
+// prefixes such as ::ffff:10.0.0.0/104 are returned in their IPv4 form.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if p, err := netip.ParsePrefix(s); err == nil {
+		if p.Addr().Is4In6() && p.Bits() >= 96 {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		return p.Masked(), nil
+	}
+	if addr, err := netip.ParseAddr(s); err == nil {
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	return netip.Prefix{}, fmt.Errorf("%q is not a CIDR or IP address", s)
+}
+
+// Read parses one prefix or address per line. Blank lines and text after
+// "#" or ";" are ignored, so most published blocklists can be used as is.
+func Read(r io.Reader) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text, _, _ := strings.Cut(sc.Text(), "#")
+		text, _, _ = strings.Cut(text, ";")
+		if text = strings.TrimSpace(text); text == "" {
+			continue
+		}
+		p, err := ParsePrefix(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, sc.Err()
+}
+
+// ReadFile parses the file at path as Read does.
+func ReadFile(path string) ([]netip.Prefix, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	prefixes, err := Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return prefixes, nil
+}
+
+// AccessList allows or denies clients by address. Deny wins: an address in
+// both lists is denied. With an empty allow list every address not denied
+// is allowed.
+type AccessList struct {
+	Allow *Set
+	Deny  *Set
+}
+
+// Allows reports whether addr may connect. Invalid addresses are only
+// allowed by lists that allow everyone.
+func (l *AccessList) Allows(addr netip.Addr) bool {
+	if l == nil {
+		return true
+	}
+	if !addr.IsValid() {
+		return l.Allow.Len() == 0 && l.Deny.Len() == 0
+	}
+	if l.Deny.Contains(addr) {
+		return false
+	}
+	return l.Allow.Len() == 0 || l.Allow.Contains(addr)
+}
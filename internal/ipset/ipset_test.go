@@ -0,0 +1,153 @@
+package ipset
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func mustPrefixes(t *testing.T, ss ...string) []netip.Prefix {
+	t.Helper()
+	var prefixes []netip.Prefix
+	for _, s := range ss {
+		p, err := ParsePrefix(s)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", s, err)
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes
+}
+
+func TestSetContains(t *testing.T) {
+	s := New(mustPrefixes(t, "10.0.0.0/8", "192.0.2.1", "198.51.100.0/25", "2001:db8::/32", "2001:db8:1::/48"))
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.200.3.4", true},
+		{"11.0.0.1", false},
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"198.51.100.127", true},
+		{"198.51.100.128", false},
+		{"::ffff:10.1.1.1", true},
+		{"2001:db8:ffff::1", true},
+		{"2001:db9::1", false},
+		{"::1", false},
+	}
+	for _, tt := range tests {
+		if got := s.Contains(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Fatalf("Contains(%s): expected %v, got %v", tt.addr, tt.want, got)
+		}
+	}
+	if (*Set)(nil).Contains(netip.MustParseAddr("10.0.0.1")) {
+		t.Fatalf("expected a nil set to be empty")
+	}
+}
+
+func TestSetIPv4MappedPrefixes(t *testing.T) {
+	// Built directly, mapped prefixes are matched in the mapped space.
+	s := New([]netip.Prefix{netip.MustParsePrefix("::ffff:10.0.0.0/104"), netip.MustParsePrefix("::ffff:192.0.2.1/128")})
+	for addr, want := range map[string]bool{
+		"10.1.2.3":         true,
+		"::ffff:10.1.2.3":  true,
+		"11.0.0.1":         false,
+		"192.0.2.1":        true,
+		"::ffff:192.0.2.2": false,
+		"::1":              false,
+	} {
+		if got := s.Contains(netip.MustParseAddr(addr)); got != want {
+			t.Fatalf("Contains(%s): expected %v, got %v", addr, want, got)
+		}
+	}
+
+	p, err := ParsePrefix("::ffff:10.0.0.0/104")
+	if err != nil || p != netip.MustParsePrefix("10.0.0.0/8") {
+		t.Fatalf("expected a mapped prefix parsed as 10.0.0.0/8, got %v (%v)", p, err)
+	}
+	if p, _ := ParsePrefix("::ffff:0:0/96"); p != netip.MustParsePrefix("0.0.0.0/0") {
+		t.Fatalf("expected the whole mapped space parsed as 0.0.0.0/0, got %v", p)
+	}
+}
+
+func TestSetMatchesLinearScan(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	randomAddr := func() netip.Addr {
+		if rng.IntN(2) == 0 {
+			return netip.AddrFrom4([4]byte{10, byte(rng.IntN(4)), byte(rng.IntN(256)), byte(rng.IntN(256))})
+		}
+		return netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, byte(rng.IntN(4)), byte(rng.IntN(256)), 15: byte(rng.IntN(256))})
+	}
+
+	var prefixes []netip.Prefix
+	for range 5000 {
+		addr := randomAddr()
+		bits := 8 + rng.IntN(addr.BitLen()-7)
+		prefixes = append(prefixes, netip.PrefixFrom(addr, bits).Masked())
+	}
+	s := New(prefixes)
+	for range 20000 {
+		addr := randomAddr()
+		want := false
+		for _, p := range prefixes {
+			if p.Contains(addr) {
+				want = true
+				break
+			}
+		}
+		if got := s.Contains(addr); got != want {
+			t.Fatalf("Contains(%s): expected %v, got %v", addr, want, got)
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	prefixes, err := Read(strings.NewReader("# blocklist\n203.0.113.0/24 ; SBL123\n\n2001:db8::1  # host\n"))
+	if err != nil || len(prefixes) != 2 || prefixes[1].Bits() != 128 {
+		t.Fatalf("expected two prefixes, got %v (%v)", prefixes, err)
+	}
+	if _, err := Read(strings.NewReader("203.0.113.0/24\nexample.com\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected error naming line 2, got %v", err)
+	}
+}
+
+func TestAccessList(t *testing.T) {
+	l := &AccessList{
+		Allow: New(mustPrefixes(t, "10.0.0.0/8")),
+		Deny:  New(mustPrefixes(t, "10.6.6.0/24")),
+	}
+	if !l.Allows(netip.MustParseAddr("10.1.2.3")) {
+		t.Fatalf("expected allowed network to be allowed")
+	}
+	if l.Allows(netip.MustParseAddr("10.6.6.6")) {
+		t.Fatalf("expected deny to win over allow")
+	}
+	if l.Allows(netip.MustParseAddr("192.0.2.1")) {
+		t.Fatalf("expected addresses outside the allow list to be denied")
+	}
+	if l.Allows(netip.Addr{}) {
+		t.Fatalf("expected an unknown address to be denied")
+	}
+
+	denyOnly := &AccessList{Deny: New(mustPrefixes(t, "10.6.6.0/24"))}
+	if !denyOnly.Allows(netip.MustParseAddr("192.0.2.1")) {
+		t.Fatalf("expected a deny list alone to allow other addresses")
+	}
+}
+
+func BenchmarkSetContains(b *testing.B) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	prefixes := make([]netip.Prefix, 50000)
+	for i := range prefixes {
+		prefixes[i] = netip.PrefixFrom(netip.AddrFrom4([4]byte{byte(rng.IntN(256)), byte(rng.IntN(256)), byte(rng.IntN(256)), 0}), 24)
+	}
+	s := New(prefixes)
+	addr := netip.MustParseAddr("203.0.113.7")
+	b.ResetTimer()
+	for range b.N {
+		s.Contains(addr)
+	}
+}
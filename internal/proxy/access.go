@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"net/http"
+	"net/netip"
+	"sync/atomic"
+
+	"github.com/sargisis/edgecore/internal/ipset"
+	"github.com/sargisis/edgecore/internal/router"
+)
+
+// listenerAccess holds the access lists of HTTP listeners by port.
+var listenerAccess atomic.Pointer[map[int]*ipset.AccessList]
+
+func init() {
+	listenerAccess.Store(&map[int]*ipset.AccessList{})
+}
+
+// SetListenerAccessLists replaces the access lists of HTTP listeners, keyed
+// by port.
+func SetListenerAccessLists(lists map[int]*ipset.AccessList) {
+	listenerAccess.Store(&lists)
+}
+
+// ListenerAccess refuses clients denied by the access list of the listener
+// on port with 403. Clients are identified by clientIP, so behind trusted
+// proxies the forwarded address is checked.
+func ListenerAccess(port int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l := (*listenerAccess.Load())[port]; l != nil && !l.Allows(clientAddr(r)) {
+			atomic.AddUint64(&GlobalMetrics.AccessDeniedListener, 1)
+			accessDenied(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RouteAccess refuses clients denied by the access list of the matched
+// route with 403.
+func RouteAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := router.FromContext(r.Context())
+		if route != nil && route.Access != nil && !route.Access.Allows(clientAddr(r)) {
+			atomic.AddUint64(&GlobalMetrics.AccessDeniedRoute, 1)
+			accessDenied(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientAddr returns the parsed clientIP of r, or the zero Addr.
+func clientAddr(r *http.Request) netip.Addr {
+	addr, _ := netip.ParseAddr(clientIP(r))
+	return addr
+}
+
+func accessDenied(w http.ResponseWriter, r *http.Request) {
+	if router.IsGRPC(r) {
+		GRPCError(w, GRPCPermissionDenied, "access denied")
+		return
+	}
+	http.Error(w, "Forbidden", http.StatusForbidden)
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/sargisis/edgecore/internal/ipset"
+	"github.com/sargisis/edgecore/internal/router"
+)
+
+func accessList(t *testing.T, allow, deny []string) *ipset.AccessList {
+	t.Helper()
+
+	parse := func(ss []string) *ipset.Set {
+		var prefixes []netip.Prefix
+		for _, s := range ss {
+			prefixes = append(prefixes, netip.MustParsePrefix(s))
+		}
+		return ipset.New(prefixes)
+	}
+	return &ipset.AccessList{Allow: parse(allow), Deny: parse(deny)}
+}
+
+func TestListenerAccessChecksClientIP(t *testing.T) {
+	SetListenerAccessLists(map[int]*ipset.AccessList{8443: accessList(t, []string{"203.0.113.0/24"}, nil)})
+	t.Cleanup(func() { SetListenerAccessLists(nil) })
+	trustProxies(t, "10.0.0.0/8")
+
+	handler := ListenerAccess(8443, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(remote, forwardedFor string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = remote + ":1234"
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := serve("203.0.113.9", ""); code != http.StatusOK {
+		t.Fatalf("expected allowed client served, got %d", code)
+	}
+	if code := serve("198.51.100.1", ""); code != http.StatusForbidden {
+		t.Fatalf("expected other client refused, got %d", code)
+	}
+	if code := serve("10.0.0.1", "203.0.113.9"); code != http.StatusOK {
+		t.Fatalf("expected client forwarded by a trusted proxy served, got %d", code)
+	}
+	if code := serve("198.51.100.1", "203.0.113.9"); code != http.StatusForbidden {
+		t.Fatalf("expected forwarding header from an untrusted peer ignored, got %d", code)
+	}
+
+	other := ListenerAccess(8080, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rr := httptest.NewRecorder()
+	other.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected a listener without a list to serve everyone, got %d", rr.Code)
+	}
+}
+
+func TestRouteAccess(t *testing.T) {
+	route := &router.Route{Name: "admin", Access: accessList(t, nil, []string{"192.0.2.0/24", "2001:db8::/32"})}
+	handler := RouteAccess(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(remote string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = remote
+		req = req.WithContext(router.WithRoute(req.Context(), route))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := serve("192.0.2.7:1234"); code != http.StatusForbidden {
+		t.Fatalf("expected denied IPv4 client refused, got %d", code)
+	}
+	if code := serve("[2001:db8::7]:1234"); code != http.StatusForbidden {
+		t.Fatalf("expected denied IPv6 client refused, got %d", code)
+	}
+	if code := serve("198.51.100.1:1234"); code != http.StatusOK {
+		t.Fatalf("expected other client served, got %d", code)
+	}
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// AdminPrefix starts the paths of the admin API.
+const AdminPrefix = "/_admin/"
+
+var adminToken atomic.Pointer[string]
+
+func init() {
+	adminToken.Store(new(string))
+}
+
+// SetAdminToken sets the bearer token the admin API requires; empty
+// disables the API.
+func SetAdminToken(token string) {
+	adminToken.Store(&token)
+}
+
+// AdminAPI serves the admin API under AdminPrefix:
+//
+//	GET    /_admin/quotas              usage of every consumer with a quota
+//	GET    /_admin/quotas/{consumer}   usage of one consumer
+//	DELETE /_admin/quotas/{consumer}   reset a consumer's usage
+//	GET    /_admin/bans                clients currently banned
+//	DELETE /_admin/bans/{client}       lift a client's ban
+//
+// Requests must carry "Authorization: Bearer <token>". While no token is
+// set, the API answers 404 as if it did not exist.
+func AdminAPI() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+AdminPrefix+"quotas", adminQuotas)
+	mux.HandleFunc("GET "+AdminPrefix+"quotas/{consumer}", adminQuota)
+	mux.HandleFunc("DELETE "+AdminPrefix+"quotas/{consumer}", adminResetQuota)
+	mux.HandleFunc("GET "+AdminPrefix+"bans", adminBans)
+	mux.HandleFunc("DELETE "+AdminPrefix+"bans/{client}", adminUnban)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := *adminToken.Load()
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			atomic.AddUint64(&GlobalMetrics.AdminAuthFailures, 1)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="edgecore admin"`)
+			adminError(w, http.StatusUnauthorized, "invalid or missing admin token")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// adminJSON writes v as the JSON response body.
+func adminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminError(w http.ResponseWriter, status int, message string) {
+	adminJSON(w, status, struct {
+		Error string `json:"error"`
+	}{message})
+}
+
+// adminQuotaTracker returns the quota tracker, answering 404 if quotas are
+// disabled.
+func adminQuotaTracker(w http.ResponseWriter) *QuotaTracker {
+	t := quotaTracker.Load()
+	if t == nil {
+		adminError(w, http.StatusNotFound, "quotas are not enabled")
+	}
+	return t
+}
+
+func adminQuotas(w http.ResponseWriter, r *http.Request) {
+	if t := adminQuotaTracker(w); t != nil {
+		adminJSON(w, http.StatusOK, t.Reports())
+	}
+}
+
+func adminQuota(w http.ResponseWriter, r *http.Request) {
+	t := adminQuotaTracker(w)
+	if t == nil {
+		return
+	}
+	report, ok := t.Report(r.PathValue("consumer"))
+	if !ok {
+		adminError(w, http.StatusNotFound, "consumer has no quota")
+		return
+	}
+	adminJSON(w, http.StatusOK, report)
+}
+
+func adminResetQuota(w http.ResponseWriter, r *http.Request) {
+	t := adminQuotaTracker(w)
+	if t == nil {
+		return
+	}
+	consumer := r.PathValue("consumer")
+	t.Reset(consumer)
+	logEntry(LogEntry{Level: "info", Message: fmt.Sprintf("quota usage of %q reset by %s", consumer, clientIP(r))})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminBanner returns the banner, answering 404 if bans are disabled.
+func adminBanner(w http.ResponseWriter) *Banner {
+	b := banner.Load()
+	if b == nil {
+		adminError(w, http.StatusNotFound, "bans are not enabled")
+	}
+	return b
+}
+
+func adminBans(w http.ResponseWriter, r *http.Request) {
+	if b := adminBanner(w); b != nil {
+		adminJSON(w, http.StatusOK, b.Bans())
+	}
+}
+
+func adminUnban(w http.ResponseWriter, r *http.Request) {
+	b := adminBanner(w)
+	if b == nil {
+		return
+	}
+	client := r.PathValue("client")
+	if !b.Unban(client) {
+		adminError(w, http.StatusNotFound, "client is not banned")
+		return
+	}
+	logEntry(LogEntry{Level: "info", Message: fmt.Sprintf("ban of %s lifted by %s", client, clientIP(r))})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdminAPIRequiresToken(t *testing.T) {
+	api := AdminAPI()
+	serve := func(auth string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/_admin/quotas", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := serve("Bearer secret"); code != http.StatusNotFound {
+		t.Fatalf("expected 404 without a configured token, got %d", code)
+	}
+	SetAdminToken("secret")
+	t.Cleanup(func() { SetAdminToken("") })
+	if code := serve(""); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a token, got %d", code)
+	}
+	if code := serve("Bearer wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a wrong token, got %d", code)
+	}
+	if code := serve("Bearer secret"); code != http.StatusNotFound {
+		t.Fatalf("expected 404 while quotas are disabled, got %d", code)
+	}
+}
+
+func TestAdminAPIQuotas(t *testing.T) {
+	clock := newFakeClock(time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC))
+	tracker := newTestQuotaTracker(t, clock, "")
+	tracker.take("key-free")
+	SetQuotaTracker(tracker)
+	SetAdminToken("secret")
+	t.Cleanup(func() {
+		SetQuotaTracker(nil)
+		SetAdminToken("")
+	})
+	api := AdminAPI()
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://example.com"+path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve(http.MethodGet, "/_admin/quotas/key-free")
+	var report QuotaReport
+	if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("expected a JSON report, got %d %s", rr.Code, rr.Body)
+	}
+	if report.Daily.Used != 1 || report.Daily.Remaining != 1 || report.Monthly.Limit != 3 {
+		t.Fatalf("expected 1 request used, got %+v", report)
+	}
+
+	if rr := serve(http.MethodGet, "/_admin/quotas"); rr.Code != http.StatusOK {
+		t.Fatalf("expected the consumer list, got %d", rr.Code)
+	} else if err := json.Unmarshal(rr.Body.Bytes(), &[]QuotaReport{}); err != nil {
+		t.Fatalf("expected a JSON list, got %s", rr.Body)
+	}
+
+	if rr := serve(http.MethodDelete, "/_admin/quotas/key-free"); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 for a reset, got %d", rr.Code)
+	}
+	if r, _ := tracker.Report("key-free"); r.Daily.Used != 0 {
+		t.Fatalf("expected usage reset, got %+v", r)
+	}
+}
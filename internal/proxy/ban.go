@@ -0,0 +1,447 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sargisis/edgecore/internal/ipset"
+	"github.com/sargisis/edgecore/internal/router"
+)
+
+// BanRule bans a client that gets Threshold responses with one of Statuses
+// within Window.
+type BanRule struct {
+	Name      string
+	Statuses  []int
+	Threshold int
+	Window    time.Duration
+}
+
+// BanOptions configure a Banner.
+type BanOptions struct {
+	Rules []BanRule
+	// BanTime is the length of a first ban. A ban starting within
+	// ForgetAfter of the end of the previous one lasts twice as long as
+	// it, up to MaxBanTime.
+	BanTime     time.Duration
+	MaxBanTime  time.Duration
+	ForgetAfter time.Duration
+	// Exempt clients are never banned.
+	Exempt *ipset.Set
+	// IPv6Prefix is the length of the IPv6 networks banned as one client,
+	// since a single host often holds a whole /64; zero means 64.
+	IPv6Prefix int
+	// MaxClients caps the clients tracked. Beyond it a client without a
+	// current ban is forgotten to make room, and new clients are not
+	// counted while every tracked one is banned. Zero means 100000.
+	MaxClients int
+	// StateFile keeps bans across restarts; empty keeps them in memory.
+	StateFile string
+	Clock     Clock
+}
+
+// Ban is the current or last ban of a client.
+type Ban struct {
+	// Client is an IPv4 address or an IPv6 network.
+	Client string    `json:"client"`
+	Rule   string    `json:"rule"`
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+	// Count is the number of bans in a row, which sets their length.
+	Count int `json:"count"`
+}
+
+// Banner counts the responses each client gets against the ban rules and
+// bans the clients reaching a threshold.
+type Banner struct {
+	mu      sync.Mutex
+	opts    BanOptions
+	clock   Clock
+	clients map[string]*banClient
+	// dirty marks bans not yet saved to the state file.
+	dirty bool
+}
+
+type banClient struct {
+	// hits holds the times of recent matching responses by rule, oldest
+	// first.
+	hits [][]time.Time
+	// ban is the current or last ban; its Count is 0 if there was none.
+	ban Ban
+}
+
+// NewBanner returns a banner, loading the bans saved in opts.StateFile.
+func NewBanner(opts BanOptions) (*Banner, error) {
+	if opts.Clock == nil {
+		opts.Clock = time.Now
+	}
+	opts = banDefaults(opts)
+	b := &Banner{opts: opts, clock: opts.Clock, clients: make(map[string]*banClient)}
+	if opts.StateFile == "" {
+		return b, nil
+	}
+	data, err := os.ReadFile(opts.StateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var bans []Ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return nil, fmt.Errorf("ban state %s: %w", opts.StateFile, err)
+	}
+	for _, ban := range bans {
+		// Bans saved by address are kept by network from now on.
+		if addr, err := netip.ParseAddr(ban.Client); err == nil {
+			ban.Client = b.key(addr)
+		}
+		b.clients[ban.Client] = &banClient{ban: ban}
+	}
+	return b, nil
+}
+
+func banDefaults(opts BanOptions) BanOptions {
+	if opts.IPv6Prefix == 0 {
+		opts.IPv6Prefix = 64
+	}
+	if opts.MaxClients == 0 {
+		opts.MaxClients = 100000
+	}
+	return opts
+}
+
+// SetOptions replaces the options but the state file and clock. Responses
+// counted so far are forgotten; bans are kept.
+func (b *Banner) SetOptions(opts BanOptions) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	opts.StateFile, opts.Clock = b.opts.StateFile, b.opts.Clock
+	b.opts = banDefaults(opts)
+	for _, c := range b.clients {
+		c.hits = nil
+	}
+}
+
+// key returns the client addr is counted and banned as: the address
+// itself for IPv4, its network for IPv6; the caller holds b.mu.
+func (b *Banner) key(addr netip.Addr) string {
+	addr = addr.Unmap()
+	if addr.Is4() {
+		return addr.String()
+	}
+	p, _ := addr.Prefix(b.opts.IPv6Prefix)
+	return p.String()
+}
+
+// lookup returns the key of client, which may be an address or a network
+// as returned by key. Other identities are not banned.
+func (b *Banner) lookup(client string) (string, bool) {
+	if p, err := netip.ParsePrefix(client); err == nil {
+		client = p.Addr().String()
+	}
+	addr, err := netip.ParseAddr(client)
+	if err != nil {
+		return "", false
+	}
+	return b.key(addr), true
+}
+
+// Banned reports whether client is banned, and for how much longer.
+func (b *Banner) Banned(client string) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key, ok := b.lookup(client)
+	if !ok {
+		return 0, false
+	}
+	c := b.clients[key]
+	if c == nil {
+		return 0, false
+	}
+	left := c.ban.Until.Sub(b.clock())
+	return left, left > 0
+}
+
+// observe counts a response with status to client against the rules and
+// bans the client if one reaches its threshold. Clients that are not IP
+// addresses are not counted.
+func (b *Banner) observe(client string, status int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.clock()
+	var c *banClient
+	for i, rule := range b.opts.Rules {
+		if !slices.Contains(rule.Statuses, status) {
+			continue
+		}
+		if c == nil {
+			addr, err := netip.ParseAddr(client)
+			if err != nil || b.opts.Exempt.Contains(addr) {
+				return
+			}
+			client = b.key(addr)
+			c = b.clients[client]
+			if c == nil {
+				if !b.makeRoom(now) {
+					return
+				}
+				c = &banClient{}
+				b.clients[client] = c
+			}
+			// Requests in flight when the client was banned must not
+			// ban it again.
+			if now.Before(c.ban.Until) {
+				return
+			}
+			if len(c.hits) != len(b.opts.Rules) {
+				c.hits = make([][]time.Time, len(b.opts.Rules))
+			}
+		}
+		hits := c.hits[i]
+		for len(hits) > 0 && now.Sub(hits[0]) >= rule.Window {
+			hits = hits[1:]
+		}
+		c.hits[i] = append(hits, now)
+		if len(c.hits[i]) >= rule.Threshold {
+			b.ban(client, c, rule.Name, now)
+			return
+		}
+	}
+}
+
+// ban bans client, twice as long as the last time if that was recent; the
+// caller holds b.mu.
+func (b *Banner) ban(client string, c *banClient, rule string, now time.Time) {
+	count := 1
+	if c.ban.Count > 0 && now.Sub(c.ban.Until) < b.opts.ForgetAfter {
+		count = c.ban.Count + 1
+	}
+	d := b.opts.BanTime
+	for i := 1; i < count && d < b.opts.MaxBanTime; i++ {
+		d *= 2
+	}
+	d = min(d, max(b.opts.BanTime, b.opts.MaxBanTime))
+
+	c.ban = Ban{Client: client, Rule: rule, Since: now, Until: now.Add(d), Count: count}
+	c.hits = nil
+	b.dirty = true
+	recordBan(rule)
+	logEntry(LogEntry{Level: "warn", Message: fmt.Sprintf("banned %s for %s by rule %q (ban %d in a row)", client, d, rule, count)})
+}
+
+// makeRoom forgets a client without a current ban if the cap is reached,
+// and reports whether another client fits; the caller holds b.mu.
+func (b *Banner) makeRoom(now time.Time) bool {
+	if len(b.clients) < b.opts.MaxClients {
+		return true
+	}
+	for client, c := range b.clients {
+		if !now.Before(c.ban.Until) {
+			delete(b.clients, client)
+			atomic.AddUint64(&GlobalMetrics.BanClientsEvicted, 1)
+			return true
+		}
+	}
+	return false
+}
+
+// Bans returns the current bans, by client.
+func (b *Banner) Bans() []Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.clock()
+	bans := []Ban{}
+	for _, c := range b.clients {
+		if now.Before(c.ban.Until) {
+			bans = append(bans, c.ban)
+		}
+	}
+	slices.SortFunc(bans, func(a, b Ban) int { return strings.Compare(a.Client, b.Client) })
+	return bans
+}
+
+// Len returns the number of banned clients.
+func (b *Banner) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.clock()
+	n := 0
+	for _, c := range b.clients {
+		if now.Before(c.ban.Until) {
+			n++
+		}
+	}
+	return n
+}
+
+// Unban lifts the ban of client, an address or a banned network, and
+// forgets its past bans. It reports whether the client was banned.
+func (b *Banner) Unban(client string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if key, ok := b.lookup(client); ok {
+		client = key
+	}
+	c := b.clients[client]
+	if c == nil || !b.clock().Before(c.ban.Until) {
+		return false
+	}
+	delete(b.clients, client)
+	b.dirty = true
+	return true
+}
+
+// prune forgets the clients with no current ban, no ban recent enough to
+// escalate the next and no responses within the rule windows; the caller
+// holds b.mu.
+func (b *Banner) prune(now time.Time) {
+	for client, c := range b.clients {
+		if c.ban.Count > 0 && now.Sub(c.ban.Until) < b.opts.ForgetAfter {
+			continue
+		}
+		recent := false
+		for i, hits := range c.hits {
+			if len(hits) > 0 && now.Sub(hits[len(hits)-1]) < b.opts.Rules[i].Window {
+				recent = true
+				break
+			}
+		}
+		if !recent {
+			delete(b.clients, client)
+		}
+	}
+}
+
+// Save writes the bans to the state file, if any, along with the past
+// bans that still escalate the next.
+func (b *Banner) Save() error {
+	b.mu.Lock()
+	if b.opts.StateFile == "" || !b.dirty {
+		b.mu.Unlock()
+		return nil
+	}
+	b.prune(b.clock())
+	bans := []Ban{}
+	for _, c := range b.clients {
+		if c.ban.Count > 0 {
+			bans = append(bans, c.ban)
+		}
+	}
+	data, err := json.Marshal(bans)
+	b.dirty = false
+	path := b.opts.StateFile
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err = writeStateFile(path, data); err != nil {
+		b.mu.Lock()
+		b.dirty = true
+		b.mu.Unlock()
+	}
+	return err
+}
+
+// Run forgets idle clients and saves the bans every ten seconds until stop
+// is closed, then saves them once more.
+func (b *Banner) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			b.save()
+			return
+		}
+		b.mu.Lock()
+		b.prune(b.clock())
+		b.mu.Unlock()
+		b.save()
+	}
+}
+
+func (b *Banner) save() {
+	if err := b.Save(); err != nil {
+		logEntry(LogEntry{Level: "warn", Message: "failed to save bans", Error: err.Error()})
+	}
+}
+
+var banner atomic.Pointer[Banner]
+
+// SetBanner replaces the banner used by BanAbusers; nil disables bans.
+func SetBanner(b *Banner) {
+	banner.Store(b)
+}
+
+// bansByRule counts bans by rule name.
+var bansByRule sync.Map
+
+func recordBan(rule string) {
+	c, _ := bansByRule.LoadOrStore(rule, new(atomic.Uint64))
+	c.(*atomic.Uint64).Add(1)
+}
+
+// banCounts returns the bans of every rule seen so far.
+func banCounts() map[string]uint64 {
+	counts := make(map[string]uint64)
+	bansByRule.Range(func(rule, c any) bool {
+		counts[rule.(string)] = c.(*atomic.Uint64).Load()
+		return true
+	})
+	return counts
+}
+
+// BanAbusers refuses the requests of banned clients with 403 and counts
+// the responses to the others against the ban rules.
+func BanAbusers(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := banner.Load()
+		if b == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client := clientIP(r)
+		if left, ok := b.Banned(client); ok {
+			banned(w, r, left)
+			return
+		}
+		rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(rw, r)
+		b.observe(client, rw.statusCode)
+	})
+}
+
+func banned(w http.ResponseWriter, r *http.Request, left time.Duration) {
+	atomic.AddUint64(&GlobalMetrics.BannedRequests, 1)
+
+	retry := max(1, ceilSeconds(left))
+	h := w.Header()
+	h.Set("Retry-After", strconv.FormatInt(retry, 10))
+	if router.IsGRPC(r) {
+		GRPCError(w, GRPCPermissionDenied, "client banned")
+		return
+	}
+	body, _ := json.Marshal(struct {
+		Error      string `json:"error"`
+		Message    string `json:"message"`
+		RetryAfter int64  `json:"retry_after_seconds"`
+	}{"banned", "Too many failed requests", retry})
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write(body)
+}
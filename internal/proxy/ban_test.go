@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sargisis/edgecore/internal/ipset"
+)
+
+func newTestBanner(t *testing.T, clock *fakeClock, stateFile string) *Banner {
+	t.Helper()
+	b, err := NewBanner(BanOptions{
+		Rules: []BanRule{
+			{Name: "rate_limited", Statuses: []int{429}, Threshold: 3, Window: time.Minute},
+			{Name: "auth", Statuses: []int{401, 403}, Threshold: 2, Window: time.Minute},
+		},
+		BanTime:     10 * time.Minute,
+		MaxBanTime:  30 * time.Minute,
+		ForgetAfter: time.Hour,
+		Exempt:      ipset.New([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}),
+		StateFile:   stateFile,
+		Clock:       clock.Now,
+	})
+	if err != nil {
+		t.Fatalf("NewBanner: %v", err)
+	}
+	return b
+}
+
+func TestBannerBansWithinWindow(t *testing.T) {
+	clock := newFakeClock(time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC))
+	b := newTestBanner(t, clock, "")
+
+	b.observe("203.0.113.7", http.StatusTooManyRequests)
+	b.observe("203.0.113.7", http.StatusOK)
+	clock.Add(30 * time.Second)
+	b.observe("203.0.113.7", http.StatusTooManyRequests)
+	clock.Add(30 * time.Second)
+	// The first response left the window.
+	b.observe("203.0.113.7", http.StatusTooManyRequests)
+	if _, ok := b.Banned("203.0.113.7"); ok {
+		t.Fatalf("expected no ban with responses spread over more than the window")
+	}
+	b.observe("203.0.113.7", http.StatusTooManyRequests)
+	left, ok := b.Banned("203.0.113.7")
+	if !ok || left != 10*time.Minute {
+		t.Fatalf("expected a 10m ban, got %v %v", left, ok)
+	}
+	if bans := b.Bans(); len(bans) != 1 || bans[0].Rule != "rate_limited" || bans[0].Count != 1 {
+		t.Fatalf("expected one ban by rate_limited, got %+v", bans)
+	}
+
+	for range 5 {
+		b.observe("10.1.2.3", http.StatusUnauthorized)
+	}
+	if _, ok := b.Banned("10.1.2.3"); ok {
+		t.Fatalf("expected exempt client not to be banned")
+	}
+}
+
+func TestBannerEscalates(t *testing.T) {
+	clock := newFakeClock(time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC))
+	b := newTestBanner(t, clock, "")
+	offend := func() time.Duration {
+		b.observe("2001:db8::1", http.StatusUnauthorized)
+		b.observe("2001:db8::1", http.StatusForbidden)
+		left, _ := b.Banned("2001:db8::1")
+		return left
+	}
+
+	if d := offend(); d != 10*time.Minute {
+		t.Fatalf("expected a first ban of 10m, got %v", d)
+	}
+	// Responses to requests in flight at the ban do not extend it.
+	b.observe("2001:db8::1", http.StatusUnauthorized)
+	b.observe("2001:db8::1", http.StatusUnauthorized)
+	if bans := b.Bans(); bans[0].Count != 1 {
+		t.Fatalf("expected the ban not to be renewed, got %+v", bans[0])
+	}
+	clock.Add(10 * time.Minute)
+	if d := offend(); d != 20*time.Minute {
+		t.Fatalf("expected a second ban of 20m, got %v", d)
+	}
+	clock.Add(20 * time.Minute)
+	if d := offend(); d != 30*time.Minute {
+		t.Fatalf("expected a third ban capped at 30m, got %v", d)
+	}
+	clock.Add(30*time.Minute + time.Hour)
+	if d := offend(); d != 10*time.Minute {
+		t.Fatalf("expected past bans to be forgotten after an hour, got %v", d)
+	}
+}
+
+func TestBannerUnban(t *testing.T) {
+	clock := newFakeClock(time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC))
+	b := newTestBanner(t, clock, "")
+	b.observe("203.0.113.7", http.StatusUnauthorized)
+	b.observe("203.0.113.7", http.StatusUnauthorized)
+
+	if !b.Unban("203.0.113.7") {
+		t.Fatalf("expected Unban to lift the ban")
+	}
+	if _, ok := b.Banned("203.0.113.7"); ok {
+		t.Fatalf("expected client not to be banned")
+	}
+	if b.Unban("203.0.113.7") {
+		t.Fatalf("expected Unban of a client not banned to report false")
+	}
+	b.observe("203.0.113.7", http.StatusUnauthorized)
+	b.observe("203.0.113.7", http.StatusUnauthorized)
+	if bans := b.Bans(); len(bans) != 1 || bans[0].Count != 1 {
+		t.Fatalf("expected Unban to forget past bans, got %+v", bans)
+	}
+}
+
+func TestBannerBansIPv6Networks(t *testing.T) {
+	clock := newFakeClock(time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC))
+	b := newTestBanner(t, clock, "")
+
+	// Responses to addresses of one /64 add up.
+	b.observe("2001:db8::1", http.StatusUnauthorized)
+	b.observe("2001:db8::2", http.StatusUnauthorized)
+	if _, ok := b.Banned("2001:db8::ffff"); !ok {
+		t.Fatalf("expected the whole /64 banned")
+	}
+	if _, ok := b.Banned("2001:db8:0:1::1"); ok {
+		t.Fatalf("expected another /64 not to be banned")
+	}
+	if bans := b.Bans(); len(bans) != 1 || bans[0].Client != "2001:db8::/64" {
+		t.Fatalf("expected the network listed as the client, got %+v", bans)
+	}
+	if !b.Unban("2001:db8::/64") {
+		t.Fatalf("expected Unban of the listed network to lift the ban")
+	}
+
+	// Identities that are not addresses are not counted.
+	for range 5 {
+		b.observe("unknown", http.StatusUnauthorized)
+	}
+	if _, ok := b.Banned("unknown"); ok || len(b.clients) != 0 {
+		t.Fatalf("expected a client that is not an address to be ignored")
+	}
+}
+
+func TestBannerCapsClients(t *testing.T) {
+	clock := newFakeClock(time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC))
+	b := newTestBanner(t, clock, "")
+	opts := b.opts
+	opts.MaxClients = 2
+	b.SetOptions(opts)
+
+	b.observe("203.0.113.1", http.StatusUnauthorized)
+	b.observe("203.0.113.1", http.StatusUnauthorized)
+	b.observe("203.0.113.2", http.StatusUnauthorized)
+	b.observe("203.0.113.3", http.StatusUnauthorized)
+	if len(b.clients) != 2 {
+		t.Fatalf("expected 2 clients tracked, got %d", len(b.clients))
+	}
+	if _, ok := b.Banned("203.0.113.1"); !ok {
+		t.Fatalf("expected a banned client to be kept over the cap")
+	}
+	if b.clients["203.0.113.2"] != nil || b.clients["203.0.113.3"] == nil {
+		t.Fatalf("expected the client without a ban to make room")
+	}
+
+	// While every tracked client is banned, new ones are not counted.
+	b.observe("203.0.113.3", http.StatusUnauthorized)
+	b.observe("203.0.113.4", http.StatusUnauthorized)
+	b.observe("203.0.113.4", http.StatusUnauthorized)
+	if _, ok := b.Banned("203.0.113.4"); ok || len(b.clients) != 2 {
+		t.Fatalf("expected no room for another client while all are banned")
+	}
+}
+
+func TestBansSurviveRestart(t *testing.T) {
+	clock := newFakeClock(time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC))
+	path := filepath.Join(t.TempDir(), "bans.json")
+	b := newTestBanner(t, clock, path)
+	b.observe("203.0.113.7", http.StatusUnauthorized)
+	b.observe("203.0.113.7", http.StatusUnauthorized)
+
+	clock.Add(5 * time.Minute)
+	b = restart(t, b, func() *Banner { return newTestBanner(t, clock, path) })
+	if left, ok := b.Banned("203.0.113.7"); !ok || left != 5*time.Minute {
+		t.Fatalf("expected the ban to survive a restart with 5m left, got %v %v", left, ok)
+	}
+	clock.Add(5 * time.Minute)
+	b.observe("203.0.113.7", http.StatusUnauthorized)
+	b.observe("203.0.113.7", http.StatusUnauthorized)
+	if left, _ := b.Banned("203.0.113.7"); left != 20*time.Minute {
+		t.Fatalf("expected the saved ban to escalate the next, got %v", left)
+	}
+}
+
+func TestBanAbusersRefusesBannedClients(t *testing.T) {
+	clock := newFakeClock(time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC))
+	SetBanner(newTestBanner(t, clock, ""))
+	t.Cleanup(func() { SetBanner(nil) })
+	calls := 0
+	handler := BanAbusers(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/login", nil)
+		req.RemoteAddr = "203.0.113.7:40000"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	serve()
+	serve()
+	rr := serve()
+	if rr.Code != http.StatusForbidden || calls != 2 {
+		t.Fatalf("expected the third request to be refused with 403 after 2 calls, got %d after %d", rr.Code, calls)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "600" {
+		t.Fatalf("expected Retry-After 600, got %q", got)
+	}
+}
+
+func TestAdminAPIBans(t *testing.T) {
+	clock := newFakeClock(time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC))
+	b := newTestBanner(t, clock, "")
+	b.observe("2001:db8::1", http.StatusUnauthorized)
+	b.observe("2001:db8::1", http.StatusUnauthorized)
+	SetBanner(b)
+	SetAdminToken("secret")
+	t.Cleanup(func() {
+		SetBanner(nil)
+		SetAdminToken("")
+	})
+	api := AdminAPI()
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://example.com"+path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := serve(http.MethodGet, "/_admin/bans"); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 listing bans, got %d", rr.Code)
+	}
+	if rr := serve(http.MethodDelete, "/_admin/bans/2001:0db8::0001"); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 lifting a ban by a non-canonical address, got %d", rr.Code)
+	}
+	if rr := serve(http.MethodDelete, "/_admin/bans/2001:db8::1"); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a client not banned, got %d", rr.Code)
+	}
+
+	b.observe("2001:db8::1", http.StatusUnauthorized)
+	b.observe("2001:db8::1", http.StatusUnauthorized)
+	if rr := serve(http.MethodDelete, "/_admin/bans/2001:db8::%2F64"); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 lifting a ban by its network, got %d", rr.Code)
+	}
+}
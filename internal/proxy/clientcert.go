@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sargisis/edgecore/internal/router"
+)
+
+// Headers used to pass the verified client certificate to backends.
+const (
+	headerClientCertSubject     = "X-Client-Cert-Subject"
+	headerClientCertSANs        = "X-Client-Cert-SANs"
+	headerClientCertFingerprint = "X-Client-Cert-Fingerprint"
+)
+
+// clientCertificate returns the verified client certificate of r, if any.
+// Listeners with client authentication reject the handshake for certificates
+// that fail verification, so any peer certificate here has been verified.
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return r.TLS.PeerCertificates[0]
+}
+
+// certFingerprint returns the hex SHA-256 fingerprint of cert.
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// certSANs lists the subject alternative names of cert.
+func certSANs(cert *x509.Certificate) []string {
+	var sans []string
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
+
+// SetClientCertHeaders passes the verified client certificate's subject, SANs
+// and fingerprint to the backend. Values sent by the client are always
+// removed so they cannot be spoofed.
+func SetClientCertHeaders(pr *httputil.ProxyRequest) {
+	pr.Out.Header.Del(headerClientCertSubject)
+	pr.Out.Header.Del(headerClientCertSANs)
+	pr.Out.Header.Del(headerClientCertFingerprint)
+
+	cert := clientCertificate(pr.In)
+	if cert == nil {
+		return
+	}
+	pr.Out.Header.Set(headerClientCertSubject, cert.Subject.String())
+	if sans := certSANs(cert); len(sans) > 0 {
+		pr.Out.Header.Set(headerClientCertSANs, strings.Join(sans, ","))
+	}
+	pr.Out.Header.Set(headerClientCertFingerprint, certFingerprint(cert))
+}
+
+// RequireHostClientCert rejects requests that check, the client
+// authentication of the listener, refuses for their connection and Host;
+// see certs.Manager.CheckRequest.
+func RequireHostClientCert(check func(cs *tls.ConnectionState, host string) error, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := check(r.TLS, r.Host); err != nil {
+			atomic.AddUint64(&GlobalMetrics.ClientCertFailures, 1)
+			logEntry(LogEntry{Level: "warn", Message: "client certificate check failed", ClientIP: clientIP(r), SNI: r.TLS.ServerName, Error: err.Error()})
+			http.Error(w, "Client certificate required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireClientCert rejects requests to routes with RequireClientCert that
+// did not present a verified client certificate.
+func RequireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := router.FromContext(r.Context())
+		if route != nil && route.RequireClientCert && clientCertificate(r) == nil {
+			atomic.AddUint64(&GlobalMetrics.ClientCertFailures, 1)
+			http.Error(w, "Client certificate required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
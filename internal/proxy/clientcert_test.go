@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"testing"
+	"time"
+
+	"github.com/sargisis/edgecore/internal/router"
+)
+
+func newClientCert(t *testing.T) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(1),
+		Subject:        pkix.Name{CommonName: "svc-a", Organization: []string{"Example"}},
+		DNSNames:       []string{"svc-a.internal"},
+		EmailAddresses: []string{"ops@example.com"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func TestSetClientCertHeaders(t *testing.T) {
+	cert := newClientCert(t)
+
+	in := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	in.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	in.Header.Set(headerClientCertSubject, "CN=spoofed")
+	pr := &httputil.ProxyRequest{In: in, Out: in.Clone(in.Context())}
+
+	SetClientCertHeaders(pr)
+
+	if got := pr.Out.Header.Get(headerClientCertSubject); got != "CN=svc-a,O=Example" {
+		t.Fatalf("expected verified subject, got %q", got)
+	}
+	if got := pr.Out.Header.Get(headerClientCertSANs); got != "svc-a.internal,ops@example.com" {
+		t.Fatalf("expected SANs, got %q", got)
+	}
+	if got := pr.Out.Header.Get(headerClientCertFingerprint); got != certFingerprint(cert) || len(got) != 64 {
+		t.Fatalf("expected SHA-256 fingerprint, got %q", got)
+	}
+}
+
+func TestSetClientCertHeadersStripsSpoofedValues(t *testing.T) {
+	in := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	in.Header.Set(headerClientCertSubject, "CN=spoofed")
+	in.Header.Set(headerClientCertFingerprint, "deadbeef")
+	pr := &httputil.ProxyRequest{In: in, Out: in.Clone(in.Context())}
+
+	SetClientCertHeaders(pr)
+
+	if pr.Out.Header.Get(headerClientCertSubject) != "" || pr.Out.Header.Get(headerClientCertFingerprint) != "" {
+		t.Fatalf("expected client supplied certificate headers to be removed")
+	}
+}
+
+func TestRequireClientCert(t *testing.T) {
+	handler := RequireClientCert(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	route := &router.Route{Name: "internal", RequireClientCert: true}
+	before := GlobalMetrics.ClientCertFailures
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req = req.WithContext(router.WithRoute(req.Context(), route))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected request without client certificate to be rejected, got %d", rr.Code)
+	}
+	if GlobalMetrics.ClientCertFailures != before+1 {
+		t.Fatalf("expected failure to be counted")
+	}
+
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{newClientCert(t)}}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected request with client certificate to pass, got %d", rr.Code)
+	}
+}
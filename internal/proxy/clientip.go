@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sargisis/edgecore/internal/ipset"
+)
+
+// trustedProxies holds the CIDR ranges whose forwarding headers are believed.
+var trustedProxies atomic.Pointer[[]netip.Prefix]
+
+// clientIPHeader is the header trusted proxies report the client in.
+var clientIPHeader atomic.Pointer[string]
+
+func init() {
+	clientIPHeader.Store(new(string))
+}
+
+// SetClientIPHeader selects the header trusted proxies report the client
+// in: "x-forwarded-for" (the default when empty), "forwarded" or
+// "x-real-ip". The other headers are ignored: a proxy that only appends to
+// one of them passes the others on as the client sent them.
+func SetClientIPHeader(name string) {
+	clientIPHeader.Store(&name)
+}
+
+// SetTrustedProxies replaces the set of proxies allowed to report the client
+// address in the header chosen with SetClientIPHeader. Entries are CIDR
+// prefixes or single IP addresses.
+func SetTrustedProxies(cidrs []string) error {
+	prefixes, err := ParsePrefixes(cidrs)
+	if err != nil {
+		return err
+	}
+	trustedProxies.Store(&prefixes)
+	return nil
+}
+
+// ParsePrefixes parses a list of CIDR prefixes or single IP addresses.
+func ParsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, s := range cidrs {
+		p, err := ipset.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+// isTrustedProxy reports whether addr belongs to a trusted proxy range.
+func isTrustedProxy(addr netip.Addr) bool {
+	prefixes := trustedProxies.Load()
+	if prefixes == nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range *prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP determines the real client IP. The forwarding header is only
+// consulted when the direct peer is a trusted proxy; its hop chain is then
+// walked right to left and the first untrusted hop is the client, so values
+// prepended by the client itself are never believed. A hop that is not an
+// address, such as "unknown" or an obfuscated identifier, ends the walk at
+// the trusted proxy that passed it on: it may have been written by the
+// client, and is not fit to key rate limits, bans or access lists.
+func clientIP(r *http.Request) string {
+	remote := remoteAddr(r)
+	addr, err := netip.ParseAddr(remote)
+	if err != nil || !isTrustedProxy(addr) {
+		return remote
+	}
+
+	var hops []string
+	switch *clientIPHeader.Load() {
+	case "forwarded":
+		hops = forwardedForHops(r.Header)
+	case "x-real-ip":
+		if v := r.Header.Values("X-Real-IP"); len(v) > 0 {
+			hops = []string{strings.TrimSpace(v[len(v)-1])}
+		}
+	default:
+		hops = xForwardedForHops(r.Header)
+	}
+
+	client := addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := parseHop(hops[i])
+		if err != nil {
+			break
+		}
+		client = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return client.Unmap().String()
+}
+
+// remoteAddr returns the IP of the direct peer (RemoteAddr without the port).
+func remoteAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// xForwardedForHops returns the entries of all X-Forwarded-For headers in order.
+func xForwardedForHops(h http.Header) []string {
+	var hops []string
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, part := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(part))
+		}
+	}
+	return hops
+}
+
+// forwardedForHops returns the "for" parameters of all RFC 7239 Forwarded
+// elements in order.
+func forwardedForHops(h http.Header) []string {
+	var hops []string
+	for _, v := range h.Values("Forwarded") {
+		for _, element := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hops = append(hops, strings.Trim(value, `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// parseHop parses an address from a forwarding header, which may carry a
+// port and, for IPv6, brackets.
+func parseHop(s string) (netip.Addr, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr.Unmap(), nil
+	}
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), nil
+	}
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		if addr, err := netip.ParseAddr(s[1 : len(s)-1]); err == nil {
+			return addr.Unmap(), nil
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("invalid forwarded address %q", s)
+}
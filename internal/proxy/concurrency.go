@@ -0,0 +1,338 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sargisis/edgecore/internal/router"
+)
+
+// AdaptiveMode selects how a ConcurrencyLimiter adjusts its limit.
+type AdaptiveMode string
+
+const (
+	// AIMD grows the limit by one for every limit's worth of fast, healthy
+	// requests and cuts it by a tenth for each slow or failed one.
+	AIMD AdaptiveMode = "aimd"
+	// Gradient compares recent latency with the long-term latency and
+	// shrinks the limit as the ratio grows, as Netflix's Gradient2 does.
+	Gradient AdaptiveMode = "gradient"
+)
+
+// ConcurrencyOptions configure a ConcurrencyLimiter.
+type ConcurrencyOptions struct {
+	// Limit caps the requests in flight; with Adaptive it is the starting
+	// limit.
+	Limit int
+	// MaxQueue is how many requests may wait for a slot; beyond it they are
+	// shed at once.
+	MaxQueue int
+	// MaxWait sheds requests queued this long; zero means one second.
+	MaxWait time.Duration
+	// Adaptive adjusts the limit to observed latency; empty keeps it fixed.
+	Adaptive AdaptiveMode
+	// MinLimit and MaxLimit bound an adaptive limit; zero means 1 and 1000.
+	MinLimit int
+	MaxLimit int
+	// LatencyThreshold marks slower requests as overload for AIMD.
+	LatencyThreshold time.Duration
+}
+
+// ConcurrencyLimiter caps requests in flight and queues the excess for a
+// short while, so slow backends see a bounded load instead of a pile-up.
+type ConcurrencyLimiter struct {
+	opts ConcurrencyOptions
+
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+	// queue holds the waiting requests, highest priority first and oldest
+	// first within a priority.
+	queue list.List
+	// shortRTT and longRTT are the recent and long-term average latency in
+	// seconds, for Gradient.
+	shortRTT float64
+	longRTT  float64
+}
+
+// waiter is a request queued for a slot.
+type waiter struct {
+	priority Priority
+	// result receives "" when the request gets a slot, or the shed reason
+	// when a higher priority request takes its place in the queue.
+	result chan string
+}
+
+// Shed reasons, as used in metrics.
+const (
+	shedQueueFull = "queue_full"
+	shedTimeout   = "timeout"
+	shedPressure  = "pressure"
+)
+
+// NewConcurrencyLimiter returns a limiter with the given options.
+func NewConcurrencyLimiter(opts ConcurrencyOptions) *ConcurrencyLimiter {
+	if opts.MaxWait == 0 {
+		opts.MaxWait = time.Second
+	}
+	if opts.MinLimit == 0 {
+		opts.MinLimit = 1
+	}
+	if opts.MaxLimit == 0 {
+		opts.MaxLimit = 1000
+	}
+	return &ConcurrencyLimiter{opts: opts, limit: float64(max(1, opts.Limit))}
+}
+
+// Limit returns the current limit.
+func (c *ConcurrencyLimiter) Limit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.current()
+}
+
+// InFlight returns the number of requests holding a slot.
+func (c *ConcurrencyLimiter) InFlight() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inflight
+}
+
+// current is the limit as a whole number of requests; the caller holds
+// c.mu.
+func (c *ConcurrencyLimiter) current() int {
+	return max(1, int(c.limit))
+}
+
+// acquire takes a slot, waiting in the queue if there is room. A full
+// queue makes room for a request by shedding the newest of its lowest
+// priority requests, if that is below the request's priority. It returns
+// the shed reason if the request did not get a slot.
+func (c *ConcurrencyLimiter) acquire(ctx context.Context) string {
+	w := &waiter{priority: PriorityFromContext(ctx), result: make(chan string, 1)}
+	c.mu.Lock()
+	if c.inflight < c.current() && c.queue.Len() == 0 {
+		c.inflight++
+		c.mu.Unlock()
+		return ""
+	}
+	if c.queue.Len() >= c.opts.MaxQueue {
+		last := c.queue.Back()
+		if last == nil || last.Value.(*waiter).priority >= w.priority {
+			c.mu.Unlock()
+			return shedQueueFull
+		}
+		c.queue.Remove(last).(*waiter).result <- shedQueueFull
+	}
+	el := c.enqueue(w)
+	c.mu.Unlock()
+
+	t := time.NewTimer(c.opts.MaxWait)
+	defer t.Stop()
+	select {
+	case reason := <-w.result:
+		return reason
+	case <-t.C:
+	case <-ctx.Done():
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case reason := <-w.result:
+		// Decided while giving up; a slot must be used.
+		return reason
+	default:
+		c.queue.Remove(el)
+		return shedTimeout
+	}
+}
+
+// enqueue queues w behind the requests of its priority and above; the
+// caller holds c.mu.
+func (c *ConcurrencyLimiter) enqueue(w *waiter) *list.Element {
+	for e := c.queue.Back(); e != nil; e = e.Prev() {
+		if e.Value.(*waiter).priority >= w.priority {
+			return c.queue.InsertAfter(w, e)
+		}
+	}
+	return c.queue.PushFront(w)
+}
+
+// release frees a slot and hands it to the oldest waiting request.
+func (c *ConcurrencyLimiter) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inflight--
+	c.grant()
+}
+
+// grant hands free slots to waiting requests; the caller holds c.mu.
+func (c *ConcurrencyLimiter) grant() {
+	for c.inflight < c.current() && c.queue.Len() > 0 {
+		c.queue.Remove(c.queue.Front()).(*waiter).result <- ""
+		c.inflight++
+	}
+}
+
+// observe feeds the latency of a finished request to an adaptive limit.
+// dropped marks requests the backend failed to serve. It must be called
+// before the request's slot is released.
+func (c *ConcurrencyLimiter) observe(latency time.Duration, dropped bool) {
+	if c.opts.Adaptive == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.opts.Adaptive {
+	case AIMD:
+		if dropped || latency > c.opts.LatencyThreshold {
+			c.limit *= 0.9
+		} else if c.inflight*2 >= c.current() {
+			// Only grow while the limit is actually used.
+			c.limit += 1 / c.limit
+		}
+	case Gradient:
+		rtt := latency.Seconds()
+		if c.longRTT == 0 {
+			c.shortRTT, c.longRTT = rtt, rtt
+		}
+		c.shortRTT += (rtt - c.shortRTT) * 2 / 11
+		c.longRTT += (rtt - c.longRTT) * 2 / 601
+		// Let the baseline follow a lasting drop in latency quickly.
+		if c.longRTT/c.shortRTT > 2 {
+			c.longRTT *= 0.95
+		}
+		if c.inflight*2 < c.current() {
+			return
+		}
+		gradient := max(0.5, min(1, 1.5*c.longRTT/c.shortRTT))
+		next := c.limit*gradient + math.Sqrt(c.limit)
+		c.limit = c.limit*0.8 + next*0.2
+	}
+	c.limit = max(float64(c.opts.MinLimit), min(float64(c.opts.MaxLimit), c.limit))
+	c.grant()
+}
+
+// ConcurrencyLimits are the limiters applied by ConcurrencyLimit.
+type ConcurrencyLimits struct {
+	// Routes are keyed by route name.
+	Routes map[string]*ConcurrencyLimiter
+	// Pools are keyed by pool name. DefaultPool names the pool serving
+	// routes without one and requests matching no route.
+	Pools       map[string]*ConcurrencyLimiter
+	DefaultPool string
+}
+
+var concurrencyLimits atomic.Pointer[ConcurrencyLimits]
+
+func init() {
+	concurrencyLimits.Store(&ConcurrencyLimits{})
+}
+
+// SetConcurrencyLimits replaces the limiters applied by ConcurrencyLimit.
+// Requests in flight release the limiters they acquired.
+func SetConcurrencyLimits(limits ConcurrencyLimits) {
+	concurrencyLimits.Store(&limits)
+}
+
+// ConcurrencyLimit caps the requests in flight per route and per pool.
+// Requests beyond a limit wait in its queue, higher priorities first; those
+// that find it full or wait too long are shed with 503. WebSocket sessions
+// are not counted: they hold a connection for hours and are capped per
+// client instead.
+func ConcurrencyLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := router.FromContext(r.Context())
+		limiters := concurrencyLimits.Load().forRoute(route)
+		if len(limiters) == 0 || IsWebSocketUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		for i, l := range limiters {
+			if reason := l.acquire(r.Context()); reason != "" {
+				for _, held := range limiters[:i] {
+					held.release()
+				}
+				shed(w, r, reason, l.opts.MaxWait)
+				return
+			}
+		}
+
+		// The reverse proxy panics to abort broken responses; the slots
+		// must be released all the same.
+		defer func() {
+			for _, l := range limiters {
+				l.release()
+			}
+		}()
+
+		start := time.Now()
+		rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(rw, r)
+		latency := time.Since(start)
+
+		// A streamed response lasts as long as the client listens; its
+		// duration says nothing about backend load.
+		if route != nil && route.Streaming {
+			return
+		}
+		dropped := rw.statusCode == http.StatusBadGateway || rw.statusCode == http.StatusServiceUnavailable ||
+			rw.statusCode == http.StatusGatewayTimeout
+		if router.IsGRPC(r) {
+			code := grpcStatus(rw.Header(), rw.statusCode)
+			dropped = code == GRPCUnavailable || code == GRPCDeadlineExceeded
+		}
+		for _, l := range limiters {
+			l.observe(latency, dropped)
+		}
+	})
+}
+
+// forRoute returns the limiters applying to requests on route, which may
+// be nil.
+func (cl *ConcurrencyLimits) forRoute(route *router.Route) []*ConcurrencyLimiter {
+	var limiters []*ConcurrencyLimiter
+	pool := cl.DefaultPool
+	if route != nil {
+		if l := cl.Routes[route.Name]; l != nil && route.Name != "" {
+			limiters = append(limiters, l)
+		}
+		if route.Pool != "" {
+			pool = route.Pool
+		}
+	}
+	if l := cl.Pools[pool]; l != nil {
+		limiters = append(limiters, l)
+	}
+	return limiters
+}
+
+// shed answers a request that got no slot with 503, or UNAVAILABLE for
+// gRPC, and asks the client to come back after wait.
+func shed(w http.ResponseWriter, r *http.Request, reason string, wait time.Duration) {
+	switch reason {
+	case shedQueueFull:
+		atomic.AddUint64(&GlobalMetrics.ShedQueueFull, 1)
+	case shedTimeout:
+		atomic.AddUint64(&GlobalMetrics.ShedTimeout, 1)
+	case shedPressure:
+		atomic.AddUint64(&GlobalMetrics.ShedPressure, 1)
+	}
+	atomic.AddUint64(&GlobalMetrics.ShedByPriority[PriorityFromContext(r.Context())], 1)
+
+	w.Header().Set("Retry-After", strconv.FormatInt(max(1, ceilSeconds(wait)), 10))
+	if router.IsGRPC(r) {
+		GRPCError(w, GRPCUnavailable, "server overloaded")
+		return
+	}
+	http.Error(w, "Server overloaded", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,234 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sargisis/edgecore/internal/router"
+)
+
+// withConcurrencyLimits installs limits for the duration of a test.
+func withConcurrencyLimits(t *testing.T, limits ConcurrencyLimits) {
+	t.Helper()
+
+	SetConcurrencyLimits(limits)
+	t.Cleanup(func() { SetConcurrencyLimits(ConcurrencyLimits{}) })
+}
+
+func TestConcurrencyLimitQueuesAndSheds(t *testing.T) {
+	limiter := NewConcurrencyLimiter(ConcurrencyOptions{Limit: 1, MaxQueue: 1, MaxWait: 5 * time.Second})
+	withConcurrencyLimits(t, ConcurrencyLimits{Pools: map[string]*ConcurrencyLimiter{"default": limiter}, DefaultPool: "default"})
+	queueFull := atomic.LoadUint64(&GlobalMetrics.ShedQueueFull)
+
+	unblock := make(chan struct{})
+	handler := ConcurrencyLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-unblock
+		}
+	}))
+	serve := func(path string) <-chan int {
+		done := make(chan int, 1)
+		go func() {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil))
+			done <- rr.Code
+		}()
+		return done
+	}
+	waitFor := func(cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for the limiter")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	queued := func() int {
+		limiter.mu.Lock()
+		defer limiter.mu.Unlock()
+		return limiter.queue.Len()
+	}
+
+	slow := serve("/slow")
+	waitFor(func() bool { return limiter.InFlight() == 1 })
+	waiting := serve("/fast")
+	waitFor(func() bool { return queued() == 1 })
+
+	if code := <-serve("/fast"); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 with a full queue, got %d", code)
+	}
+	if got := atomic.LoadUint64(&GlobalMetrics.ShedQueueFull) - queueFull; got != 1 {
+		t.Fatalf("expected 1 request shed for a full queue, got %d", got)
+	}
+
+	close(unblock)
+	if code := <-slow; code != http.StatusOK {
+		t.Fatalf("expected slow request to succeed, got %d", code)
+	}
+	if code := <-waiting; code != http.StatusOK {
+		t.Fatalf("expected queued request to get the freed slot, got %d", code)
+	}
+	if got := limiter.InFlight(); got != 0 {
+		t.Fatalf("expected no requests in flight, got %d", got)
+	}
+}
+
+func TestConcurrencyLimiterShedsAfterMaxWait(t *testing.T) {
+	l := NewConcurrencyLimiter(ConcurrencyOptions{Limit: 1, MaxQueue: 1, MaxWait: 20 * time.Millisecond})
+	if reason := l.acquire(context.Background()); reason != "" {
+		t.Fatalf("expected first request to get a slot, got %q", reason)
+	}
+	start := time.Now()
+	if reason := l.acquire(context.Background()); reason != shedTimeout {
+		t.Fatalf("expected queued request to time out, got %q", reason)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Fatalf("expected request to wait the maximum wait, waited %v", d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if reason := l.acquire(ctx); reason != shedTimeout {
+		t.Fatalf("expected canceled request to leave the queue, got %q", reason)
+	}
+	l.release()
+	if got := l.InFlight(); got != 0 {
+		t.Fatalf("expected abandoned waiters to hold no slots, got %d in flight", got)
+	}
+}
+
+func TestConcurrencyLimitReleasesOnAbort(t *testing.T) {
+	limiter := NewConcurrencyLimiter(ConcurrencyOptions{Limit: 1})
+	withConcurrencyLimits(t, ConcurrencyLimits{Routes: map[string]*ConcurrencyLimiter{"api": limiter}})
+
+	handler := ConcurrencyLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	req = req.WithContext(router.WithRoute(req.Context(), &router.Route{Name: "api"}))
+	func() {
+		defer func() { recover() }()
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	if got := limiter.InFlight(); got != 0 {
+		t.Fatalf("expected aborted request to release its slot, got %d in flight", got)
+	}
+}
+
+func TestConcurrencyLimitsForRoute(t *testing.T) {
+	api := NewConcurrencyLimiter(ConcurrencyOptions{Limit: 1})
+	def := NewConcurrencyLimiter(ConcurrencyOptions{Limit: 1})
+	slow := NewConcurrencyLimiter(ConcurrencyOptions{Limit: 1})
+	cl := &ConcurrencyLimits{
+		Routes:      map[string]*ConcurrencyLimiter{"api": api},
+		Pools:       map[string]*ConcurrencyLimiter{"default": def, "slow": slow},
+		DefaultPool: "default",
+	}
+
+	if got := cl.forRoute(nil); len(got) != 1 || got[0] != def {
+		t.Fatalf("expected unrouted requests limited by the default pool, got %v", got)
+	}
+	if got := cl.forRoute(&router.Route{Name: "api", Pool: "slow"}); len(got) != 2 || got[0] != api || got[1] != slow {
+		t.Fatalf("expected route and pool limits, got %v", got)
+	}
+	if got := cl.forRoute(&router.Route{Name: "web", Pool: "fast"}); len(got) != 0 {
+		t.Fatalf("expected no limits for an unlimited route and pool, got %v", got)
+	}
+}
+
+func TestAIMDLimitFollowsLatency(t *testing.T) {
+	l := NewConcurrencyLimiter(ConcurrencyOptions{Limit: 10, Adaptive: AIMD, LatencyThreshold: 100 * time.Millisecond})
+	l.inflight = 10
+
+	for range 50 {
+		l.observe(10*time.Millisecond, false)
+	}
+	grown := l.Limit()
+	if grown <= 10 {
+		t.Fatalf("expected fast requests at the limit to raise it, got %d", grown)
+	}
+
+	for range 5 {
+		l.observe(500*time.Millisecond, false)
+	}
+	if got := l.Limit(); got >= grown*3/4 {
+		t.Fatalf("expected slow requests to cut the limit from %d, got %d", grown, got)
+	}
+
+	for range 100 {
+		l.observe(10*time.Millisecond, true)
+	}
+	if got := l.Limit(); got != 1 {
+		t.Fatalf("expected failures to drive the limit to its minimum, got %d", got)
+	}
+}
+
+func TestGradientLimitFollowsLatency(t *testing.T) {
+	l := NewConcurrencyLimiter(ConcurrencyOptions{Limit: 20, Adaptive: Gradient, MaxLimit: 100})
+	// Keep the limit in use; otherwise samples carry no information.
+	l.inflight = 100
+
+	for range 200 {
+		l.observe(10*time.Millisecond, false)
+	}
+	steady := l.Limit()
+	if steady <= 20 {
+		t.Fatalf("expected steady latency to let the limit grow, got %d", steady)
+	}
+
+	for range 50 {
+		l.observe(100*time.Millisecond, false)
+	}
+	if got := l.Limit(); got >= steady/2 {
+		t.Fatalf("expected a latency rise to cut the limit from %d, got %d", steady, got)
+	}
+}
+
+func TestConcurrencyLimiterShedsLowerPriorityFirst(t *testing.T) {
+	l := NewConcurrencyLimiter(ConcurrencyOptions{Limit: 1, MaxQueue: 2, MaxWait: 5 * time.Second})
+	if reason := l.acquire(context.Background()); reason != "" {
+		t.Fatalf("expected first request to get a slot, got %q", reason)
+	}
+	queued := func() int {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.queue.Len()
+	}
+	wait := func(p Priority) <-chan string {
+		done := make(chan string, 1)
+		n := queued()
+		go func() { done <- l.acquire(WithPriority(context.Background(), p)) }()
+		for queued() == n {
+			time.Sleep(time.Millisecond)
+		}
+		return done
+	}
+
+	low := wait(PriorityLow)
+	normal := wait(PriorityNormal)
+	if reason := l.acquire(WithPriority(context.Background(), PriorityLow)); reason != shedQueueFull {
+		t.Fatalf("expected low priority request shed by a full queue, got %q", reason)
+	}
+
+	// A high priority request takes the low priority request's place and
+	// gets the next slot.
+	done := make(chan string, 1)
+	go func() { done <- l.acquire(WithPriority(context.Background(), PriorityHigh)) }()
+	if reason := <-low; reason != shedQueueFull {
+		t.Fatalf("expected queued low priority request shed, got %q", reason)
+	}
+	l.release()
+	if reason := <-done; reason != "" {
+		t.Fatalf("expected high priority request to get the freed slot, got %q", reason)
+	}
+	l.release()
+	if reason := <-normal; reason != "" {
+		t.Fatalf("expected normal priority request to get the next slot, got %q", reason)
+	}
+}
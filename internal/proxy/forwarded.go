@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// ForwardingPolicy decides how forwarding headers are written to upstream requests.
+type ForwardingPolicy struct {
+	// TrustIncoming keeps X-Forwarded-* and Forwarded values sent by the
+	// client and appends this hop to them. Otherwise they are overwritten.
+	TrustIncoming bool
+	// Forwarded emits the RFC 7239 Forwarded header alongside X-Forwarded-*.
+	Forwarded bool
+}
+
+type forwardingPolicyKey struct{}
+
+// WithForwarding attaches a forwarding policy to every request handled by next,
+// so each listener can use its own policy with the shared backends.
+func WithForwarding(policy ForwardingPolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), forwardingPolicyKey{}, policy)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// SetForwardedHeaders writes X-Forwarded-For, X-Forwarded-Proto,
+// X-Forwarded-Host, X-Forwarded-Port and optionally Forwarded on the outbound
+// request. It is meant to be called from httputil.ReverseProxy.Rewrite, which
+// has already stripped the X-Forwarded-* headers from pr.Out.
+func SetForwardedHeaders(pr *httputil.ProxyRequest) {
+	policy, _ := pr.In.Context().Value(forwardingPolicyKey{}).(ForwardingPolicy)
+	in, out := pr.In, pr.Out
+
+	client, _, err := net.SplitHostPort(in.RemoteAddr)
+	if err != nil {
+		client = in.RemoteAddr
+	}
+	proto := "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+	port := requestPort(in, proto)
+
+	xff := client
+	if prior := in.Header.Values("X-Forwarded-For"); policy.TrustIncoming && len(prior) > 0 {
+		xff = strings.Join(prior, ", ") + ", " + client
+	}
+	out.Header.Set("X-Forwarded-For", xff)
+
+	setForwarded := func(name, value string) {
+		if policy.TrustIncoming {
+			if prior := in.Header.Get(name); prior != "" {
+				value = prior
+			}
+		}
+		out.Header.Set(name, value)
+	}
+	setForwarded("X-Forwarded-Proto", proto)
+	setForwarded("X-Forwarded-Host", in.Host)
+	setForwarded("X-Forwarded-Port", port)
+
+	if !policy.TrustIncoming {
+		out.Header.Del("Forwarded")
+	}
+	if policy.Forwarded {
+		element := "for=" + forwardedNode(client) +
+			";host=" + forwardedValue(in.Host) +
+			";proto=" + proto
+		if prior := out.Header.Values("Forwarded"); len(prior) > 0 {
+			element = strings.Join(prior, ", ") + ", " + element
+		}
+		out.Header.Set("Forwarded", element)
+	}
+}
+
+// requestPort returns the port the client connected to, taken from the Host
+// header, the accepting listener, or the scheme default.
+func requestPort(r *http.Request, proto string) string {
+	if _, port, err := net.SplitHostPort(r.Host); err == nil && port != "" {
+		return port
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+			return port
+		}
+	}
+	if proto == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// forwardedNode formats an IP address as an RFC 7239 node; IPv6 addresses
+// must be bracketed and quoted.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return forwardedValue(ip)
+}
+
+// forwardedValue quotes v unless it is a valid RFC 7230 token.
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !isTokenChar(c) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
+
+func isTokenChar(c rune) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"testing"
+)
+
+func newProxyRequest(t *testing.T, policy ForwardingPolicy, header http.Header) *httputil.ProxyRequest {
+	t.Helper()
+
+	in := httptest.NewRequest(http.MethodGet, "http://example.com:8080/path", nil)
+	in.RemoteAddr = "192.0.2.1:1234"
+	for k, v := range header {
+		in.Header[k] = v
+	}
+	in = in.WithContext(context.WithValue(in.Context(), forwardingPolicyKey{}, policy))
+
+	// Mirror httputil.ReverseProxy, which strips X-Forwarded-* before Rewrite.
+	out := in.Clone(in.Context())
+	out.Header.Del("X-Forwarded-For")
+	out.Header.Del("X-Forwarded-Host")
+	out.Header.Del("X-Forwarded-Proto")
+	return &httputil.ProxyRequest{In: in, Out: out}
+}
+
+func TestSetForwardedHeadersOverwrite(t *testing.T) {
+	pr := newProxyRequest(t, ForwardingPolicy{}, http.Header{
+		"X-Forwarded-For":   {"203.0.113.9"},
+		"X-Forwarded-Proto": {"https"},
+		"X-Forwarded-Port":  {"443"},
+		"Forwarded":         {"for=203.0.113.9"},
+	})
+
+	SetForwardedHeaders(pr)
+
+	want := map[string]string{
+		"X-Forwarded-For":   "192.0.2.1",
+		"X-Forwarded-Proto": "http",
+		"X-Forwarded-Host":  "example.com:8080",
+		"X-Forwarded-Port":  "8080",
+		"Forwarded":         "",
+	}
+	for name, value := range want {
+		if got := pr.Out.Header.Get(name); got != value {
+			t.Errorf("expected %s to be %q, got %q", name, value, got)
+		}
+	}
+}
+
+func TestSetForwardedHeadersTrustIncoming(t *testing.T) {
+	pr := newProxyRequest(t, ForwardingPolicy{TrustIncoming: true, Forwarded: true}, http.Header{
+		"X-Forwarded-For":   {"203.0.113.9"},
+		"X-Forwarded-Proto": {"https"},
+		"Forwarded":         {"for=203.0.113.9;proto=https"},
+	})
+
+	SetForwardedHeaders(pr)
+
+	if got := pr.Out.Header.Get("X-Forwarded-For"); got != "203.0.113.9, 192.0.2.1" {
+		t.Fatalf("expected X-Forwarded-For to be appended, got %q", got)
+	}
+	if got := pr.Out.Header.Get("X-Forwarded-Proto"); got != "https" {
+		t.Fatalf("expected incoming X-Forwarded-Proto to be kept, got %q", got)
+	}
+	want := `for=203.0.113.9;proto=https, for=192.0.2.1;host="example.com:8080";proto=http`
+	if got := pr.Out.Header.Get("Forwarded"); got != want {
+		t.Fatalf("expected Forwarded %q, got %q", want, got)
+	}
+}
+
+func TestForwardedNodeIPv6(t *testing.T) {
+	if got := forwardedNode("2001:db8::1"); got != `"[2001:db8::1]"` {
+		t.Fatalf("expected quoted and bracketed IPv6 node, got %q", got)
+	}
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+)
+
+// gRPC status codes used by edgecore itself.
+const (
+	GRPCDeadlineExceeded  = 4
+	GRPCPermissionDenied  = 7
+	GRPCResourceExhausted = 8
+	GRPCUnavailable       = 14
+)
+
+// grpcCodeNames are the canonical names of gRPC status codes, used as
+// metric labels.
+var grpcCodeNames = []string{
+	"OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED",
+	"NOT_FOUND", "ALREADY_EXISTS", "PERMISSION_DENIED", "RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION", "ABORTED", "OUT_OF_RANGE", "UNIMPLEMENTED",
+	"INTERNAL", "UNAVAILABLE", "DATA_LOSS", "UNAUTHENTICATED",
+}
+
+// grpcResponses counts gRPC responses by status code.
+var grpcResponses = make([]uint64, len(grpcCodeNames))
+
+// grpcStatus returns the gRPC status of a finished response. It is taken
+// from the grpc-status trailer (or header, for trailers-only responses);
+// without one the HTTP status is mapped as gRPC clients do.
+func grpcStatus(h http.Header, httpStatus int) int {
+	for _, key := range []string{"Grpc-Status", http.TrailerPrefix + "Grpc-Status"} {
+		if v := h.Get(key); v != "" {
+			if code, err := strconv.Atoi(v); err == nil && code >= 0 && code < len(grpcCodeNames) {
+				return code
+			}
+			return 2 // UNKNOWN
+		}
+	}
+
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return 13 // INTERNAL
+	case http.StatusUnauthorized:
+		return 16 // UNAUTHENTICATED
+	case http.StatusForbidden:
+		return 7 // PERMISSION_DENIED
+	case http.StatusNotFound:
+		return 12 // UNIMPLEMENTED
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return GRPCUnavailable
+	default:
+		return 2 // UNKNOWN
+	}
+}
+
+func recordGRPCStatus(code int) {
+	atomic.AddUint64(&grpcResponses[code], 1)
+}
+
+// GRPCError answers a gRPC call with a trailers-only response carrying
+// code and msg, so clients see a proper gRPC status instead of a bare HTTP
+// error.
+func GRPCError(w http.ResponseWriter, code int, msg string) {
+	h := w.Header()
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		h.Set("Grpc-Message", grpcMessage(msg))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcMessage percent-encodes msg for the grpc-message header.
+func grpcMessage(msg string) string {
+	return url.PathEscape(msg)
+}
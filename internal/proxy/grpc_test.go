@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// startH2C starts a test server that only speaks cleartext HTTP/2.
+func startH2C(t *testing.T, h http.Handler) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewUnstartedServer(h)
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func h2cTransport() *http.Transport {
+	tr := &http.Transport{Protocols: new(http.Protocols)}
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	return tr
+}
+
+func TestLoggerProxiesGRPCTrailers(t *testing.T) {
+	// The backend sends undeclared trailers, as gRPC servers do.
+	backend := startH2C(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write([]byte{0, 0, 0, 0, 0})
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "5")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "not found")
+	}))
+	target, _ := url.Parse(backend.URL)
+	rp := &httputil.ReverseProxy{
+		Rewrite:   func(pr *httputil.ProxyRequest) { pr.SetURL(target) },
+		Transport: h2cTransport(),
+	}
+	front := startH2C(t, Logger(rp))
+
+	before := atomic.LoadUint64(&grpcResponses[5])
+	req, _ := http.NewRequest(http.MethodPost, front.URL+"/helloworld.Greeter/SayHello", strings.NewReader("\x00\x00\x00\x00\x00"))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := h2cTransport().RoundTrip(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if got := resp.Trailer.Get("Grpc-Status"); got != "5" {
+		t.Fatalf("expected grpc-status trailer 5, got %q", got)
+	}
+	if got := resp.Trailer.Get("Grpc-Message"); got != "not found" {
+		t.Fatalf("expected grpc-message trailer, got %q", got)
+	}
+	if got := atomic.LoadUint64(&grpcResponses[5]) - before; got != 1 {
+		t.Fatalf("expected one NOT_FOUND response counted, got %d", got)
+	}
+}
+
+func TestGRPCStatusFromHTTPStatus(t *testing.T) {
+	cases := map[int]int{
+		http.StatusOK:                 2,
+		http.StatusForbidden:          7,
+		http.StatusTooManyRequests:    GRPCUnavailable,
+		http.StatusServiceUnavailable: GRPCUnavailable,
+	}
+	for httpStatus, want := range cases {
+		if got := grpcStatus(http.Header{}, httpStatus); got != want {
+			t.Errorf("HTTP %d: expected gRPC code %d, got %d", httpStatus, want, got)
+		}
+	}
+}
+
+func TestGRPCError(t *testing.T) {
+	rr := httptest.NewRecorder()
+	GRPCError(rr, GRPCUnavailable, "no backend available")
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rr.Code)
+	}
+	if got := rr.Header().Get("Grpc-Status"); got != "14" {
+		t.Fatalf("expected grpc-status 14, got %q", got)
+	}
+	if got := rr.Header().Get("Grpc-Message"); got != "no%20backend%20available" {
+		t.Fatalf("expected percent-encoded grpc-message, got %q", got)
+	}
+}
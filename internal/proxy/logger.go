@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -28,17 +29,29 @@ func SetLogFormat(format LogFormat) {
 
 // LogEntry represents a structured log entry.
 type LogEntry struct {
-	Time      string  `json:"time"`
-	Level     string  `json:"level"`
-	Message   string  `json:"message,omitempty"`
-	ClientIP  string  `json:"client_ip,omitempty"`
-	Method    string  `json:"method,omitempty"`
-	Path      string  `json:"path,omitempty"`
-	Status    int     `json:"status,omitempty"`
-	Duration  float64 `json:"duration_seconds,omitempty"`
-	RequestID string  `json:"request_id,omitempty"`
-	Backend   string  `json:"backend,omitempty"`
-	Error     string  `json:"error,omitempty"`
+	Time                  string  `json:"time"`
+	Level                 string  `json:"level"`
+	Message               string  `json:"message,omitempty"`
+	ClientIP              string  `json:"client_ip,omitempty"`
+	Method                string  `json:"method,omitempty"`
+	Path                  string  `json:"path,omitempty"`
+	Status                int     `json:"status,omitempty"`
+	GRPCStatus            string  `json:"grpc_status,omitempty"`
+	Duration              float64 `json:"duration_seconds,omitempty"`
+	RequestID             string  `json:"request_id,omitempty"`
+	Backend               string  `json:"backend,omitempty"`
+	SNI                   string  `json:"sni,omitempty"`
+	BytesIn               int64   `json:"bytes_in,omitempty"`
+	BytesOut              int64   `json:"bytes_out,omitempty"`
+	ClientCertSubject     string  `json:"client_cert_subject,omitempty"`
+	ClientCertFingerprint string  `json:"client_cert_fingerprint,omitempty"`
+	Error                 string  `json:"error,omitempty"`
+}
+
+// Log writes entry in the configured format. It is used by the layer-4
+// proxies, which have no HTTP request to log.
+func Log(entry LogEntry) {
+	logEntry(entry)
 }
 
 // logEntry writes a structured log entry.
@@ -54,21 +67,43 @@ func logEntry(entry LogEntry) {
 		fmt.Fprintln(os.Stderr, string(data))
 	} else {
 		// Pretty format for development
-		if entry.RequestID != "" {
+		if entry.Message != "" && entry.ClientIP != "" {
+			// Connection-level entries (WebSocket sessions, TCP connections).
+			log.Printf("[%s] %s (client: %s, %sbackend: %s, duration: %.3fs, in: %dB, out: %dB%s)",
+				entry.Level, strings.TrimSpace(entry.Message+" "+entry.Path), entry.ClientIP, sniText(entry.SNI),
+				entry.Backend, entry.Duration, entry.BytesIn, entry.BytesOut, errorText(entry.Error))
+		} else if entry.RequestID != "" {
 			log.Printf("[%s] %s %s %s (client: %s, duration: %.3fs, request_id: %s)",
 				entry.Level, entry.Method, entry.Path,
-				statusText(entry.Status), entry.ClientIP, entry.Duration, entry.RequestID)
+				statusText(entry.Status, entry.GRPCStatus), entry.ClientIP, entry.Duration, entry.RequestID)
 		} else if entry.Message != "" {
-			log.Printf("[%s] %s", entry.Level, entry.Message)
+			log.Printf("[%s] %s%s", entry.Level, entry.Message, errorText(entry.Error))
 		} else {
 			log.Printf("[%s] %s", entry.Level, entry.Message)
 		}
 	}
 }
 
-func statusText(status int) string {
+func errorText(err string) string {
+	if err == "" {
+		return ""
+	}
+	return ", error: " + err
+}
+
+func sniText(sni string) string {
+	if sni == "" {
+		return ""
+	}
+	return "sni: " + sni + ", "
+}
+
+func statusText(status int, grpcStatus string) string {
 	if status == 0 {
 		return ""
 	}
+	if grpcStatus != "" {
+		return fmt.Sprintf("status=%d grpc_status=%s", status, grpcStatus)
+	}
 	return fmt.Sprintf("status=%d", status)
 }
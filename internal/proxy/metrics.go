@@ -2,10 +2,25 @@ package proxy
 
 import (
 	"fmt"
+	"io"
 	"net/http"
+	"sort"
+	"strings"
 	"sync/atomic"
+	"time"
+
+	"github.com/sargisis/edgecore/internal/backend"
+	"github.com/sargisis/edgecore/internal/certs"
 )
 
+// backendLister returns the backends of every pool keyed by pool name.
+var backendLister func() map[string][]*backend.Backend
+
+// SetBackendLister registers the source of per-backend metrics.
+func SetBackendLister(f func() map[string][]*backend.Backend) {
+	backendLister = f
+}
+
 // PrometheusMetrics exposes metrics in Prometheus format
 func PrometheusMetrics(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
@@ -18,6 +33,185 @@ func PrometheusMetrics(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "# TYPE edgecore_rate_limited_total counter\n")
 	fmt.Fprintf(w, "edgecore_rate_limited_total %d\n", atomic.LoadUint64(&GlobalMetrics.RateLimited))
 
+	fmt.Fprintf(w, "# HELP edgecore_rate_limiter_keys Keys (client IPs, API keys, ...) tracked by rate limiters\n")
+	fmt.Fprintf(w, "# TYPE edgecore_rate_limiter_keys gauge\n")
+	fmt.Fprintf(w, "edgecore_rate_limiter_keys %d\n", trackedRateLimitKeys())
+
+	fmt.Fprintf(w, "# HELP edgecore_rate_limiter_evictions_total Rate limiter buckets evicted, by reason\n")
+	fmt.Fprintf(w, "# TYPE edgecore_rate_limiter_evictions_total counter\n")
+	fmt.Fprintf(w, "edgecore_rate_limiter_evictions_total{reason=\"idle\"} %d\n", atomic.LoadUint64(&GlobalMetrics.RateLimiterEvictedIdle))
+	fmt.Fprintf(w, "edgecore_rate_limiter_evictions_total{reason=\"capacity\"} %d\n", atomic.LoadUint64(&GlobalMetrics.RateLimiterEvictedLRU))
+
+	fmt.Fprintf(w, "# HELP edgecore_rate_limit_store_requests_total Round trips to the shared rate limit store\n")
+	fmt.Fprintf(w, "# TYPE edgecore_rate_limit_store_requests_total counter\n")
+	fmt.Fprintf(w, "edgecore_rate_limit_store_requests_total %d\n", atomic.LoadUint64(&GlobalMetrics.RateLimitStoreRequests))
+
+	fmt.Fprintf(w, "# HELP edgecore_rate_limit_store_errors_total Failed round trips to the shared rate limit store\n")
+	fmt.Fprintf(w, "# TYPE edgecore_rate_limit_store_errors_total counter\n")
+	fmt.Fprintf(w, "edgecore_rate_limit_store_errors_total %d\n", atomic.LoadUint64(&GlobalMetrics.RateLimitStoreErrors))
+
+	fmt.Fprintf(w, "# HELP edgecore_rate_limit_rule_rejected_total Requests rejected by each rate limit rule\n")
+	fmt.Fprintf(w, "# TYPE edgecore_rate_limit_rule_rejected_total counter\n")
+	ruleCounts := ruleRejectionCounts()
+	ruleNames := make([]string, 0, len(ruleCounts))
+	for name := range ruleCounts {
+		ruleNames = append(ruleNames, name)
+	}
+	sort.Strings(ruleNames)
+	for _, name := range ruleNames {
+		fmt.Fprintf(w, "edgecore_rate_limit_rule_rejected_total{rule=\"%s\"} %d\n", labelValue(name), ruleCounts[name])
+	}
+
+	fmt.Fprintf(w, "# HELP edgecore_load_shed_total Requests shed by concurrency limits or pressure, by reason\n")
+	fmt.Fprintf(w, "# TYPE edgecore_load_shed_total counter\n")
+	fmt.Fprintf(w, "edgecore_load_shed_total{reason=\"queue_full\"} %d\n", atomic.LoadUint64(&GlobalMetrics.ShedQueueFull))
+	fmt.Fprintf(w, "edgecore_load_shed_total{reason=\"timeout\"} %d\n", atomic.LoadUint64(&GlobalMetrics.ShedTimeout))
+	fmt.Fprintf(w, "edgecore_load_shed_total{reason=\"pressure\"} %d\n", atomic.LoadUint64(&GlobalMetrics.ShedPressure))
+	fmt.Fprintf(w, "# HELP edgecore_load_shed_priority_total Requests shed, by priority\n")
+	fmt.Fprintf(w, "# TYPE edgecore_load_shed_priority_total counter\n")
+	for p := range GlobalMetrics.ShedByPriority {
+		fmt.Fprintf(w, "edgecore_load_shed_priority_total{priority=\"%s\"} %d\n", Priority(p), atomic.LoadUint64(&GlobalMetrics.ShedByPriority[p]))
+	}
+	if m := priorityOptions.Load().Pressure; m != nil {
+		fmt.Fprintf(w, "# HELP edgecore_load_shed_priorities Priorities currently shed for CPU or goroutine pressure\n")
+		fmt.Fprintf(w, "# TYPE edgecore_load_shed_priorities gauge\n")
+		fmt.Fprintf(w, "edgecore_load_shed_priorities %d\n", m.Shedding())
+	}
+	writeConcurrencyMetrics(w, concurrencyLimits.Load())
+
+	fmt.Fprintf(w, "# HELP edgecore_access_denied_total Requests and connections refused by access lists, by scope\n")
+	fmt.Fprintf(w, "# TYPE edgecore_access_denied_total counter\n")
+	fmt.Fprintf(w, "edgecore_access_denied_total{scope=\"listener\"} %d\n", atomic.LoadUint64(&GlobalMetrics.AccessDeniedListener))
+	fmt.Fprintf(w, "edgecore_access_denied_total{scope=\"route\"} %d\n", atomic.LoadUint64(&GlobalMetrics.AccessDeniedRoute))
+
+	fmt.Fprintf(w, "# HELP edgecore_bans_total Clients banned, by rule\n")
+	fmt.Fprintf(w, "# TYPE edgecore_bans_total counter\n")
+	bans := banCounts()
+	for _, rule := range sortedKeys(bans) {
+		fmt.Fprintf(w, "edgecore_bans_total{rule=\"%s\"} %d\n", labelValue(rule), bans[rule])
+	}
+	fmt.Fprintf(w, "# HELP edgecore_banned_requests_total Requests refused because the client is banned\n")
+	fmt.Fprintf(w, "# TYPE edgecore_banned_requests_total counter\n")
+	fmt.Fprintf(w, "edgecore_banned_requests_total %d\n", atomic.LoadUint64(&GlobalMetrics.BannedRequests))
+	fmt.Fprintf(w, "# HELP edgecore_ban_clients_evicted_total Clients whose responses were forgotten to stay within max_clients\n")
+	fmt.Fprintf(w, "# TYPE edgecore_ban_clients_evicted_total counter\n")
+	fmt.Fprintf(w, "edgecore_ban_clients_evicted_total %d\n", atomic.LoadUint64(&GlobalMetrics.BanClientsEvicted))
+	if b := banner.Load(); b != nil {
+		fmt.Fprintf(w, "# HELP edgecore_banned_clients Clients currently banned\n")
+		fmt.Fprintf(w, "# TYPE edgecore_banned_clients gauge\n")
+		fmt.Fprintf(w, "edgecore_banned_clients %d\n", b.Len())
+	}
+
+	fmt.Fprintf(w, "# HELP edgecore_quota_exceeded_total Requests rejected for a spent quota\n")
+	fmt.Fprintf(w, "# TYPE edgecore_quota_exceeded_total counter\n")
+	fmt.Fprintf(w, "edgecore_quota_exceeded_total %d\n", atomic.LoadUint64(&GlobalMetrics.QuotaExceeded))
+	if t := quotaTracker.Load(); t != nil {
+		fmt.Fprintf(w, "# HELP edgecore_quota_consumers API consumers with recorded quota usage\n")
+		fmt.Fprintf(w, "# TYPE edgecore_quota_consumers gauge\n")
+		fmt.Fprintf(w, "edgecore_quota_consumers %d\n", t.Consumers())
+	}
+	fmt.Fprintf(w, "# HELP edgecore_quota_consumers_evicted_total Consumers whose quota usage was forgotten to stay within max_consumers\n")
+	fmt.Fprintf(w, "# TYPE edgecore_quota_consumers_evicted_total counter\n")
+	fmt.Fprintf(w, "edgecore_quota_consumers_evicted_total %d\n", atomic.LoadUint64(&GlobalMetrics.QuotaConsumersEvicted))
+	fmt.Fprintf(w, "# HELP edgecore_quota_consumers_rejected_total Requests of new consumers rejected because max_consumers consumers have usage\n")
+	fmt.Fprintf(w, "# TYPE edgecore_quota_consumers_rejected_total counter\n")
+	fmt.Fprintf(w, "edgecore_quota_consumers_rejected_total %d\n", atomic.LoadUint64(&GlobalMetrics.QuotaConsumersRejected))
+	fmt.Fprintf(w, "# HELP edgecore_admin_auth_failures_total Admin API requests without a valid token\n")
+	fmt.Fprintf(w, "# TYPE edgecore_admin_auth_failures_total counter\n")
+	fmt.Fprintf(w, "edgecore_admin_auth_failures_total %d\n", atomic.LoadUint64(&GlobalMetrics.AdminAuthFailures))
+
+	fmt.Fprintf(w, "# HELP edgecore_websocket_sessions Open WebSocket sessions\n")
+	fmt.Fprintf(w, "# TYPE edgecore_websocket_sessions gauge\n")
+	fmt.Fprintf(w, "edgecore_websocket_sessions %d\n", openWebSockets())
+
+	fmt.Fprintf(w, "# HELP edgecore_websocket_rejected_total WebSocket upgrades rejected by the per-client limit\n")
+	fmt.Fprintf(w, "# TYPE edgecore_websocket_rejected_total counter\n")
+	fmt.Fprintf(w, "edgecore_websocket_rejected_total %d\n", atomic.LoadUint64(&GlobalMetrics.WebSocketsRejected))
+
+	fmt.Fprintf(w, "# HELP edgecore_tcp_connections_total Total number of accepted TCP proxy connections\n")
+	fmt.Fprintf(w, "# TYPE edgecore_tcp_connections_total counter\n")
+	fmt.Fprintf(w, "edgecore_tcp_connections_total %d\n", atomic.LoadUint64(&GlobalMetrics.TCPConnections))
+
+	fmt.Fprintf(w, "# HELP edgecore_tcp_dial_failures_total TCP proxy connections that found no reachable backend\n")
+	fmt.Fprintf(w, "# TYPE edgecore_tcp_dial_failures_total counter\n")
+	fmt.Fprintf(w, "edgecore_tcp_dial_failures_total %d\n", atomic.LoadUint64(&GlobalMetrics.TCPDialFailures))
+
+	fmt.Fprintf(w, "# HELP edgecore_tcp_bytes_total Bytes copied by the TCP proxy\n")
+	fmt.Fprintf(w, "# TYPE edgecore_tcp_bytes_total counter\n")
+	fmt.Fprintf(w, "edgecore_tcp_bytes_total{direction=\"in\"} %d\n", atomic.LoadUint64(&GlobalMetrics.TCPBytesIn))
+	fmt.Fprintf(w, "edgecore_tcp_bytes_total{direction=\"out\"} %d\n", atomic.LoadUint64(&GlobalMetrics.TCPBytesOut))
+
+	fmt.Fprintf(w, "# HELP edgecore_tls_passthrough_unmatched_total TLS passthrough connections closed without a matching SNI route\n")
+	fmt.Fprintf(w, "# TYPE edgecore_tls_passthrough_unmatched_total counter\n")
+	fmt.Fprintf(w, "edgecore_tls_passthrough_unmatched_total %d\n", atomic.LoadUint64(&GlobalMetrics.TLSPassthroughUnmatched))
+
+	fmt.Fprintf(w, "# HELP edgecore_udp_packets_total Datagrams forwarded by the UDP proxy\n")
+	fmt.Fprintf(w, "# TYPE edgecore_udp_packets_total counter\n")
+	fmt.Fprintf(w, "edgecore_udp_packets_total{direction=\"in\"} %d\n", atomic.LoadUint64(&GlobalMetrics.UDPPacketsIn))
+	fmt.Fprintf(w, "edgecore_udp_packets_total{direction=\"out\"} %d\n", atomic.LoadUint64(&GlobalMetrics.UDPPacketsOut))
+
+	fmt.Fprintf(w, "# HELP edgecore_udp_bytes_total Bytes forwarded by the UDP proxy\n")
+	fmt.Fprintf(w, "# TYPE edgecore_udp_bytes_total counter\n")
+	fmt.Fprintf(w, "edgecore_udp_bytes_total{direction=\"in\"} %d\n", atomic.LoadUint64(&GlobalMetrics.UDPBytesIn))
+	fmt.Fprintf(w, "edgecore_udp_bytes_total{direction=\"out\"} %d\n", atomic.LoadUint64(&GlobalMetrics.UDPBytesOut))
+
+	fmt.Fprintf(w, "# HELP edgecore_udp_dropped_total Datagrams dropped for lack of a session or backend\n")
+	fmt.Fprintf(w, "# TYPE edgecore_udp_dropped_total counter\n")
+	fmt.Fprintf(w, "edgecore_udp_dropped_total %d\n", atomic.LoadUint64(&GlobalMetrics.UDPDropped))
+
+	fmt.Fprintf(w, "# HELP edgecore_udp_sessions_total Total number of UDP sessions created\n")
+	fmt.Fprintf(w, "# TYPE edgecore_udp_sessions_total counter\n")
+	fmt.Fprintf(w, "edgecore_udp_sessions_total %d\n", atomic.LoadUint64(&GlobalMetrics.UDPSessionsTotal))
+
+	fmt.Fprintf(w, "# HELP edgecore_udp_sessions Open UDP sessions\n")
+	fmt.Fprintf(w, "# TYPE edgecore_udp_sessions gauge\n")
+	fmt.Fprintf(w, "edgecore_udp_sessions %d\n", atomic.LoadInt64(&GlobalMetrics.UDPSessionsActive))
+
+	fmt.Fprintf(w, "# HELP edgecore_http3_requests_total Requests received over HTTP/3\n")
+	fmt.Fprintf(w, "# TYPE edgecore_http3_requests_total counter\n")
+	fmt.Fprintf(w, "edgecore_http3_requests_total %d\n", atomic.LoadUint64(&GlobalMetrics.HTTP3Requests))
+
+	fmt.Fprintf(w, "# HELP edgecore_quic_connections_total Total number of accepted QUIC connections\n")
+	fmt.Fprintf(w, "# TYPE edgecore_quic_connections_total counter\n")
+	fmt.Fprintf(w, "edgecore_quic_connections_total %d\n", atomic.LoadUint64(&GlobalMetrics.QUICConnections))
+
+	fmt.Fprintf(w, "# HELP edgecore_quic_connections Open QUIC connections\n")
+	fmt.Fprintf(w, "# TYPE edgecore_quic_connections gauge\n")
+	fmt.Fprintf(w, "edgecore_quic_connections %d\n", atomic.LoadInt64(&GlobalMetrics.QUICConnectionsActive))
+
+	fmt.Fprintf(w, "# HELP edgecore_quic_packets_total Packets of closed QUIC connections; lost packets were retransmitted\n")
+	fmt.Fprintf(w, "# TYPE edgecore_quic_packets_total counter\n")
+	fmt.Fprintf(w, "edgecore_quic_packets_total{direction=\"sent\"} %d\n", atomic.LoadUint64(&GlobalMetrics.QUICPacketsSent))
+	fmt.Fprintf(w, "edgecore_quic_packets_total{direction=\"received\"} %d\n", atomic.LoadUint64(&GlobalMetrics.QUICPacketsReceived))
+	fmt.Fprintf(w, "edgecore_quic_packets_total{direction=\"lost\"} %d\n", atomic.LoadUint64(&GlobalMetrics.QUICPacketsLost))
+
+	fmt.Fprintf(w, "# HELP edgecore_quic_bytes_total Bytes of closed QUIC connections, including retransmissions\n")
+	fmt.Fprintf(w, "# TYPE edgecore_quic_bytes_total counter\n")
+	fmt.Fprintf(w, "edgecore_quic_bytes_total{direction=\"sent\"} %d\n", atomic.LoadUint64(&GlobalMetrics.QUICBytesSent))
+	fmt.Fprintf(w, "edgecore_quic_bytes_total{direction=\"received\"} %d\n", atomic.LoadUint64(&GlobalMetrics.QUICBytesReceived))
+
+	fmt.Fprintf(w, "# HELP edgecore_grpc_responses_total Total number of gRPC responses by status code\n")
+	fmt.Fprintf(w, "# TYPE edgecore_grpc_responses_total counter\n")
+	for code, name := range grpcCodeNames {
+		fmt.Fprintf(w, "edgecore_grpc_responses_total{code=\"%s\"} %d\n", name, atomic.LoadUint64(&grpcResponses[code]))
+	}
+
+	fmt.Fprintf(w, "# HELP edgecore_tls_client_auth_failures_total Total number of rejected client certificates\n")
+	fmt.Fprintf(w, "# TYPE edgecore_tls_client_auth_failures_total counter\n")
+	fmt.Fprintf(w, "edgecore_tls_client_auth_failures_total %d\n", atomic.LoadUint64(&GlobalMetrics.ClientCertFailures))
+
+	fmt.Fprintf(w, "# HELP edgecore_tls_cert_expiry_seconds Seconds until the served TLS certificate expires\n")
+	fmt.Fprintf(w, "# TYPE edgecore_tls_cert_expiry_seconds gauge\n")
+	now := time.Now()
+	for _, exp := range certs.Expiries() {
+		fmt.Fprintf(w, "edgecore_tls_cert_expiry_seconds{name=\"%s\",serial=\"%s\"} %.0f\n",
+			labelValue(exp.Name), exp.Serial, exp.NotAfter.Sub(now).Seconds())
+	}
+
+	if backendLister != nil {
+		writeBackendMetrics(w, backendLister())
+	}
+
 	// Request duration histogram (seconds).
 	fmt.Fprintf(w, "# HELP edgecore_request_duration_seconds Request duration in seconds\n")
 	fmt.Fprintf(w, "# TYPE edgecore_request_duration_seconds histogram\n")
@@ -39,3 +233,75 @@ func PrometheusMetrics(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "edgecore_request_duration_seconds_sum %f\n", sumSeconds)
 	fmt.Fprintf(w, "edgecore_request_duration_seconds_count %d\n", count)
 }
+
+// labelValue escapes a Prometheus label value.
+func labelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func writeBackendMetrics(w io.Writer, pools map[string][]*backend.Backend) {
+	names := make([]string, 0, len(pools))
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "# HELP edgecore_backend_active_requests In-flight requests per backend (HTTP/2 streams count individually)\n")
+	fmt.Fprintf(w, "# TYPE edgecore_backend_active_requests gauge\n")
+	for _, name := range names {
+		for _, b := range pools[name] {
+			fmt.Fprintf(w, "edgecore_backend_active_requests{pool=\"%s\",backend=\"%s\"} %d\n",
+				labelValue(name), labelValue(b.URL.String()), b.GetConnections())
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP edgecore_backend_websockets Open WebSocket sessions per backend\n")
+	fmt.Fprintf(w, "# TYPE edgecore_backend_websockets gauge\n")
+	for _, name := range names {
+		for _, b := range pools[name] {
+			fmt.Fprintf(w, "edgecore_backend_websockets{pool=\"%s\",backend=\"%s\"} %d\n",
+				labelValue(name), labelValue(b.URL.String()), b.GetWebSockets())
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP edgecore_backend_upstream_connections Open transport connections per backend\n")
+	fmt.Fprintf(w, "# TYPE edgecore_backend_upstream_connections gauge\n")
+	for _, name := range names {
+		for _, b := range pools[name] {
+			fmt.Fprintf(w, "edgecore_backend_upstream_connections{pool=\"%s\",backend=\"%s\"} %d\n",
+				labelValue(name), labelValue(b.URL.String()), b.GetUpstreamConns())
+		}
+	}
+}
+
+func writeConcurrencyMetrics(w io.Writer, cl *ConcurrencyLimits) {
+	scopes := []struct {
+		scope    string
+		limiters map[string]*ConcurrencyLimiter
+	}{{"route", cl.Routes}, {"pool", cl.Pools}}
+
+	fmt.Fprintf(w, "# HELP edgecore_concurrency_limit Current concurrency limit per route and pool\n")
+	fmt.Fprintf(w, "# TYPE edgecore_concurrency_limit gauge\n")
+	for _, s := range scopes {
+		for _, name := range sortedKeys(s.limiters) {
+			fmt.Fprintf(w, "edgecore_concurrency_limit{%s=\"%s\"} %d\n", s.scope, labelValue(name), s.limiters[name].Limit())
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP edgecore_concurrency_in_flight Requests holding a concurrency slot per route and pool\n")
+	fmt.Fprintf(w, "# TYPE edgecore_concurrency_in_flight gauge\n")
+	for _, s := range scopes {
+		for _, name := range sortedKeys(s.limiters) {
+			fmt.Fprintf(w, "edgecore_concurrency_in_flight{%s=\"%s\"} %d\n", s.scope, labelValue(name), s.limiters[name].InFlight())
+		}
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,21 +1,82 @@
 package proxy
 
 import (
+	"bufio"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"math"
 	"net"
 	"net/http"
-	"strings"
-	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/sargisis/edgecore/internal/router"
 )
 
 // Metrics holds the data for the load balancer performance
 type Metrics struct {
-	TotalRequests uint64
-	RateLimited   uint64
+	TotalRequests      uint64
+	RateLimited        uint64
+	ClientCertFailures uint64
+	WebSocketsRejected uint64
+	TCPConnections     uint64
+	TCPDialFailures    uint64
+	TCPBytesIn         uint64
+	TCPBytesOut        uint64
+	// TLSPassthroughUnmatched counts TLS passthrough connections closed
+	// because no SNI route or default pool took them.
+	TLSPassthroughUnmatched uint64
+	UDPPacketsIn            uint64
+	UDPPacketsOut           uint64
+	UDPBytesIn              uint64
+	UDPBytesOut             uint64
+	UDPDropped              uint64
+	UDPSessionsTotal        uint64
+	// UDPSessionsActive is a gauge, hence signed.
+	UDPSessionsActive   int64
+	HTTP3Requests       uint64
+	QUICConnections     uint64
+	QUICPacketsSent     uint64
+	QUICPacketsReceived uint64
+	QUICPacketsLost     uint64
+	QUICBytesSent       uint64
+	QUICBytesReceived   uint64
+	// QUICConnectionsActive is a gauge, hence signed.
+	QUICConnectionsActive  int64
+	RateLimiterEvictedIdle uint64
+	RateLimiterEvictedLRU  uint64
+	// RateLimitStoreRequests counts round trips to the shared rate limit
+	// store; RateLimitStoreErrors the failed ones.
+	RateLimitStoreRequests uint64
+	RateLimitStoreErrors   uint64
+	// ShedQueueFull and ShedTimeout count requests shed by concurrency
+	// limits because the queue was full or they waited too long.
+	ShedQueueFull uint64
+	ShedTimeout   uint64
+	// ShedPressure counts requests shed for CPU or goroutine pressure.
+	ShedPressure uint64
+	// ShedByPriority counts shed requests of each priority, for any reason.
+	ShedByPriority [PriorityCritical + 1]uint64
+	// QuotaExceeded counts requests rejected for a spent quota.
+	QuotaExceeded uint64
+	// QuotaConsumersEvicted counts consumers whose usage was forgotten to
+	// stay within the consumer cap.
+	QuotaConsumersEvicted uint64
+	// QuotaConsumersRejected counts requests of new consumers rejected
+	// because the consumer cap is taken by consumers with usage.
+	QuotaConsumersRejected uint64
+	// AdminAuthFailures counts admin API requests without a valid token.
+	AdminAuthFailures uint64
+	// AccessDeniedListener and AccessDeniedRoute count requests and
+	// connections refused by access lists.
+	AccessDeniedListener uint64
+	AccessDeniedRoute    uint64
+	// BannedRequests counts requests refused because the client is banned.
+	BannedRequests uint64
+	// BanClientsEvicted counts clients forgotten to stay within the cap
+	// of tracked clients.
+	BanClientsEvicted uint64
 }
 
 var GlobalMetrics Metrics
@@ -103,6 +164,15 @@ func Logger(next http.Handler) http.Handler {
 		if backendURL != "" {
 			entry.Backend = backendURL
 		}
+		if router.IsGRPC(r) {
+			code := grpcStatus(rw.Header(), rw.statusCode)
+			recordGRPCStatus(code)
+			entry.GRPCStatus = grpcCodeNames[code]
+		}
+		if cert := clientCertificate(r); cert != nil {
+			entry.ClientCertSubject = cert.Subject.String()
+			entry.ClientCertFingerprint = certFingerprint(cert)
+		}
 		logEntry(entry)
 	})
 }
@@ -118,86 +188,90 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
-// RateLimitMiddleware applies a global rate limit to all requests.
-// Kept for backwards compatibility; new code should prefer IPRateLimitMiddleware.
-func RateLimitMiddleware(limiter *RateLimiter, next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !limiter.Allow() {
-			atomic.AddUint64(&GlobalMetrics.RateLimited, 1)
-			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
-			return
-		}
-		next.ServeHTTP(w, r)
-	})
+// Flush sends buffered data to the client; streamed responses such as
+// Server-Sent Events and gRPC depend on it.
+func (rw *responseWriter) Flush() {
+	_ = http.NewResponseController(rw.ResponseWriter).Flush()
 }
 
-// IPRateLimiter manages a set of RateLimiters keyed by client IP.
-type IPRateLimiter struct {
-	mu       sync.Mutex
-	limiters map[string]*RateLimiter
-	rate     float64
-	capacity float64
+// CloseNotify is kept for handlers still using http.CloseNotifier.
+func (rw *responseWriter) CloseNotify() <-chan bool {
+	if cn, ok := rw.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
 }
 
-// NewIPRateLimiter creates a new IP-based rate limiter.
-func NewIPRateLimiter(rate, capacity float64) *IPRateLimiter {
-	return &IPRateLimiter{
-		limiters: make(map[string]*RateLimiter),
-		rate:     rate,
-		capacity: capacity,
+// Hijack takes over the connection for upgraded protocols such as
+// WebSocket and records the switch in the logged status.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(rw.ResponseWriter).Hijack()
+	if err == nil {
+		rw.statusCode = http.StatusSwitchingProtocols
 	}
+	return conn, brw, err
 }
 
-// getLimiter returns the RateLimiter for the given IP, creating one if needed.
-func (l *IPRateLimiter) getLimiter(ip string) *RateLimiter {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-
-	limiter, ok := l.limiters[ip]
-	if !ok {
-		limiter = NewRateLimiter(l.rate, l.capacity)
-		l.limiters[ip] = limiter
-	}
-	return limiter
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// set deadlines.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
 }
 
-// clientIP attempts to determine the real client IP, taking into account
-// common proxy headers. This is a best-effort implementation and assumes
-// that the deployment sits behind trusted proxies that set these headers.
-func clientIP(r *http.Request) string {
-	// X-Forwarded-For may contain a comma-separated list of IPs.
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		parts := strings.Split(xff, ",")
-		if len(parts) > 0 {
-			ip := strings.TrimSpace(parts[0])
-			if ip != "" {
-				return ip
-			}
+// RateLimitMiddleware applies a global rate limit to all requests.
+// Kept for backwards compatibility; new code should prefer IPRateLimitMiddleware.
+func RateLimitMiddleware(limiter Limiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := limiter.Take()
+		if !d.Allowed {
+			rateLimited(w, r, d)
+			return
 		}
-	}
-
-	// X-Real-IP is often set by reverse proxies.
-	if xrip := r.Header.Get("X-Real-IP"); xrip != "" {
-		return xrip
-	}
-
-	// Fallback to RemoteAddr (strip port if present).
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr
-	}
-	return host
+		setRateLimitHeaders(w.Header(), d)
+		next.ServeHTTP(w, r)
+	})
 }
 
-// IPRateLimitMiddleware applies rate limiting per client IP.
-func IPRateLimitMiddleware(limiter *IPRateLimiter, next http.Handler) http.Handler {
+// IPRateLimitMiddleware applies rate limiting per client IP, then the
+// rules set with SetRateLimitRules. A nil limiter applies only the rules.
+// A request rejected by one limit is refunded to the others, so it does
+// not use them up. Headers describe the most restrictive limit.
+func IPRateLimitMiddleware(limiter *KeyedRateLimiter, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip := clientIP(r)
-		if !limiter.getLimiter(ip).Allow() {
-			atomic.AddUint64(&GlobalMetrics.RateLimited, 1)
-			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+		d := Decision{Allowed: true, Remaining: math.Inf(1)}
+		var admitted []Limiter
+		if limiter != nil {
+			l := limiter.getLimiter(clientIP(r))
+			if d = l.Take(); d.Allowed {
+				admitted = append(admitted, l)
+			}
+		}
+		for _, rule := range *rateLimitRules.Load() {
+			key, ok := rule.Key.Key(r)
+			if !ok {
+				continue
+			}
+			l := rule.Limiter.getLimiter(key)
+			rd := l.Take()
+			if rd.Allowed {
+				admitted = append(admitted, l)
+			} else {
+				recordRuleRejection(rule.Name)
+			}
+			d = stricter(d, rd)
+		}
+		if math.IsInf(d.Remaining, 1) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !d.Allowed {
+			for _, l := range admitted {
+				l.Refund()
+			}
+			rateLimited(w, r, d)
 			return
 		}
+		setRateLimitHeaders(w.Header(), d)
 		next.ServeHTTP(w, r)
 	})
 }
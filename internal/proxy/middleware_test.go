@@ -1,12 +1,34 @@
 package proxy
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
+// trustProxies configures trusted proxies for the duration of a test.
+func trustProxies(t *testing.T, cidrs ...string) {
+	t.Helper()
+
+	if err := SetTrustedProxies(cidrs); err != nil {
+		t.Fatalf("failed to set trusted proxies: %v", err)
+	}
+	t.Cleanup(func() { _ = SetTrustedProxies(nil) })
+}
+
+// useClientIPHeader selects the client IP header for the duration of a test.
+func useClientIPHeader(t *testing.T, name string) {
+	t.Helper()
+
+	SetClientIPHeader(name)
+	t.Cleanup(func() { SetClientIPHeader("") })
+}
+
 func TestClientIPFromXForwardedFor(t *testing.T) {
+	trustProxies(t, "192.0.2.0/24", "10.0.0.0/8")
+
 	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
 	req.Header.Set("X-Forwarded-For", "203.0.113.1, 10.0.0.1")
 	req.RemoteAddr = "192.0.2.1:1234"
@@ -17,9 +39,25 @@ func TestClientIPFromXForwardedFor(t *testing.T) {
 	}
 }
 
+func TestClientIPTrustsIPv4MappedProxies(t *testing.T) {
+	trustProxies(t, "::ffff:192.0.2.0/120")
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.1")
+	req.RemoteAddr = "192.0.2.1:1234"
+
+	if ip := clientIP(req); ip != "203.0.113.1" {
+		t.Fatalf("expected a mapped trusted proxy range to match IPv4 peers, got %q", ip)
+	}
+}
+
 func TestClientIPFromXRealIP(t *testing.T) {
+	trustProxies(t, "192.0.2.1")
+	useClientIPHeader(t, "x-real-ip")
+
 	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
 	req.Header.Set("X-Real-IP", "198.51.100.2")
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
 	req.RemoteAddr = "192.0.2.1:1234"
 
 	ip := clientIP(req)
@@ -38,6 +76,99 @@ func TestClientIPFromRemoteAddr(t *testing.T) {
 	}
 }
 
+func TestClientIPIgnoresHeadersFromUntrustedPeer(t *testing.T) {
+	trustProxies(t, "10.0.0.0/8")
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.1")
+	req.Header.Set("X-Real-IP", "198.51.100.2")
+	req.Header.Set("Forwarded", "for=198.51.100.3")
+	req.RemoteAddr = "192.0.2.1:1234"
+
+	ip := clientIP(req)
+	if ip != "192.0.2.1" {
+		t.Fatalf("expected spoofed headers from untrusted peer to be ignored, got %q", ip)
+	}
+}
+
+func TestClientIPIgnoresSpoofedXForwardedForPrefix(t *testing.T) {
+	trustProxies(t, "10.0.0.0/8")
+
+	// The client sent "X-Forwarded-For: 1.2.3.4" and the trusted proxy
+	// appended the address it actually saw.
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 203.0.113.7, 10.0.0.2")
+	req.RemoteAddr = "10.0.0.1:1234"
+
+	ip := clientIP(req)
+	if ip != "203.0.113.7" {
+		t.Fatalf("expected rightmost untrusted hop 203.0.113.7, got %q", ip)
+	}
+}
+
+func TestClientIPFromForwarded(t *testing.T) {
+	trustProxies(t, "10.0.0.0/8")
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	req.Header.Set("Forwarded", `for=1.2.3.4, for="[2001:db8::7]:4711";proto=https, for=10.0.0.2`)
+	req.Header.Set("X-Forwarded-For", "198.51.100.9")
+	req.RemoteAddr = "10.0.0.1:1234"
+
+	// The proxy appends to X-Forwarded-For; the client wrote Forwarded.
+	if ip := clientIP(req); ip != "198.51.100.9" {
+		t.Fatalf("expected Forwarded to be ignored by default, got %q", ip)
+	}
+
+	useClientIPHeader(t, "forwarded")
+	if ip := clientIP(req); ip != "2001:db8::7" {
+		t.Fatalf("expected client IP from Forwarded to be 2001:db8::7, got %q", ip)
+	}
+}
+
+func TestClientIPStopsAtUnparsableHop(t *testing.T) {
+	trustProxies(t, "10.0.0.0/8")
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.1, garbage, 10.0.0.2")
+	req.RemoteAddr = "10.0.0.1:1234"
+
+	ip := clientIP(req)
+	if ip != "10.0.0.2" {
+		t.Fatalf("expected the trusted hop before the unparsable one, got %q", ip)
+	}
+
+	// Proxies hiding the client send an obfuscated identifier.
+	useClientIPHeader(t, "forwarded")
+	req.Header.Del("X-Forwarded-For")
+	req.Header.Set("Forwarded", "for=unknown, for=10.0.0.2")
+	if ip := clientIP(req); ip != "10.0.0.2" {
+		t.Fatalf("expected the trusted hop before the obfuscated one, got %q", ip)
+	}
+	req.Header.Set("Forwarded", "for=_hidden")
+	if ip := clientIP(req); ip != "10.0.0.1" {
+		t.Fatalf("expected the proxy itself for an obfuscated client, got %q", ip)
+	}
+}
+
+func TestIPRateLimitMiddlewareIgnoresSpoofedIPs(t *testing.T) {
+	limiter := NewIPRateLimiter(1, 1)
+	handler := IPRateLimitMiddleware(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for i, spoofed := range []string{"203.0.113.1", "203.0.113.2"} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+		req.Header.Set("X-Forwarded-For", spoofed)
+		req.RemoteAddr = "192.0.2.1:1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if i == 1 && rr.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected rotating X-Forwarded-For not to bypass the limit, got status %d", rr.Code)
+		}
+	}
+}
+
 func TestIPRateLimitMiddlewareBlocksPerIP(t *testing.T) {
 	limiter := NewIPRateLimiter(1, 1) // 1 request per second per IP
 
@@ -83,3 +214,75 @@ func TestIPRateLimitMiddlewareBlocksPerIP(t *testing.T) {
 		t.Fatalf("expected handler to be called twice, got %d", calls)
 	}
 }
+
+func TestIPRateLimitMiddlewareHeaders(t *testing.T) {
+	SetRateLimitResponse(RateLimitResponseOptions{LegacyHeaders: true})
+	t.Cleanup(func() { SetRateLimitResponse(RateLimitResponseOptions{}) })
+
+	handler := IPRateLimitMiddleware(NewIPRateLimiter(1, 2), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve()
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected first request to succeed, got status %d", rr.Code)
+	}
+	for key, want := range map[string]string{
+		"RateLimit-Limit":       "2",
+		"RateLimit-Remaining":   "1",
+		"RateLimit-Reset":       "1",
+		"X-RateLimit-Remaining": "1",
+	} {
+		if got := rr.Header().Get(key); got != want {
+			t.Fatalf("expected %s %q on allowed response, got %q", key, want, got)
+		}
+	}
+
+	serve()
+	rr = serve()
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected third request to be rate limited, got status %d", rr.Code)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "1" {
+		t.Fatalf("expected Retry-After 1, got %q", got)
+	}
+	if got := rr.Header().Get("RateLimit-Remaining"); got != "0" {
+		t.Fatalf("expected RateLimit-Remaining 0 on rejected response, got %q", got)
+	}
+	var body struct {
+		Error      string `json:"error"`
+		RetryAfter int    `json:"retry_after_seconds"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || body.Error != "rate_limit_exceeded" || body.RetryAfter != 1 {
+		t.Fatalf("expected JSON error body, got %q (%v)", rr.Body.String(), err)
+	}
+}
+
+func TestRateLimitedCustomBodyAndGRPC(t *testing.T) {
+	SetRateLimitResponse(RateLimitResponseOptions{ErrorBody: json.RawMessage(`{"code":"slow_down"}`)})
+	t.Cleanup(func() { SetRateLimitResponse(RateLimitResponseOptions{}) })
+
+	rr := httptest.NewRecorder()
+	rateLimited(rr, httptest.NewRequest(http.MethodGet, "/", nil), Decision{Limit: 1, RetryAfter: 2500 * time.Millisecond})
+	if rr.Body.String() != `{"code":"slow_down"}` || rr.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("expected configured JSON body, got %q", rr.Body.String())
+	}
+	if got := rr.Header().Get("Retry-After"); got != "3" {
+		t.Fatalf("expected Retry-After rounded up to 3, got %q", got)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/pkg.Service/Method", nil)
+	req.Header.Set("Content-Type", "application/grpc")
+	rr = httptest.NewRecorder()
+	rateLimited(rr, req, Decision{Limit: 1, RetryAfter: time.Second})
+	if rr.Code != http.StatusOK || rr.Header().Get("Grpc-Status") != "8" {
+		t.Fatalf("expected gRPC RESOURCE_EXHAUSTED, got status %d grpc-status %q", rr.Code, rr.Header().Get("Grpc-Status"))
+	}
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// PressureOptions configure a PressureMonitor. Zero thresholds are not
+// checked.
+type PressureOptions struct {
+	// MaxCPU is the share of the available CPUs (GOMAXPROCS) the process
+	// may use, from 0 to 1.
+	MaxCPU float64
+	// MaxGoroutines caps the number of goroutines, which grows with the
+	// requests and connections in progress.
+	MaxGoroutines int
+}
+
+// PressureMonitor samples the process CPU use and goroutine count every
+// second. For each sample over a threshold it sheds one more priority, up
+// to but not including PriorityCritical; for each sample below 90% of the
+// thresholds it sheds one less.
+type PressureMonitor struct {
+	opts atomic.Pointer[PressureOptions]
+	// shedBelow is the priority below which requests are shed.
+	shedBelow atomic.Int32
+
+	// Only used by the Run goroutine.
+	lastCPU  time.Duration
+	lastTime time.Time
+}
+
+// NewPressureMonitor returns a monitor with the given thresholds; it only
+// sheds requests once Run is started.
+func NewPressureMonitor(opts PressureOptions) *PressureMonitor {
+	m := &PressureMonitor{}
+	m.opts.Store(&opts)
+	return m
+}
+
+// SetOptions replaces the thresholds. Without thresholds nothing is shed.
+func (m *PressureMonitor) SetOptions(opts PressureOptions) {
+	m.opts.Store(&opts)
+	if opts.MaxCPU <= 0 && opts.MaxGoroutines <= 0 {
+		m.shedBelow.Store(0)
+	}
+}
+
+// Sheds reports whether requests of priority p are currently shed.
+func (m *PressureMonitor) Sheds(p Priority) bool {
+	return int32(p) < m.shedBelow.Load()
+}
+
+// Shedding returns how many priorities are currently shed.
+func (m *PressureMonitor) Shedding() int {
+	return int(m.shedBelow.Load())
+}
+
+// Run samples the process until stop is closed.
+func (m *PressureMonitor) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			m.sample(now)
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (m *PressureMonitor) sample(now time.Time) {
+	cpu := 0.0
+	used, ok := processCPUTime()
+	if ok && !m.lastTime.IsZero() {
+		available := now.Sub(m.lastTime).Seconds() * float64(runtime.GOMAXPROCS(0))
+		cpu = (used - m.lastCPU).Seconds() / available
+	}
+	m.lastCPU, m.lastTime = used, now
+	m.update(cpu, runtime.NumGoroutine())
+}
+
+// update adjusts the shed priorities to one sample.
+func (m *PressureMonitor) update(cpu float64, goroutines int) {
+	opts := m.opts.Load()
+	if opts.MaxCPU <= 0 && opts.MaxGoroutines <= 0 {
+		return
+	}
+	// load is the highest ratio of a measurement to its threshold.
+	load := 0.0
+	if opts.MaxCPU > 0 {
+		load = max(load, cpu/opts.MaxCPU)
+	}
+	if opts.MaxGoroutines > 0 {
+		load = max(load, float64(goroutines)/float64(opts.MaxGoroutines))
+	}
+
+	old := m.shedBelow.Load()
+	level := old
+	switch {
+	case load > 1 && level < int32(PriorityCritical):
+		level++
+		logEntry(LogEntry{Level: "warn", Message: fmt.Sprintf("overloaded (cpu %.0f%%, %d goroutines), shedding %s priority requests", cpu*100, goroutines, Priority(level-1))})
+	case load < 0.9 && level > 0:
+		level--
+		logEntry(LogEntry{Level: "info", Message: fmt.Sprintf("load easing (cpu %.0f%%, %d goroutines), admitting %s priority requests", cpu*100, goroutines, Priority(level))})
+	default:
+		return
+	}
+	// A concurrent SetOptions without thresholds wins.
+	m.shedBelow.CompareAndSwap(old, level)
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package proxy
+
+import "time"
+
+// processCPUTime is not available on this platform; only the goroutine
+// threshold is checked.
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}
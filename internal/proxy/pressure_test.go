@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPressureShedsOnePriorityPerSample(t *testing.T) {
+	m := NewPressureMonitor(PressureOptions{MaxCPU: 0.8, MaxGoroutines: 1000})
+
+	m.update(0.9, 10)
+	if !m.Sheds(PriorityLow) || m.Sheds(PriorityNormal) {
+		t.Fatalf("expected only low priority shed after one overloaded sample, shedding %d", m.Shedding())
+	}
+	for range 5 {
+		m.update(0.5, 2000)
+	}
+	if !m.Sheds(PriorityHigh) || m.Sheds(PriorityCritical) {
+		t.Fatalf("expected all but critical shed under lasting overload, shedding %d", m.Shedding())
+	}
+
+	// Between 90% and 100% of a threshold nothing changes.
+	m.update(0.75, 10)
+	if m.Shedding() != 3 {
+		t.Fatalf("expected shedding to hold near the threshold, shedding %d", m.Shedding())
+	}
+	m.update(0.1, 10)
+	if !m.Sheds(PriorityNormal) || m.Sheds(PriorityHigh) {
+		t.Fatalf("expected high priority admitted again as load eases, shedding %d", m.Shedding())
+	}
+}
+
+func TestPressureStopsSheddingWithoutThresholds(t *testing.T) {
+	m := NewPressureMonitor(PressureOptions{MaxGoroutines: 1000})
+	m.update(0, 2000)
+	m.update(0, 2000)
+
+	m.SetOptions(PressureOptions{})
+	if m.Shedding() != 0 {
+		t.Fatalf("expected nothing shed once the thresholds are removed, shedding %d", m.Shedding())
+	}
+	m.update(0, 2000)
+	if m.Shedding() != 0 {
+		t.Fatalf("expected samples without thresholds to shed nothing, shedding %d", m.Shedding())
+	}
+
+	// Thresholds added back start from nothing shed.
+	m.SetOptions(PressureOptions{MaxGoroutines: 1000})
+	m.update(0, 2000)
+	if m.Shedding() != 1 {
+		t.Fatalf("expected one priority shed after one overloaded sample, shedding %d", m.Shedding())
+	}
+}
+
+func TestPressureSamplesProcess(t *testing.T) {
+	m := NewPressureMonitor(PressureOptions{MaxGoroutines: 1})
+	m.sample(time.Now())
+	if m.Shedding() != 1 {
+		t.Fatalf("expected the test's goroutines to exceed a limit of 1, shedding %d", m.Shedding())
+	}
+}
@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/sargisis/edgecore/internal/router"
+)
+
+// Priority ranks requests for load shedding: under overload, lower
+// priorities are shed before higher ones.
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+	// PriorityCritical requests are never shed for process pressure.
+	PriorityCritical
+)
+
+var priorityNames = [...]string{"low", "normal", "high", "critical"}
+
+func (p Priority) String() string {
+	if p < 0 || int(p) >= len(priorityNames) {
+		return fmt.Sprintf("Priority(%d)", int(p))
+	}
+	return priorityNames[p]
+}
+
+// ParsePriority parses a priority name: "low", "normal", "high" or
+// "critical".
+func ParsePriority(s string) (Priority, error) {
+	i := slices.Index(priorityNames[:], s)
+	if i < 0 {
+		return 0, fmt.Errorf("unknown priority %q", s)
+	}
+	return Priority(i), nil
+}
+
+type priorityKey struct{}
+
+// WithPriority returns a copy of ctx carrying the request priority.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// PriorityFromContext returns the request priority stored by Prioritize,
+// or PriorityNormal.
+func PriorityFromContext(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return p
+	}
+	return PriorityNormal
+}
+
+// PriorityRule gives a priority to the requests it matches. A rule matches
+// when all of its conditions that are set do.
+type PriorityRule struct {
+	Priority Priority
+	// Routes are route names.
+	Routes []string
+	// Key, if set, must build one of Values, or any key when Values is
+	// empty.
+	Key    *KeyTemplate
+	Values []string
+	// Networks must contain the client IP.
+	Networks []netip.Prefix
+}
+
+func (rule *PriorityRule) matches(r *http.Request) bool {
+	if len(rule.Routes) > 0 {
+		route := router.FromContext(r.Context())
+		if route == nil || !slices.Contains(rule.Routes, route.Name) {
+			return false
+		}
+	}
+	if rule.Key != nil {
+		key, ok := rule.Key.Key(r)
+		if !ok || len(rule.Values) > 0 && !slices.Contains(rule.Values, key) {
+			return false
+		}
+	}
+	if len(rule.Networks) > 0 {
+		addr, err := netip.ParseAddr(clientIP(r))
+		if err != nil {
+			return false
+		}
+		addr = addr.Unmap()
+		if !slices.ContainsFunc(rule.Networks, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// PriorityOptions configure Prioritize.
+type PriorityOptions struct {
+	// Rules are checked in order; the first match sets the priority.
+	Rules []PriorityRule
+	// Default is the priority of requests matching no rule.
+	Default Priority
+	// Pressure sheds low priorities while the process is overloaded; nil
+	// disables it.
+	Pressure *PressureMonitor
+}
+
+var priorityOptions atomic.Pointer[PriorityOptions]
+
+func init() {
+	priorityOptions.Store(&PriorityOptions{Default: PriorityNormal})
+}
+
+// SetPriorityOptions replaces the options used by Prioritize.
+func SetPriorityOptions(opts PriorityOptions) {
+	priorityOptions.Store(&opts)
+}
+
+func (o *PriorityOptions) classify(r *http.Request) Priority {
+	for i := range o.Rules {
+		if o.Rules[i].matches(r) {
+			return o.Rules[i].Priority
+		}
+	}
+	return o.Default
+}
+
+// Prioritize gives each request a priority, which concurrency limits use to
+// shed lower priorities first. While the pressure monitor reports overload,
+// requests below the priority it protects are shed right away with 503.
+func Prioritize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		opts := priorityOptions.Load()
+		p := opts.classify(r)
+		r = r.WithContext(WithPriority(r.Context(), p))
+		if opts.Pressure != nil && opts.Pressure.Sheds(p) {
+			shed(w, r, shedPressure, time.Second)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sargisis/edgecore/internal/router"
+)
+
+func TestPriorityClassification(t *testing.T) {
+	plan, err := ParseKeyTemplate("{header:X-Plan}")
+	if err != nil {
+		t.Fatalf("failed to parse key: %v", err)
+	}
+	opts := &PriorityOptions{
+		Rules: []PriorityRule{
+			{Priority: PriorityCritical, Networks: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}},
+			{Priority: PriorityHigh, Routes: []string{"checkout"}},
+			{Priority: PriorityLow, Key: &plan, Values: []string{"free"}},
+			{Priority: PriorityHigh, Key: &plan},
+		},
+		Default: PriorityNormal,
+	}
+	request := func(remote, route, plan string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		r.RemoteAddr = remote + ":1234"
+		if route != "" {
+			r = r.WithContext(router.WithRoute(r.Context(), &router.Route{Name: route}))
+		}
+		if plan != "" {
+			r.Header.Set("X-Plan", plan)
+		}
+		return r
+	}
+
+	tests := []struct {
+		name string
+		r    *http.Request
+		want Priority
+	}{
+		{"internal client", request("10.1.2.3", "", "free"), PriorityCritical},
+		{"checkout route", request("192.0.2.1", "checkout", "free"), PriorityHigh},
+		{"free plan", request("192.0.2.1", "search", "free"), PriorityLow},
+		{"paid plan", request("192.0.2.1", "", "enterprise"), PriorityHigh},
+		{"no rule", request("192.0.2.1", "search", ""), PriorityNormal},
+	}
+	for _, tt := range tests {
+		if got := opts.classify(tt.r); got != tt.want {
+			t.Fatalf("%s: expected %s, got %s", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestPrioritizeShedsUnderPressure(t *testing.T) {
+	pressure := NewPressureMonitor(PressureOptions{MaxGoroutines: 100})
+	pressure.update(0, 200)
+	SetPriorityOptions(PriorityOptions{Default: PriorityLow, Pressure: pressure})
+	t.Cleanup(func() { SetPriorityOptions(PriorityOptions{Default: PriorityNormal}) })
+	shedLow := atomic.LoadUint64(&GlobalMetrics.ShedByPriority[PriorityLow])
+
+	var got Priority
+	handler := Prioritize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = PriorityFromContext(r.Context())
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected low priority request shed with Retry-After, got %d", rr.Code)
+	}
+	if n := atomic.LoadUint64(&GlobalMetrics.ShedByPriority[PriorityLow]) - shedLow; n != 1 {
+		t.Fatalf("expected 1 low priority request shed, got %d", n)
+	}
+
+	SetPriorityOptions(PriorityOptions{Default: PriorityNormal, Pressure: pressure})
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	if rr.Code != http.StatusOK || got != PriorityNormal {
+		t.Fatalf("expected normal priority request served, got %d with priority %s", rr.Code, got)
+	}
+}
+
+func TestParsePriority(t *testing.T) {
+	if p, err := ParsePriority("high"); err != nil || p != PriorityHigh {
+		t.Fatalf("expected high, got %s (%v)", p, err)
+	}
+	if _, err := ParsePriority("urgent"); err == nil {
+		t.Fatalf("expected error for unknown priority")
+	}
+}
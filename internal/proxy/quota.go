@@ -0,0 +1,543 @@
+package proxy
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sargisis/edgecore/internal/router"
+)
+
+// Quota caps the requests of an API consumer per calendar day and month;
+// zero means no cap.
+type Quota struct {
+	Daily   int64
+	Monthly int64
+}
+
+// QuotaOptions configure a QuotaTracker.
+type QuotaOptions struct {
+	// Consumer builds the consumer of a request, e.g. from an API key
+	// header. Requests without one are not counted.
+	Consumer KeyTemplate
+	// Plans are quotas by plan name.
+	Plans map[string]Quota
+	// Consumers maps consumers to plan names; the others are on
+	// DefaultPlan. Consumers without a plan have no quota.
+	Consumers   map[string]string
+	DefaultPlan string
+	// MaxConsumers caps the consumers on DefaultPlan whose usage is kept.
+	// Beyond it the least recently seen is forgotten if it has no usage in
+	// its current windows; otherwise new consumers are rejected. Consumers
+	// listed in Consumers are always kept. Zero means 100000.
+	MaxConsumers int
+	// Location sets when days and months begin; nil means UTC.
+	Location *time.Location
+	// StateFile keeps usage across restarts; empty keeps it in memory.
+	StateFile string
+	Clock     Clock
+}
+
+// QuotaUsage is a consumer's request count in its current day and month.
+type QuotaUsage struct {
+	// Day is formatted as 2006-01-02, Month as 2006-01.
+	Day        string `json:"day"`
+	DayCount   int64  `json:"day_count"`
+	Month      string `json:"month"`
+	MonthCount int64  `json:"month_count"`
+}
+
+// QuotaTracker counts requests per consumer in calendar windows and
+// rejects those over the consumer's quota.
+type QuotaTracker struct {
+	mu    sync.Mutex
+	opts  QuotaOptions
+	usage map[string]*QuotaUsage
+	// unlisted indexes lru by the consumers with usage that are not in
+	// opts.Consumers; the front of lru is the most recently seen.
+	unlisted map[string]*list.Element
+	lru      list.List
+	// dirty marks usage not yet saved to the state file.
+	dirty bool
+}
+
+// NewQuotaTracker returns a tracker, loading usage from opts.StateFile if
+// it exists.
+func NewQuotaTracker(opts QuotaOptions) (*QuotaTracker, error) {
+	if opts.Clock == nil {
+		opts.Clock = time.Now
+	}
+	if opts.Location == nil {
+		opts.Location = time.UTC
+	}
+	if opts.MaxConsumers == 0 {
+		opts.MaxConsumers = 100000
+	}
+	opts.Consumers = storedConsumers(opts.Consumers)
+	t := &QuotaTracker{opts: opts, usage: make(map[string]*QuotaUsage), unlisted: make(map[string]*list.Element)}
+	if opts.StateFile == "" {
+		return t, nil
+	}
+	data, err := os.ReadFile(opts.StateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &t.usage); err != nil {
+		return nil, fmt.Errorf("quota state %s: %w", opts.StateFile, err)
+	}
+	t.index()
+	return t, nil
+}
+
+// SetOptions replaces the consumer template, plans and location; usage,
+// the state file and the clock are kept.
+func (t *QuotaTracker) SetOptions(opts QuotaOptions) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	opts.StateFile, opts.Clock = t.opts.StateFile, t.opts.Clock
+	if opts.Location == nil {
+		opts.Location = time.UTC
+	}
+	if opts.MaxConsumers == 0 {
+		opts.MaxConsumers = 100000
+	}
+	opts.Consumers = storedConsumers(opts.Consumers)
+	t.opts = opts
+	t.index()
+}
+
+// storedConsumers returns consumers keyed as consumers are stored, so long
+// consumers find their plan once hashed.
+func storedConsumers(consumers map[string]string) map[string]string {
+	stored := make(map[string]string, len(consumers))
+	for consumer, plan := range consumers {
+		stored[storedKey(consumer)] = plan
+	}
+	return stored
+}
+
+// index brings unlisted in line with the usage and opts.Consumers, after
+// they were loaded or replaced; the caller holds t.mu.
+func (t *QuotaTracker) index() {
+	for _, consumer := range sortedKeys(t.usage) {
+		_, listed := t.opts.Consumers[consumer]
+		el, indexed := t.unlisted[consumer]
+		switch {
+		case listed && indexed:
+			t.lru.Remove(el)
+			delete(t.unlisted, consumer)
+		case !listed && !indexed:
+			t.unlisted[consumer] = t.lru.PushBack(consumer)
+		}
+	}
+	t.evict(t.opts.Clock().In(t.opts.Location), 0)
+}
+
+// seen records a use of consumer at now. It returns false if consumer is
+// new and unlisted and the cap is reached by consumers with usage; the
+// caller holds t.mu.
+func (t *QuotaTracker) seen(consumer string, now time.Time) bool {
+	if _, ok := t.opts.Consumers[consumer]; ok {
+		return true
+	}
+	if el, ok := t.unlisted[consumer]; ok {
+		t.lru.MoveToFront(el)
+		return true
+	}
+	if !t.evict(now, 1) {
+		return false
+	}
+	t.unlisted[consumer] = t.lru.PushFront(consumer)
+	return true
+}
+
+// evict forgets the least recently seen unlisted consumers until room more
+// fit under the cap, and reports whether they do. Consumers with usage in
+// their current windows are never forgotten; as they were mostly seen more
+// recently than idle ones, eviction stops at the first. The caller holds
+// t.mu.
+func (t *QuotaTracker) evict(now time.Time, room int) bool {
+	for t.lru.Len()+room > t.opts.MaxConsumers {
+		consumer := t.lru.Back().Value.(string)
+		if t.active(consumer, now) {
+			return false
+		}
+		t.forget(consumer)
+		atomic.AddUint64(&GlobalMetrics.QuotaConsumersEvicted, 1)
+	}
+	return true
+}
+
+// active reports whether consumer has usage counted against its quota at
+// now; the caller holds t.mu.
+func (t *QuotaTracker) active(consumer string, now time.Time) bool {
+	u := t.usage[consumer]
+	_, q, ok := t.plan(consumer)
+	if u == nil || !ok {
+		return false
+	}
+	return q.Daily > 0 && u.Day == now.Format(time.DateOnly) && u.DayCount > 0 ||
+		q.Monthly > 0 && u.Month == now.Format("2006-01") && u.MonthCount > 0
+}
+
+// forget drops the usage of consumer; the caller holds t.mu.
+func (t *QuotaTracker) forget(consumer string) {
+	delete(t.usage, consumer)
+	if el, ok := t.unlisted[consumer]; ok {
+		t.lru.Remove(el)
+		delete(t.unlisted, consumer)
+	}
+}
+
+// plan returns the plan of consumer; the caller holds t.mu.
+func (t *QuotaTracker) plan(consumer string) (string, Quota, bool) {
+	name, ok := t.opts.Consumers[consumer]
+	if !ok {
+		name = t.opts.DefaultPlan
+	}
+	q, ok := t.opts.Plans[name]
+	return name, q, ok && (q.Daily > 0 || q.Monthly > 0)
+}
+
+// current returns the usage of consumer in the windows containing now; the
+// caller holds t.mu.
+func (t *QuotaTracker) current(consumer string, now time.Time) *QuotaUsage {
+	day, month := now.Format(time.DateOnly), now.Format("2006-01")
+	u := t.usage[consumer]
+	if u == nil {
+		u = &QuotaUsage{}
+		t.usage[consumer] = u
+	}
+	if u.Day != day {
+		u.Day, u.DayCount = day, 0
+	}
+	if u.Month != month {
+		u.Month, u.MonthCount = month, 0
+	}
+	return u
+}
+
+// consumer returns the consumer of r, if any. Long consumers are hashed.
+func (t *QuotaTracker) consumer(r *http.Request) (string, bool) {
+	t.mu.Lock()
+	tmpl := t.opts.Consumer
+	t.mu.Unlock()
+	consumer, ok := tmpl.Key(r)
+	return storedKey(consumer), ok
+}
+
+// quotaDecision describes the tightest window of a consumer's quota.
+type quotaDecision struct {
+	allowed   bool
+	limit     int64
+	remaining int64
+	reset     time.Duration
+}
+
+// take counts a request of consumer if its quota allows it. It returns
+// false if the consumer has no quota.
+func (t *QuotaTracker) take(consumer string) (quotaDecision, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, q, ok := t.plan(consumer)
+	if !ok {
+		return quotaDecision{}, false
+	}
+	now := t.opts.Clock().In(t.opts.Location)
+	if !t.seen(consumer, now) {
+		// Too many consumers are using their quota to track another; it
+		// waits for the first window to reset.
+		atomic.AddUint64(&GlobalMetrics.QuotaConsumersRejected, 1)
+		windows := t.windows(q, &QuotaUsage{}, now)
+		return quotaDecision{limit: windows[0].Limit, reset: windows[0].ResetsAt.Sub(now)}, true
+	}
+	u := t.current(consumer, now)
+	windows := t.windows(q, u, now)
+
+	d := quotaDecision{allowed: true}
+	for _, w := range windows {
+		if w.Remaining == 0 {
+			d.allowed = false
+		}
+	}
+	if d.allowed {
+		u.DayCount++
+		u.MonthCount++
+		t.dirty = true
+		for i := range windows {
+			windows[i].Remaining--
+		}
+	}
+	// Report the window closest to running out or, of those spent, the one
+	// resetting last: every spent window must reset before the next request.
+	tightest := windows[0]
+	for _, w := range windows[1:] {
+		if w.Remaining < tightest.Remaining || w.Remaining == tightest.Remaining && w.ResetsAt.After(tightest.ResetsAt) {
+			tightest = w
+		}
+	}
+	d.limit, d.remaining, d.reset = tightest.Limit, tightest.Remaining, tightest.ResetsAt.Sub(now)
+	return d, true
+}
+
+// QuotaWindow reports a consumer's usage of one quota window.
+type QuotaWindow struct {
+	// Period is the day (2006-01-02) or month (2006-01).
+	Period    string    `json:"period"`
+	Limit     int64     `json:"limit"`
+	Used      int64     `json:"used"`
+	Remaining int64     `json:"remaining"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+// QuotaReport is a consumer's usage of its quota.
+type QuotaReport struct {
+	Consumer string       `json:"consumer"`
+	Plan     string       `json:"plan"`
+	Daily    *QuotaWindow `json:"daily,omitempty"`
+	Monthly  *QuotaWindow `json:"monthly,omitempty"`
+}
+
+// windows returns the limited windows of q; the caller holds t.mu.
+func (t *QuotaTracker) windows(q Quota, u *QuotaUsage, now time.Time) []QuotaWindow {
+	var windows []QuotaWindow
+	if q.Daily > 0 {
+		y, m, d := now.Date()
+		windows = append(windows, QuotaWindow{
+			Period:    u.Day,
+			Limit:     q.Daily,
+			Used:      u.DayCount,
+			Remaining: max(0, q.Daily-u.DayCount),
+			ResetsAt:  time.Date(y, m, d+1, 0, 0, 0, 0, now.Location()),
+		})
+	}
+	if q.Monthly > 0 {
+		y, m, _ := now.Date()
+		windows = append(windows, QuotaWindow{
+			Period:    u.Month,
+			Limit:     q.Monthly,
+			Used:      u.MonthCount,
+			Remaining: max(0, q.Monthly-u.MonthCount),
+			ResetsAt:  time.Date(y, m+1, 1, 0, 0, 0, 0, now.Location()),
+		})
+	}
+	return windows
+}
+
+// Report returns the usage of consumer. It returns false if the consumer
+// has no quota.
+func (t *QuotaTracker) Report(consumer string) (QuotaReport, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.report(storedKey(consumer))
+}
+
+// report is Report; the caller holds t.mu.
+func (t *QuotaTracker) report(consumer string) (QuotaReport, bool) {
+	plan, q, ok := t.plan(consumer)
+	if !ok {
+		return QuotaReport{}, false
+	}
+	now := t.opts.Clock().In(t.opts.Location)
+	u := *t.current(consumer, now)
+	if u.DayCount == 0 && u.MonthCount == 0 {
+		// Reporting does not make a consumer worth saving.
+		t.forget(consumer)
+	}
+	r := QuotaReport{Consumer: consumer, Plan: plan}
+	windows := t.windows(q, &u, now)
+	if q.Daily > 0 {
+		r.Daily, windows = &windows[0], windows[1:]
+	}
+	if q.Monthly > 0 {
+		r.Monthly = &windows[0]
+	}
+	return r, true
+}
+
+// Reports returns the usage of every consumer with recorded requests.
+func (t *QuotaTracker) Reports() []QuotaReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	reports := make([]QuotaReport, 0, len(t.usage))
+	for _, consumer := range sortedKeys(t.usage) {
+		if r, ok := t.report(consumer); ok {
+			reports = append(reports, r)
+		}
+	}
+	return reports
+}
+
+// Reset clears the usage of consumer.
+func (t *QuotaTracker) Reset(consumer string) {
+	consumer = storedKey(consumer)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.usage[consumer]; ok {
+		t.forget(consumer)
+		t.dirty = true
+	}
+}
+
+// Consumers returns the number of consumers with recorded usage.
+func (t *QuotaTracker) Consumers() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.usage)
+}
+
+// Save writes the usage to the state file, if it changed since the last
+// save. Consumers without requests this month are dropped.
+func (t *QuotaTracker) Save() error {
+	t.mu.Lock()
+	if t.opts.StateFile == "" || !t.dirty {
+		t.mu.Unlock()
+		return nil
+	}
+	month := t.opts.Clock().In(t.opts.Location).Format("2006-01")
+	usage := make(map[string]QuotaUsage, len(t.usage))
+	for consumer, u := range t.usage {
+		if u.Month != month {
+			t.forget(consumer)
+			continue
+		}
+		usage[consumer] = *u
+	}
+	t.dirty = false
+	path := t.opts.StateFile
+	t.mu.Unlock()
+
+	data, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+
+	if err = writeStateFile(path, data); err != nil {
+		t.mu.Lock()
+		t.dirty = true
+		t.mu.Unlock()
+	}
+	return err
+}
+
+// writeStateFile writes a new file and renames it over path, so a crash
+// never leaves a truncated state file behind.
+func writeStateFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Run saves the usage every ten seconds until stop is closed, then once
+// more.
+func (t *QuotaTracker) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			t.save()
+			return
+		}
+		t.save()
+	}
+}
+
+func (t *QuotaTracker) save() {
+	if err := t.Save(); err != nil {
+		logEntry(LogEntry{Level: "warn", Message: "failed to save quota usage", Error: err.Error()})
+	}
+}
+
+var quotaTracker atomic.Pointer[QuotaTracker]
+
+// SetQuotaTracker replaces the tracker used by EnforceQuotas; nil disables
+// quotas.
+func SetQuotaTracker(t *QuotaTracker) {
+	quotaTracker.Store(t)
+}
+
+// EnforceQuotas counts the requests of each API consumer against its quota
+// and rejects those over it with 429. Responses carry X-Quota-Limit,
+// X-Quota-Remaining and X-Quota-Reset for the window closest to running
+// out.
+func EnforceQuotas(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := quotaTracker.Load()
+		if t == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		consumer, ok := t.consumer(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		d, ok := t.take(consumer)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Set("X-Quota-Limit", strconv.FormatInt(d.limit, 10))
+		h.Set("X-Quota-Remaining", strconv.FormatInt(d.remaining, 10))
+		h.Set("X-Quota-Reset", strconv.FormatInt(ceilSeconds(d.reset), 10))
+		if d.allowed {
+			next.ServeHTTP(w, r)
+			return
+		}
+		quotaExceeded(w, r, d)
+	})
+}
+
+// quotaExceeded answers a request over its quota: gRPC clients get
+// RESOURCE_EXHAUSTED, everyone else a 429 with Retry-After and a JSON body.
+func quotaExceeded(w http.ResponseWriter, r *http.Request, d quotaDecision) {
+	atomic.AddUint64(&GlobalMetrics.QuotaExceeded, 1)
+
+	retry := max(1, ceilSeconds(d.reset))
+	h := w.Header()
+	h.Set("Retry-After", strconv.FormatInt(retry, 10))
+	if router.IsGRPC(r) {
+		GRPCError(w, GRPCResourceExhausted, "quota exceeded")
+		return
+	}
+	body, _ := json.Marshal(struct {
+		Error      string `json:"error"`
+		Message    string `json:"message"`
+		RetryAfter int64  `json:"retry_after_seconds"`
+	}{"quota_exceeded", "Quota exceeded", retry})
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write(body)
+}
@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestQuotaTracker(t *testing.T, clock *fakeClock, stateFile string) *QuotaTracker {
+	t.Helper()
+
+	consumer, err := ParseKeyTemplate("{header:X-API-Key}")
+	if err != nil {
+		t.Fatalf("failed to parse key: %v", err)
+	}
+	tracker, err := NewQuotaTracker(QuotaOptions{
+		Consumer: consumer,
+		Plans: map[string]Quota{
+			"free": {Daily: 2, Monthly: 3},
+			"pro":  {Monthly: 100},
+		},
+		Consumers:   map[string]string{"key-pro": "pro"},
+		DefaultPlan: "free",
+		StateFile:   stateFile,
+		Clock:       clock.Now,
+	})
+	if err != nil {
+		t.Fatalf("failed to create tracker: %v", err)
+	}
+	return tracker
+}
+
+// restart saves s to its state file and returns the instance open loads
+// from it, as after a restart.
+func restart[T interface{ Save() error }](t *testing.T, s T, open func() T) T {
+	t.Helper()
+
+	if err := s.Save(); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+	return open()
+}
+
+func TestQuotaCalendarWindows(t *testing.T) {
+	clock := newFakeClock(time.Date(2026, 3, 30, 22, 0, 0, 0, time.UTC))
+	tracker := newTestQuotaTracker(t, clock, "")
+
+	d, _ := tracker.take("key-free")
+	if !d.allowed || d.limit != 2 || d.remaining != 1 || d.reset != 2*time.Hour {
+		t.Fatalf("expected the daily window reported with 1 remaining, got %+v", d)
+	}
+	tracker.take("key-free")
+	d, _ = tracker.take("key-free")
+	if d.allowed || d.remaining != 0 || d.reset != 2*time.Hour {
+		t.Fatalf("expected rejection until midnight, got %+v", d)
+	}
+
+	// The next day has a fresh daily window but the month is nearly spent.
+	clock.Add(3 * time.Hour)
+	d, _ = tracker.take("key-free")
+	if !d.allowed || d.limit != 3 || d.remaining != 0 {
+		t.Fatalf("expected the monthly window reported once tighter, got %+v", d)
+	}
+	d, _ = tracker.take("key-free")
+	if d.allowed || d.reset != 23*time.Hour {
+		t.Fatalf("expected rejection until the month ends, got %+v", d)
+	}
+
+	clock.Set(time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC))
+	if d, _ = tracker.take("key-free"); !d.allowed {
+		t.Fatalf("expected admission in a new month, got %+v", d)
+	}
+	if _, ok := tracker.take("key-pro"); !ok {
+		t.Fatalf("expected a consumer on the pro plan to have a quota")
+	}
+}
+
+func TestQuotaUsageSurvivesRestart(t *testing.T) {
+	clock := newFakeClock(time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC))
+	state := filepath.Join(t.TempDir(), "quotas.json")
+	tracker := newTestQuotaTracker(t, clock, state)
+	tracker.take("key-free")
+
+	restarted := restart(t, tracker, func() *QuotaTracker { return newTestQuotaTracker(t, clock, state) })
+	r, ok := restarted.Report("key-free")
+	if !ok || r.Plan != "free" || r.Daily.Used != 1 || r.Monthly.Remaining != 2 {
+		t.Fatalf("expected usage restored from the state file, got %+v", r)
+	}
+
+	restarted.Reset("key-free")
+	if r, _ := restarted.Report("key-free"); r.Daily.Used != 0 || r.Monthly.Used != 0 {
+		t.Fatalf("expected reset usage, got %+v", r)
+	}
+}
+
+func TestQuotaFindsPlanOfLongConsumer(t *testing.T) {
+	long := strings.Repeat("k", 200)
+	consumer, err := ParseKeyTemplate("{header:X-API-Key}")
+	if err != nil {
+		t.Fatalf("failed to parse key: %v", err)
+	}
+	opts := QuotaOptions{
+		Consumer:    consumer,
+		Plans:       map[string]Quota{"free": {Daily: 2}, "pro": {Monthly: 100}},
+		Consumers:   map[string]string{long: "pro"},
+		DefaultPlan: "free",
+	}
+	tracker, err := NewQuotaTracker(opts)
+	if err != nil {
+		t.Fatalf("failed to create tracker: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("X-API-Key", long)
+	key, _ := tracker.consumer(req)
+	if d, _ := tracker.take(key); d.limit != 100 {
+		t.Fatalf("expected a long listed consumer on its plan, got %+v", d)
+	}
+	if r, _ := tracker.Report(long); r.Plan != "pro" || r.Monthly.Used != 1 {
+		t.Fatalf("expected the report of a long listed consumer on its plan, got %+v", r)
+	}
+
+	tracker.SetOptions(opts)
+	if r, _ := tracker.Report(long); r.Plan != "pro" {
+		t.Fatalf("expected the plan kept across a reload, got %+v", r)
+	}
+}
+
+func TestQuotaForgetsLeastRecentUnlistedConsumers(t *testing.T) {
+	clock := newFakeClock(time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC))
+	tracker, err := NewQuotaTracker(QuotaOptions{
+		Plans:        map[string]Quota{"free": {Daily: 2}, "pro": {Monthly: 100}},
+		Consumers:    map[string]string{"key-pro": "pro"},
+		DefaultPlan:  "free",
+		MaxConsumers: 2,
+		Clock:        clock.Now,
+	})
+	if err != nil {
+		t.Fatalf("failed to create tracker: %v", err)
+	}
+
+	tracker.take("key-pro")
+	tracker.take("random-1")
+	tracker.take("random-2")
+	tracker.take("random-1")
+
+	// Both unlisted consumers have usage today, so a third is turned away
+	// rather than resetting one of them.
+	if d, ok := tracker.take("random-3"); !ok || d.allowed || d.reset != 12*time.Hour {
+		t.Fatalf("expected a new consumer rejected until midnight, got %+v", d)
+	}
+	if r, _ := tracker.Report("random-2"); r.Daily.Used != 1 {
+		t.Fatalf("expected a consumer with usage kept, got %+v", r)
+	}
+	if got := tracker.Consumers(); got != 3 {
+		t.Fatalf("expected 2 unlisted consumers and the listed one, got %d", got)
+	}
+
+	// The next day their usage no longer counts, and the least recently
+	// seen makes room.
+	clock.Add(24 * time.Hour)
+	if d, _ := tracker.take("random-3"); !d.allowed {
+		t.Fatalf("expected a new consumer admitted once others are idle, got %+v", d)
+	}
+	if got := tracker.Consumers(); got != 3 {
+		t.Fatalf("expected 2 unlisted consumers and the listed one, got %d", got)
+	}
+	tracker.mu.Lock()
+	_, kept := tracker.usage["random-1"]
+	_, forgotten := tracker.usage["random-2"]
+	tracker.mu.Unlock()
+	if !kept || forgotten {
+		t.Fatalf("expected the least recently seen consumer forgotten")
+	}
+	if r, _ := tracker.Report("key-pro"); r.Monthly.Used != 1 {
+		t.Fatalf("expected a listed consumer kept, got %+v", r)
+	}
+}
+
+func TestEnforceQuotasSetsHeaders(t *testing.T) {
+	clock := newFakeClock(time.Date(2026, 3, 10, 23, 59, 30, 0, time.UTC))
+	SetQuotaTracker(newTestQuotaTracker(t, clock, ""))
+	t.Cleanup(func() { SetQuotaTracker(nil) })
+	handler := EnforceQuotas(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve("key-free")
+	if rr.Code != http.StatusOK || rr.Header().Get("X-Quota-Limit") != "2" || rr.Header().Get("X-Quota-Remaining") != "1" || rr.Header().Get("X-Quota-Reset") != "30" {
+		t.Fatalf("expected quota headers, got %d %v", rr.Code, rr.Header())
+	}
+	serve("key-free")
+	rr = serve("key-free")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "30" || rr.Header().Get("X-Quota-Remaining") != "0" {
+		t.Fatalf("expected 429 until midnight, got %d %v", rr.Code, rr.Header())
+	}
+
+	if rr := serve(""); rr.Code != http.StatusOK || rr.Header().Get("X-Quota-Limit") != "" {
+		t.Fatalf("expected requests without a consumer to pass uncounted, got %d %v", rr.Code, rr.Header())
+	}
+}
@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Clock returns the current time. Limiters take one so tests can move time
+// forward instead of sleeping.
+type Clock func() time.Time
+
+// Limiter admits or rejects requests against a single limit.
+type Limiter interface {
+	// Take admits a request if the limit allows it and reports the state
+	// of the limit after the decision.
+	Take() Decision
+	// Refund gives back a request admitted by Take that another limit
+	// rejected, so it does not count against this one.
+	Refund()
+}
+
+// Algorithm selects how a Limit is enforced.
+type Algorithm string
+
+const (
+	// TokenBucket refills Burst tokens at Rate per second; it is the
+	// default.
+	TokenBucket Algorithm = "token_bucket"
+	// SlidingWindowLog admits Burst requests in any window of Burst/Rate
+	// seconds. It remembers the time of every admitted request, so memory
+	// per key grows with Burst.
+	SlidingWindowLog Algorithm = "sliding_window_log"
+	// SlidingWindowCounter approximates SlidingWindowLog from the counts of
+	// the current and previous fixed windows, in constant memory.
+	SlidingWindowCounter Algorithm = "sliding_window_counter"
+	// GCRA (generic cell rate algorithm) spaces requests 1/Rate seconds
+	// apart with a tolerance of Burst; it behaves like the token bucket but
+	// keeps a single timestamp.
+	GCRA Algorithm = "gcra"
+)
+
+// NewLimiter returns a limiter enforcing limit with alg. An empty alg
+// selects the token bucket; a nil clock uses time.Now.
+func NewLimiter(alg Algorithm, limit Limit, clock Clock) Limiter {
+	if clock == nil {
+		clock = time.Now
+	}
+	if limit.Rate <= 0 || limit.Burst < 1 {
+		// Windows and spacing need a rate and room for a request; the token
+		// bucket handles such limits without dividing by zero.
+		return newTokenBucket(limit, clock)
+	}
+	switch alg {
+	case SlidingWindowLog:
+		return &slidingWindowLog{
+			window: limitWindow(limit),
+			limit:  int(math.Floor(limit.Burst)),
+			now:    clock,
+		}
+	case SlidingWindowCounter:
+		return &slidingWindowCounter{
+			window: limitWindow(limit),
+			limit:  math.Floor(limit.Burst),
+			start:  clock(),
+			now:    clock,
+		}
+	case GCRA:
+		interval := seconds(1 / limit.Rate)
+		return &gcra{
+			interval:  interval,
+			tolerance: time.Duration(float64(interval) * limit.Burst),
+			burst:     limit.Burst,
+			now:       clock,
+		}
+	}
+	return newTokenBucket(limit, clock)
+}
+
+// limitWindow is the window in which a windowed algorithm admits Burst
+// requests, so their average rate matches the token bucket's.
+func limitWindow(limit Limit) time.Duration {
+	return seconds(limit.Burst / limit.Rate)
+}
+
+// forgetAfter is how long a key must be idle before its limiter is back
+// to its initial state and can be dropped without handing out requests.
+func (a Algorithm) forgetAfter(limit Limit) time.Duration {
+	if limit.Rate <= 0 {
+		return 0
+	}
+	if a == SlidingWindowCounter {
+		// The previous window still counts until the current one ends.
+		return 2 * limitWindow(limit)
+	}
+	return limitWindow(limit)
+}
+
+type slidingWindowLog struct {
+	mu     sync.Mutex
+	window time.Duration
+	limit  int
+	// times holds the admission times within the window, oldest first.
+	times []time.Time
+	now   Clock
+}
+
+func (l *slidingWindowLog) Take() Decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	expired := 0
+	for expired < len(l.times) && !l.times[expired].Add(l.window).After(now) {
+		expired++
+	}
+	l.times = l.times[expired:]
+
+	d := Decision{Limit: float64(l.limit)}
+	if len(l.times) < l.limit {
+		l.times = append(l.times, now)
+		d.Allowed = true
+	}
+	d.Remaining = float64(l.limit - len(l.times))
+	if len(l.times) > 0 {
+		if d.Remaining < 1 {
+			d.RetryAfter = l.times[0].Add(l.window).Sub(now)
+		}
+		d.Reset = l.times[len(l.times)-1].Add(l.window).Sub(now)
+	}
+	return d
+}
+
+func (l *slidingWindowLog) Refund() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.times) > 0 {
+		l.times = l.times[:len(l.times)-1]
+	}
+}
+
+type slidingWindowCounter struct {
+	mu     sync.Mutex
+	window time.Duration
+	limit  float64
+	// start is the beginning of the current fixed window; prev and curr
+	// count the requests admitted in the previous and current one.
+	start      time.Time
+	prev, curr float64
+	now        Clock
+}
+
+func (c *slidingWindowCounter) Take() Decision {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if n := now.Sub(c.start) / c.window; n > 0 {
+		c.prev = 0
+		if n == 1 {
+			c.prev = c.curr
+		}
+		c.curr = 0
+		c.start = c.start.Add(n * c.window)
+	}
+	elapsed := now.Sub(c.start)
+
+	// A request is admitted while the estimate is below the limit, so
+	// evenly spaced requests at the full rate all pass.
+	d := Decision{Limit: c.limit}
+	used := c.used(elapsed)
+	if used < c.limit {
+		c.curr++
+		used++
+		d.Allowed = true
+	}
+	d.Remaining = max(0, math.Ceil(c.limit-used))
+	if d.Remaining < 1 {
+		d.RetryAfter = c.until(elapsed, c.limit)
+	}
+	d.Reset = c.until(elapsed, 0)
+	return d
+}
+
+func (c *slidingWindowCounter) Refund() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.curr = max(0, c.curr-1)
+}
+
+// used estimates the requests admitted in the sliding window ending
+// elapsed into the current fixed window, weighting the previous window by
+// its overlap.
+func (c *slidingWindowCounter) used(elapsed time.Duration) float64 {
+	return c.prev*(1-float64(elapsed)/float64(c.window)) + c.curr
+}
+
+// until returns how long after elapsed the estimate drops to target.
+func (c *slidingWindowCounter) until(elapsed time.Duration, target float64) time.Duration {
+	if c.curr < target || c.curr == 0 {
+		if c.prev == 0 {
+			return 0
+		}
+		// Within the current window, only the previous one's weight falls.
+		at := time.Duration(float64(c.window) * (1 - (target-c.curr)/c.prev))
+		return max(0, at-elapsed)
+	}
+	// In the next window the current count becomes the previous one.
+	at := time.Duration(float64(c.window) * (1 - target/c.curr))
+	return c.window - elapsed + at
+}
+
+type gcra struct {
+	mu sync.Mutex
+	// interval is the spacing of requests at the sustained rate and
+	// tolerance how far ahead of it a burst may run.
+	interval  time.Duration
+	tolerance time.Duration
+	burst     float64
+	// tat is the theoretical arrival time of the next request.
+	tat time.Time
+	now Clock
+}
+
+func (g *gcra) Take() Decision {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	tat := g.tat
+	if tat.Before(now) {
+		tat = now
+	}
+
+	d := Decision{Limit: g.burst}
+	if next := tat.Add(g.interval); next.Sub(now) <= g.tolerance {
+		g.tat = next
+		tat = next
+		d.Allowed = true
+	}
+	backlog := tat.Sub(now)
+	d.Remaining = max(0, math.Floor(float64(g.tolerance-backlog)/float64(g.interval)))
+	if d.Remaining < 1 {
+		d.RetryAfter = max(0, backlog+g.interval-g.tolerance)
+	}
+	d.Reset = backlog
+	return d
+}
+
+func (g *gcra) Refund() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.tat = g.tat.Add(-g.interval)
+}
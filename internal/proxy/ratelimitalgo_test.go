@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that tests move by hand.
+type fakeClock struct {
+	now time.Time
+}
+
+func newFakeClock(t time.Time) *fakeClock {
+	return &fakeClock{now: t}
+}
+
+func (c *fakeClock) Now() time.Time      { return c.now }
+func (c *fakeClock) Set(t time.Time)     { c.now = t }
+func (c *fakeClock) Add(d time.Duration) { c.now = c.now.Add(d) }
+
+var algorithms = []Algorithm{TokenBucket, SlidingWindowLog, SlidingWindowCounter, GCRA}
+
+// takeN takes n times and returns how many were allowed.
+func takeN(l Limiter, n int) int {
+	allowed := 0
+	for range n {
+		if l.Take().Allowed {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestLimitersAdmitBurstThenRate(t *testing.T) {
+	for _, alg := range algorithms {
+		t.Run(string(alg), func(t *testing.T) {
+			now := time.Now()
+			l := NewLimiter(alg, Limit{Rate: 2, Burst: 4}, func() time.Time { return now })
+
+			if got := takeN(l, 6); got != 4 {
+				t.Fatalf("expected a burst of 4 admitted, got %d", got)
+			}
+			d := l.Take()
+			if d.Allowed || d.Remaining != 0 || d.RetryAfter <= 0 {
+				t.Fatalf("expected rejection with a retry time, got %+v", d)
+			}
+
+			// Just past the reported time the next request is admitted.
+			now = now.Add(d.RetryAfter + time.Millisecond)
+			if !l.Take().Allowed {
+				t.Fatalf("expected request admitted after Retry-After %v", d.RetryAfter)
+			}
+
+			// Over a long run the average rate holds.
+			admitted := 0
+			for range 100 {
+				now = now.Add(100 * time.Millisecond)
+				admitted += takeN(l, 1)
+			}
+			if admitted < 19 || admitted > 21 {
+				t.Fatalf("expected about 20 requests admitted over 10s at 2/s, got %d", admitted)
+			}
+		})
+	}
+}
+
+func TestLimitersResetWhenIdle(t *testing.T) {
+	for _, alg := range algorithms {
+		t.Run(string(alg), func(t *testing.T) {
+			limit := Limit{Rate: 2, Burst: 4}
+			now := time.Now()
+			l := NewLimiter(alg, limit, func() time.Time { return now })
+
+			takeN(l, 4)
+			d := l.Take()
+			if d.Reset <= 0 || d.Reset > alg.forgetAfter(limit) {
+				t.Fatalf("expected reset within %v, got %v", alg.forgetAfter(limit), d.Reset)
+			}
+			now = now.Add(alg.forgetAfter(limit))
+			if got := takeN(l, 5); got != 4 {
+				t.Fatalf("expected a full burst of 4 after %v idle, got %d", alg.forgetAfter(limit), got)
+			}
+		})
+	}
+}
+
+func TestLimitersRefund(t *testing.T) {
+	for _, alg := range algorithms {
+		t.Run(string(alg), func(t *testing.T) {
+			now := time.Now()
+			l := NewLimiter(alg, Limit{Rate: 2, Burst: 4}, func() time.Time { return now })
+
+			takeN(l, 4)
+			l.Refund()
+			if got := takeN(l, 2); got != 1 {
+				t.Fatalf("expected the refunded request to be admitted again, got %d", got)
+			}
+		})
+	}
+}
+
+func TestSlidingWindowLogCountsEveryRequestInWindow(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter(SlidingWindowLog, Limit{Rate: 1, Burst: 3}, func() time.Time { return now })
+
+	takeN(l, 2)
+	now = now.Add(2 * time.Second)
+	takeN(l, 1)
+	// The first two requests leave the 3s window at 3s, the third at 5s.
+	now = now.Add(999 * time.Millisecond)
+	if l.Take().Allowed {
+		t.Fatalf("expected rejection while three requests are in the window")
+	}
+	now = now.Add(time.Millisecond)
+	if got := takeN(l, 3); got != 2 {
+		t.Fatalf("expected 2 requests admitted once the first two expired, got %d", got)
+	}
+}
+
+func TestSlidingWindowCounterWeightsPreviousWindow(t *testing.T) {
+	start := time.Now()
+	now := start
+	l := NewLimiter(SlidingWindowCounter, Limit{Rate: 1, Burst: 10}, func() time.Time { return now })
+
+	takeN(l, 10)
+	// A quarter into the next window, the previous one still counts 7.5,
+	// so requests are admitted while the estimate is below 10.
+	now = start.Add(12500 * time.Millisecond)
+	d := l.Take()
+	if !d.Allowed || d.Remaining != 2 {
+		t.Fatalf("expected admission with 2 remaining, got %+v", d)
+	}
+	if got := takeN(l, 3); got != 2 {
+		t.Fatalf("expected 2 more requests admitted, got %d", got)
+	}
+}
@@ -1,7 +1,15 @@
 package proxy
 
 import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/maphash"
+	"maps"
+	"math"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,25 +19,51 @@ type RateLimiter struct {
 	capacity   float64 // max tokens
 	tokens     float64
 	lastUpdate time.Time
+	now        Clock
 	mu         sync.Mutex
 }
 
 // NewRateLimiter creates a new Token Bucket limiter
 func NewRateLimiter(rate, capacity float64) *RateLimiter {
+	return newTokenBucket(Limit{Rate: rate, Burst: capacity}, time.Now)
+}
+
+func newTokenBucket(limit Limit, clock Clock) *RateLimiter {
 	return &RateLimiter{
-		rate:       rate,
-		capacity:   capacity,
-		tokens:     capacity,
-		lastUpdate: time.Now(),
+		rate:       limit.Rate,
+		capacity:   limit.Burst,
+		tokens:     limit.Burst,
+		lastUpdate: clock(),
+		now:        clock,
 	}
 }
 
 // Allow checks if a request can be proceeded
 func (rl *RateLimiter) Allow() bool {
+	return rl.Take().Allowed
+}
+
+// Decision is the outcome of a rate limit check and the state of the
+// limit after it, as reported in rate limit headers.
+type Decision struct {
+	Allowed bool
+	// Limit is the bucket capacity, or the requests allowed per window.
+	Limit float64
+	// Remaining is the number of requests that would be admitted now.
+	Remaining float64
+	// RetryAfter is the time until the next request is admitted; zero
+	// while one is left.
+	RetryAfter time.Duration
+	// Reset is the time until the limit is fully available again.
+	Reset time.Duration
+}
+
+// Take consumes a token if one is available and reports the bucket state.
+func (rl *RateLimiter) Take() Decision {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
-	now := time.Now()
+	now := rl.now()
 	// Refill tokens based on time passed
 	elapsed := now.Sub(rl.lastUpdate).Seconds()
 	rl.tokens += elapsed * rl.rate
@@ -38,10 +72,255 @@ func (rl *RateLimiter) Allow() bool {
 	}
 	rl.lastUpdate = now
 
+	d := Decision{Limit: rl.capacity}
 	if rl.tokens >= 1 {
 		rl.tokens--
+		d.Allowed = true
+	}
+	d.Remaining = math.Floor(rl.tokens)
+	if rl.rate > 0 {
+		if rl.tokens < 1 {
+			d.RetryAfter = seconds((1 - rl.tokens) / rl.rate)
+		}
+		d.Reset = seconds((rl.capacity - rl.tokens) / rl.rate)
+	}
+	return d
+}
+
+// Refund puts back a token consumed by Take.
+func (rl *RateLimiter) Refund() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.tokens = min(rl.tokens+1, rl.capacity)
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// Limit is a token bucket rate and burst capacity.
+type Limit struct {
+	Rate  float64
+	Burst float64
+}
+
+// KeyedRateLimiterOptions bound the memory used by a KeyedRateLimiter and
+// set limits for individual keys.
+type KeyedRateLimiterOptions struct {
+	// IdleTTL evicts buckets of keys not seen for this long. It is raised
+	// to the time an empty bucket takes to refill, so eviction never hands
+	// out extra tokens. Zero means 10 minutes.
+	IdleTTL time.Duration
+	// MaxKeys caps the number of tracked keys; beyond it the least
+	// recently seen ones are evicted. Zero means 100000.
+	MaxKeys int
+	// CleanupInterval is how often Run evicts idle buckets. Zero means one
+	// minute.
+	CleanupInterval time.Duration
+	// Overrides replace the limit for specific keys, e.g. premium API keys.
+	Overrides map[string]Limit
+	// Algorithm enforces the limits; empty means the token bucket.
+	Algorithm Algorithm
+	// Clock defaults to time.Now.
+	Clock Clock
+	// Store shares the limits with other instances; Namespace separates
+	// this limiter's keys from those of other limiters in the store.
+	Store     *RateLimitStore
+	Namespace string
+}
+
+// limiterShards splits the keys over independently locked maps.
+const limiterShards = 64
+
+// maxStoredKeyLen is the longest key stored as is; longer ones are hashed.
+const maxStoredKeyLen = 128
+
+// runningLimiters are the limiters whose Run is active, for metrics.
+var runningLimiters sync.Map
+
+// trackedRateLimitKeys returns the number of keys held by running limiters.
+func trackedRateLimitKeys() int {
+	n := 0
+	runningLimiters.Range(func(l, _ any) bool {
+		n += l.(*KeyedRateLimiter).Len()
 		return true
+	})
+	return n
+}
+
+// KeyedRateLimiter manages a set of Limiters keyed by an arbitrary string,
+// such as a client IP or an API key.
+type KeyedRateLimiter struct {
+	limit     Limit
+	overrides map[string]Limit
+	algorithm Algorithm
+	store     *RateLimitStore
+	namespace string
+	ttl       time.Duration
+	interval  time.Duration
+	// shardMax is MaxKeys spread over the shards; LRU order is kept per
+	// shard, which approximates a global LRU for well-spread keys.
+	shardMax int
+	seed     maphash.Seed
+	shards   [limiterShards]limiterShard
+	now      Clock
+}
+
+type limiterShard struct {
+	mu sync.Mutex
+	// keys index lru, whose front is the most recently seen key.
+	keys map[string]*list.Element
+	lru  list.List
+}
+
+type limiterEntry struct {
+	key      string
+	limiter  Limiter
+	lastSeen time.Time
+}
+
+// NewIPRateLimiter creates a new IP-based rate limiter with default memory
+// bounds.
+func NewIPRateLimiter(rate, capacity float64) *KeyedRateLimiter {
+	return NewKeyedRateLimiter(Limit{Rate: rate, Burst: capacity}, KeyedRateLimiterOptions{})
+}
+
+// NewKeyedRateLimiter creates a rate limiter applying limit to every key
+// without an override. Idle buckets are only evicted while Run is running;
+// the key cap always holds.
+func NewKeyedRateLimiter(limit Limit, opts KeyedRateLimiterOptions) *KeyedRateLimiter {
+	if opts.IdleTTL == 0 {
+		opts.IdleTTL = 10 * time.Minute
 	}
+	limits := append([]Limit{limit}, slices.Collect(maps.Values(opts.Overrides))...)
+	for _, lim := range limits {
+		opts.IdleTTL = max(opts.IdleTTL, opts.Algorithm.forgetAfter(lim))
+	}
+	if opts.MaxKeys == 0 {
+		opts.MaxKeys = 100000
+	}
+	if opts.CleanupInterval == 0 {
+		opts.CleanupInterval = time.Minute
+	}
+	if opts.Clock == nil {
+		opts.Clock = time.Now
+	}
+
+	l := &KeyedRateLimiter{
+		limit:     limit,
+		overrides: opts.Overrides,
+		algorithm: opts.Algorithm,
+		store:     opts.Store,
+		namespace: opts.Namespace,
+		ttl:       opts.IdleTTL,
+		interval:  opts.CleanupInterval,
+		shardMax:  max(1, (opts.MaxKeys+limiterShards-1)/limiterShards),
+		seed:      maphash.MakeSeed(),
+		now:       opts.Clock,
+	}
+	for i := range l.shards {
+		l.shards[i].keys = make(map[string]*list.Element)
+	}
+	return l
+}
+
+// getLimiter returns the Limiter for the given key, creating one if needed.
+func (l *KeyedRateLimiter) getLimiter(key string) Limiter {
+	lim, ok := l.overrides[key]
+	if !ok {
+		lim = l.limit
+	}
+	key = storedKey(key)
+	sh := &l.shards[maphash.String(l.seed, key)%limiterShards]
+	now := l.now()
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if el, ok := sh.keys[key]; ok {
+		e := el.Value.(*limiterEntry)
+		e.lastSeen = now
+		sh.lru.MoveToFront(el)
+		return e.limiter
+	}
+
+	if sh.lru.Len() >= l.shardMax {
+		sh.evict(sh.lru.Back())
+		atomic.AddUint64(&GlobalMetrics.RateLimiterEvictedLRU, 1)
+	}
+	e := &limiterEntry{key: key, limiter: l.newLimiter(key, lim), lastSeen: now}
+	sh.keys[key] = sh.lru.PushFront(e)
+	return e.limiter
+}
 
-	return false
+// storedKey returns key, or its hash if it is too long to store. Keys come
+// from request data; don't let one pin a large header.
+func storedKey(key string) string {
+	if len(key) <= maxStoredKeyLen {
+		return key
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func (l *KeyedRateLimiter) newLimiter(key string, lim Limit) Limiter {
+	if l.store != nil {
+		return newSharedLimiter(l.store, l.store.opts.Prefix+l.namespace+":"+key, l.algorithm, lim, l.now)
+	}
+	return NewLimiter(l.algorithm, lim, l.now)
+}
+
+// evict removes el; the caller holds sh.mu.
+func (sh *limiterShard) evict(el *list.Element) {
+	delete(sh.keys, el.Value.(*limiterEntry).key)
+	sh.lru.Remove(el)
+}
+
+// Run evicts idle buckets every cleanup interval until stop is closed.
+// While it runs, the limiter's keys count towards the tracked keys metric.
+func (l *KeyedRateLimiter) Run(stop <-chan struct{}) {
+	runningLimiters.Store(l, struct{}{})
+	defer runningLimiters.Delete(l)
+
+	t := time.NewTicker(l.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			l.evictIdle()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// evictIdle removes buckets not used within the idle TTL. Entries are
+// walked from the least recently seen end, so it stops at the first
+// active one.
+func (l *KeyedRateLimiter) evictIdle() {
+	cutoff := l.now().Add(-l.ttl)
+	for i := range l.shards {
+		sh := &l.shards[i]
+		sh.mu.Lock()
+		for el := sh.lru.Back(); el != nil; el = sh.lru.Back() {
+			if el.Value.(*limiterEntry).lastSeen.After(cutoff) {
+				break
+			}
+			sh.evict(el)
+			atomic.AddUint64(&GlobalMetrics.RateLimiterEvictedIdle, 1)
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// Len returns the number of tracked keys.
+func (l *KeyedRateLimiter) Len() int {
+	n := 0
+	for i := range l.shards {
+		sh := &l.shards[i]
+		sh.mu.Lock()
+		n += sh.lru.Len()
+		sh.mu.Unlock()
+	}
+	return n
 }
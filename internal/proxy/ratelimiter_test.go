@@ -1,6 +1,9 @@
 package proxy
 
 import (
+	"fmt"
+	"hash/maphash"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -22,7 +25,8 @@ func TestRateLimiterInitialBurst(t *testing.T) {
 }
 
 func TestRateLimiterRefill(t *testing.T) {
-	rl := NewRateLimiter(2, 2) // 2 tokens/second, capacity 2
+	now := time.Now()
+	rl := newTokenBucket(Limit{Rate: 2, Burst: 2}, func() time.Time { return now }) // 2 tokens/second, capacity 2
 
 	// Consume both tokens.
 	if !rl.Allow() || !rl.Allow() {
@@ -33,10 +37,76 @@ func TestRateLimiterRefill(t *testing.T) {
 		t.Fatalf("expected third immediate Allow to fail when bucket is empty")
 	}
 
-	// Wait slightly more than half a second so at least one token is refilled.
-	time.Sleep(600 * time.Millisecond)
+	// Half a second refills one token.
+	now = now.Add(500 * time.Millisecond)
 
 	if !rl.Allow() {
 		t.Fatalf("expected Allow to succeed after tokens refill")
 	}
+	if rl.Allow() {
+		t.Fatalf("expected Allow to fail once the refilled token is used")
+	}
+}
+
+func TestKeyedRateLimiterEvictsIdleBuckets(t *testing.T) {
+	l := NewKeyedRateLimiter(Limit{Rate: 10, Burst: 10}, KeyedRateLimiterOptions{IdleTTL: time.Minute})
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	l.getLimiter("192.0.2.1")
+	now = now.Add(30 * time.Second)
+	l.getLimiter("192.0.2.2")
+	now = now.Add(45 * time.Second)
+
+	l.evictIdle()
+	if got := l.Len(); got != 1 {
+		t.Fatalf("expected only the recently seen client to remain, got %d keys", got)
+	}
+	sh := &l.shards[maphash.String(l.seed, "192.0.2.2")%limiterShards]
+	if _, ok := sh.keys["192.0.2.2"]; !ok {
+		t.Fatalf("expected 192.0.2.2 to survive eviction")
+	}
+}
+
+func TestKeyedRateLimiterIdleTTLCoversRefill(t *testing.T) {
+	// An empty bucket needs 100s to refill; evicting it earlier would hand
+	// the client a full bucket.
+	l := NewKeyedRateLimiter(Limit{Rate: 1, Burst: 100}, KeyedRateLimiterOptions{IdleTTL: time.Second})
+	if l.ttl != 100*time.Second {
+		t.Fatalf("expected idle TTL raised to the refill time, got %v", l.ttl)
+	}
+}
+
+func TestKeyedRateLimiterCapsKeys(t *testing.T) {
+	l := NewKeyedRateLimiter(Limit{Rate: 1, Burst: 1}, KeyedRateLimiterOptions{MaxKeys: limiterShards})
+	evicted := atomic.LoadUint64(&GlobalMetrics.RateLimiterEvictedLRU)
+	for i := range 10 * limiterShards {
+		l.getLimiter(fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+	}
+	if got := l.Len(); got > limiterShards {
+		t.Fatalf("expected at most %d keys, got %d", limiterShards, got)
+	}
+	if got := atomic.LoadUint64(&GlobalMetrics.RateLimiterEvictedLRU) - evicted; got < 9*limiterShards {
+		t.Fatalf("expected at least %d capacity evictions, got %d", 9*limiterShards, got)
+	}
+}
+
+func TestRateLimiterTakeReportsState(t *testing.T) {
+	rl := NewRateLimiter(2, 2) // 2 tokens/second, capacity 2
+
+	d := rl.Take()
+	if !d.Allowed || d.Limit != 2 || d.Remaining != 1 || d.RetryAfter != 0 {
+		t.Fatalf("expected first Take to leave 1 token, got %+v", d)
+	}
+	rl.Take()
+	d = rl.Take()
+	if d.Allowed || d.Remaining != 0 {
+		t.Fatalf("expected empty bucket to reject, got %+v", d)
+	}
+	if d.RetryAfter <= 0 || d.RetryAfter > 500*time.Millisecond {
+		t.Fatalf("expected next token within 500ms, got %v", d.RetryAfter)
+	}
+	if d.Reset <= 500*time.Millisecond || d.Reset > time.Second {
+		t.Fatalf("expected bucket to be full within 1s, got %v", d.Reset)
+	}
 }
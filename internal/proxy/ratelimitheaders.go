@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/sargisis/edgecore/internal/router"
+)
+
+// RateLimitResponseOptions shape the headers and body of rate limited
+// responses.
+type RateLimitResponseOptions struct {
+	// DisableHeaders omits RateLimit-* headers; Retry-After is still sent
+	// with 429 responses.
+	DisableHeaders bool
+	// LegacyHeaders also sends X-RateLimit-Limit, X-RateLimit-Remaining and
+	// X-RateLimit-Reset (a Unix timestamp), as older clients expect.
+	LegacyHeaders bool
+	// ErrorBody replaces the default JSON body of 429 responses. It must be
+	// valid JSON.
+	ErrorBody json.RawMessage
+}
+
+var rateLimitResponse atomic.Pointer[RateLimitResponseOptions]
+
+func init() {
+	rateLimitResponse.Store(&RateLimitResponseOptions{})
+}
+
+// SetRateLimitResponse replaces the rate limit response options.
+func SetRateLimitResponse(opts RateLimitResponseOptions) {
+	rateLimitResponse.Store(&opts)
+}
+
+// setRateLimitHeaders describes d in the RateLimit-* headers of the IETF
+// draft (draft-ietf-httpapi-ratelimit-headers), whose reset is the number
+// of seconds until the bucket is full again.
+func setRateLimitHeaders(h http.Header, d Decision) {
+	opts := rateLimitResponse.Load()
+	if opts.DisableHeaders {
+		return
+	}
+	limit := strconv.FormatFloat(math.Floor(d.Limit), 'f', 0, 64)
+	remaining := strconv.FormatFloat(d.Remaining, 'f', 0, 64)
+	h.Set("RateLimit-Limit", limit)
+	h.Set("RateLimit-Remaining", remaining)
+	h.Set("RateLimit-Reset", strconv.FormatInt(ceilSeconds(d.Reset), 10))
+	if opts.LegacyHeaders {
+		h.Set("X-RateLimit-Limit", limit)
+		h.Set("X-RateLimit-Remaining", remaining)
+		h.Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(d.Reset).Unix(), 10))
+	}
+}
+
+// rateLimited answers a request rejected by d: gRPC clients get
+// RESOURCE_EXHAUSTED, everyone else a 429 with Retry-After and a JSON body.
+func rateLimited(w http.ResponseWriter, r *http.Request, d Decision) {
+	atomic.AddUint64(&GlobalMetrics.RateLimited, 1)
+
+	retry := max(1, ceilSeconds(d.RetryAfter))
+	h := w.Header()
+	setRateLimitHeaders(h, d)
+	h.Set("Retry-After", strconv.FormatInt(retry, 10))
+	if router.IsGRPC(r) {
+		GRPCError(w, GRPCResourceExhausted, "rate limit exceeded")
+		return
+	}
+
+	body := rateLimitResponse.Load().ErrorBody
+	if len(body) == 0 {
+		body, _ = json.Marshal(struct {
+			Error      string `json:"error"`
+			Message    string `json:"message"`
+			RetryAfter int64  `json:"retry_after_seconds"`
+		}{"rate_limit_exceeded", "Rate limit exceeded", retry})
+	}
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write(body)
+}
+
+// ceilSeconds rounds d up to whole seconds, as rate limit headers use.
+func ceilSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sargisis/edgecore/internal/router"
+)
+
+// KeyTemplate builds a rate limit key from request attributes. Templates
+// mix literal text with placeholders:
+//
+//	{ip}             client IP
+//	{method}         request method
+//	{host}           host name, without port
+//	{path}           request path
+//	{route}          name of the matched route
+//	{user}           common name of the verified client certificate
+//	{header:Name}    request header
+//	{cookie:Name}    cookie value
+//	{query:Name}     query parameter
+//	{jwt:claim}      claim of the bearer token (signature not verified)
+//
+// A request for which any placeholder is empty has no key.
+type KeyTemplate struct {
+	raw   string
+	parts []keyPart
+}
+
+// keyPart is literal text or, when value is set, a placeholder.
+type keyPart struct {
+	literal string
+	value   func(r *http.Request) string
+}
+
+// ParseKeyTemplate parses a template such as "{header:X-API-Key}:{route}".
+func ParseKeyTemplate(s string) (KeyTemplate, error) {
+	t := KeyTemplate{raw: s}
+	rest := s
+	for rest != "" {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			t.parts = append(t.parts, keyPart{literal: rest})
+			break
+		}
+		if open > 0 {
+			t.parts = append(t.parts, keyPart{literal: rest[:open]})
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return KeyTemplate{}, fmt.Errorf("unclosed placeholder in key %q", s)
+		}
+		value, err := placeholder(rest[open+1 : open+end])
+		if err != nil {
+			return KeyTemplate{}, fmt.Errorf("key %q: %w", s, err)
+		}
+		t.parts = append(t.parts, keyPart{value: value})
+		rest = rest[open+end+1:]
+	}
+	if len(t.parts) == 0 {
+		return KeyTemplate{}, fmt.Errorf("empty key template")
+	}
+	return t, nil
+}
+
+// String returns the template as written.
+func (t KeyTemplate) String() string {
+	return t.raw
+}
+
+// Key builds the key of r. It returns false when a placeholder is empty,
+// e.g. a request without the API key header.
+func (t KeyTemplate) Key(r *http.Request) (string, bool) {
+	if len(t.parts) == 1 && t.parts[0].value != nil {
+		v := t.parts[0].value(r)
+		return v, v != ""
+	}
+	var b strings.Builder
+	for _, p := range t.parts {
+		if p.value == nil {
+			b.WriteString(p.literal)
+			continue
+		}
+		v := p.value(r)
+		if v == "" {
+			return "", false
+		}
+		b.WriteString(v)
+	}
+	return b.String(), true
+}
+
+func placeholder(name string) (func(r *http.Request) string, error) {
+	kind, arg, hasArg := strings.Cut(name, ":")
+	if hasArg != (kind == "header" || kind == "cookie" || kind == "query" || kind == "jwt") || (hasArg && arg == "") {
+		return nil, fmt.Errorf("invalid placeholder {%s}", name)
+	}
+
+	switch kind {
+	case "ip":
+		return clientIP, nil
+	case "method":
+		return func(r *http.Request) string { return r.Method }, nil
+	case "host":
+		return func(r *http.Request) string {
+			host := strings.ToLower(r.Host)
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			return host
+		}, nil
+	case "path":
+		return func(r *http.Request) string { return r.URL.Path }, nil
+	case "route":
+		return func(r *http.Request) string {
+			if route := router.FromContext(r.Context()); route != nil {
+				return route.Name
+			}
+			return ""
+		}, nil
+	case "user":
+		return func(r *http.Request) string {
+			if cert := clientCertificate(r); cert != nil {
+				return cert.Subject.CommonName
+			}
+			return ""
+		}, nil
+	case "header":
+		return func(r *http.Request) string { return r.Header.Get(arg) }, nil
+	case "cookie":
+		return func(r *http.Request) string {
+			if c, err := r.Cookie(arg); err == nil {
+				return c.Value
+			}
+			return ""
+		}, nil
+	case "query":
+		return func(r *http.Request) string { return r.URL.Query().Get(arg) }, nil
+	case "jwt":
+		return func(r *http.Request) string { return jwtClaim(r, arg) }, nil
+	}
+	return nil, fmt.Errorf("unknown placeholder {%s}", name)
+}
+
+// jwtClaim returns a string or number claim of the bearer token in the
+// Authorization header. The signature is not checked: edgecore has no keys
+// for it, so the claim is only as trustworthy as the client.
+func jwtClaim(r *http.Request, claim string) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return ""
+	}
+	parts := strings.Split(auth[7:], ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	switch v := claims[claim].(type) {
+	case string:
+		return v
+	case float64:
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// RateLimitRule limits requests sharing a key built from Key. Rules stack:
+// a request must pass the per-IP limit and every rule that yields a key.
+type RateLimitRule struct {
+	Name    string
+	Key     KeyTemplate
+	Limiter *KeyedRateLimiter
+}
+
+var rateLimitRules atomic.Pointer[[]*RateLimitRule]
+
+// ruleRejections counts rejections per rule name; it outlives rules
+// replaced by a reload so the counters stay monotonic.
+var ruleRejections sync.Map
+
+func init() {
+	rateLimitRules.Store(&[]*RateLimitRule{})
+}
+
+// SetRateLimitRules replaces the rules applied by IPRateLimitMiddleware.
+func SetRateLimitRules(rules []*RateLimitRule) {
+	rateLimitRules.Store(&rules)
+}
+
+func recordRuleRejection(name string) {
+	c, _ := ruleRejections.LoadOrStore(name, new(atomic.Uint64))
+	c.(*atomic.Uint64).Add(1)
+}
+
+// ruleRejectionCounts returns the rejections of every rule seen so far.
+func ruleRejectionCounts() map[string]uint64 {
+	counts := make(map[string]uint64)
+	ruleRejections.Range(func(name, c any) bool {
+		counts[name.(string)] = c.(*atomic.Uint64).Load()
+		return true
+	})
+	return counts
+}
+
+// stricter returns the decision to report of two stacked limits: a
+// rejection over an admission, the longer wait of two rejections and the
+// fewer remaining requests of two admissions.
+func stricter(a, b Decision) Decision {
+	switch {
+	case a.Allowed != b.Allowed:
+		if !a.Allowed {
+			return a
+		}
+		return b
+	case !a.Allowed:
+		if b.RetryAfter > a.RetryAfter {
+			return b
+		}
+		return a
+	case b.Remaining < a.Remaining || (b.Remaining == a.Remaining && b.Reset > a.Reset):
+		return b
+	}
+	return a
+}
@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sargisis/edgecore/internal/router"
+)
+
+func TestKeyTemplateKeys(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"alice","tenant":42}`))
+
+	req := httptest.NewRequest(http.MethodPost, "http://API.example.com:8443/v1/items?plan=pro", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-API-Key", "k1")
+	req.Header.Set("Authorization", "Bearer h."+payload+".s")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+	req = req.WithContext(router.WithRoute(req.Context(), &router.Route{Name: "items"}))
+
+	for template, want := range map[string]string{
+		"{ip}":                   "192.0.2.1",
+		"{method} {host}{path}":  "POST api.example.com/v1/items",
+		"{header:X-API-Key}":     "k1",
+		"key:{header:x-api-key}": "key:k1",
+		"{cookie:session}":       "s1",
+		"{query:plan}":           "pro",
+		"{route}:{jwt:sub}":      "items:alice",
+		"{jwt:tenant}":           "42",
+	} {
+		tmpl, err := ParseKeyTemplate(template)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", template, err)
+		}
+		if got, ok := tmpl.Key(req); !ok || got != want {
+			t.Fatalf("expected %q to give key %q, got %q (%v)", template, want, got, ok)
+		}
+	}
+
+	for _, template := range []string{"{user}", "{header:X-Missing}", "{jwt:email}", "{cookie:none}:x"} {
+		tmpl, err := ParseKeyTemplate(template)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", template, err)
+		}
+		if got, ok := tmpl.Key(req); ok {
+			t.Fatalf("expected %q to give no key, got %q", template, got)
+		}
+	}
+}
+
+func TestParseKeyTemplateRejectsInvalid(t *testing.T) {
+	for _, template := range []string{"", "{ip", "{nope}", "{header}", "{header:}", "{ip:x}"} {
+		if _, err := ParseKeyTemplate(template); err == nil {
+			t.Fatalf("expected %q to be rejected", template)
+		}
+	}
+}
+
+// withRules installs rate limit rules for the duration of a test.
+func withRules(t *testing.T, rules ...*RateLimitRule) {
+	t.Helper()
+
+	SetRateLimitRules(rules)
+	t.Cleanup(func() { SetRateLimitRules(nil) })
+}
+
+func keyRule(t *testing.T, name, template string, limit Limit, overrides map[string]Limit) *RateLimitRule {
+	t.Helper()
+
+	key, err := ParseKeyTemplate(template)
+	if err != nil {
+		t.Fatalf("failed to parse %q: %v", template, err)
+	}
+	return &RateLimitRule{
+		Name:    name,
+		Key:     key,
+		Limiter: NewKeyedRateLimiter(limit, KeyedRateLimiterOptions{Overrides: overrides}),
+	}
+}
+
+func TestRateLimitRulesStackAndOverride(t *testing.T) {
+	withRules(t,
+		keyRule(t, "api-key", "{header:X-API-Key}", Limit{Rate: 1, Burst: 2}, map[string]Limit{"premium": {Rate: 1, Burst: 4}}),
+		keyRule(t, "tenant", "{header:X-Tenant}", Limit{Rate: 1, Burst: 3}, nil),
+	)
+	before := ruleRejectionCounts()
+
+	handler := IPRateLimitMiddleware(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(apiKey, tenant string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		req.Header.Set("X-Tenant", tenant)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Both limits apply; headers report the tighter one.
+	rr := serve("basic", "t1")
+	if got := rr.Header().Get("RateLimit-Remaining"); rr.Code != http.StatusOK || got != "1" {
+		t.Fatalf("expected request allowed with 1 remaining, got status %d remaining %q", rr.Code, got)
+	}
+	serve("basic", "t1")
+	if rr := serve("basic", "t1"); rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected API key limit to reject third request, got status %d", rr.Code)
+	}
+
+	// The premium override outlasts the tenant limit, which now rejects.
+	for i := 0; i < 3; i++ {
+		if rr := serve("premium", "t2"); rr.Code != http.StatusOK {
+			t.Fatalf("expected premium request %d to be allowed, got status %d", i+1, rr.Code)
+		}
+	}
+	if rr := serve("premium", "t2"); rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected tenant limit to reject fourth request, got status %d", rr.Code)
+	}
+
+	// Requests without an API key skip that rule.
+	if rr := serve("", "t3"); rr.Code != http.StatusOK {
+		t.Fatalf("expected request without API key to be allowed, got status %d", rr.Code)
+	}
+
+	counts := ruleRejectionCounts()
+	if got := counts["api-key"] - before["api-key"]; got != 1 {
+		t.Fatalf("expected 1 rejection by api-key rule, got %d", got)
+	}
+	if got := counts["tenant"] - before["tenant"]; got != 1 {
+		t.Fatalf("expected 1 rejection by tenant rule, got %d", got)
+	}
+}
+
+func TestRateLimitRulesRefundRejectedRequests(t *testing.T) {
+	withRules(t,
+		keyRule(t, "user", "{header:X-User}", Limit{Rate: 0.01, Burst: 1}, nil),
+		keyRule(t, "global", "{host}", Limit{Rate: 0.01, Burst: 3}, nil),
+	)
+	handler := IPRateLimitMiddleware(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(user string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+		req.Header.Set("X-User", user)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := serve("abuser"); code != http.StatusOK {
+		t.Fatalf("expected first request allowed, got status %d", code)
+	}
+	for i := 0; i < 4; i++ {
+		if code := serve("abuser"); code != http.StatusTooManyRequests {
+			t.Fatalf("expected per-user limit to reject request %d, got status %d", i+2, code)
+		}
+	}
+	// Rejected requests did not use up the global limit.
+	for _, user := range []string{"alice", "bob"} {
+		if code := serve(user); code != http.StatusOK {
+			t.Fatalf("expected %s to be allowed by the global limit, got status %d", user, code)
+		}
+	}
+}
+
+func TestRateLimitMiddlewareWithoutLimitsSendsNoHeaders(t *testing.T) {
+	handler := IPRateLimitMiddleware(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com", nil))
+	if rr.Code != http.StatusOK || rr.Header().Get("RateLimit-Limit") != "" {
+		t.Fatalf("expected request passed through without headers, got status %d and %v", rr.Code, rr.Header())
+	}
+}
@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sargisis/edgecore/internal/resp"
+)
+
+// RateLimitStoreOptions configure a RateLimitStore.
+type RateLimitStoreOptions struct {
+	Client *resp.Client
+	// Prefix starts every key written to the store.
+	Prefix string
+	// LeaseSize is how many requests an instance reserves per round trip;
+	// zero means a tenth of the burst. Larger leases save round trips but
+	// let an instance hold requests others could have used.
+	LeaseSize int
+	// FailClosed rejects requests while the store is unreachable. By
+	// default each instance falls back to enforcing the limits locally.
+	FailClosed bool
+	// RetryInterval is how long the store is left alone after a failure;
+	// zero means one second.
+	RetryInterval time.Duration
+}
+
+// RateLimitStore counts requests in a Redis-compatible store shared by
+// edgecore instances, so a limit holds for all of them together.
+//
+// Limits are counted in fixed windows of Burst/Rate seconds aligned to the
+// Unix epoch, so instances need roughly synchronised clocks. Like any fixed
+// window, a client may get up to twice the burst across a window boundary.
+type RateLimitStore struct {
+	opts RateLimitStoreOptions
+	// downUntil is the UnixNano time before which the store is not tried.
+	downUntil atomic.Int64
+}
+
+// NewRateLimitStore returns a store using opts.Client.
+func NewRateLimitStore(opts RateLimitStoreOptions) *RateLimitStore {
+	if opts.RetryInterval == 0 {
+		opts.RetryInterval = time.Second
+	}
+	return &RateLimitStore{opts: opts}
+}
+
+// lease reserves up to n of the limit requests counted under key and
+// returns how many were granted and how many the window has used in total.
+// The key expires with ttl.
+func (s *RateLimitStore) lease(key string, n, limit int, ttl time.Duration) (granted, used int, err error) {
+	atomic.AddUint64(&GlobalMetrics.RateLimitStoreRequests, 1)
+	// SET NX creates the counter with its expiry, so no key outlives its
+	// window even if an instance dies between the two commands.
+	replies, err := s.opts.Client.Pipeline(context.Background(),
+		[]string{"SET", key, "0", "PX", strconv.FormatInt(ttl.Milliseconds(), 10), "NX"},
+		[]string{"INCRBY", key, strconv.Itoa(n)},
+	)
+	if err == nil {
+		if e, ok := replies[1].(resp.Error); ok {
+			err = e
+		}
+	}
+	if err != nil {
+		atomic.AddUint64(&GlobalMetrics.RateLimitStoreErrors, 1)
+		return 0, 0, err
+	}
+	total, ok := replies[1].(int64)
+	if !ok {
+		atomic.AddUint64(&GlobalMetrics.RateLimitStoreErrors, 1)
+		return 0, 0, fmt.Errorf("unexpected INCRBY reply %v", replies[1])
+	}
+	before := int(total) - n
+	granted = min(n, max(0, limit-before))
+	return granted, min(int(total), limit), nil
+}
+
+// available reports whether the store should be tried at now.
+func (s *RateLimitStore) available(now time.Time) bool {
+	return now.UnixNano() >= s.downUntil.Load()
+}
+
+// failed leaves the store alone for the retry interval.
+func (s *RateLimitStore) failed(now time.Time) {
+	s.downUntil.Store(now.Add(s.opts.RetryInterval).UnixNano())
+}
+
+// sharedLimiter enforces a limit counted in a RateLimitStore. Requests are
+// admitted from a local lease; the store is only asked for a new lease
+// once it runs out. One request fetches the lease without holding the
+// lock, and those arriving meanwhile wait for it, so every admission is
+// counted in the store.
+type sharedLimiter struct {
+	mu     sync.Mutex
+	store  *RateLimitStore
+	key    string
+	limit  int
+	lease  int
+	window time.Duration
+	// local enforces the limit while the store is unreachable, when the
+	// store fails open.
+	local Limiter
+	now   Clock
+
+	// The lease of the current window: tokens left locally, requests
+	// used cluster-wide when it was taken, and whether the window is
+	// spent.
+	windowIdx int64
+	tokens    int
+	used      int
+	exhausted bool
+	// fetching is set while a request is asking the store for a lease;
+	// fetched is signalled when it is done.
+	fetching bool
+	fetched  sync.Cond
+}
+
+func newSharedLimiter(store *RateLimitStore, key string, alg Algorithm, limit Limit, clock Clock) Limiter {
+	burst := int(math.Floor(limit.Burst))
+	if limit.Rate <= 0 || burst < 1 {
+		// Without a window there is nothing to share.
+		return NewLimiter(alg, limit, clock)
+	}
+	lease := store.opts.LeaseSize
+	if lease == 0 {
+		lease = burst / 10
+	}
+	l := &sharedLimiter{
+		store:     store,
+		key:       key,
+		limit:     burst,
+		lease:     min(max(1, lease), burst),
+		window:    limitWindow(limit),
+		local:     NewLimiter(alg, limit, clock),
+		now:       clock,
+		windowIdx: -1,
+	}
+	l.fetched.L = &l.mu
+	return l
+}
+
+func (l *sharedLimiter) Take() Decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var now time.Time
+	var idx int64
+	for {
+		now = l.now()
+		idx = now.UnixNano() / int64(l.window)
+		if idx != l.windowIdx {
+			l.windowIdx, l.tokens, l.used, l.exhausted = idx, 0, 0, false
+		}
+		if l.tokens > 0 || l.exhausted {
+			break
+		}
+		if !l.store.available(now) {
+			return l.unavailable(now)
+		}
+		if l.fetching {
+			l.fetched.Wait()
+			continue
+		}
+
+		l.fetching = true
+		l.mu.Unlock()
+		granted, used, err := l.store.lease(l.key+":"+strconv.FormatInt(idx, 10), l.lease, l.limit, 2*l.window)
+		l.mu.Lock()
+		l.fetching = false
+		l.fetched.Broadcast()
+		if err != nil {
+			l.store.failed(now)
+			logEntry(LogEntry{Level: "warn", Message: "rate limit store unavailable", Error: err.Error()})
+			return l.unavailable(now)
+		}
+		if idx != l.windowIdx {
+			// The window ended during the round trip; its lease is of no
+			// use to the next one.
+			continue
+		}
+		// Refunds during the round trip are kept.
+		l.tokens += granted
+		l.used, l.exhausted = used, l.tokens == 0
+	}
+
+	end := time.Unix(0, (idx+1)*int64(l.window))
+	d := Decision{Limit: float64(l.limit), Reset: end.Sub(now)}
+	if l.tokens > 0 {
+		l.tokens--
+		d.Allowed = true
+	}
+	// Others' leases count as used; our own unspent tokens do not.
+	d.Remaining = float64(l.limit - l.used + l.tokens)
+	if d.Remaining < 1 {
+		d.RetryAfter = d.Reset
+	}
+	return d
+}
+
+// Refund returns a request to the lease of the current window, or to the
+// local limiter while the store is unavailable.
+func (l *sharedLimiter) Refund() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	switch {
+	case !l.store.available(now):
+		if !l.store.opts.FailClosed {
+			l.local.Refund()
+		}
+	case now.UnixNano()/int64(l.window) == l.windowIdx:
+		l.tokens++
+	}
+}
+
+// unavailable decides without the store: by the local limiter when the
+// store fails open, otherwise by rejecting until the store is retried.
+func (l *sharedLimiter) unavailable(now time.Time) Decision {
+	if !l.store.opts.FailClosed {
+		return l.local.Take()
+	}
+	retry := time.Duration(l.store.downUntil.Load() - now.UnixNano())
+	return Decision{Limit: float64(l.limit), RetryAfter: retry, Reset: retry}
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sargisis/edgecore/internal/resp"
+	"github.com/sargisis/edgecore/internal/resp/resptest"
+)
+
+func startStore(t *testing.T, opts RateLimitStoreOptions) (*RateLimitStore, *resptest.Server) {
+	t.Helper()
+
+	srv, err := resptest.NewServer()
+	if err != nil {
+		t.Fatalf("failed to start store: %v", err)
+	}
+	t.Cleanup(srv.Close)
+	client := resp.NewClient(resp.Options{Addr: srv.Addr(), Timeout: time.Second})
+	t.Cleanup(func() { client.Close() })
+	opts.Client = client
+	return NewRateLimitStore(opts), srv
+}
+
+// windowStart returns the start of a 10s window, as used by limits of
+// burst 10 at 1 request per second.
+func windowStart() time.Time {
+	return time.Now().Truncate(10 * time.Second).Add(10 * time.Second)
+}
+
+func TestSharedLimitHoldsAcrossInstances(t *testing.T) {
+	store, srv := startStore(t, RateLimitStoreOptions{Prefix: "test:", LeaseSize: 3})
+	now := windowStart()
+	clock := func() time.Time { return now }
+
+	// Two instances sharing the store.
+	limit := Limit{Rate: 1, Burst: 10}
+	a := NewKeyedRateLimiter(limit, KeyedRateLimiterOptions{Store: store, Namespace: "ip", Clock: clock})
+	b := NewKeyedRateLimiter(limit, KeyedRateLimiterOptions{Store: store, Namespace: "ip", Clock: clock})
+
+	admitted := 0
+	for range 10 {
+		admitted += takeN(a.getLimiter("192.0.2.1"), 1)
+		admitted += takeN(b.getLimiter("192.0.2.1"), 1)
+	}
+	if admitted != 10 {
+		t.Fatalf("expected the burst of 10 shared by both instances, got %d admitted", admitted)
+	}
+	// Leases of 3 need 4 round trips per instance plus one each to learn
+	// the window is spent; each round trip is two commands.
+	if got := srv.Commands(); got > 2*(4+4+2) {
+		t.Fatalf("expected leases to save round trips, got %d commands", got)
+	}
+
+	// Other keys have their own counters.
+	if !a.getLimiter("192.0.2.2").Take().Allowed {
+		t.Fatalf("expected another client to be admitted")
+	}
+
+	// The next window starts afresh.
+	now = now.Add(10 * time.Second)
+	if !b.getLimiter("192.0.2.1").Take().Allowed {
+		t.Fatalf("expected admission in the next window")
+	}
+}
+
+func TestSharedLimitReportsState(t *testing.T) {
+	store, _ := startStore(t, RateLimitStoreOptions{LeaseSize: 5})
+	now := windowStart().Add(4 * time.Second)
+	l := newSharedLimiter(store, "k", "", Limit{Rate: 1, Burst: 10}, func() time.Time { return now })
+
+	d := l.Take()
+	if !d.Allowed || d.Limit != 10 || d.Remaining != 9 || d.Reset != 6*time.Second {
+		t.Fatalf("expected admission with 9 remaining and reset in 6s, got %+v", d)
+	}
+	takeN(l, 9)
+	d = l.Take()
+	if d.Allowed || d.Remaining != 0 || d.RetryAfter != 6*time.Second {
+		t.Fatalf("expected rejection until the window ends, got %+v", d)
+	}
+}
+
+func TestSharedLimitFailsOpenToLocalLimit(t *testing.T) {
+	store, srv := startStore(t, RateLimitStoreOptions{})
+	srv.Close()
+	errors := atomic.LoadUint64(&GlobalMetrics.RateLimitStoreErrors)
+
+	now := windowStart()
+	l := newSharedLimiter(store, "k", "", Limit{Rate: 1, Burst: 3}, func() time.Time { return now })
+	if got := takeN(l, 5); got != 3 {
+		t.Fatalf("expected the local limit of 3 while the store is down, got %d admitted", got)
+	}
+	if got := atomic.LoadUint64(&GlobalMetrics.RateLimitStoreErrors) - errors; got != 1 {
+		t.Fatalf("expected the store tried once within the retry interval, got %d errors", got)
+	}
+}
+
+func TestSharedLimitFailsClosed(t *testing.T) {
+	store, srv := startStore(t, RateLimitStoreOptions{FailClosed: true, RetryInterval: 2 * time.Second})
+	srv.Close()
+
+	now := windowStart()
+	l := newSharedLimiter(store, "k", "", Limit{Rate: 1, Burst: 3}, func() time.Time { return now })
+	d := l.Take()
+	if d.Allowed || d.RetryAfter != 2*time.Second {
+		t.Fatalf("expected rejection until the store is retried, got %+v", d)
+	}
+}
+
+func TestSharedLimitHoldsWhileLeasesAreFetched(t *testing.T) {
+	store, _ := startStore(t, RateLimitStoreOptions{LeaseSize: 3})
+	now := windowStart()
+	clock := func() time.Time { return now }
+
+	limit := Limit{Rate: 1, Burst: 10}
+	instances := []Limiter{
+		newSharedLimiter(store, "k", "", limit, clock),
+		newSharedLimiter(store, "k", "", limit, clock),
+	}
+
+	// Requests arriving while a lease is in flight must wait for it
+	// rather than be admitted without being counted in the store.
+	var admitted atomic.Int64
+	var wg sync.WaitGroup
+	for i := range 40 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if instances[i%2].Take().Allowed {
+				admitted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := admitted.Load(); got != 10 {
+		t.Fatalf("expected the burst of 10 shared by both instances, got %d admitted", got)
+	}
+}
@@ -0,0 +1,22 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// RedirectToHTTPS answers every request with a permanent redirect to the same
+// URL over HTTPS on the given port.
+func RedirectToHTTPS(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectToHTTPS(t *testing.T) {
+	cases := []struct {
+		port   int
+		target string
+		want   string
+	}{
+		{443, "http://example.com/a?b=c", "https://example.com/a?b=c"},
+		{443, "http://example.com:8080/", "https://example.com/"},
+		{8443, "http://example.com:8080/a", "https://example.com:8443/a"},
+	}
+
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodPost, tc.target, nil)
+		rr := httptest.NewRecorder()
+		RedirectToHTTPS(tc.port).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusPermanentRedirect {
+			t.Fatalf("expected status 308, got %d", rr.Code)
+		}
+		if got := rr.Header().Get("Location"); got != tc.want {
+			t.Fatalf("expected redirect to %q, got %q", tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/sargisis/edgecore/internal/router"
+)
+
+// Streaming lifts the server's read and write timeouts for requests on
+// streaming routes and replaces them with the route's idle timeout: the
+// request is cancelled once nothing has been written for that long.
+func Streaming(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := router.FromContext(r.Context())
+		if route == nil || !route.Streaming {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rc := http.NewResponseController(w)
+		// Errors mean the writer has no deadlines to lift.
+		_ = rc.SetReadDeadline(time.Time{})
+		_ = rc.SetWriteDeadline(time.Time{})
+		if route.StreamIdleTimeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		sw := &streamWriter{
+			ResponseWriter: w,
+			rc:             rc,
+			idle:           route.StreamIdleTimeout,
+			timer:          time.AfterFunc(route.StreamIdleTimeout, cancel),
+		}
+		defer sw.timer.Stop()
+		next.ServeHTTP(sw, r.WithContext(ctx))
+	})
+}
+
+// streamWriter restarts the idle timer on every write and bounds each
+// write by the idle timeout, so a client that stops reading is dropped too.
+type streamWriter struct {
+	http.ResponseWriter
+	rc    *http.ResponseController
+	idle  time.Duration
+	timer *time.Timer
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	sw.timer.Reset(sw.idle)
+	_ = sw.rc.SetWriteDeadline(time.Now().Add(sw.idle))
+	return sw.ResponseWriter.Write(p)
+}
+
+func (sw *streamWriter) Flush() {
+	_ = sw.rc.SetWriteDeadline(time.Now().Add(sw.idle))
+	_ = sw.rc.Flush()
+}
+
+func (sw *streamWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sargisis/edgecore/internal/router"
+)
+
+func TestResponseWriterExposesOptionalInterfaces(t *testing.T) {
+	var w http.ResponseWriter = &responseWriter{ResponseWriter: httptest.NewRecorder()}
+
+	if _, ok := w.(http.Flusher); !ok {
+		t.Fatalf("expected responseWriter to implement http.Flusher")
+	}
+	if _, ok := w.(http.Hijacker); !ok {
+		t.Fatalf("expected responseWriter to implement http.Hijacker")
+	}
+	if _, ok := w.(http.CloseNotifier); !ok {
+		t.Fatalf("expected responseWriter to implement http.CloseNotifier")
+	}
+}
+
+// streamingServer serves handler behind Logger and Streaming on a route
+// with the given idle timeout, with a server write timeout of 100ms.
+func streamingServer(t *testing.T, idle time.Duration, handler http.Handler) *httptest.Server {
+	t.Helper()
+
+	table := router.NewTable([]router.Route{{Name: "events", Streaming: true, StreamIdleTimeout: idle}})
+	srv := httptest.NewUnstartedServer(Logger(router.Middleware(table, Streaming(handler))))
+	srv.Config.WriteTimeout = 100 * time.Millisecond
+	srv.Config.ReadTimeout = 100 * time.Millisecond
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestStreamingOutlivesWriteTimeout(t *testing.T) {
+	srv := streamingServer(t, time.Second, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 4; i++ {
+			w.Write([]byte("data: tick\n\n"))
+			w.(http.Flusher).Flush()
+			time.Sleep(60 * time.Millisecond)
+		}
+	}))
+
+	resp, err := http.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	events := 0
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		if strings.HasPrefix(sc.Text(), "data:") {
+			events++
+		}
+	}
+	if events != 4 {
+		t.Fatalf("expected 4 events past the write timeout, got %d (%v)", events, sc.Err())
+	}
+}
+
+func TestStreamingIdleTimeoutCancelsRequest(t *testing.T) {
+	cancelled := make(chan struct{})
+	srv := streamingServer(t, 50*time.Millisecond, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data: first\n\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+
+	resp, err := http.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected idle stream to be cancelled")
+	}
+}
@@ -0,0 +1,363 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sargisis/edgecore/internal/backend"
+)
+
+// WebSocketOptions limits proxied WebSocket sessions.
+type WebSocketOptions struct {
+	// IdleTimeout closes sessions without frames in either direction for
+	// this long. Zero disables it.
+	IdleTimeout time.Duration
+	// MaxLifetime closes sessions older than this. Zero disables it.
+	MaxLifetime time.Duration
+	// MaxPerClient caps concurrent sessions per client IP. Zero is unlimited.
+	MaxPerClient int
+}
+
+var (
+	wsOptions  atomic.Pointer[WebSocketOptions]
+	webSockets = &wsRegistry{
+		perClient: make(map[string]int),
+		sessions:  make(map[*wsSession]struct{}),
+	}
+)
+
+func init() {
+	wsOptions.Store(&WebSocketOptions{})
+}
+
+// SetWebSocketOptions replaces the WebSocket limits. Open sessions keep the
+// limits they started with.
+func SetWebSocketOptions(opts WebSocketOptions) {
+	wsOptions.Store(&opts)
+}
+
+// IsWebSocketUpgrade reports whether r asks for a WebSocket upgrade.
+func IsWebSocketUpgrade(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") &&
+		strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+func headerHasToken(h http.Header, key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hopHeaders are removed before a request is sent upstream.
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// ServeWebSocket performs the upgrade handshake with b through its reverse
+// proxy settings and then tunnels frames between the client and b. It
+// returns once the tunnel is running, so the session is neither counted as
+// an in-flight request nor bound by the server's write timeout.
+func ServeWebSocket(w http.ResponseWriter, r *http.Request, b *backend.Backend) {
+	opts := *wsOptions.Load()
+	client := clientIP(r)
+	if !webSockets.acquire(client, opts.MaxPerClient) {
+		atomic.AddUint64(&GlobalMetrics.WebSocketsRejected, 1)
+		http.Error(w, "Too many WebSocket connections", http.StatusTooManyRequests)
+		return
+	}
+	started := false
+	defer func() {
+		if !started {
+			webSockets.release(client)
+		}
+	}()
+
+	rp := b.ReverseProxy
+	// The session outlives this handler, so the upstream request must not
+	// be cancelled when it returns.
+	out := r.Clone(context.WithoutCancel(r.Context()))
+	out.RequestURI = ""
+	out.Close = false
+	for _, f := range r.Header.Values("Connection") {
+		for _, name := range strings.Split(f, ",") {
+			out.Header.Del(textproto.TrimString(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		out.Header.Del(name)
+	}
+	out.Header.Set("Connection", "Upgrade")
+	out.Header.Set("Upgrade", r.Header.Get("Upgrade"))
+	for _, name := range []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"} {
+		out.Header.Del(name)
+	}
+	rp.Rewrite(&httputil.ProxyRequest{In: r, Out: out})
+
+	transport := rp.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	// Upgrades need HTTP/1.1. Transports that also speak HTTP/2 use it for
+	// them on their own, but h2c pools speak HTTP/2 only, which cannot carry
+	// the upgrade.
+	if t, ok := transport.(*http.Transport); ok && t.Protocols != nil && !t.Protocols.HTTP1() {
+		http.Error(w, "WebSocket is not supported by the backend protocol", http.StatusBadGateway)
+		return
+	}
+	resp, err := transport.RoundTrip(out)
+	if err != nil {
+		if rp.ErrorHandler != nil {
+			rp.ErrorHandler(w, r, err)
+		} else {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		return
+	}
+
+	for k, vv := range resp.Header {
+		w.Header()[k] = vv
+	}
+	backConn, ok := resp.Body.(io.ReadWriteCloser)
+	if resp.StatusCode != http.StatusSwitchingProtocols || !ok {
+		// The backend refused the upgrade; relay its answer.
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		backConn.Close()
+		http.Error(w, "WebSocket upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+	// Clear the server's read and write timeouts; the session has its own.
+	conn.SetDeadline(time.Time{})
+
+	resp.Header = w.Header()
+	resp.Body = nil
+	if err := resp.Write(brw); err == nil {
+		err = brw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		backConn.Close()
+		return
+	}
+
+	s := &wsSession{
+		toClient:  &wsWriter{conn: conn},
+		toBackend: &wsWriter{conn: backConn, masked: true},
+		clientR:   brw.Reader,
+		backendR:  backConn,
+		closers:   []io.Closer{conn, backConn},
+		stop:      make(chan wsClose, 1),
+		done:      make(chan struct{}),
+		start:     time.Now(),
+		opts:      opts,
+		backend:   b,
+		client:    client,
+		entry: LogEntry{
+			Level:     "info",
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			ClientIP:  client,
+			RequestID: r.Header.Get("X-Request-ID"),
+			Backend:   b.URL.String(),
+		},
+	}
+	started = true
+	webSockets.add(s)
+	b.IncWebSockets()
+	go s.run()
+}
+
+// CloseWebSockets sends a "going away" close frame to both ends of every
+// open session and waits for them to finish or for ctx to expire.
+func CloseWebSockets(ctx context.Context) {
+	for _, done := range webSockets.closeAll(wsClose{code: wsCloseGoingAway, reason: "server shutdown"}) {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// wsClose is a reason to end a session from the proxy side.
+type wsClose struct {
+	code   int
+	reason string
+}
+
+// wsSession is one tunnelled WebSocket connection.
+type wsSession struct {
+	toClient, toBackend *wsWriter
+	clientR, backendR   io.Reader
+	closers             []io.Closer
+	activity            atomic.Int64
+	stop                chan wsClose
+	done                chan struct{}
+	start               time.Time
+	opts                WebSocketOptions
+	backend             *backend.Backend
+	client              string
+	entry               LogEntry
+}
+
+// closeGrace is how long peers get to answer a close frame.
+const closeGrace = time.Second
+
+func (s *wsSession) run() {
+	defer close(s.done)
+	defer webSockets.remove(s)
+	defer s.backend.DecWebSockets()
+
+	s.activity.Store(s.start.UnixNano())
+	errc := make(chan error, 2)
+	go func() { errc <- s.toBackend.copyFrames(s.clientR, &s.activity) }()
+	go func() { errc <- s.toClient.copyFrames(s.backendR, &s.activity) }()
+
+	var lifetime <-chan time.Time
+	if s.opts.MaxLifetime > 0 {
+		t := time.NewTimer(s.opts.MaxLifetime)
+		defer t.Stop()
+		lifetime = t.C
+	}
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if s.opts.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(s.opts.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	var reason string
+	var closing <-chan time.Time
+	stop := s.stop
+	pending := 2
+	for pending > 0 {
+		var c wsClose
+		select {
+		case <-errc:
+			pending--
+			// One side is gone; the other cannot continue.
+			s.closeConns()
+			continue
+		case <-closing:
+			s.closeConns()
+			continue
+		case <-idle:
+			if left := time.Until(time.Unix(0, s.activity.Load()).Add(s.opts.IdleTimeout)); left > 0 {
+				idleTimer.Reset(left)
+				continue
+			}
+			c = wsClose{code: wsCloseNormal, reason: "idle timeout"}
+		case <-lifetime:
+			c = wsClose{code: wsCloseNormal, reason: "max lifetime"}
+		case c = <-stop:
+		}
+		// Close once; the peers get closeGrace to answer.
+		idle, lifetime, stop = nil, nil, nil
+		reason, closing = c.reason, s.shutdown(c)
+	}
+
+	entry := s.entry
+	entry.Message = "websocket closed"
+	if reason != "" {
+		entry.Message += " (" + reason + ")"
+	}
+	entry.Duration = time.Since(s.start).Seconds()
+	entry.BytesIn = s.toBackend.written()
+	entry.BytesOut = s.toClient.written()
+	logEntry(entry)
+}
+
+// shutdown sends close frames to both peers and returns a channel firing
+// when the grace period for their replies is over.
+func (s *wsSession) shutdown(c wsClose) <-chan time.Time {
+	s.toClient.sendClose(c.code, c.reason, closeGrace)
+	s.toBackend.sendClose(c.code, c.reason, closeGrace)
+	return time.After(closeGrace)
+}
+
+func (s *wsSession) closeConns() {
+	for _, c := range s.closers {
+		c.Close()
+	}
+}
+
+// wsRegistry tracks open sessions for shutdown and per-client limits.
+type wsRegistry struct {
+	mu        sync.Mutex
+	perClient map[string]int
+	sessions  map[*wsSession]struct{}
+}
+
+func (reg *wsRegistry) acquire(client string, max int) bool {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if max > 0 && reg.perClient[client] >= max {
+		return false
+	}
+	reg.perClient[client]++
+	return true
+}
+
+func (reg *wsRegistry) release(client string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.perClient[client]--; reg.perClient[client] <= 0 {
+		delete(reg.perClient, client)
+	}
+}
+
+func (reg *wsRegistry) add(s *wsSession) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.sessions[s] = struct{}{}
+}
+
+func (reg *wsRegistry) remove(s *wsSession) {
+	reg.mu.Lock()
+	delete(reg.sessions, s)
+	reg.mu.Unlock()
+	reg.release(s.client)
+}
+
+// closeAll asks every session to close and returns channels closed when
+// they are done.
+func (reg *wsRegistry) closeAll(c wsClose) []chan struct{} {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	var done []chan struct{}
+	for s := range reg.sessions {
+		select {
+		case s.stop <- c:
+		default:
+		}
+		done = append(done, s.done)
+	}
+	return done
+}
+
+// openWebSockets returns the number of open sessions.
+func openWebSockets() int {
+	webSockets.mu.Lock()
+	defer webSockets.mu.Unlock()
+	return len(webSockets.sessions)
+}
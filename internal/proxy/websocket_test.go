@@ -0,0 +1,318 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sargisis/edgecore/internal/backend"
+)
+
+// startWebSocketProxy starts an echo WebSocket backend behind
+// ServeWebSocket and returns the proxy address and the backend.
+func startWebSocketProxy(t *testing.T, opts WebSocketOptions) (string, *backend.Backend) {
+	t.Helper()
+
+	SetWebSocketOptions(opts)
+	t.Cleanup(func() { SetWebSocketOptions(WebSocketOptions{}) })
+
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsWebSocketUpgrade(r) {
+			t.Errorf("expected upgrade request at backend, got headers %v", r.Header)
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("backend hijack failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+	t.Cleanup(echo.Close)
+
+	target, _ := url.Parse(echo.URL)
+	b := backend.NewBackend(target, &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) { pr.SetURL(target) },
+	})
+	front := httptest.NewServer(Logger(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWebSocket(w, r, b)
+	})))
+	t.Cleanup(front.Close)
+	return front.Listener.Addr().String(), b
+}
+
+// dialWebSocket performs the client handshake and returns the connection
+// and the response status.
+func dialWebSocket(t *testing.T, addr string) (net.Conn, *bufio.Reader, int) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("failed to read handshake response: %v", err)
+	}
+	return conn, br, resp.StatusCode
+}
+
+// readFrame reads one unfragmented frame with a short payload.
+func readFrame(t *testing.T, br *bufio.Reader) (opcode byte, payload []byte) {
+	t.Helper()
+
+	var hdr [2]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		t.Fatalf("failed to read frame: %v", err)
+	}
+	if hdr[1]&0x80 != 0 {
+		t.Fatalf("expected unmasked frame from proxy")
+	}
+	payload = make([]byte, hdr[1]&0x7f)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		t.Fatalf("failed to read payload: %v", err)
+	}
+	return hdr[0] & 0x0f, payload
+}
+
+// maskedText builds a masked client text frame.
+func maskedText(msg string) []byte {
+	key := []byte{1, 2, 3, 4}
+	frame := append([]byte{0x81, 0x80 | byte(len(msg))}, key...)
+	for i := range len(msg) {
+		frame = append(frame, msg[i]^key[i%4])
+	}
+	return frame
+}
+
+func TestServeWebSocketTunnelsFrames(t *testing.T) {
+	addr, b := startWebSocketProxy(t, WebSocketOptions{})
+	conn, br, status := dialWebSocket(t, addr)
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status 101, got %d", status)
+	}
+
+	conn.Write(maskedText("hello"))
+	// The echo backend returns the client's masked frame as is.
+	var hdr [6]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		t.Fatalf("failed to read echoed frame: %v", err)
+	}
+	if hdr[0] != 0x81 || hdr[1] != 0x85 {
+		t.Fatalf("expected echoed text frame header, got %x", hdr[:2])
+	}
+	if got := b.GetWebSockets(); got != 1 {
+		t.Fatalf("expected 1 open WebSocket on backend, got %d", got)
+	}
+}
+
+func TestCloseWebSocketsSendsGoingAway(t *testing.T) {
+	addr, b := startWebSocketProxy(t, WebSocketOptions{})
+	_, br, _ := dialWebSocket(t, addr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go CloseWebSockets(ctx)
+
+	opcode, payload := readFrame(t, br)
+	if opcode != wsOpClose || binary.BigEndian.Uint16(payload) != wsCloseGoingAway {
+		t.Fatalf("expected close frame 1001, got opcode %d payload %q", opcode, payload)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for b.GetWebSockets() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := b.GetWebSockets(); got != 0 {
+		t.Fatalf("expected session to be closed, got %d open", got)
+	}
+}
+
+func TestWebSocketIdleTimeout(t *testing.T) {
+	addr, _ := startWebSocketProxy(t, WebSocketOptions{IdleTimeout: 50 * time.Millisecond})
+	_, br, _ := dialWebSocket(t, addr)
+
+	opcode, payload := readFrame(t, br)
+	if opcode != wsOpClose || string(payload[2:]) != "idle timeout" {
+		t.Fatalf("expected idle timeout close frame, got opcode %d payload %q", opcode, payload)
+	}
+}
+
+func TestWebSocketPerClientLimit(t *testing.T) {
+	addr, _ := startWebSocketProxy(t, WebSocketOptions{MaxPerClient: 1})
+
+	if _, _, status := dialWebSocket(t, addr); status != http.StatusSwitchingProtocols {
+		t.Fatalf("expected first session to be accepted, got %d", status)
+	}
+	if _, _, status := dialWebSocket(t, addr); status != http.StatusTooManyRequests {
+		t.Fatalf("expected second session to be rejected with 429, got %d", status)
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for one writer and one reader.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Clone(b.buf.Bytes())
+}
+
+type wsFrame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+// parseFrames splits data into frames, unmasking their payloads.
+func parseFrames(t *testing.T, data []byte) []wsFrame {
+	t.Helper()
+
+	var frames []wsFrame
+	for len(data) > 0 {
+		f := wsFrame{fin: data[0]&0x80 != 0, opcode: data[0] & 0x0f}
+		length, n := uint64(data[1]&0x7f), 2
+		switch length {
+		case 126:
+			length, n = uint64(binary.BigEndian.Uint16(data[2:4])), 4
+		case 127:
+			length, n = binary.BigEndian.Uint64(data[2:10]), 10
+		}
+		var key []byte
+		if data[1]&0x80 != 0 {
+			key, n = data[n:n+4], n+4
+		}
+		if uint64(len(data)-n) < length {
+			t.Fatalf("truncated frame: want %d payload bytes, have %d", length, len(data)-n)
+		}
+		f.payload = bytes.Clone(data[n : n+int(length)])
+		for i := range f.payload {
+			f.payload[i] ^= key[i%4]
+		}
+		frames = append(frames, f)
+		data = data[n+int(length):]
+	}
+	return frames
+}
+
+// maskedBinary builds a masked client binary frame.
+func maskedBinary(payload []byte) []byte {
+	key := []byte{1, 2, 3, 4}
+	frame := []byte{0x82, 0x80 | 127}
+	frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	frame = append(frame, key...)
+	for i, c := range payload {
+		frame = append(frame, c^key[i%4])
+	}
+	return frame
+}
+
+func TestCopyFramesFragmentsLongFrames(t *testing.T) {
+	payload := make([]byte, 3*wsFragment+5)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	var out lockedBuffer
+	w := &wsWriter{conn: &out, masked: true}
+	var activity atomic.Int64
+	if err := w.copyFrames(bytes.NewReader(maskedBinary(payload)), &activity); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	frames := parseFrames(t, out.Bytes())
+	if len(frames) != 4 {
+		t.Fatalf("expected 4 fragments, got %d", len(frames))
+	}
+	var got []byte
+	for i, f := range frames {
+		wantOp := byte(0)
+		if i == 0 {
+			wantOp = 0x2
+		}
+		if f.opcode != wantOp || f.fin != (i == len(frames)-1) {
+			t.Fatalf("fragment %d: unexpected opcode %d fin %v", i, f.opcode, f.fin)
+		}
+		got = append(got, f.payload...)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("expected fragments to carry the original payload")
+	}
+}
+
+func TestSendCloseDuringStalledFrame(t *testing.T) {
+	payload := make([]byte, 3*wsFragment)
+	frame := maskedBinary(payload)
+	src, peer := io.Pipe()
+	t.Cleanup(func() { peer.Close() })
+	var out lockedBuffer
+	w := &wsWriter{conn: &out, masked: true}
+	var activity atomic.Int64
+	go w.copyFrames(src, &activity)
+
+	// Send the header and one fragment's worth of payload, then stall.
+	peer.Write(frame[:14+wsFragment])
+	deadline := time.Now().Add(3 * time.Second)
+	for len(out.Bytes()) < wsFragment && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	w.sendClose(wsCloseGoingAway, "server shutdown", time.Second)
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("expected the close frame not to wait for the stalled frame, took %v", elapsed)
+	}
+	frames := parseFrames(t, out.Bytes())
+	if len(frames) != 2 || frames[0].fin || frames[1].opcode != wsOpClose {
+		t.Fatalf("expected a fragment followed by a close frame, got %d frames", len(frames))
+	}
+	if code := binary.BigEndian.Uint16(frames[1].payload); code != wsCloseGoingAway {
+		t.Fatalf("expected close code 1001, got %d", code)
+	}
+}
+
+func TestServeWebSocketRejectsH2CBackends(t *testing.T) {
+	target, _ := url.Parse("http://127.0.0.1:1")
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	b := backend.NewBackend(target, &httputil.ReverseProxy{
+		Rewrite:   func(pr *httputil.ProxyRequest) { pr.SetURL(target) },
+		Transport: transport,
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	rr := httptest.NewRecorder()
+	ServeWebSocket(rr, req, b)
+	if rr.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502 for an h2c backend, got %d", rr.Code)
+	}
+}
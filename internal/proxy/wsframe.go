@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WebSocket close codes sent by edgecore.
+const (
+	wsCloseNormal    = 1000
+	wsCloseGoingAway = 1001
+)
+
+const wsOpClose = 0x8
+
+// wsFragment is the largest payload forwarded in one frame. Longer data
+// frames are split into fragments so that mu is only held while one is
+// written, and a close frame can be injected between them (RFC 6455
+// section 5.4). It is a multiple of 4 so every fragment starts at the same
+// position in the masking key as in the original frame.
+const wsFragment = 32 << 10
+
+// wsWriter is one direction of a WebSocket tunnel. Frames, or fragments of
+// long ones, are written whole under mu, so a close frame can be injected
+// between them.
+type wsWriter struct {
+	conn io.Writer
+	// masked is set for the backend side: frames sent by a client must be
+	// masked (RFC 6455 section 5.3).
+	masked bool
+
+	mu sync.Mutex
+	// closed is set once a close frame went out; later frames are dropped.
+	closed bool
+	bytes  int64
+}
+
+// copyFrames forwards frames from src to w until src fails. activity is
+// updated after every frame for idle tracking.
+func (w *wsWriter) copyFrames(src io.Reader, activity *atomic.Int64) error {
+	var hdr [14]byte
+	buf := make([]byte, wsFragment)
+	for {
+		if _, err := io.ReadFull(src, hdr[:2]); err != nil {
+			return err
+		}
+		n := 2
+		length := uint64(hdr[1] & 0x7f)
+		switch length {
+		case 126:
+			if _, err := io.ReadFull(src, hdr[2:4]); err != nil {
+				return err
+			}
+			length = uint64(binary.BigEndian.Uint16(hdr[2:4]))
+			n = 4
+		case 127:
+			if _, err := io.ReadFull(src, hdr[2:10]); err != nil {
+				return err
+			}
+			length = binary.BigEndian.Uint64(hdr[2:10])
+			n = 10
+		}
+		var key []byte
+		if hdr[1]&0x80 != 0 {
+			if _, err := io.ReadFull(src, hdr[n:n+4]); err != nil {
+				return err
+			}
+			key = hdr[n : n+4]
+			n += 4
+		}
+		if length > 1<<62 {
+			return errors.New("websocket frame too large")
+		}
+
+		opcode := hdr[0] & 0x0f
+		if length <= wsFragment || opcode&0x8 != 0 {
+			// Control frames cannot be fragmented; they are at most 125
+			// bytes unless the peer is broken.
+			if err := w.forward(src, hdr[:n], buf, length); err != nil {
+				return err
+			}
+		} else {
+			for sent := uint64(0); sent < length; {
+				size := min(length-sent, wsFragment)
+				// The first fragment keeps the opcode and extension bits,
+				// the others are continuations; only the last one keeps FIN.
+				b0 := byte(0)
+				if sent == 0 {
+					b0 = hdr[0] &^ 0x80
+				}
+				if sent+size == length {
+					b0 |= hdr[0] & 0x80
+				}
+				if err := w.forward(src, wsFrameHeader(b0, size, key), buf, size); err != nil {
+					return err
+				}
+				sent += size
+			}
+		}
+		activity.Store(time.Now().UnixNano())
+	}
+}
+
+// forward reads size payload bytes from src and writes them to w after
+// hdr. The payload is read before taking mu, so a stalled peer does not
+// hold up sendClose; payloads larger than buf are copied under mu.
+func (w *wsWriter) forward(src io.Reader, hdr, buf []byte, size uint64) error {
+	var payload []byte
+	if size <= uint64(len(buf)) {
+		payload = buf[:size]
+		if _, err := io.ReadFull(src, payload); err != nil {
+			return err
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		if payload == nil {
+			_, err := io.CopyN(io.Discard, src, int64(size))
+			return err
+		}
+		return nil
+	}
+	_, err := w.conn.Write(hdr)
+	if err == nil {
+		if payload != nil {
+			_, err = w.conn.Write(payload)
+		} else {
+			_, err = io.CopyN(w.conn, src, int64(size))
+		}
+	}
+	w.bytes += int64(len(hdr)) + int64(size)
+	if hdr[0]&0x0f == wsOpClose {
+		w.closed = true
+	}
+	return err
+}
+
+// wsFrameHeader builds a frame header with first byte b0, the payload
+// length size and the masking key, if any.
+func wsFrameHeader(b0 byte, size uint64, key []byte) []byte {
+	hdr := []byte{b0, 0}
+	switch {
+	case size < 126:
+		hdr[1] = byte(size)
+	case size <= 0xffff:
+		hdr[1] = 126
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(size))
+	default:
+		hdr[1] = 127
+		hdr = binary.BigEndian.AppendUint64(hdr, size)
+	}
+	if key != nil {
+		hdr[1] |= 0x80
+		hdr = append(hdr, key...)
+	}
+	return hdr
+}
+
+// sendClose writes a close frame between two forwarded frames. If a frame
+// write is still stuck after wait, the peer is not reading: the write is
+// ended with a deadline so the session can finish, and no close frame is
+// sent.
+func (w *wsWriter) sendClose(code int, reason string, wait time.Duration) {
+	deadline := time.Now().Add(wait)
+	for !w.mu.TryLock() {
+		if time.Now().After(deadline) {
+			if c, ok := w.conn.(interface{ SetWriteDeadline(time.Time) error }); ok {
+				c.SetWriteDeadline(time.Now())
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	w.closed = true
+
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > 125 {
+		payload = payload[:125]
+	}
+	frame := []byte{0x80 | wsOpClose, byte(len(payload))}
+	if w.masked {
+		var key [4]byte
+		rand.Read(key[:])
+		frame[1] |= 0x80
+		frame = append(frame, key[:]...)
+		for i := range payload {
+			payload[i] ^= key[i%4]
+		}
+	}
+	if c, ok := w.conn.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		c.SetWriteDeadline(time.Now().Add(wait))
+	}
+	w.conn.Write(append(frame, payload...))
+}
+
+func (w *wsWriter) written() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.bytes
+}
@@ -0,0 +1,50 @@
+package proxyproto
+
+import (
+	"context"
+	"net"
+)
+
+// DialFunc matches http.Transport.DialContext.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+type addrsKey struct{}
+
+type addrs struct {
+	src, dst *net.TCPAddr
+}
+
+// WithAddrs records the client and destination addresses of the downstream
+// connection so Dialer can announce them upstream.
+func WithAddrs(ctx context.Context, src, dst *net.TCPAddr) context.Context {
+	return context.WithValue(ctx, addrsKey{}, addrs{src: src, dst: dst})
+}
+
+// Dialer wraps dial so that every new connection starts with a PROXY header
+// of the given version describing the addresses stored by WithAddrs. Without
+// them a LOCAL/UNKNOWN header is sent.
+//
+// Connections carry a single client's address, so the transport using this
+// dialer must not reuse connections across requests (DisableKeepAlives).
+func Dialer(version int, dial DialFunc) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		h := &Header{Version: version}
+		if a, ok := ctx.Value(addrsKey{}).(addrs); ok {
+			h.Source, h.Destination = a.src, a.dst
+		}
+		buf, err := h.Format()
+		if err == nil {
+			_, err = conn.Write(buf)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,206 @@
+// Package proxyproto implements the HAProxy PROXY protocol (versions 1 and 2),
+// used by L4 load balancers to pass the original client address along a TCP
+// connection.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// v2Signature prefixes every version 2 header.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// v1MaxLength is the longest possible version 1 header, including CRLF.
+const v1MaxLength = 107
+
+var errInvalidHeader = errors.New("proxyproto: invalid header")
+
+// Header is a decoded PROXY protocol header. Source and Destination are nil
+// for LOCAL (v2) and UNKNOWN (v1) headers, in which case the connection's own
+// addresses apply.
+type Header struct {
+	Version     int
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+}
+
+// ReadHeader reads a version 1 or version 2 header from r.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	sig, err := r.Peek(len(v2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, v2Signature) {
+		return readV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readV1(r)
+	}
+	return nil, errInvalidHeader
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errInvalidHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	h := &Header{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errInvalidHeader
+	}
+
+	src, err := parseV1Addr(fields[2], fields[4], fields[1])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseV1Addr(fields[3], fields[5], fields[1])
+	if err != nil {
+		return nil, err
+	}
+	h.Source, h.Destination = src, dst
+	return h, nil
+}
+
+func parseV1Addr(ip, port, family string) (*net.TCPAddr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Is4() != (family == "TCP4") {
+		return nil, errInvalidHeader
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errInvalidHeader
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, err
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, errInvalidHeader
+	}
+	command := fixed[12] & 0x0f
+	family := fixed[13]
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	h := &Header{Version: 2}
+	switch command {
+	case 0x0: // LOCAL: health checks from the proxy itself
+		return h, nil
+	case 0x1: // PROXY
+	default:
+		return nil, errInvalidHeader
+	}
+
+	var ipLen int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLen = 4
+	case 0x21: // TCP over IPv6
+		ipLen = 16
+	default:
+		// UDP and unix sockets carry no TCP address to report.
+		return h, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, errInvalidHeader
+	}
+
+	srcIP, _ := netip.AddrFromSlice(payload[:ipLen])
+	dstIP, _ := netip.AddrFromSlice(payload[ipLen : 2*ipLen])
+	srcPort := binary.BigEndian.Uint16(payload[2*ipLen:])
+	dstPort := binary.BigEndian.Uint16(payload[2*ipLen+2:])
+	h.Source = net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP, srcPort))
+	h.Destination = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP, dstPort))
+	return h, nil
+}
+
+// Format encodes the header in its Version's wire format.
+func (h *Header) Format() ([]byte, error) {
+	switch h.Version {
+	case 1:
+		return h.formatV1(), nil
+	case 2:
+		return h.formatV2(), nil
+	default:
+		return nil, fmt.Errorf("proxyproto: unsupported version %d", h.Version)
+	}
+}
+
+func (h *Header) formatV1() []byte {
+	src, dst, ok := h.addrs()
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP4"
+	if src.Addr().Is6() {
+		family = "TCP6"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+		family, src.Addr(), dst.Addr(), src.Port(), dst.Port()))
+}
+
+func (h *Header) formatV2() []byte {
+	buf := append([]byte{}, v2Signature...)
+	src, dst, ok := h.addrs()
+	if !ok {
+		return append(buf, 0x20, 0x00, 0x00, 0x00) // LOCAL, unspecified family
+	}
+
+	family := byte(0x11)
+	if src.Addr().Is6() {
+		family = 0x21
+	}
+	srcIP, dstIP := src.Addr().AsSlice(), dst.Addr().AsSlice()
+	buf = append(buf, 0x21, family)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(srcIP)+len(dstIP)+4))
+	buf = append(buf, srcIP...)
+	buf = append(buf, dstIP...)
+	buf = binary.BigEndian.AppendUint16(buf, src.Port())
+	return binary.BigEndian.AppendUint16(buf, dst.Port())
+}
+
+// addrs returns the source and destination in a common address family.
+func (h *Header) addrs() (src, dst netip.AddrPort, ok bool) {
+	if h.Source == nil || h.Destination == nil {
+		return src, dst, false
+	}
+	src, dst = h.Source.AddrPort(), h.Destination.AddrPort()
+	src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+	dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	if src.Addr().Is4() != dst.Addr().Is4() {
+		// Mixed families: promote both to IPv6.
+		src = netip.AddrPortFrom(netip.AddrFrom16(src.Addr().As16()), src.Port())
+		dst = netip.AddrPortFrom(netip.AddrFrom16(dst.Addr().As16()), dst.Port())
+	}
+	return src, dst, true
+}
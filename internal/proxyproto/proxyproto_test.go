@@ -0,0 +1,165 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tcpAddr(t *testing.T, s string) *net.TCPAddr {
+	t.Helper()
+
+	ap, err := netip.ParseAddrPort(s)
+	if err != nil {
+		t.Fatalf("failed to parse address %q: %v", s, err)
+	}
+	return net.TCPAddrFromAddrPort(ap)
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	cases := []struct {
+		version  int
+		src, dst string
+	}{
+		{1, "203.0.113.7:51234", "10.0.0.1:443"},
+		{1, "[2001:db8::7]:51234", "[2001:db8::1]:443"},
+		{2, "203.0.113.7:51234", "10.0.0.1:443"},
+		{2, "[2001:db8::7]:51234", "[2001:db8::1]:443"},
+	}
+
+	for _, tc := range cases {
+		h := &Header{Version: tc.version, Source: tcpAddr(t, tc.src), Destination: tcpAddr(t, tc.dst)}
+		buf, err := h.Format()
+		if err != nil {
+			t.Fatalf("v%d: failed to format header: %v", tc.version, err)
+		}
+
+		got, err := ReadHeader(bufio.NewReader(io.MultiReader(bytes.NewReader(buf), strings.NewReader("GET / HTTP/1.1\r\n"))))
+		if err != nil {
+			t.Fatalf("v%d: failed to read header: %v", tc.version, err)
+		}
+		if got.Source.String() != h.Source.String() || got.Destination.String() != h.Destination.String() {
+			t.Fatalf("v%d: expected %s -> %s, got %s -> %s", tc.version, h.Source, h.Destination, got.Source, got.Destination)
+		}
+	}
+}
+
+func TestReadHeaderLocal(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		buf, _ := (&Header{Version: version}).Format()
+		h, err := ReadHeader(bufio.NewReader(bytes.NewReader(buf)))
+		if err != nil {
+			t.Fatalf("v%d: failed to read LOCAL header: %v", version, err)
+		}
+		if h.Source != nil {
+			t.Fatalf("v%d: expected no source address, got %s", version, h.Source)
+		}
+	}
+}
+
+func TestReadHeaderInvalid(t *testing.T) {
+	for _, raw := range []string{
+		"GET / HTTP/1.1\r\nHost: x\r\n\r\n",
+		"PROXY TCP4 999.0.0.1 10.0.0.1 1 2\r\n",
+		"PROXY TCP4 2001:db8::1 10.0.0.1 1 2\r\n",
+		"PROXY TCP4 203.0.113.7 10.0.0.1 1 2\n",
+	} {
+		if _, err := ReadHeader(bufio.NewReader(strings.NewReader(raw))); err == nil {
+			t.Fatalf("expected error for header %q", raw)
+		}
+	}
+}
+
+func serveOne(t *testing.T, trusted []netip.Prefix) (addr string, conns <-chan net.Conn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	ch := make(chan net.Conn, 1)
+	pl := &Listener{Listener: ln, Trusted: trusted, Timeout: time.Second}
+	go func() {
+		conn, err := pl.Accept()
+		if err == nil {
+			ch <- conn
+		}
+	}()
+	return ln.Addr().String(), ch
+}
+
+func TestListenerTrustedSource(t *testing.T) {
+	addr, conns := serveOne(t, []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer c.Close()
+	c.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\nhello"))
+
+	conn := <-conns
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != "203.0.113.7:51234" {
+		t.Fatalf("expected remote address from header, got %s", got)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("expected payload after header, got %q (%v)", buf, err)
+	}
+}
+
+func TestListenerUntrustedSourceIsNotParsed(t *testing.T) {
+	addr, conns := serveOne(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")})
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer c.Close()
+	header := "PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n"
+	c.Write([]byte(header))
+
+	conn := <-conns
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got == "203.0.113.7:51234" {
+		t.Fatalf("expected header from untrusted source to be ignored")
+	}
+	buf := make([]byte, len(header))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != header {
+		t.Fatalf("expected raw header bytes to be passed through, got %q (%v)", buf, err)
+	}
+}
+
+func TestDialerSendsHeader(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	dial := Dialer(2, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return client, nil
+	})
+	ctx := WithAddrs(context.Background(), tcpAddr(t, "203.0.113.7:51234"), tcpAddr(t, "10.0.0.1:80"))
+
+	go func() {
+		conn, err := dial(ctx, "tcp", "backend:80")
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	h, err := ReadHeader(bufio.NewReader(server))
+	if err != nil {
+		t.Fatalf("failed to read header sent by dialer: %v", err)
+	}
+	if h.Source.String() != "203.0.113.7:51234" {
+		t.Fatalf("expected source 203.0.113.7:51234, got %s", h.Source)
+	}
+}
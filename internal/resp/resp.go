@@ -0,0 +1,286 @@
+// Package resp is a small client for the Redis serialization protocol
+// (RESP2), enough to keep counters in Redis or a compatible store shared by
+// several edgecore instances.
+package resp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Error is an error reply sent by the server.
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Options configure a Client.
+type Options struct {
+	// Addr is the host:port of the server.
+	Addr     string
+	Password string
+	DB       int
+	// Timeout bounds each command, including dialing; zero means one
+	// second.
+	Timeout time.Duration
+	// PoolSize caps the idle connections kept open; zero means 8.
+	PoolSize int
+}
+
+// Client sends commands over a pool of connections. It is safe for
+// concurrent use.
+type Client struct {
+	opts Options
+	idle chan *conn
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// NewClient returns a client for opts.Addr. Connections are opened on
+// demand.
+func NewClient(opts Options) *Client {
+	if opts.Timeout == 0 {
+		opts.Timeout = time.Second
+	}
+	if opts.PoolSize == 0 {
+		opts.PoolSize = 8
+	}
+	return &Client{opts: opts, idle: make(chan *conn, opts.PoolSize)}
+}
+
+// Do sends one command and returns its reply: a string for simple and bulk
+// strings, int64 for integers, nil for null replies and []any for arrays.
+// An error reply is returned as an Error.
+func (c *Client) Do(ctx context.Context, args ...string) (any, error) {
+	replies, err := c.Pipeline(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := replies[0].(Error); ok {
+		return nil, e
+	}
+	return replies[0], nil
+}
+
+// Pipeline sends cmds in one write and returns their replies in order, so
+// they cost a single round trip. Error replies are returned as Error
+// values among the replies.
+func (c *Client) Pipeline(ctx context.Context, cmds ...[]string) ([]any, error) {
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := cn.roundTrip(c.deadline(ctx), cmds)
+	if err != nil {
+		cn.Close()
+		return nil, err
+	}
+	c.put(cn)
+	return replies, nil
+}
+
+// Close closes the idle connections.
+func (c *Client) Close() error {
+	for {
+		select {
+		case cn := <-c.idle:
+			cn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *Client) deadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(c.opts.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		return d
+	}
+	return deadline
+}
+
+// get returns an idle connection or dials a new one, authenticating and
+// selecting the database.
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	default:
+	}
+
+	ctx, cancel := context.WithDeadline(ctx, c.deadline(ctx))
+	defer cancel()
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", c.opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{Conn: nc, r: bufio.NewReader(nc)}
+
+	var setup [][]string
+	if c.opts.Password != "" {
+		setup = append(setup, []string{"AUTH", c.opts.Password})
+	}
+	if c.opts.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.opts.DB)})
+	}
+	if len(setup) > 0 {
+		replies, err := cn.roundTrip(c.deadline(ctx), setup)
+		if err == nil {
+			for _, r := range replies {
+				if e, ok := r.(Error); ok {
+					err = e
+				}
+			}
+		}
+		if err != nil {
+			cn.Close()
+			return nil, fmt.Errorf("connection setup: %w", err)
+		}
+	}
+	return cn, nil
+}
+
+func (c *Client) put(cn *conn) {
+	select {
+	case c.idle <- cn:
+	default:
+		cn.Close()
+	}
+}
+
+func (cn *conn) roundTrip(deadline time.Time, cmds [][]string) ([]any, error) {
+	if err := cn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	var buf []byte
+	for _, args := range cmds {
+		buf = appendCommand(buf, args)
+	}
+	if _, err := cn.Write(buf); err != nil {
+		return nil, err
+	}
+	replies := make([]any, len(cmds))
+	for i := range replies {
+		r, err := readReply(cn.r)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = r
+	}
+	return replies, nil
+}
+
+// appendCommand encodes args as an array of bulk strings.
+func appendCommand(buf []byte, args []string) []byte {
+	buf = fmt.Appendf(buf, "*%d\r\n", len(args))
+	for _, a := range args {
+		buf = fmt.Appendf(buf, "$%d\r\n%s\r\n", len(a), a)
+	}
+	return buf
+}
+
+// ReadCommand reads a command sent by a client, as an array of bulk
+// strings. It is the server side of the protocol, for test servers.
+func ReadCommand(r *bufio.Reader) ([]string, error) {
+	v, err := readReply(r)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := v.([]any)
+	if !ok {
+		return nil, errors.New("resp: command is not an array")
+	}
+	args := make([]string, len(items))
+	for i, item := range items {
+		s, ok := item.(string)
+		if !ok {
+			return nil, errors.New("resp: command argument is not a string")
+		}
+		args[i] = s
+	}
+	return args, nil
+}
+
+// AppendReply encodes v as a reply, with the types Do returns.
+func AppendReply(buf []byte, v any) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(buf, "$-1\r\n"...)
+	case Error:
+		return fmt.Appendf(buf, "-%s\r\n", string(v))
+	case int64:
+		return fmt.Appendf(buf, ":%d\r\n", v)
+	case string:
+		return fmt.Appendf(buf, "$%d\r\n%s\r\n", len(v), v)
+	case []any:
+		buf = fmt.Appendf(buf, "*%d\r\n", len(v))
+		for _, item := range v {
+			buf = AppendReply(buf, item)
+		}
+		return buf
+	}
+	panic(fmt.Sprintf("resp: cannot encode %T", v))
+}
+
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("resp: malformed line %q", line)
+	}
+	kind, rest := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return Error(rest), nil
+	case ':':
+		n, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("resp: malformed integer %q", rest)
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("resp: malformed bulk length %q", rest)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("resp: malformed array length %q", rest)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("resp: unknown reply type %q", kind)
+}
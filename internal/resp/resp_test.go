@@ -0,0 +1,99 @@
+package resp_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sargisis/edgecore/internal/resp"
+	"github.com/sargisis/edgecore/internal/resp/resptest"
+)
+
+func startServer(t *testing.T) *resptest.Server {
+	t.Helper()
+
+	srv, err := resptest.NewServer()
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestClientCommands(t *testing.T) {
+	srv := startServer(t)
+	c := resp.NewClient(resp.Options{Addr: srv.Addr()})
+	defer c.Close()
+	ctx := context.Background()
+
+	if v, err := c.Do(ctx, "PING"); err != nil || v != "PONG" {
+		t.Fatalf("expected PONG, got %v (%v)", v, err)
+	}
+	if v, err := c.Do(ctx, "GET", "missing"); err != nil || v != nil {
+		t.Fatalf("expected nil for a missing key, got %v (%v)", v, err)
+	}
+	if v, err := c.Do(ctx, "SET", "k", "hello\r\nworld"); err != nil || v != "OK" {
+		t.Fatalf("expected OK, got %v (%v)", v, err)
+	}
+	if v, err := c.Do(ctx, "GET", "k"); err != nil || v != "hello\r\nworld" {
+		t.Fatalf("expected the stored value back, got %q (%v)", v, err)
+	}
+
+	var replyErr resp.Error
+	if _, err := c.Do(ctx, "INCRBY", "k", "1"); !errors.As(err, &replyErr) {
+		t.Fatalf("expected an error reply for INCRBY on a string, got %v", err)
+	}
+}
+
+func TestClientPipeline(t *testing.T) {
+	srv := startServer(t)
+	c := resp.NewClient(resp.Options{Addr: srv.Addr()})
+	defer c.Close()
+
+	replies, err := c.Pipeline(context.Background(),
+		[]string{"SET", "n", "0", "PX", "60000", "NX"},
+		[]string{"INCRBY", "n", "5"},
+		[]string{"SET", "n", "0", "PX", "60000", "NX"},
+		[]string{"INCRBY", "n", "5"},
+	)
+	if err != nil {
+		t.Fatalf("pipeline failed: %v", err)
+	}
+	if replies[0] != "OK" || replies[1] != int64(5) || replies[2] != nil || replies[3] != int64(10) {
+		t.Fatalf("expected OK, 5, nil, 10, got %v", replies)
+	}
+}
+
+func TestClientAuthenticates(t *testing.T) {
+	srv := startServer(t)
+	srv.SetPassword("secret")
+	ctx := context.Background()
+
+	c := resp.NewClient(resp.Options{Addr: srv.Addr(), Password: "secret", DB: 2})
+	defer c.Close()
+	if _, err := c.Do(ctx, "INCR", "n"); err != nil {
+		t.Fatalf("expected authenticated command to succeed, got %v", err)
+	}
+
+	bad := resp.NewClient(resp.Options{Addr: srv.Addr(), Password: "wrong"})
+	defer bad.Close()
+	if _, err := bad.Do(ctx, "INCR", "n"); err == nil {
+		t.Fatalf("expected wrong password to fail")
+	}
+}
+
+func TestClientReconnectsAfterServerFailure(t *testing.T) {
+	srv := startServer(t)
+	c := resp.NewClient(resp.Options{Addr: srv.Addr(), Timeout: 200 * time.Millisecond})
+	defer c.Close()
+	ctx := context.Background()
+
+	if _, err := c.Do(ctx, "PING"); err != nil {
+		t.Fatalf("PING failed: %v", err)
+	}
+	srv.Close()
+	if _, err := c.Do(ctx, "PING"); err == nil {
+		t.Fatalf("expected PING to fail once the server is gone")
+	}
+}
@@ -0,0 +1,238 @@
+// Package resptest provides an in-memory Redis stand-in for tests, speaking
+// the subset of commands edgecore uses.
+package resptest
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sargisis/edgecore/internal/resp"
+)
+
+// Server is an in-memory key-value server listening on loopback. It
+// supports PING, AUTH, SELECT, GET, SET (with NX, EX and PX), DEL, INCR,
+// INCRBY and PEXPIRE.
+type Server struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	password string
+	data     map[string]entry
+	conns    map[net.Conn]struct{}
+	commands int
+}
+
+type entry struct {
+	value   string
+	expires time.Time
+}
+
+// NewServer starts a server on a random loopback port.
+func NewServer() (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		ln:    ln,
+		data:  make(map[string]entry),
+		conns: make(map[net.Conn]struct{}),
+	}
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the host:port the server listens on.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// SetPassword makes the server require AUTH with password.
+func (s *Server) SetPassword(password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.password = password
+}
+
+// Get returns the value of key, as the GET command would.
+func (s *Server) Get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.lookup(key)
+	return e.value, ok
+}
+
+// Commands returns the number of commands served so far.
+func (s *Server) Commands() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commands
+}
+
+// Close stops the server and closes client connections.
+func (s *Server) Close() {
+	s.ln.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+func (s *Server) serve() {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+		go s.handle(c)
+	}
+}
+
+func (s *Server) handle(c net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		c.Close()
+	}()
+
+	r := bufio.NewReader(c)
+	authed := false
+	for {
+		args, err := resp.ReadCommand(r)
+		if err != nil || len(args) == 0 {
+			return
+		}
+		reply := s.exec(args, &authed)
+		if _, err := c.Write(resp.AppendReply(nil, reply)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) exec(args []string, authed *bool) any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands++
+
+	cmd := strings.ToUpper(args[0])
+	if cmd == "AUTH" {
+		if len(args) != 2 || args[1] != s.password {
+			return resp.Error("WRONGPASS invalid password")
+		}
+		*authed = true
+		return "OK"
+	}
+	if s.password != "" && !*authed {
+		return resp.Error("NOAUTH Authentication required.")
+	}
+
+	switch {
+	case cmd == "PING":
+		return "PONG"
+	case cmd == "SELECT" && len(args) == 2:
+		return "OK"
+	case cmd == "GET" && len(args) == 2:
+		if e, ok := s.lookup(args[1]); ok {
+			return e.value
+		}
+		return nil
+	case cmd == "SET" && len(args) >= 3:
+		return s.set(args[1], args[2], args[3:])
+	case cmd == "DEL" && len(args) >= 2:
+		var n int64
+		for _, key := range args[1:] {
+			if _, ok := s.lookup(key); ok {
+				delete(s.data, key)
+				n++
+			}
+		}
+		return n
+	case cmd == "INCR" && len(args) == 2:
+		return s.incr(args[1], "1")
+	case cmd == "INCRBY" && len(args) == 3:
+		return s.incr(args[1], args[2])
+	case cmd == "PEXPIRE" && len(args) == 3:
+		e, ok := s.lookup(args[1])
+		ms, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return resp.Error("ERR value is not an integer or out of range")
+		}
+		if !ok {
+			return int64(0)
+		}
+		e.expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		s.data[args[1]] = e
+		return int64(1)
+	}
+	return resp.Error("ERR unknown command or wrong number of arguments for '" + args[0] + "'")
+}
+
+// lookup returns the live entry of key, dropping it once expired; the
+// caller holds s.mu.
+func (s *Server) lookup(key string) (entry, bool) {
+	e, ok := s.data[key]
+	if ok && !e.expires.IsZero() && !time.Now().Before(e.expires) {
+		delete(s.data, key)
+		return entry{}, false
+	}
+	return e, ok
+}
+
+func (s *Server) set(key, value string, opts []string) any {
+	e := entry{value: value}
+	nx := false
+	for i := 0; i < len(opts); i++ {
+		switch strings.ToUpper(opts[i]) {
+		case "NX":
+			nx = true
+		case "EX", "PX":
+			if i+1 == len(opts) {
+				return resp.Error("ERR syntax error")
+			}
+			n, err := strconv.ParseInt(opts[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				return resp.Error("ERR invalid expire time in 'set' command")
+			}
+			unit := time.Millisecond
+			if strings.EqualFold(opts[i], "EX") {
+				unit = time.Second
+			}
+			e.expires = time.Now().Add(time.Duration(n) * unit)
+			i++
+		default:
+			return resp.Error("ERR syntax error")
+		}
+	}
+	if _, ok := s.lookup(key); ok && nx {
+		return nil
+	}
+	s.data[key] = e
+	return "OK"
+}
+
+func (s *Server) incr(key, by string) any {
+	delta, err := strconv.ParseInt(by, 10, 64)
+	if err != nil {
+		return resp.Error("ERR value is not an integer or out of range")
+	}
+	e, _ := s.lookup(key)
+	var n int64
+	if e.value != "" {
+		if n, err = strconv.ParseInt(e.value, 10, 64); err != nil {
+			return resp.Error("ERR value is not an integer or out of range")
+		}
+	}
+	n += delta
+	e.value = strconv.FormatInt(n, 10)
+	s.data[key] = e
+	return n
+}
@@ -0,0 +1,139 @@
+// Package router matches requests to configured routes by host and path.
+package router
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sargisis/edgecore/internal/ipset"
+)
+
+// Route describes how matching requests are handled.
+type Route struct {
+	Name string
+	// Host is an exact host name or a one-label wildcard ("*.example.com").
+	// Empty matches any host.
+	Host string
+	// PathPrefix matches the request path; empty matches every path.
+	PathPrefix string
+	// RequireClientCert rejects requests without a verified client certificate.
+	RequireClientCert bool
+	// Pool names the backend pool serving the route; empty means the default.
+	Pool string
+	// GRPCService matches gRPC calls to a fully qualified service
+	// ("package.Service"); GRPCMethod narrows it to a single method. Routes
+	// with a service only match requests with a gRPC content type.
+	GRPCService string
+	GRPCMethod  string
+	// Streaming marks routes with long-lived responses. FlushInterval is
+	// passed to the reverse proxy (negative flushes after every write) and
+	// StreamIdleTimeout replaces the server's write timeout.
+	Streaming         bool
+	FlushInterval     time.Duration
+	StreamIdleTimeout time.Duration
+	// Access limits the clients allowed on the route; nil allows all.
+	Access *ipset.AccessList
+}
+
+// Table holds an ordered list of routes; the first match wins. It is safe
+// to replace the routes while requests are being matched.
+type Table struct {
+	routes atomic.Pointer[[]*Route]
+}
+
+// NewTable creates a Table with the given routes.
+func NewTable(routes []Route) *Table {
+	t := &Table{}
+	t.Store(routes)
+	return t
+}
+
+// Store replaces the routes.
+func (t *Table) Store(routes []Route) {
+	rs := make([]*Route, len(routes))
+	for i := range routes {
+		r := routes[i]
+		r.Host = strings.ToLower(r.Host)
+		rs[i] = &r
+	}
+	t.routes.Store(&rs)
+}
+
+// Match returns the first route matching r, or nil.
+func (t *Table) Match(r *http.Request) *Route {
+	routes := t.routes.Load()
+	if routes == nil {
+		return nil
+	}
+
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, route := range *routes {
+		if matchHost(route.Host, host) && strings.HasPrefix(r.URL.Path, route.PathPrefix) && matchGRPC(route, r) {
+			return route
+		}
+	}
+	return nil
+}
+
+// matchGRPC checks the /package.Service/Method path of gRPC routes.
+func matchGRPC(route *Route, r *http.Request) bool {
+	if route.GRPCService == "" {
+		return true
+	}
+	if !IsGRPC(r) {
+		return false
+	}
+	service, method, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if !ok || service != route.GRPCService {
+		return false
+	}
+	return route.GRPCMethod == "" || method == route.GRPCMethod
+}
+
+// IsGRPC reports whether r is a gRPC call (application/grpc, including
+// sub-types such as application/grpc+proto).
+func IsGRPC(r *http.Request) bool {
+	ct := r.Header.Get("Content-Type")
+	return ct == "application/grpc" || strings.HasPrefix(ct, "application/grpc+") || strings.HasPrefix(ct, "application/grpc;")
+}
+
+func matchHost(pattern, host string) bool {
+	if pattern == "" || pattern == host {
+		return true
+	}
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		_, parent, found := strings.Cut(host, ".")
+		return found && parent == suffix
+	}
+	return false
+}
+
+type routeKey struct{}
+
+// Middleware stores the matched route in the request context.
+func Middleware(t *Table, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := t.Match(r); route != nil {
+			r = r.WithContext(WithRoute(r.Context(), route))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// WithRoute returns a copy of ctx carrying route.
+func WithRoute(ctx context.Context, route *Route) context.Context {
+	return context.WithValue(ctx, routeKey{}, route)
+}
+
+// FromContext returns the route matched by Middleware, or nil.
+func FromContext(ctx context.Context) *Route {
+	route, _ := ctx.Value(routeKey{}).(*Route)
+	return route
+}
@@ -0,0 +1,82 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTableMatch(t *testing.T) {
+	table := NewTable([]Route{
+		{Name: "admin", Host: "api.example.com", PathPrefix: "/admin"},
+		{Name: "api", Host: "api.example.com"},
+		{Name: "wildcard", Host: "*.example.com"},
+		{Name: "static", PathPrefix: "/static/"},
+	})
+
+	cases := []struct {
+		target string
+		want   string
+	}{
+		{"http://api.example.com/admin/users", "admin"},
+		{"http://API.example.com:8080/users", "api"},
+		{"http://www.example.com/", "wildcard"},
+		{"http://a.b.example.com/static/x.css", "static"},
+		{"http://other.org/", ""},
+	}
+
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+		got := ""
+		if route := table.Match(req); route != nil {
+			got = route.Name
+		}
+		if got != tc.want {
+			t.Errorf("%s: expected route %q, got %q", tc.target, tc.want, got)
+		}
+	}
+}
+
+func TestMiddlewareStoresRoute(t *testing.T) {
+	table := NewTable([]Route{{Name: "api", PathPrefix: "/api"}})
+
+	var got *Route
+	handler := Middleware(table, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = FromContext(r.Context())
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1", nil))
+
+	if got == nil || got.Name != "api" {
+		t.Fatalf("expected matched route in context, got %v", got)
+	}
+}
+
+func TestTableMatchGRPC(t *testing.T) {
+	table := NewTable([]Route{
+		{Name: "say-hello", GRPCService: "helloworld.Greeter", GRPCMethod: "SayHello"},
+		{Name: "greeter", GRPCService: "helloworld.Greeter"},
+	})
+
+	cases := []struct {
+		path        string
+		contentType string
+		want        string
+	}{
+		{"/helloworld.Greeter/SayHello", "application/grpc", "say-hello"},
+		{"/helloworld.Greeter/SayGoodbye", "application/grpc+proto", "greeter"},
+		{"/helloworld.Greeter/SayHello", "application/json", ""},
+		{"/helloworld.GreeterV2/SayHello", "application/grpc", ""},
+	}
+
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodPost, tc.path, nil)
+		req.Header.Set("Content-Type", tc.contentType)
+		got := ""
+		if route := table.Match(req); route != nil {
+			got = route.Name
+		}
+		if got != tc.want {
+			t.Errorf("%s (%s): expected route %q, got %q", tc.path, tc.contentType, tc.want, got)
+		}
+	}
+}
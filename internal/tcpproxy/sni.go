@@ -0,0 +1,106 @@
+package tcpproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/sargisis/edgecore/internal/balancer"
+)
+
+// SNIRoute sends TLS connections for a server name to a pool without
+// terminating TLS.
+type SNIRoute struct {
+	// Host is an exact server name or a one-label wildcard ("*.example.com").
+	Host string
+	// Pool returns the pool to balance matching connections over.
+	Pool func() *balancer.ServerPool
+}
+
+// matchSNI returns the pool for serverName: an exact route wins over a
+// wildcard one, and among equals the first listed wins. It returns nil when
+// no route matches.
+func matchSNI(routes []SNIRoute, serverName string) func() *balancer.ServerPool {
+	name := strings.TrimSuffix(strings.ToLower(serverName), ".")
+	if name == "" {
+		return nil
+	}
+	var wildcard func() *balancer.ServerPool
+	for _, r := range routes {
+		host := strings.ToLower(r.Host)
+		if host == name {
+			return r.Pool
+		}
+		if wildcard == nil && strings.HasPrefix(host, "*.") {
+			if _, parent, ok := strings.Cut(name, "."); ok && host[2:] == parent {
+				wildcard = r.Pool
+			}
+		}
+	}
+	return wildcard
+}
+
+// errHelloRead stops the handshake once the ClientHello has been parsed.
+var errHelloRead = errors.New("client hello read")
+
+// peekClientHello reads the TLS ClientHello from conn and returns the
+// server name it asks for, which is empty when the client sent no SNI. The
+// returned connection replays the bytes consumed, so the backend sees the
+// handshake from the start. A connection that does not start with a
+// ClientHello yields an error.
+func peekClientHello(conn net.Conn, timeout time.Duration) (string, net.Conn, error) {
+	var buf bytes.Buffer
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(readOnlyConn{Conn: conn, r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = h
+			return nil, errHelloRead
+		},
+	}).Handshake()
+
+	replay := &peekedConn{Conn: conn, r: io.MultiReader(&buf, conn)}
+	if hello == nil {
+		if err == nil {
+			err = errors.New("no client hello")
+		}
+		return "", replay, err
+	}
+	return hello.ServerName, replay, nil
+}
+
+// readOnlyConn lets crypto/tls parse a ClientHello without answering it.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// peekedConn is a connection whose first bytes were already read.
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// CloseWrite half-closes the underlying connection, so tunnel.Pipe can
+// propagate EOF.
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
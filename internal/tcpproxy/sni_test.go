@@ -0,0 +1,151 @@
+package tcpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sargisis/edgecore/internal/balancer"
+	"github.com/sargisis/edgecore/internal/proxy"
+)
+
+func TestMatchSNI(t *testing.T) {
+	exact := &balancer.ServerPool{}
+	wild := &balancer.ServerPool{}
+	routes := []SNIRoute{
+		{Host: "*.example.com", Pool: func() *balancer.ServerPool { return wild }},
+		{Host: "API.example.com", Pool: func() *balancer.ServerPool { return exact }},
+	}
+
+	tests := []struct {
+		name string
+		want *balancer.ServerPool
+	}{
+		{"api.example.com", exact},
+		{"api.example.com.", exact},
+		{"www.example.com", wild},
+		{"example.com", nil},
+		{"a.b.example.com", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		var got *balancer.ServerPool
+		if p := matchSNI(routes, tt.name); p != nil {
+			got = p()
+		}
+		if got != tt.want {
+			t.Fatalf("matchSNI(%q): expected pool %p, got %p", tt.name, tt.want, got)
+		}
+	}
+}
+
+// startTLSBackend starts an HTTPS server answering with body and returns a
+// pool holding it as a tcp:// backend.
+func startTLSBackend(t *testing.T, body string) *balancer.ServerPool {
+	t.Helper()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	pool := &balancer.ServerPool{}
+	pool.AddBackend(newBackend(t, "tcp://"+srv.Listener.Addr().String()))
+	return pool
+}
+
+// getVia requests https://serverName/ through the proxy at addr.
+func getVia(addr, serverName string) (string, error) {
+	client := &http.Client{
+		Timeout: 2 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+			TLSClientConfig:   &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		},
+	}
+	resp, err := client.Get("https://" + serverName + "/")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestServerRoutesBySNI(t *testing.T) {
+	api := startTLSBackend(t, "api")
+	web := startTLSBackend(t, "web")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := &Server{
+		Pool: func() *balancer.ServerPool { return web },
+		SNIRoutes: []SNIRoute{
+			{Host: "api.example.com", Pool: func() *balancer.ServerPool { return api }},
+		},
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+	addr := ln.Addr().String()
+
+	if body, err := getVia(addr, "api.example.com"); err != nil || body != "api" {
+		t.Fatalf("expected api backend for api.example.com, got %q (%v)", body, err)
+	}
+	if body, err := getVia(addr, "www.example.com"); err != nil || body != "web" {
+		t.Fatalf("expected default pool for unmatched name, got %q (%v)", body, err)
+	}
+}
+
+func TestServerRejectsUnmatchedSNI(t *testing.T) {
+	api := startTLSBackend(t, "api")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := &Server{
+		SNIRoutes:    []SNIRoute{{Host: "api.example.com", Pool: func() *balancer.ServerPool { return api }}},
+		HelloTimeout: 200 * time.Millisecond,
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+
+	before := atomic.LoadUint64(&proxy.GlobalMetrics.TLSPassthroughUnmatched)
+	if _, err := getVia(ln.Addr().String(), "other.example.com"); err == nil {
+		t.Fatalf("expected connection for unrouted name to be closed")
+	}
+
+	// A client that never sends a ClientHello is dropped after HelloTimeout.
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("expected proxy to close a silent connection, got %v", err)
+	}
+	if got := atomic.LoadUint64(&proxy.GlobalMetrics.TLSPassthroughUnmatched) - before; got != 2 {
+		t.Fatalf("expected 2 unmatched connections, got %d", got)
+	}
+}
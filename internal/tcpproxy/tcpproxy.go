@@ -0,0 +1,267 @@
+// Package tcpproxy balances plain TCP connections over a backend pool, and
+// TLS connections over pools chosen by SNI without terminating TLS.
+package tcpproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sargisis/edgecore/internal/backend"
+	"github.com/sargisis/edgecore/internal/balancer"
+	"github.com/sargisis/edgecore/internal/ipset"
+	"github.com/sargisis/edgecore/internal/proxy"
+	"github.com/sargisis/edgecore/internal/tunnel"
+)
+
+// Server accepts TCP connections and pipes each one to the backend with the
+// fewest active connections.
+type Server struct {
+	// Pool returns the pool to balance over. It is called per connection,
+	// so reloaded pools take effect for new connections. With SNIRoutes it
+	// takes connections no route matches; nil rejects them.
+	Pool func() *balancer.ServerPool
+	// SNIRoutes turn the listener into a TLS passthrough: the ClientHello
+	// is peeked to pick a pool by server name, and the encrypted stream is
+	// forwarded as is.
+	SNIRoutes []SNIRoute
+	// HelloTimeout bounds waiting for the ClientHello; zero means 5 seconds.
+	HelloTimeout time.Duration
+	// IdleTimeout closes connections silent in both directions; zero
+	// disables it.
+	IdleTimeout time.Duration
+	// DialTimeout bounds connecting to a backend; zero means 5 seconds.
+	DialTimeout time.Duration
+	// Access returns the access list clients are checked against; it is
+	// called per connection, so reloaded lists take effect. Nil allows all.
+	Access func() *ipset.AccessList
+
+	mu       sync.Mutex
+	ln       net.Listener
+	conns    map[net.Conn]struct{}
+	shutdown bool
+}
+
+// ErrServerClosed is returned by Serve after Shutdown.
+var ErrServerClosed = errors.New("tcpproxy: server closed")
+
+// Serve accepts connections on ln until Shutdown is called.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.ln = ln
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.shutdown
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go s.handle(conn)
+	}
+}
+
+// Shutdown stops accepting connections and waits for open ones to finish.
+// When ctx expires first, the remaining connections are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shutdown = true
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	s.mu.Unlock()
+
+	t := time.NewTicker(50 * time.Millisecond)
+	defer t.Stop()
+	for {
+		s.mu.Lock()
+		open := len(s.conns)
+		if open == 0 || ctx.Err() != nil {
+			for c := range s.conns {
+				c.Close()
+			}
+			s.mu.Unlock()
+			return ctx.Err()
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutdown {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer s.untrack(conn)
+	defer conn.Close()
+
+	start := time.Now()
+	atomic.AddUint64(&proxy.GlobalMetrics.TCPConnections, 1)
+	entry := proxy.LogEntry{
+		Level:    "info",
+		Message:  "tcp connection closed",
+		ClientIP: hostOf(conn.RemoteAddr()),
+	}
+
+	if s.Access != nil {
+		addr, _ := netip.ParseAddr(entry.ClientIP)
+		if !s.Access().Allows(addr) {
+			atomic.AddUint64(&proxy.GlobalMetrics.AccessDeniedListener, 1)
+			entry.Level = "warn"
+			entry.Error = "access denied"
+			proxy.Log(entry)
+			return
+		}
+	}
+
+	pool := s.Pool
+	if len(s.SNIRoutes) > 0 {
+		var sni string
+		var err error
+		sni, conn, err = s.peek(conn)
+		entry.SNI = sni
+		if p := matchSNI(s.SNIRoutes, sni); p != nil {
+			pool = p
+		}
+		if pool == nil {
+			atomic.AddUint64(&proxy.GlobalMetrics.TLSPassthroughUnmatched, 1)
+			entry.Level = "warn"
+			entry.Error = "no route for server name"
+			if err != nil {
+				entry.Error = err.Error()
+			}
+			entry.Duration = time.Since(start).Seconds()
+			proxy.Log(entry)
+			return
+		}
+	}
+
+	b, upstream, err := s.dial(pool)
+	if err != nil {
+		atomic.AddUint64(&proxy.GlobalMetrics.TCPDialFailures, 1)
+		entry.Level = "error"
+		entry.Error = err.Error()
+		entry.Duration = time.Since(start).Seconds()
+		proxy.Log(entry)
+		return
+	}
+	b.IncConnections()
+	defer b.DecConnections()
+	upstream = b.TrackConn(upstream)
+	defer upstream.Close()
+
+	in, out, err := tunnel.Pipe(conn, upstream, s.IdleTimeout)
+	atomic.AddUint64(&proxy.GlobalMetrics.TCPBytesIn, uint64(in))
+	atomic.AddUint64(&proxy.GlobalMetrics.TCPBytesOut, uint64(out))
+
+	entry.Backend = b.URL.String()
+	entry.Duration = time.Since(start).Seconds()
+	entry.BytesIn, entry.BytesOut = in, out
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	proxy.Log(entry)
+}
+
+// peek reads the ClientHello and returns its server name along with a
+// connection that replays it.
+func (s *Server) peek(conn net.Conn) (string, net.Conn, error) {
+	timeout := s.HelloTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	return peekClientHello(conn, timeout)
+}
+
+// maxDialFailures failed connection attempts in a row mark a backend down
+// until the next health check.
+const maxDialFailures = 3
+
+// dial connects to the least loaded backend of poolFn. When a backend
+// cannot be reached the next one is tried; the failed one is only marked
+// down after maxDialFailures failures in a row, so a single dropped
+// connection attempt does not take it out of rotation.
+func (s *Server) dial(poolFn func() *balancer.ServerPool) (*backend.Backend, net.Conn, error) {
+	timeout := s.DialTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+
+	if poolFn == nil {
+		return nil, nil, errors.New("no backend pool")
+	}
+	pool := poolFn()
+	if pool == nil {
+		return nil, nil, errors.New("no backend pool")
+	}
+	lastErr := errors.New("no backend available")
+	tried := make(map[*backend.Backend]bool)
+	for range pool.Backends() {
+		b := pool.GetLeastConnectionsExcept(tried)
+		if b == nil {
+			break
+		}
+		conn, err := net.DialTimeout("tcp", balancer.HostPort(b.URL), timeout)
+		if err == nil {
+			b.DialSucceeded()
+			return b, conn, nil
+		}
+		tried[b] = true
+		if b.DialFailed(maxDialFailures) {
+			b.SetAlive(false)
+		}
+		lastErr = fmt.Errorf("dial %s: %w", b.URL.Host, err)
+	}
+	return nil, nil, lastErr
+}
+
+func hostOf(addr net.Addr) string {
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
@@ -0,0 +1,177 @@
+package tcpproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sargisis/edgecore/internal/backend"
+	"github.com/sargisis/edgecore/internal/balancer"
+	"github.com/sargisis/edgecore/internal/ipset"
+	"github.com/sargisis/edgecore/internal/proxy"
+)
+
+// startEcho starts a TCP echo server and returns its backend.
+func startEcho(t *testing.T) *backend.Backend {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return newBackend(t, "tcp://"+ln.Addr().String())
+}
+
+func newBackend(t *testing.T, rawURL string) *backend.Backend {
+	t.Helper()
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("failed to parse URL %q: %v", rawURL, err)
+	}
+	return backend.NewBackend(u, &httputil.ReverseProxy{})
+}
+
+func startServer(t *testing.T, pool *balancer.ServerPool) (*Server, string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := &Server{Pool: func() *balancer.ServerPool { return pool }, IdleTimeout: time.Second}
+	go srv.Serve(ln)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+	return srv, ln.Addr().String()
+}
+
+func TestServerProxiesAndCountsConnections(t *testing.T) {
+	echo := startEcho(t)
+	pool := &balancer.ServerPool{}
+	pool.AddBackend(echo)
+	_, addr := startServer(t, pool)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	defer c.Close()
+	c.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("expected echo, got %q (%v)", buf, err)
+	}
+	if got := echo.GetConnections(); got != 1 {
+		t.Fatalf("expected 1 active connection on backend, got %d", got)
+	}
+
+	c.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for echo.GetConnections() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := echo.GetConnections(); got != 0 {
+		t.Fatalf("expected connection count to drop after close, got %d", got)
+	}
+	if got := echo.GetUpstreamConns(); got != 0 {
+		t.Fatalf("expected upstream connection to be closed, got %d open", got)
+	}
+}
+
+func TestServerSkipsUnreachableBackend(t *testing.T) {
+	// Reserve a port and close it so connecting is refused.
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead := newBackend(t, "tcp://"+ln.Addr().String())
+	ln.Close()
+
+	echo := startEcho(t)
+	pool := &balancer.ServerPool{}
+	pool.AddBackend(dead)
+	pool.AddBackend(echo)
+	_, addr := startServer(t, pool)
+
+	for i := range maxDialFailures {
+		if i > 0 && !dead.IsAlive() {
+			t.Fatalf("expected backend to stay up after %d failed dials", i)
+		}
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to dial proxy: %v", err)
+		}
+		c.Write([]byte("x"))
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			t.Fatalf("expected connection to reach the live backend, got %v", err)
+		}
+		c.Close()
+		deadline := time.Now().Add(2 * time.Second)
+		for echo.GetConnections() != 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if dead.IsAlive() {
+		t.Fatalf("expected unreachable backend to be marked down after %d failed dials", maxDialFailures)
+	}
+}
+
+func TestServerRefusesDeniedClients(t *testing.T) {
+	echo := startEcho(t)
+	pool := &balancer.ServerPool{}
+	pool.AddBackend(echo)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	deny := &ipset.AccessList{Deny: ipset.New([]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})}
+	srv := &Server{
+		Pool:   func() *balancer.ServerPool { return pool },
+		Access: func() *ipset.AccessList { return deny },
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+	denied := atomic.LoadUint64(&proxy.GlobalMetrics.AccessDeniedListener)
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected denied connection to be closed, got %v", err)
+	}
+	if got := atomic.LoadUint64(&proxy.GlobalMetrics.AccessDeniedListener) - denied; got != 1 {
+		t.Fatalf("expected 1 denied connection, got %d", got)
+	}
+	if got := echo.GetConnections(); got != 0 {
+		t.Fatalf("expected no connection to the backend, got %d", got)
+	}
+}
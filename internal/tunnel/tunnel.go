@@ -0,0 +1,109 @@
+// Package tunnel copies bytes between two connections, as used by the
+// layer-4 proxies.
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ErrIdleTimeout is returned by Pipe when neither side sent anything for
+// the idle timeout.
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// Pipe copies between a and b in both directions until both are done, and
+// returns the bytes copied each way. When one side finishes sending, the
+// other side's write half is closed so it sees EOF while the reverse
+// direction continues. A connection silent in both directions for idle is
+// closed; zero disables the idle timeout. Pipe does not close a or b.
+func Pipe(a, b net.Conn, idle time.Duration) (aToB, bToA int64, err error) {
+	var last atomic.Int64
+	last.Store(time.Now().UnixNano())
+	// stopped tells the remaining direction to give up after a failure.
+	var stopped atomic.Bool
+
+	type result struct {
+		n   int64
+		err error
+	}
+	ab := make(chan result, 1)
+	ba := make(chan result, 1)
+	go func() {
+		n, err := copyIdle(b, a, idle, &last, &stopped)
+		ab <- result{n, err}
+	}()
+	go func() {
+		n, err := copyIdle(a, b, idle, &last, &stopped)
+		ba <- result{n, err}
+	}()
+
+	for pending := 2; pending > 0; pending-- {
+		var r result
+		select {
+		case r = <-ab:
+			aToB = r.n
+		case r = <-ba:
+			bToA = r.n
+		}
+		if r.err != nil {
+			if err == nil {
+				err = r.err
+			}
+			// Unblock the other direction.
+			stopped.Store(true)
+			now := time.Now()
+			a.SetDeadline(now)
+			b.SetDeadline(now)
+		}
+	}
+	return aToB, bToA, err
+}
+
+// copyIdle copies src to dst. A read timeout only ends the copy when the
+// other direction has been quiet as well.
+func copyIdle(dst, src net.Conn, idle time.Duration, last *atomic.Int64, stopped *atomic.Bool) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var total int64
+	for {
+		if idle > 0 {
+			src.SetReadDeadline(time.Now().Add(idle))
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			last.Store(time.Now().UnixNano())
+			if idle > 0 {
+				dst.SetWriteDeadline(time.Now().Add(idle))
+			}
+			w, werr := dst.Write(buf[:n])
+			total += int64(w)
+			if werr != nil {
+				return total, werr
+			}
+		}
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			closeWrite(dst)
+			return total, nil
+		}
+		var ne net.Error
+		if idle > 0 && errors.As(err, &ne) && ne.Timeout() {
+			if !stopped.Load() && time.Since(time.Unix(0, last.Load())) < idle {
+				continue
+			}
+			return total, ErrIdleTimeout
+		}
+		return total, err
+	}
+}
+
+// closeWrite half-closes conn when it supports it.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
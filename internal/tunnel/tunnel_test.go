@@ -0,0 +1,105 @@
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	s := <-accepted
+	t.Cleanup(func() { c.Close(); s.Close() })
+	return c, s
+}
+
+func TestPipeCopiesBothWaysWithHalfClose(t *testing.T) {
+	client, proxyIn := tcpPair(t)
+	proxyOut, server := tcpPair(t)
+
+	type result struct {
+		ab, ba int64
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ab, ba, err := Pipe(proxyIn, proxyOut, time.Second)
+		done <- result{ab, ba, err}
+	}()
+
+	// The client sends a request and half-closes; the server answers after
+	// seeing EOF.
+	client.Write([]byte("ping"))
+	client.(*net.TCPConn).CloseWrite()
+	req, err := io.ReadAll(server)
+	if err != nil || string(req) != "ping" {
+		t.Fatalf("expected server to read ping then EOF, got %q (%v)", req, err)
+	}
+	server.Write([]byte("pong!"))
+	server.Close()
+
+	resp, _ := io.ReadAll(client)
+	if string(resp) != "pong!" {
+		t.Fatalf("expected pong!, got %q", resp)
+	}
+	r := <-done
+	if r.err != nil || r.ab != 4 || r.ba != 5 {
+		t.Fatalf("expected 4/5 bytes without error, got %d/%d (%v)", r.ab, r.ba, r.err)
+	}
+}
+
+func TestPipeIdleTimeout(t *testing.T) {
+	_, proxyIn := tcpPair(t)
+	proxyOut, _ := tcpPair(t)
+
+	start := time.Now()
+	_, _, err := Pipe(proxyIn, proxyOut, 50*time.Millisecond)
+	if !errors.Is(err, ErrIdleTimeout) {
+		t.Fatalf("expected idle timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected idle timeout after ~50ms, took %s", elapsed)
+	}
+}
+
+func TestPipeActiveDirectionKeepsConnectionAlive(t *testing.T) {
+	client, proxyIn := tcpPair(t)
+	proxyOut, server := tcpPair(t)
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := Pipe(proxyIn, proxyOut, 100*time.Millisecond)
+		done <- err
+	}()
+
+	// Only the server talks; the quiet client side must not time out.
+	go io.Copy(io.Discard, client)
+	for i := 0; i < 5; i++ {
+		server.Write([]byte("tick"))
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("expected pipe to stay open while one side is active, got %v", err)
+	default:
+	}
+}
@@ -0,0 +1,342 @@
+// Package udpproxy balances UDP datagrams over a backend pool. Datagrams
+// from one client address form a session bound to one backend through its
+// own upstream socket, so replies are sent back to the right client.
+package udpproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sargisis/edgecore/internal/backend"
+	"github.com/sargisis/edgecore/internal/balancer"
+	"github.com/sargisis/edgecore/internal/proxy"
+)
+
+// ErrServerClosed is returned by Serve after Shutdown.
+var ErrServerClosed = errors.New("udpproxy: server closed")
+
+// Server forwards datagrams received on a UDP socket.
+type Server struct {
+	// Pool returns the pool to balance new sessions over.
+	Pool func() *balancer.ServerPool
+	// SessionTimeout expires sessions without datagrams in either
+	// direction; zero means 60 seconds.
+	SessionTimeout time.Duration
+	// MaxSessions caps concurrent sessions; datagrams from new clients are
+	// dropped when it is reached. Zero means 10000.
+	MaxSessions int
+
+	mu       sync.Mutex
+	conn     *net.UDPConn
+	sessions map[netip.AddrPort]*session
+	shutdown bool
+	// ctx is canceled by Shutdown to stop the backend dials in progress.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// relays tracks the goroutines dialing and serving sessions.
+	relays sync.WaitGroup
+}
+
+// maxPending caps the datagrams queued for a session while its backend
+// socket is being set up.
+const maxPending = 16
+
+// session is the state of one client.
+type session struct {
+	client  netip.AddrPort
+	backend *backend.Backend
+	start   time.Time
+
+	mu sync.Mutex
+	// upstream is nil until the backend is dialed.
+	upstream *net.UDPConn
+	// pending holds the datagrams received before upstream was set.
+	pending [][]byte
+	ended   bool
+
+	last     atomic.Int64
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	closed   sync.Once
+	// err records why the session ended early, e.g. port unreachable.
+	err atomic.Pointer[error]
+}
+
+func (s *Server) sessionTimeout() time.Duration {
+	if s.SessionTimeout > 0 {
+		return s.SessionTimeout
+	}
+	return 60 * time.Second
+}
+
+func (s *Server) maxSessions() int {
+	if s.MaxSessions > 0 {
+		return s.MaxSessions
+	}
+	return 10000
+}
+
+// Serve forwards datagrams arriving on conn until Shutdown is called.
+func (s *Server) Serve(conn *net.UDPConn) error {
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		conn.Close()
+		return ErrServerClosed
+	}
+	s.conn = conn
+	s.sessions = make(map[netip.AddrPort]*session)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.mu.Unlock()
+
+	go s.expireSessions()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, client, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			s.mu.Lock()
+			closed := s.shutdown
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		atomic.AddUint64(&proxy.GlobalMetrics.UDPPacketsIn, 1)
+		atomic.AddUint64(&proxy.GlobalMetrics.UDPBytesIn, uint64(n))
+
+		sess := s.session(client)
+		if sess == nil {
+			atomic.AddUint64(&proxy.GlobalMetrics.UDPDropped, 1)
+			continue
+		}
+		sess.last.Store(time.Now().UnixNano())
+		if !sess.send(buf[:n]) {
+			atomic.AddUint64(&proxy.GlobalMetrics.UDPDropped, 1)
+		}
+	}
+}
+
+// send forwards p to the backend, or queues a copy while the backend is
+// being dialed. It reports whether p was not dropped.
+func (sess *session) send(p []byte) bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.upstream == nil {
+		if sess.ended || len(sess.pending) >= maxPending {
+			return false
+		}
+		sess.pending = append(sess.pending, append([]byte(nil), p...))
+		return true
+	}
+	if _, err := sess.upstream.Write(p); err != nil {
+		return false
+	}
+	sess.bytesIn.Add(int64(len(p)))
+	return true
+}
+
+// session returns the session of client, creating it on the least loaded
+// backend if needed. It returns nil when no session can be created. A new
+// session is dialed in the background so that a slow name lookup does not
+// hold up the datagrams of other clients.
+func (s *Server) session(client netip.AddrPort) *session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sess, ok := s.sessions[client]; ok {
+		return sess
+	}
+	if s.shutdown || len(s.sessions) >= s.maxSessions() {
+		return nil
+	}
+
+	pool := s.Pool()
+	if pool == nil {
+		return nil
+	}
+	b := pool.GetLeastConnections()
+	if b == nil {
+		return nil
+	}
+
+	sess := &session{client: client, backend: b, start: time.Now()}
+	sess.last.Store(sess.start.UnixNano())
+	s.sessions[client] = sess
+	b.IncConnections()
+	atomic.AddUint64(&proxy.GlobalMetrics.UDPSessionsTotal, 1)
+	atomic.AddInt64(&proxy.GlobalMetrics.UDPSessionsActive, 1)
+	s.relays.Add(1)
+	go s.relayReplies(sess)
+	return sess
+}
+
+// dial connects sess to its backend and sends the datagrams queued
+// meanwhile. It reports whether the session can go on.
+func (s *Server) dial(sess *session) bool {
+	var d net.Dialer
+	c, err := d.DialContext(s.ctx, "udp", balancer.HostPort(sess.backend.URL))
+	if err != nil {
+		sess.err.Store(&err)
+		s.endSession(sess)
+		return false
+	}
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.ended {
+		c.Close()
+		return false
+	}
+	sess.upstream = c.(*net.UDPConn)
+	for _, p := range sess.pending {
+		if _, err := sess.upstream.Write(p); err != nil {
+			atomic.AddUint64(&proxy.GlobalMetrics.UDPDropped, 1)
+			continue
+		}
+		sess.bytesIn.Add(int64(len(p)))
+	}
+	sess.pending = nil
+	return true
+}
+
+// relayReplies dials the backend of sess and sends its datagrams back to
+// the client.
+func (s *Server) relayReplies(sess *session) {
+	defer s.relays.Done()
+	if !s.dial(sess) {
+		return
+	}
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := sess.upstream.Read(buf)
+		if err != nil {
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				// ICMP port unreachable: take the backend out until the
+				// next health check and let the client start over.
+				sess.backend.SetAlive(false)
+				sess.err.Store(&err)
+				s.endSession(sess)
+			}
+			return
+		}
+		sess.last.Store(time.Now().UnixNano())
+		if _, err := s.conn.WriteToUDPAddrPort(buf[:n], sess.client); err != nil {
+			continue
+		}
+		sess.bytesOut.Add(int64(n))
+		atomic.AddUint64(&proxy.GlobalMetrics.UDPPacketsOut, 1)
+		atomic.AddUint64(&proxy.GlobalMetrics.UDPBytesOut, uint64(n))
+	}
+}
+
+// expireSessions ends idle sessions until the server shuts down.
+func (s *Server) expireSessions() {
+	timeout := s.sessionTimeout()
+	t := time.NewTicker(timeout / 4)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-s.ctx.Done():
+			return
+		}
+
+		var idle []*session
+		s.mu.Lock()
+		for _, sess := range s.sessions {
+			if time.Since(time.Unix(0, sess.last.Load())) >= timeout {
+				idle = append(idle, sess)
+			}
+		}
+		s.mu.Unlock()
+		for _, sess := range idle {
+			s.endSession(sess)
+		}
+	}
+}
+
+// endSession removes sess, closes its upstream socket and logs it.
+func (s *Server) endSession(sess *session) {
+	sess.closed.Do(func() {
+		s.mu.Lock()
+		if s.sessions[sess.client] == sess {
+			delete(s.sessions, sess.client)
+		}
+		s.mu.Unlock()
+
+		sess.mu.Lock()
+		sess.ended = true
+		sess.pending = nil
+		if sess.upstream != nil {
+			sess.upstream.Close()
+		}
+		sess.mu.Unlock()
+		sess.backend.DecConnections()
+		atomic.AddInt64(&proxy.GlobalMetrics.UDPSessionsActive, -1)
+
+		entry := proxy.LogEntry{
+			Level:    "info",
+			Message:  "udp session closed",
+			ClientIP: sess.client.Addr().Unmap().String(),
+			Backend:  sess.backend.URL.String(),
+			Duration: time.Since(sess.start).Seconds(),
+			BytesIn:  sess.bytesIn.Load(),
+			BytesOut: sess.bytesOut.Load(),
+		}
+		if err := sess.err.Load(); err != nil {
+			entry.Level = "warn"
+			entry.Error = (*err).Error()
+		}
+		proxy.Log(entry)
+	})
+}
+
+// Shutdown stops reading datagrams, ends every session and waits for their
+// relays to return or ctx to expire. UDP has no connections to drain, so
+// sessions are ended at once.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		return nil
+	}
+	s.shutdown = true
+	if s.conn != nil {
+		s.conn.Close()
+		s.cancel()
+	}
+	sessions := make([]*session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.mu.Unlock()
+
+	for _, sess := range sessions {
+		s.endSession(sess)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.relays.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,127 @@
+package udpproxy
+
+import (
+	"context"
+	"net"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/sargisis/edgecore/internal/backend"
+	"github.com/sargisis/edgecore/internal/balancer"
+	"github.com/sargisis/edgecore/internal/devtools"
+)
+
+// echoBackend starts a UDP echo server and returns its backend.
+func echoBackend(t *testing.T) *backend.Backend {
+	t.Helper()
+
+	conn, err := devtools.ListenUDPEcho("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start UDP echo: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	u, _ := url.Parse("udp://" + conn.LocalAddr().String())
+	return backend.NewBackend(u, &httputil.ReverseProxy{})
+}
+
+func startServer(t *testing.T, srv *Server) string {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go srv.Serve(conn)
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+	return conn.LocalAddr().String()
+}
+
+// roundTrip sends msg from a fresh client socket and returns the reply.
+func roundTrip(t *testing.T, client *net.UDPConn, msg string) string {
+	t.Helper()
+
+	if _, err := client.Write([]byte(msg)); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func dial(t *testing.T, addr string) *net.UDPConn {
+	t.Helper()
+
+	raddr, _ := net.ResolveUDPAddr("udp", addr)
+	c, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestServerKeepsClientsOnTheirBackend(t *testing.T) {
+	b1, b2 := echoBackend(t), echoBackend(t)
+	pool := &balancer.ServerPool{}
+	pool.AddBackend(b1)
+	pool.AddBackend(b2)
+	addr := startServer(t, &Server{Pool: func() *balancer.ServerPool { return pool }})
+
+	c1, c2 := dial(t, addr), dial(t, addr)
+	for i := 0; i < 3; i++ {
+		if got := roundTrip(t, c1, "one"); got != "one" {
+			t.Fatalf("expected reply one, got %q", got)
+		}
+		if got := roundTrip(t, c2, "two"); got != "two" {
+			t.Fatalf("expected reply two, got %q", got)
+		}
+	}
+	// Two sessions spread over the least loaded backends.
+	if b1.GetConnections() != 1 || b2.GetConnections() != 1 {
+		t.Fatalf("expected one session per backend, got %d and %d", b1.GetConnections(), b2.GetConnections())
+	}
+}
+
+func TestServerExpiresIdleSessions(t *testing.T) {
+	b := echoBackend(t)
+	pool := &balancer.ServerPool{}
+	pool.AddBackend(b)
+	addr := startServer(t, &Server{
+		Pool:           func() *balancer.ServerPool { return pool },
+		SessionTimeout: 80 * time.Millisecond,
+	})
+
+	roundTrip(t, dial(t, addr), "ping")
+	if got := b.GetConnections(); got != 1 {
+		t.Fatalf("expected an open session, got %d", got)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for b.GetConnections() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := b.GetConnections(); got != 0 {
+		t.Fatalf("expected idle session to expire, got %d open", got)
+	}
+}
+
+func TestServerMaxSessions(t *testing.T) {
+	b := echoBackend(t)
+	pool := &balancer.ServerPool{}
+	pool.AddBackend(b)
+	addr := startServer(t, &Server{Pool: func() *balancer.ServerPool { return pool }, MaxSessions: 1})
+
+	roundTrip(t, dial(t, addr), "first")
+
+	second := dial(t, addr)
+	second.Write([]byte("second"))
+	second.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := second.Read(make([]byte, 16)); err == nil {
+		t.Fatalf("expected datagram beyond max_sessions to be dropped")
+	}
+}